@@ -0,0 +1,210 @@
+package caddy_thumbs
+
+import (
+	"bytes"
+	"image"
+	"math"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// approximateHeader 近似结果的响应头, 内容为缩放所用缓存的模式目录
+const approximateHeader = "X-Thumbs-Approximate"
+
+// ApproximateConfig 缓存未命中时从同模式、同纵横比的更大尺寸缓存缩放, 比解码原图更快地返回近似的缩略图.
+// 近似结果不写入缓存, 使用短缓存头返回
+type ApproximateConfig struct {
+	// 返回近似结果后在后台生成精确尺寸的缩略图
+	Regenerate bool `json:"regenerate,omitempty"`
+	// 同时在后台生成的最大数量, 默认 2
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+// approximateDirPattern 拆分缓存目录为模式、尺寸和其余部分(颜色、质量、标记等), 百分比尺寸不匹配
+var approximateDirPattern = regexp.MustCompile(`^(?:([a-z]+)(\d+)x(\d+)|(long|short)(\d+))(.*)$`)
+
+// approximateDir 缓存目录解析后的尺寸信息, long/short 模式只使用 width
+type approximateDir struct {
+	mode          string
+	width, height int
+	rest          string
+}
+
+func parseApproximateDir(dir string) (approximateDir, bool) {
+	m := approximateDirPattern.FindStringSubmatch(dir)
+	if m == nil {
+		return approximateDir{}, false
+	}
+	if m[4] != "" {
+		n, _ := strconv.Atoi(m[5])
+		return approximateDir{mode: m[4], width: n, rest: m[6]}, true
+	}
+	w, _ := strconv.Atoi(m[2])
+	h, _ := strconv.Atoi(m[3])
+	return approximateDir{mode: m[1], width: w, height: h, rest: m[6]}, true
+}
+
+// scaleTo 判断 d 能否缩小为 target: 模式和其余参数相同, 纵横比相同且两边都不小于 target. 返回缩放比例
+func (d approximateDir) scaleTo(target approximateDir) (float64, bool) {
+	if d.mode != target.mode || d.rest != target.rest || d == target {
+		return 0, false
+	}
+	if (d.width == 0) != (target.width == 0) || (d.height == 0) != (target.height == 0) {
+		return 0, false
+	}
+	if d.width < target.width || d.height < target.height || d.width*target.height != d.height*target.width {
+		return 0, false
+	}
+	if d.width > 0 {
+		return float64(target.width) / float64(d.width), true
+	}
+	return float64(target.height) / float64(d.height), true
+}
+
+// fullSize 判断缓存的缩略图是否按目录中的尺寸生成. upscale_policy 为 clamp 时小原图的缩略图按比例缩小,
+// 两边都小于目录中的尺寸, 不能按目录尺寸的比例缩放
+func (d approximateDir) fullSize(b image.Rectangle) bool {
+	switch d.mode {
+	case "long":
+		return max(b.Dx(), b.Dy()) == d.width
+	case "short":
+		return min(b.Dx(), b.Dy()) == d.width
+	}
+	return d.width > 0 && b.Dx() == d.width || d.height > 0 && b.Dy() == d.height
+}
+
+// approximateCandidate 可以缩放为请求尺寸的缓存目录
+type approximateCandidate struct {
+	dir   approximateDir
+	name  string
+	scale float64
+}
+
+// approximateFromCache 查找同模式的更大尺寸缓存并缩小为请求的尺寸, 多个候选时优先使用最小的一个,
+// 跳过没有按目录尺寸生成的缓存. 找不到或处理失败时返回 false. 候选从内存中的缓存索引查找, 不列举存储
+func (t ThumbsServer) approximateFromCache(req *thumbRequest) ([]byte, string, bool) {
+	// 字节预算和抖动的结果不能由缩放得到, SVG 透传不需要缩放
+	if req.format == "" || req.format == ".svg" || req.maxBytes > 0 || req.dither > 0 || t.index == nil {
+		return nil, "", false
+	}
+	parent, rel := "/", strings.TrimPrefix(req.thumbPath, "/")
+	if strings.HasPrefix(rel, cacheBucketPrefix) {
+		var bucket string
+		bucket, rel, _ = strings.Cut(rel, "/")
+		parent = "/" + bucket + "/"
+	}
+	cacheDir, tail, _ := strings.Cut(rel, "/")
+	target, ok := parseApproximateDir(cacheDir)
+	if !ok {
+		return nil, "", false
+	}
+	var candidates []approximateCandidate
+	t.index.each(func(key string, _ int64) {
+		rest, ok := strings.CutPrefix(key, parent)
+		if !ok {
+			return
+		}
+		name, keyTail, _ := strings.Cut(rest, "/")
+		if keyTail != tail && keyTail != tail+".jpg" && keyTail != tail+".png" {
+			return
+		}
+		candidate, ok := parseApproximateDir(name)
+		if !ok {
+			return
+		}
+		if scale, ok := candidate.scaleTo(target); ok {
+			candidates = append(candidates, approximateCandidate{dir: candidate, name: name, scale: scale})
+		}
+	})
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].scale > candidates[j].scale })
+
+	for i, candidate := range candidates {
+		if i > 0 && candidate.name == candidates[i-1].name {
+			continue
+		}
+		cachedPath, cached := t.findCachedThumb(path.Join(parent, candidate.name, tail))
+		if !cached {
+			continue
+		}
+		data, err := t.loadThumb(cachedPath)
+		if err != nil {
+			continue
+		}
+		img, err := t.decodeImage(bytes.NewReader(data), uint(req.width), uint(req.height))
+		if err != nil {
+			t.logger.Warn("Failed to decode cached thumbnail for approximation", zap.String("path", cachedPath), zap.Error(err))
+			continue
+		}
+		b := img.Bounds()
+		if !candidate.dir.fullSize(b) {
+			t.logger.Debug("Skipping capped cached thumbnail for approximation", zap.String("path", cachedPath), zap.Int("width", b.Dx()), zap.Int("height", b.Dy()))
+			continue
+		}
+		width := max(1, uint(math.Round(float64(b.Dx())*candidate.scale)))
+		height := max(1, uint(math.Round(float64(b.Dy())*candidate.scale)))
+		modeFilter, _ := t.filterForMode(req.mode)
+		data, err = t.encodeForRequest(t.resizeImage(width, height, img, req.quality, modeFilter), req)
+		if err != nil {
+			t.logger.Warn("Failed to encode approximate thumbnail", zap.String("path", cachedPath), zap.Error(err))
+			return nil, "", false
+		}
+		t.logger.Info("Approximated thumbnail from cache", zap.String("from", cachedPath), zap.String("path", req.thumbPath))
+		return data, candidate.name, true
+	}
+	return nil, "", false
+}
+
+// serveApproximate 返回近似结果, 开启 regenerate 时在后台生成精确尺寸的缩略图
+func (t ThumbsServer) serveApproximate(w http.ResponseWriter, r *http.Request, req *thumbRequest, data []byte, fromDir string) error {
+	if t.approximate != nil {
+		job := *req
+		err := t.approximate.start(job.thumbPath, func() error {
+			if _, err := t.renderThumb(&job); err != nil {
+				t.logger.Warn("Background thumbnail regeneration failed", zap.String("path", job.thumbPath), zap.Error(err))
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			t.logger.Debug("Previous background regeneration failed, retrying on next request", zap.String("path", req.thumbPath), zap.Error(err))
+		}
+	}
+	t.setDebugHeaders(w, req, "APPROXIMATE", 0)
+	w.Header().Set(approximateHeader, fromDir)
+	w.Header().Set("ETag", thumbETag(data))
+	req.shortCache = true
+	t.setCacheHeaders(w, req)
+	http.ServeContent(w, r, path.Base(req.thumbPath), time.Now(), bytes.NewReader(data))
+	return nil
+}
+
+// unmarshalApproximate 解析 approximate_from_cache, 不带块时只返回近似结果
+func unmarshalApproximate(d *caddyfile.Dispenser) (*ApproximateConfig, error) {
+	cfg := new(ApproximateConfig)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch key := d.Val(); key {
+		case "regenerate":
+			cfg.Regenerate = true
+		case "concurrency":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			val, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid concurrency value: %s", d.Val())
+			}
+			cfg.Concurrency = val
+		default:
+			return nil, d.Errf("unrecognized approximate_from_cache subdirective: %s", key)
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,49 @@
+package caddy_thumbs
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestApproximateFromCache 有更大尺寸的缓存时直接缩小该缓存, 不读取原图
+func TestApproximateFromCache(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.Approximate = &ApproximateConfig{} })
+	src.put("/a.png", encodePNG(t, gradientImage(400, 400)))
+	mustStatus(t, get(t, ts, "/c200x200/a.png"), http.StatusOK)
+
+	loads := src.count("Load")
+	w := get(t, ts, "/c100x100/a.png")
+	mustStatus(t, w, http.StatusOK)
+	if dir := w.Header().Get(approximateHeader); dir != "c200x200" {
+		t.Errorf("%s = %q, want c200x200", approximateHeader, dir)
+	}
+	if w, h := imageSize(t, w.Body.Bytes()); w != 100 || h != 100 {
+		t.Errorf("size = %dx%d, want 100x100", w, h)
+	}
+	if src.count("Load") != loads {
+		t.Error("source decoded although a larger cached variant exists")
+	}
+}
+
+// TestApproximateSkipsCapped clamp 缩小后的缓存不按目录尺寸使用, 从原图生成
+func TestApproximateSkipsCapped(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) {
+		ts.Approximate = &ApproximateConfig{}
+		ts.UpscalePolicy = UPSCALE_POLICY_CLAMP
+	})
+	src.put("/a.png", encodePNG(t, gradientImage(100, 100)))
+	mustStatus(t, get(t, ts, "/c400x400/a.png"), http.StatusOK)
+
+	loads := src.count("Load")
+	w := get(t, ts, "/c200x200/a.png")
+	mustStatus(t, w, http.StatusOK)
+	if dir := w.Header().Get(approximateHeader); dir != "" {
+		t.Errorf("approximated from capped %s", dir)
+	}
+	if w, h := imageSize(t, w.Body.Bytes()); w != 100 || h != 100 {
+		t.Errorf("size = %dx%d, want 100x100", w, h)
+	}
+	if src.count("Load") == loads {
+		t.Error("source not decoded")
+	}
+}
@@ -0,0 +1,171 @@
+package caddy_thumbs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// archiveCheckInterval 检查归档文件是否更新的最短间隔
+const archiveCheckInterval = time.Minute
+
+// sourceArchive 从存储中的 zip/tar 归档读取原图. 归档整体读入内存并建立条目索引,
+// 归档文件的修改时间变化后重新加载
+type sourceArchive struct {
+	ctx     context.Context
+	storage certmagic.Storage
+	key     string
+	logger  *zap.Logger
+
+	mu        sync.Mutex
+	entries   map[string]func() (io.ReadCloser, error) // 条目路径(不带前导斜杠)到打开函数
+	modified  time.Time
+	checkedAt time.Time
+}
+
+func newSourceArchive(ctx context.Context, storage certmagic.Storage, key string, logger *zap.Logger) *sourceArchive {
+	return &sourceArchive{ctx: ctx, storage: storage, key: key, logger: logger}
+}
+
+// load 读取归档中的条目, 条目不存在时返回 false
+func (a *sourceArchive) load(name string) ([]byte, bool, error) {
+	open, err := a.lookup(archiveEntryName(name))
+	if err != nil || open == nil {
+		return nil, false, err
+	}
+	rc, err := open()
+	if err != nil {
+		return nil, false, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// lookup 查找条目, 必要时(首次使用或归档已更新)重新加载索引
+func (a *sourceArchive) lookup(name string) (func() (io.ReadCloser, error), error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.entries == nil || time.Since(a.checkedAt) >= archiveCheckInterval {
+		info, err := a.storage.Stat(a.ctx, a.key)
+		if err != nil {
+			return nil, fmt.Errorf("stat archive %s: %v", a.key, err)
+		}
+		a.checkedAt = time.Now()
+		if a.entries == nil || !info.Modified.Equal(a.modified) {
+			data, err := a.storage.Load(a.ctx, a.key)
+			if err != nil {
+				return nil, fmt.Errorf("load archive %s: %v", a.key, err)
+			}
+			entries, err := indexArchive(a.key, data)
+			if err != nil {
+				return nil, fmt.Errorf("read archive %s: %v", a.key, err)
+			}
+			a.entries, a.modified = entries, info.Modified
+			a.logger.Info("Source archive loaded", zap.String("archive", a.key), zap.Int("entries", len(entries)))
+		}
+	}
+	return a.entries[name], nil
+}
+
+// archiveSuffixes 支持的归档扩展名
+var archiveSuffixes = []string{".zip", ".tar", ".tar.gz", ".tgz"}
+
+// isArchiveKey 判断归档的扩展名是否支持
+func isArchiveKey(key string) bool {
+	lower := strings.ToLower(key)
+	for _, suffix := range archiveSuffixes {
+		if strings.HasSuffix(lower, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// indexArchive 按扩展名解析 zip、tar 或 tar.gz 归档, 建立条目索引
+func indexArchive(key string, data []byte) (map[string]func() (io.ReadCloser, error), error) {
+	lower := strings.ToLower(key)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return indexZip(data)
+	case strings.HasSuffix(lower, ".tar"):
+		return indexTar(data)
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		raw, err := io.ReadAll(gz)
+		if err != nil {
+			return nil, err
+		}
+		return indexTar(raw)
+	}
+	return nil, errors.New("unsupported archive type, expected .zip, .tar, .tar.gz or .tgz")
+}
+
+func indexZip(data []byte) (map[string]func() (io.ReadCloser, error), error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]func() (io.ReadCloser, error), len(zr.File))
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		entries[archiveEntryName(f.Name)] = f.Open
+	}
+	return entries, nil
+}
+
+// indexTar 记录每个普通文件在未压缩数据中的位置, 读取时直接切片
+func indexTar(data []byte) (map[string]func() (io.ReadCloser, error), error) {
+	var (
+		reader  = bytes.NewReader(data)
+		tr      = tar.NewReader(reader)
+		entries = make(map[string]func() (io.ReadCloser, error))
+	)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		// Next 返回后 reader 正好位于条目内容的开头
+		start := len(data) - reader.Len()
+		if hdr.Size < 0 || int64(start)+hdr.Size > int64(len(data)) {
+			return nil, fmt.Errorf("truncated entry: %s", hdr.Name)
+		}
+		content := data[start : start+int(hdr.Size)]
+		entries[archiveEntryName(hdr.Name)] = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(content)), nil
+		}
+	}
+}
+
+// archiveEntryName 统一条目路径: 去掉 ./ 和前导斜杠
+func archiveEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
@@ -0,0 +1,71 @@
+package caddy_thumbs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"image/color"
+	"net/http"
+	"testing"
+)
+
+// TestArchiveSource 原图路径在 zip/tar 归档中查找并生成缩略图, 归档只读取一次, 归档中没有的原图继续在存储中查找
+func TestArchiveSource(t *testing.T) {
+	entry := encodePNG(t, solidImage(80, 60, color.NRGBA{0, 0, 255, 255}))
+
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	f, err := zw.Create("img/a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var tgz bytes.Buffer
+	gz := gzip.NewWriter(&tgz)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: "./img/a.png", Mode: 0o644, Size: int64(len(entry)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{"/bundle.zip": zipped.Bytes(), "/bundle.tar.gz": tgz.Bytes()} {
+		t.Run(name, func(t *testing.T) {
+			ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.ArchiveSource = name })
+			src.put(name, data)
+			src.put("/b.png", encodePNG(t, solidImage(40, 40, color.White)))
+
+			for _, target := range []string{"/c40x30/img/a.png", "/m20x20/img/a.png"} {
+				w := get(t, ts, target)
+				mustStatus(t, w, http.StatusOK)
+				img, _ := decodeBody(t, w.Body.Bytes())
+				if r, g, b, _ := img.At(5, 5).RGBA(); r>>8 > 0x10 || g>>8 > 0x10 || b>>8 < 0xF0 {
+					t.Errorf("%s color = %v, want blue", target, img.At(5, 5))
+				}
+			}
+			if w, h := imageSize(t, get(t, ts, "/c40x30/img/a.png").Body.Bytes()); w != 40 || h != 30 {
+				t.Errorf("size = %dx%d, want 40x30", w, h)
+			}
+			if n := src.count("Load"); n != 1 {
+				t.Errorf("storage Load called %d times, want the archive loaded once", n)
+			}
+
+			mustStatus(t, get(t, ts, "/c20x20/b.png"), http.StatusOK)
+			mustStatus(t, get(t, ts, "/c20x20/img/missing.png"), http.StatusNotFound)
+		})
+	}
+}
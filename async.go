@@ -0,0 +1,133 @@
+package caddy_thumbs
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// maxAsyncFailures 最多保留的生成失败记录数, 超过后清空
+const maxAsyncFailures = 1000
+
+// AsyncConfig 异步生成配置: 缓存未命中时立即返回 202, 在后台生成缩略图, 客户端按 Retry-After 重试
+type AsyncConfig struct {
+	// 建议客户端重试的间隔, 默认 2s
+	RetryAfter caddy.Duration `json:"retry_after,omitempty"`
+	// 同时在后台生成的最大数量, 默认 4
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+// errAsyncBusy 后台生成任务已达到并发上限
+var errAsyncBusy = errors.New("too many thumbnails being generated")
+
+// asyncJobs 后台生成任务. 同一缩略图只会有一个任务在运行, 失败的错误在下一次请求时返回
+type asyncJobs struct {
+	mu        sync.Mutex
+	running   map[string]bool
+	failed    map[string]error
+	sem       chan struct{}
+	coalesced atomic.Int64 // 任务已在运行而合并的次数
+}
+
+func newAsyncJobs(concurrency int) *asyncJobs {
+	return &asyncJobs{
+		running: make(map[string]bool),
+		failed:  make(map[string]error),
+		sem:     make(chan struct{}, concurrency),
+	}
+}
+
+// start 在后台运行生成任务, 任务已在运行时不重复启动. 上一次生成失败时返回该错误, 下一次请求会重新生成.
+// 启动前先占用并发名额, 已满时返回 errAsyncBusy, 不会堆积等待中的 goroutine
+func (j *asyncJobs) start(key string, generate func() error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err, ok := j.failed[key]; ok {
+		delete(j.failed, key)
+		return err
+	}
+	if j.running[key] {
+		j.coalesced.Add(1)
+		return nil
+	}
+	select {
+	case j.sem <- struct{}{}:
+	default:
+		return errAsyncBusy
+	}
+	j.running[key] = true
+	go func() {
+		err := generate()
+		<-j.sem
+
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		delete(j.running, key)
+		if err != nil {
+			if len(j.failed) >= maxAsyncFailures {
+				clear(j.failed)
+			}
+			j.failed[key] = err
+		}
+	}()
+	return nil
+}
+
+// serveAsync 启动后台生成并返回 202
+func (t ThumbsServer) serveAsync(w http.ResponseWriter, req *thumbRequest) error {
+	err := t.async.start(req.thumbPath, func() error {
+		if _, err := t.renderThumb(req); err != nil {
+			t.logger.Warn("Async thumbnail generation failed", zap.String("path", req.thumbPath), zap.Error(err))
+			return err
+		}
+		return nil
+	})
+	retryAfter := max(1, int(math.Ceil(time.Duration(t.AsyncGeneration.RetryAfter).Seconds())))
+	if errors.Is(err, errAsyncBusy) {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		return caddyhttp.Error(http.StatusServiceUnavailable, err)
+	}
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+func unmarshalAsync(d *caddyfile.Dispenser) (*AsyncConfig, error) {
+	cfg := new(AsyncConfig)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		key := d.Val()
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		switch key {
+		case "retry_after":
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid retry_after value: %s", d.Val())
+			}
+			cfg.RetryAfter = caddy.Duration(dur)
+		case "concurrency":
+			val, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid concurrency value: %s", d.Val())
+			}
+			cfg.Concurrency = val
+		default:
+			return nil, d.Errf("unrecognized async_generation subdirective: %s", key)
+		}
+	}
+	return cfg, nil
+}
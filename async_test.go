@@ -0,0 +1,66 @@
+package caddy_thumbs
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestAsyncGeneration 首次请求返回 202, 后台生成完成后重试返回缩略图
+func TestAsyncGeneration(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.AsyncGeneration = &AsyncConfig{} })
+	src.put("/a.png", encodePNG(t, gradientImage(40, 40)))
+
+	w := get(t, ts, "/c20x20/a.png")
+	mustStatus(t, w, http.StatusAccepted)
+	if w.Header().Get("Retry-After") != "2" {
+		t.Errorf("Retry-After = %q, want 2", w.Header().Get("Retry-After"))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for w.Code == http.StatusAccepted && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		w = get(t, ts, "/c20x20/a.png")
+	}
+	mustStatus(t, w, http.StatusOK)
+	if w, h := imageSize(t, w.Body.Bytes()); w != 20 || h != 20 {
+		t.Errorf("size = %dx%d, want 20x20", w, h)
+	}
+}
+
+// TestAsyncGenerationBusy 并发名额用完时不启动新任务, 返回 503; 同一缩略图的重复请求合并到运行中的任务
+func TestAsyncGenerationBusy(t *testing.T) {
+	src := blockingStorage{memStorage: newMemStorage(), entered: make(chan string, 2), release: make(chan struct{})}
+	ts, _, _ := newTestServer(t, func(ts *ThumbsServer) {
+		ts.ImageStorageRaw = registerStorage(t, "blocking", src)
+		ts.AsyncGeneration = &AsyncConfig{Concurrency: 1}
+	})
+	src.put("/a.png", encodePNG(t, gradientImage(40, 40)))
+	src.put("/b.png", encodePNG(t, gradientImage(40, 40)))
+	released := false
+	release := func() {
+		if !released {
+			close(src.release)
+			released = true
+		}
+	}
+	t.Cleanup(release)
+
+	mustStatus(t, get(t, ts, "/c20x20/a.png"), http.StatusAccepted)
+	mustStatus(t, get(t, ts, "/c20x20/a.png"), http.StatusAccepted)
+	w := get(t, ts, "/c20x20/b.png")
+	mustStatus(t, w, http.StatusServiceUnavailable)
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("503 response has no Retry-After")
+	}
+	if n := ts.async.coalesced.Load(); n != 1 {
+		t.Errorf("coalesced = %d, want 1", n)
+	}
+
+	release()
+	deadline := time.Now().Add(5 * time.Second)
+	for w.Code != http.StatusOK && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		w = get(t, ts, "/c20x20/b.png")
+	}
+	mustStatus(t, w, http.StatusOK)
+}
@@ -0,0 +1,180 @@
+package caddy_thumbs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/nfnt/resize"
+	"go.uber.org/zap"
+)
+
+const (
+	base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+	// blurHashSampleSize 计算 BlurHash 前先把图片缩小到该尺寸以内, BlurHash 只保留低频信息, 无需原图精度
+	blurHashSampleSize = 64
+	// blurHashCachePrefix 缓存 BlurHash 的目录前缀, 其后为分量数, 如 /_blurhash4x3/<原图路径>
+	blurHashCachePrefix = "_blurhash"
+)
+
+// serveBlurHash 计算 source 参数指定的原图的 BlurHash, x/y 参数为横纵分量数(1-9, 默认 4x3)
+func (t ThumbsServer) serveBlurHash(w http.ResponseWriter, r *http.Request) error {
+	source := strings.TrimPrefix(r.FormValue("source"), "/")
+	if source == "" {
+		return caddyhttp.Error(http.StatusBadRequest, errors.New("missing source parameter"))
+	}
+	xComponents, yComponents := 4, 3
+	if v := r.FormValue("x"); v != "" {
+		xComponents, _ = strconv.Atoi(v)
+	}
+	if v := r.FormValue("y"); v != "" {
+		yComponents, _ = strconv.Atoi(v)
+	}
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return caddyhttp.Error(http.StatusBadRequest, errors.New("blurhash components must be between 1 and 9"))
+	}
+
+	// 计算结果保存在缩略图存储中, 命中时原图仍需存在
+	var (
+		key  = path.Join("/", fmt.Sprintf("%s%dx%d", blurHashCachePrefix, xComponents, yComponents), source)
+		hash []byte
+	)
+	if !t.NoCache {
+		if cached, err := t.loadThumb(key); err == nil {
+			if err := t.requireSource(&thumbRequest{imagePath: source}); err != nil {
+				return err
+			}
+			hash = cached
+		}
+	}
+	if hash == nil {
+		// 禁止生成的 User-Agent 只能读取已缓存的结果
+		if t.generationDenied(r) {
+			return t.denyGeneration(r, &thumbRequest{thumbPath: key})
+		}
+		var err error
+		if hash, err = t.computeBlurHash(source, t.sourceToken(r), xComponents, yComponents); err != nil {
+			return err
+		}
+		if err := t.storeThumb(key, hash); err != nil {
+			t.logger.Warn("Failed to cache blurhash", zap.String("path", key), zap.Error(err))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(map[string]string{"blurhash": string(hash)})
+}
+
+// computeBlurHash 解码原图并计算 BlurHash. 解码器返回的状态码(如不支持的格式返回 415)保持不变, 其他解码错误返回 422
+func (t ThumbsServer) computeBlurHash(source, token string, xComponents, yComponents int) ([]byte, error) {
+	gobytes, err := t.loadSource(source, token)
+	if err != nil {
+		return nil, err
+	}
+	img, err := t.decodeImage(bytes.NewReader(gobytes), blurHashSampleSize, blurHashSampleSize)
+	if err != nil {
+		var handlerErr caddyhttp.HandlerError
+		if errors.As(err, &handlerErr) {
+			return nil, err
+		}
+		return nil, caddyhttp.Error(http.StatusUnprocessableEntity, err)
+	}
+	if img.Bounds().Empty() {
+		return nil, corruptSourceError(source, "decoded image has zero size")
+	}
+	return []byte(encodeBlurHash(resize.Thumbnail(blurHashSampleSize, blurHashSampleSize, img, resize.Bilinear), xComponents, yComponents)), nil
+}
+
+// encodeBlurHash 按 BlurHash 算法对图片做 DCT 并编码为 base83 字符串
+func encodeBlurHash(img image.Image, xComponents, yComponents int) string {
+	var (
+		b             = img.Bounds()
+		width, height = b.Dx(), b.Dy()
+		factors       = make([][3]float64, 0, xComponents*yComponents)
+	)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(height))
+					r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+					factor[0] += basis * sRGBToLinear(r>>8)
+					factor[1] += basis * sRGBToLinear(g>>8)
+					factor[2] += basis * sRGBToLinear(bl>>8)
+				}
+			}
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			scale := normalisation / float64(width*height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	var (
+		sb      strings.Builder
+		dc, ac  = factors[0], factors[1:]
+		maximum = 1.0
+	)
+	sb.WriteString(encodeBase83((xComponents-1)+(yComponents-1)*9, 1))
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maximum = float64(quantisedMax+1) / 166
+		sb.WriteString(encodeBase83(quantisedMax, 1))
+	} else {
+		sb.WriteString(encodeBase83(0, 1))
+	}
+	sb.WriteString(encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+	for _, f := range ac {
+		quant := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximum, 0.5)*9+9.5))))
+		}
+		sb.WriteString(encodeBase83(quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2))
+	}
+	return sb.String()
+}
+
+// encodeBase83 将数值编码为指定长度的 base83 字符串
+func encodeBase83(value, length int) string {
+	buf := make([]byte, length)
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		buf[i-1] = base83Chars[digit]
+	}
+	return string(buf)
+}
+
+func sRGBToLinear(c uint32) float64 {
+	v := float64(c) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
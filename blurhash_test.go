@@ -0,0 +1,116 @@
+package caddy_thumbs
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// decodeBlurHash 将 BlurHash 解码为 width x height 的颜色网格
+func decodeBlurHash(t *testing.T, hash string, width, height int) [][]color.NRGBA {
+	t.Helper()
+	decode83 := func(s string) int {
+		v := 0
+		for _, c := range s {
+			v = v*83 + strings.IndexRune(base83Chars, c)
+		}
+		return v
+	}
+	sizeFlag := decode83(hash[:1])
+	nx, ny := sizeFlag%9+1, sizeFlag/9+1
+	if len(hash) != 4+2*nx*ny {
+		t.Fatalf("blurhash %q has invalid length for %dx%d components", hash, nx, ny)
+	}
+	maximum := float64(decode83(hash[1:2])+1) / 166
+	colors := make([][3]float64, nx*ny)
+	dc := decode83(hash[2:6])
+	colors[0] = [3]float64{sRGBToLinear(uint32(dc >> 16)), sRGBToLinear(uint32(dc >> 8 & 0xFF)), sRGBToLinear(uint32(dc & 0xFF))}
+	for i := 1; i < nx*ny; i++ {
+		v := decode83(hash[4+i*2 : 6+i*2])
+		q := [3]int{v / (19 * 19), v / 19 % 19, v % 19}
+		for c := range 3 {
+			colors[i][c] = signPow((float64(q[c])-9)/9, 2) * maximum
+		}
+	}
+	grid := make([][]color.NRGBA, height)
+	for y := range height {
+		grid[y] = make([]color.NRGBA, width)
+		for x := range width {
+			var rgb [3]float64
+			for j := range ny {
+				for i := range nx {
+					basis := math.Cos(math.Pi*float64(x)*float64(i)/float64(width)) * math.Cos(math.Pi*float64(y)*float64(j)/float64(height))
+					for c := range 3 {
+						rgb[c] += colors[i+j*nx][c] * basis
+					}
+				}
+			}
+			grid[y][x] = color.NRGBA{uint8(linearToSRGB(rgb[0])), uint8(linearToSRGB(rgb[1])), uint8(linearToSRGB(rgb[2])), 0xFF}
+		}
+	}
+	return grid
+}
+
+// TestBlurHash 返回的 BlurHash 解码后与原图各区域的颜色相近, 再次请求时使用缓存的结果
+func TestBlurHash(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.BlurHashPath = "/_blurhash" })
+	// 左半红色、右半蓝色
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 32))
+	for y := range 32 {
+		for x := range 64 {
+			c := color.NRGBA{0xFF, 0, 0, 0xFF}
+			if x >= 32 {
+				c = color.NRGBA{0, 0, 0xFF, 0xFF}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	src.put("/a.png", encodePNG(t, img))
+
+	w := get(t, ts, "/_blurhash?source=a.png&x=4&y=3")
+	mustStatus(t, w, http.StatusOK)
+	var resp map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	grid := decodeBlurHash(t, resp["blurhash"], 8, 4)
+	// 4 个横向分量无法还原锐利的边界, 跳过边界两侧的格子, 只检查其他格子的主色
+	for y, row := range grid {
+		for x, c := range row {
+			if x < 3 && (c.R < 0xC0 || int(c.R)-int(c.B) < 0x60) {
+				t.Errorf("cell (%d,%d) = %v, want red", x, y, c)
+			}
+			if x > 4 && (c.B < 0xC0 || int(c.B)-int(c.R) < 0x60) {
+				t.Errorf("cell (%d,%d) = %v, want blue", x, y, c)
+			}
+		}
+	}
+
+	loads := src.count("Load")
+	w = get(t, ts, "/_blurhash?source=a.png&x=4&y=3")
+	mustStatus(t, w, http.StatusOK)
+	var cached map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &cached); err != nil {
+		t.Fatal(err)
+	}
+	if cached["blurhash"] != resp["blurhash"] {
+		t.Errorf("cached blurhash = %q, want %q", cached["blurhash"], resp["blurhash"])
+	}
+	if src.count("Load") != loads {
+		t.Errorf("source loaded again for a cached blurhash")
+	}
+}
+
+// TestBlurHashUnsupportedFormat 不支持的原图格式返回 415 而不是 422
+func TestBlurHashUnsupportedFormat(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.BlurHashPath = "/_blurhash" })
+	src.put("/a.gif", []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;"))
+	mustStatus(t, get(t, ts, "/_blurhash?source=a.gif"), http.StatusUnsupportedMediaType)
+
+	src.put("/b.png", encodePNG(t, solidImage(4, 4, color.White))[:40])
+	mustStatus(t, get(t, ts, "/_blurhash?source=b.png"), http.StatusUnprocessableEntity)
+}
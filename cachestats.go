@@ -0,0 +1,86 @@
+package caddy_thumbs
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// cacheGroupStats 某一类缓存条目的数量和总大小
+type cacheGroupStats struct {
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// cacheStats 缓存统计接口返回的 JSON
+type cacheStats struct {
+	Entries  int                         `json:"entries"`
+	Bytes    int64                       `json:"bytes"`
+	ByFormat map[string]*cacheGroupStats `json:"by_format"`
+	ByMode   map[string]*cacheGroupStats `json:"by_mode"`
+}
+
+// add 按格式和模式累计一个缓存条目
+func (s *cacheStats) add(key string, size int64) {
+	s.Entries++
+	s.Bytes += size
+	addCacheGroup(s.ByFormat, cacheKeyFormat(key), size)
+	addCacheGroup(s.ByMode, cacheKeyMode(key), size)
+}
+
+func addCacheGroup(groups map[string]*cacheGroupStats, name string, size int64) {
+	g, ok := groups[name]
+	if !ok {
+		g = new(cacheGroupStats)
+		groups[name] = g
+	}
+	g.Entries++
+	g.Bytes += size
+}
+
+// cacheKeyFormat 缓存条目的格式, 低质量占位图、平均颜色和校验信息单独统计
+func cacheKeyFormat(key string) string {
+	if strings.HasSuffix(key, lqipSuffix) {
+		return "lqip"
+	}
+	if strings.HasSuffix(key, colorSuffix) {
+		return "color"
+	}
+	if strings.HasSuffix(key, thumbMetaSuffix) {
+		return "meta"
+	}
+	if ext := strings.TrimPrefix(filepath.Ext(key), "."); ext != "" {
+		return ext
+	}
+	return "unknown"
+}
+
+// cacheKeyMode 缓存条目的模式, 取模式目录(如 m200x200,q80 或 tile256,z3,x1,y2)开头的字母, 跳过 cache_key_header 的分区目录
+func cacheKeyMode(key string) string {
+	dir, rest, _ := strings.Cut(strings.TrimPrefix(key, "/"), "/")
+	if strings.HasPrefix(dir, cacheBucketPrefix) {
+		dir, _, _ = strings.Cut(rest, "/")
+	}
+	end := strings.IndexFunc(dir, func(r rune) bool { return r < 'a' || r > 'z' })
+	if end < 0 {
+		end = len(dir)
+	}
+	if end == 0 {
+		return "unknown"
+	}
+	return dir[:end]
+}
+
+// serveCacheStats 输出缩略图缓存的条目数和大小, 按格式和模式分组. 统计来自维护中的索引, 不遍历存储
+func (t ThumbsServer) serveCacheStats(w http.ResponseWriter, r *http.Request) error {
+	stats := cacheStats{
+		ByFormat: make(map[string]*cacheGroupStats),
+		ByMode:   make(map[string]*cacheGroupStats),
+	}
+	t.index.each(stats.add)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	return json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,46 @@
+package caddy_thumbs
+
+import (
+	"encoding/json"
+	"image/color"
+	"net/http"
+	"testing"
+)
+
+// TestCacheStats 缓存统计接口的条目数、大小和分组与生成的缩略图一致
+func TestCacheStats(t *testing.T) {
+	ts, src, thumbs := newTestServer(t, func(ts *ThumbsServer) { ts.CacheStatsPath = "/_stats" })
+	src.put("/a.png", encodePNG(t, solidImage(60, 60, color.White)))
+	src.put("/b.jpg", encodeJPEG(t, gradientImage(60, 60), 90))
+	for _, target := range []string{"/c20x20/a.png", "/m30x30/a.png", "/m30x30/b.jpg", "/c20x20/b.jpg", "/w40x40/b.jpg"} {
+		mustStatus(t, get(t, ts, target), http.StatusOK)
+	}
+
+	w := get(t, ts, "/_stats")
+	mustStatus(t, w, http.StatusOK)
+	var stats cacheStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for _, key := range thumbs.keys() {
+		data, _ := thumbs.get(key)
+		size += int64(len(data))
+	}
+	if stats.Entries != 5 || stats.Entries != len(thumbs.keys()) || stats.Bytes != size {
+		t.Errorf("stats = %d entries %d bytes, storage has %d entries %d bytes", stats.Entries, stats.Bytes, len(thumbs.keys()), size)
+	}
+	counts := func(groups map[string]*cacheGroupStats) map[string]int {
+		m := make(map[string]int)
+		for name, g := range groups {
+			m[name] = g.Entries
+		}
+		return m
+	}
+	if got := counts(stats.ByFormat); len(got) != 2 || got["png"] != 2 || got["jpg"] != 3 {
+		t.Errorf("by_format = %v, want png:2 jpg:3", got)
+	}
+	if got := counts(stats.ByMode); len(got) != 3 || got["c"] != 2 || got["m"] != 2 || got["w"] != 1 {
+		t.Errorf("by_mode = %v, want c:2 m:2 w:1", got)
+	}
+}
@@ -0,0 +1,78 @@
+package caddy_thumbs
+
+import (
+	"image"
+	"runtime"
+	"sync"
+	"weak"
+)
+
+const (
+	maxPooledCanvasPixels = 2048 * 2048 // 超过该像素数的画布不复用
+	maxCanvasPools        = 256         // 最多按多少种尺寸分别建池, 避免任意尺寸的请求让池无限增长
+)
+
+// canvasPools 按尺寸复用 w 模式和裁剪模式的 RGBA 画布. owned 记录 newCanvas 交出且尚未放回的画布,
+// 只有这些画布可以放回池中; 原图、ImageFilter 的输出等其他 RGBA 图片可能仍被调用方引用, 不能复用
+var canvasPools = struct {
+	sync.Mutex
+	pools map[image.Point]*sync.Pool
+	owned map[weak.Pointer[image.RGBA]]struct{}
+}{pools: make(map[image.Point]*sync.Pool), owned: make(map[weak.Pointer[image.RGBA]]struct{})}
+
+// canvasPool 返回指定尺寸的画布池, 不复用该尺寸时返回 nil
+func canvasPool(size image.Point, create bool) *sync.Pool {
+	if size.X <= 0 || size.Y <= 0 || size.X*size.Y > maxPooledCanvasPixels {
+		return nil
+	}
+	canvasPools.Lock()
+	defer canvasPools.Unlock()
+	pool, ok := canvasPools.pools[size]
+	if !ok && create && len(canvasPools.pools) < maxCanvasPools {
+		pool = new(sync.Pool)
+		canvasPools.pools[size] = pool
+	}
+	return pool
+}
+
+// newCanvas 取出(或创建)一张清空的 width x height 画布
+func newCanvas(width, height int) *image.RGBA {
+	pool := canvasPool(image.Pt(width, height), true)
+	if pool == nil {
+		return image.NewRGBA(image.Rect(0, 0, width, height))
+	}
+	canvas, ok := pool.Get().(*image.RGBA)
+	if ok {
+		clear(canvas.Pix)
+	} else {
+		canvas = image.NewRGBA(image.Rect(0, 0, width, height))
+		// 未放回而被回收的画布从登记中移除
+		runtime.AddCleanup(canvas, func(key weak.Pointer[image.RGBA]) {
+			canvasPools.Lock()
+			delete(canvasPools.owned, key)
+			canvasPools.Unlock()
+		}, weak.Make(canvas))
+	}
+	canvasPools.Lock()
+	canvasPools.owned[weak.Make(canvas)] = struct{}{}
+	canvasPools.Unlock()
+	return canvas
+}
+
+// releaseCanvas 将 newCanvas 交出的画布放回池中, 其他图片和已放回的画布不做处理.
+// 调用方必须保证编码等所有使用都已结束, 且之后不再引用该图片
+func releaseCanvas(img image.Image) {
+	canvas, ok := img.(*image.RGBA)
+	if !ok {
+		return
+	}
+	key := weak.Make(canvas)
+	canvasPools.Lock()
+	_, owned := canvasPools.owned[key]
+	delete(canvasPools.owned, key)
+	pool := canvasPools.pools[canvas.Rect.Size()]
+	canvasPools.Unlock()
+	if owned && pool != nil {
+		pool.Put(canvas)
+	}
+}
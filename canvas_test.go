@@ -0,0 +1,63 @@
+package caddy_thumbs
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// TestReleaseCanvas 只有 newCanvas 交出的画布会放回池中, 其他同尺寸的 RGBA 图片和重复放回的画布不会被复用
+func TestReleaseCanvas(t *testing.T) {
+	const size = 37
+	canvas := newCanvas(size, size)
+
+	foreign := image.NewRGBA(image.Rect(0, 0, size, size))
+	releaseCanvas(foreign)
+	for i := 0; i < 4; i++ {
+		if got := newCanvas(size, size); got == foreign {
+			t.Fatal("an image not created by newCanvas was returned from the pool")
+		}
+	}
+
+	releaseCanvas(canvas)
+	releaseCanvas(canvas)
+	if a, b := newCanvas(size, size), newCanvas(size, size); a == b {
+		t.Error("a canvas released twice was handed out twice")
+	}
+}
+
+// BenchmarkCanvasPool 重复生成相同尺寸的 w 模式和裁剪模式缩略图, 对比放回画布与不放回时的分配
+func BenchmarkCanvasPool(b *testing.B) {
+	var (
+		ts         = ThumbsServer{UpscaleFilter: "nearest", DownscaleFilter: "nearest"}
+		img        = toRGBA(gradientImage(400, 300))
+		background = image.NewUniform(color.White)
+	)
+	for _, mode := range []struct {
+		name     string
+		generate func() image.Image
+	}{
+		{"w", func() image.Image {
+			return ts.generateThumbnailModeW(img, 200, 200, background, SCALE_MODE_WCC, 85, "")
+		}},
+		{"crop", func() image.Image {
+			return ts.generateThumbnailModeCrop(img, 200, 200, CROP_MODE_CENTERCENTER, nil, 85, "")
+		}},
+	} {
+		for _, release := range []bool{true, false} {
+			label := mode.name + "/pooled"
+			if !release {
+				label = mode.name + "/unpooled"
+			}
+			b.Run(label, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					thumb := mode.generate()
+					if release {
+						releaseCanvas(thumb)
+					}
+				}
+			})
+		}
+	}
+}
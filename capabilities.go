@@ -0,0 +1,94 @@
+package caddy_thumbs
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// modeInfo 模式的 URL 标记和对齐方式, m 模式没有对齐方式
+type modeInfo struct {
+	Token      string `json:"token"`
+	Horizontal string `json:"horizontal,omitempty"` // left、center、right
+	Vertical   string `json:"vertical,omitempty"`   // top、middle、bottom
+}
+
+// capabilityLimits 当前配置的限制
+type capabilityLimits struct {
+	MaxDimension     int            `json:"max_dimension"`
+	ModeMaxDimension map[string]int `json:"mode_max_dimension,omitempty"`
+	DefaultQuality   int            `json:"default_quality"`
+	MinQuality       int            `json:"min_quality,omitempty"`
+	QualityPresets   []string       `json:"quality_presets,omitempty"`
+}
+
+// capabilities 能力查询接口返回的 JSON
+type capabilities struct {
+	InputFormats  []string         `json:"input_formats"`
+	OutputFormats []string         `json:"output_formats"`
+	ScaleModes    []modeInfo       `json:"scale_modes"`
+	CropModes     []modeInfo       `json:"crop_modes"`
+	Limits        capabilityLimits `json:"limits"`
+}
+
+var (
+	horizontalAnchors = map[int]string{-1: "left", 0: "center", 1: "right"}
+	verticalAnchors   = map[int]string{-1: "top", 0: "middle", 1: "bottom"}
+)
+
+// buildCapabilities 由 cropModeMap、modeAnchors 和格式列表生成, 新增模式或格式时自动包含
+func (t ThumbsServer) buildCapabilities() capabilities {
+	caps := capabilities{
+		InputFormats: formatNames(sourceFormats),
+		ScaleModes:   []modeInfo{},
+		CropModes:    []modeInfo{},
+		Limits: capabilityLimits{
+			MaxDimension:     t.MaxDimension,
+			ModeMaxDimension: t.ModeMaxDimension,
+			DefaultQuality:   t.DefaultQuality,
+			MinQuality:       t.MinQuality,
+			QualityPresets:   slices.Sorted(maps.Keys(t.QualityPresets)),
+		},
+	}
+	var outputs []string
+	for _, format := range outputFormats {
+		if t.formatAllowed(format) {
+			outputs = append(outputs, format)
+		}
+	}
+	caps.OutputFormats = formatNames(outputs)
+
+	for token, modeId := range cropModeMap {
+		info := modeInfo{Token: token}
+		if anchor, ok := modeAnchors[modeId]; ok {
+			info.Horizontal, info.Vertical = horizontalAnchors[anchor[0]], verticalAnchors[anchor[1]]
+		}
+		if modeId >= CROP_MODE_LEFTTOP && modeId <= CROP_MODE_CENTERBOTTOM {
+			caps.CropModes = append(caps.CropModes, info)
+		} else {
+			caps.ScaleModes = append(caps.ScaleModes, info)
+		}
+	}
+	byToken := func(a, b modeInfo) int { return strings.Compare(a.Token, b.Token) }
+	slices.SortFunc(caps.ScaleModes, byToken)
+	slices.SortFunc(caps.CropModes, byToken)
+	return caps
+}
+
+// formatNames 去掉扩展名的点, 如 .jpg 输出为 jpg
+func formatNames(formats []string) []string {
+	names := make([]string, len(formats))
+	for i, format := range formats {
+		names[i] = strings.TrimPrefix(format, ".")
+	}
+	return names
+}
+
+// serveCapabilities 输出支持的输入输出格式、模式及其 URL 标记和当前的尺寸、质量限制, 供工具发现服务的能力
+func (t ThumbsServer) serveCapabilities(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	return json.NewEncoder(w).Encode(t.buildCapabilities())
+}
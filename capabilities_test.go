@@ -0,0 +1,52 @@
+package caddy_thumbs
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+// TestCapabilities 能力查询接口包含 cropModeMap 的每个模式, 裁剪模式和缩放模式分开列出, 输出格式受 allowed_formats 限制
+func TestCapabilities(t *testing.T) {
+	ts, _, _ := newTestServer(t, func(ts *ThumbsServer) {
+		ts.CapabilitiesPath = "/_capabilities"
+		ts.AllowedFormats = []string{"jpg", "webp"}
+		ts.MaxDimension = 1500
+	})
+	w := get(t, ts, "/_capabilities")
+	mustStatus(t, w, http.StatusOK)
+	var caps capabilities
+	if err := json.Unmarshal(w.Body.Bytes(), &caps); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens := make(map[string]bool)
+	for _, m := range caps.CropModes {
+		if id := cropModeMap[m.Token]; id < CROP_MODE_LEFTTOP || id > CROP_MODE_CENTERBOTTOM {
+			t.Errorf("%s listed as a crop mode", m.Token)
+		}
+		tokens[m.Token] = true
+	}
+	for _, m := range caps.ScaleModes {
+		tokens[m.Token] = true
+	}
+	for token := range cropModeMap {
+		if !tokens[token] {
+			t.Errorf("mode %s missing from the response", token)
+		}
+	}
+	if len(tokens) != len(cropModeMap) {
+		t.Errorf("response lists %d modes, cropModeMap has %d", len(tokens), len(cropModeMap))
+	}
+
+	if !slices.Equal(caps.OutputFormats, []string{"jpg", "webp"}) {
+		t.Errorf("output_formats = %v, want [jpg webp]", caps.OutputFormats)
+	}
+	if !slices.Contains(caps.InputFormats, "png") {
+		t.Errorf("input_formats = %v, want png included", caps.InputFormats)
+	}
+	if caps.Limits.MaxDimension != 1500 {
+		t.Errorf("max_dimension = %d, want 1500", caps.Limits.MaxDimension)
+	}
+}
@@ -0,0 +1,69 @@
+package caddy_thumbs
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// CHECKER_FLAG URL 中使用棋盘格背景的标记, 如 w200x200,checker
+const CHECKER_FLAG = "checker"
+
+// 棋盘格的两种灰色
+var (
+	checkerLight = color.RGBA{0xCC, 0xCC, 0xCC, 0xFF}
+	checkerDark  = color.RGBA{0x99, 0x99, 0x99, 0xFF}
+)
+
+// checkerboard 无限大小的棋盘格图案, 可以像 image.Uniform 一样作为 draw.Draw 的源图
+type checkerboard struct {
+	size int // 格子边长
+}
+
+func (c checkerboard) ColorModel() color.Model { return color.RGBAModel }
+
+func (c checkerboard) Bounds() image.Rectangle {
+	return image.Rect(-1e9, -1e9, 1e9, 1e9)
+}
+
+func (c checkerboard) At(x, y int) color.Color {
+	if (floorDiv(x, c.size)+floorDiv(y, c.size))%2 == 0 {
+		return checkerLight
+	}
+	return checkerDark
+}
+
+// floorDiv 向下取整的整数除法, 保证负坐标的格子大小一致
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && a < 0 {
+		q--
+	}
+	return q
+}
+
+// background 返回请求的背景: 棋盘格或纯色
+func (t ThumbsServer) background(req *thumbRequest) image.Image {
+	if req.checker {
+		return checkerboard{size: t.CheckerSize}
+	}
+	return &image.Uniform{req.bgColor}
+}
+
+// formatSupportsAlpha 判断输出格式是否支持透明通道
+func formatSupportsAlpha(format string) bool {
+	switch format {
+	case ".png", ".webp", ".jxl":
+		return true
+	}
+	return false
+}
+
+// flattenOnto 将带透明通道的图片合成到背景上
+func flattenOnto(img image.Image, background image.Image) image.Image {
+	b := img.Bounds()
+	canvas := newCanvas(b.Dx(), b.Dy())
+	draw.Draw(canvas, canvas.Bounds(), background, image.Point{}, draw.Src)
+	draw.Draw(canvas, canvas.Bounds(), img, b.Min, draw.Over)
+	return canvas
+}
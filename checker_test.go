@@ -0,0 +1,39 @@
+package caddy_thumbs
+
+import (
+	"image/color"
+	"net/http"
+	"testing"
+)
+
+// TestCheckerBackground w 模式填充的区域为两种灰色交替的棋盘格, 相邻的格子颜色不同
+func TestCheckerBackground(t *testing.T) {
+	ts, src, _ := newTestServer(t, nil)
+	src.put("/a.png", encodePNG(t, solidImage(64, 16, color.NRGBA{0xFF, 0, 0, 0xFF})))
+
+	w := get(t, ts, "/wcc64x64,checker/a.png")
+	mustStatus(t, w, http.StatusOK)
+	img, _ := decodeBody(t, w.Body.Bytes())
+	// 原图居中绘制在 y=24..40, 上方为填充区域
+	gray := func(x, y int) uint32 {
+		r, g, b, _ := img.At(x, y).RGBA()
+		if r != g || g != b {
+			t.Fatalf("pixel (%d,%d) = %d,%d,%d, not gray", x, y, r>>8, g>>8, b>>8)
+		}
+		return r >> 8
+	}
+	for y := 0; y < 24; y++ {
+		for x := 0; x < 64; x++ {
+			want := uint32(checkerLight.R)
+			if (x/ts.CheckerSize+y/ts.CheckerSize)%2 == 1 {
+				want = uint32(checkerDark.R)
+			}
+			if got := gray(x, y); got != want {
+				t.Fatalf("pixel (%d,%d) = %#x, want %#x", x, y, got, want)
+			}
+		}
+	}
+	if r, _, _, _ := img.At(32, 32).RGBA(); r>>8 != 0xFF {
+		t.Errorf("image not drawn over the checkerboard, center red = %d", r>>8)
+	}
+}
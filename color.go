@@ -0,0 +1,30 @@
+package caddy_thumbs
+
+import (
+	"fmt"
+	"image"
+)
+
+const (
+	colorHeader = "X-Thumbs-Color" // 缩略图平均颜色响应头, 格式为 #rrggbb
+	colorSuffix = ".color"         // 平均颜色在缩略图存储中的后缀
+	colorSample = 64               // 每个方向最多采样的像素数
+)
+
+// averageColor 计算图片的平均颜色, 按透明度加权, 完全透明的图片返回白色. 大图按间隔采样
+func averageColor(img image.Image) string {
+	b := img.Bounds()
+	stepX, stepY := max(1, b.Dx()/colorSample), max(1, b.Dy()/colorSample)
+	var r, g, bl, a uint64
+	for y := b.Min.Y; y < b.Max.Y; y += stepY {
+		for x := b.Min.X; x < b.Max.X; x += stepX {
+			// RGBA 返回预乘透明度的值, 累加即为按透明度加权
+			cr, cg, cb, ca := img.At(x, y).RGBA()
+			r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+		}
+	}
+	if a == 0 {
+		return "#ffffff"
+	}
+	return fmt.Sprintf("#%02x%02x%02x", r*0xFF/a, g*0xFF/a, bl*0xFF/a)
+}
@@ -0,0 +1,54 @@
+package caddy_thumbs
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+// TestColorHeader 生成和缓存命中时都返回平均颜色响应头, 左红右蓝的原图平均颜色接近紫色, 未开启时不返回
+func TestColorHeader(t *testing.T) {
+	source := solidImage(100, 100, color.NRGBA{0xFF, 0, 0, 0xFF})
+	draw.Draw(source, image.Rect(50, 0, 100, 100), image.NewUniform(color.NRGBA{0, 0, 0xFF, 0xFF}), image.Point{}, draw.Src)
+
+	ts, src, thumbs := newTestServer(t, func(ts *ThumbsServer) { ts.ColorHeader = true })
+	src.put("/a.png", encodePNG(t, source))
+
+	hex := regexp.MustCompile(`^#[0-9a-f]{6}$`)
+	var first string
+	for _, state := range []string{"miss", "hit"} {
+		w := get(t, ts, "/m50x50/a.png")
+		mustStatus(t, w, http.StatusOK)
+		header := w.Header().Get(colorHeader)
+		if !hex.MatchString(header) {
+			t.Fatalf("%s: %s = %q, want #rrggbb", state, colorHeader, header)
+		}
+		channel := func(i int) int {
+			v, _ := strconv.ParseUint(header[1+2*i:3+2*i], 16, 8)
+			return int(v)
+		}
+		if r, g, b := channel(0), channel(1), channel(2); r < 0x70 || r > 0x90 || g > 0x10 || b < 0x70 || b > 0x90 {
+			t.Errorf("%s: %s = %s, want close to #800080", state, colorHeader, header)
+		}
+		if first == "" {
+			first = header
+		} else if header != first {
+			t.Errorf("cached color = %s, want %s", header, first)
+		}
+	}
+	if _, ok := thumbs.get("/m50x50/a.png" + colorSuffix); !ok {
+		t.Errorf("color was not cached, keys: %v", thumbs.keys())
+	}
+
+	plain, plainSrc, _ := newTestServer(t, nil)
+	plainSrc.put("/a.png", encodePNG(t, source))
+	w := get(t, plain, "/m50x50/a.png")
+	mustStatus(t, w, http.StatusOK)
+	if header := w.Header().Get(colorHeader); header != "" {
+		t.Errorf("color_header off: %s = %q, want empty", colorHeader, header)
+	}
+}
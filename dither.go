@@ -0,0 +1,41 @@
+package caddy_thumbs
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// DITHER_FLAG URL 中减少输出颜色的标记, 可带每个通道的色阶数(2-6), 如 c200x200,dither 或 c200x200,dither3
+const DITHER_FLAG = "dither"
+
+const (
+	minDitherLevels     = 2
+	maxDitherLevels     = 6 // 6 级即 216 色的 Web 安全色
+	defaultDitherLevels = maxDitherLevels
+)
+
+// uniformPalette 每个通道 levels 级的均匀调色板, 带透明通道时追加一个透明色
+func uniformPalette(levels int, transparent bool) color.Palette {
+	palette := make(color.Palette, 0, levels*levels*levels+1)
+	level := func(i int) uint8 { return uint8(i * 255 / (levels - 1)) }
+	for r := 0; r < levels; r++ {
+		for g := 0; g < levels; g++ {
+			for b := 0; b < levels; b++ {
+				palette = append(palette, color.RGBA{level(r), level(g), level(b), 0xFF})
+			}
+		}
+	}
+	if transparent {
+		palette = append(palette, color.RGBA{})
+	}
+	return palette
+}
+
+// ditherImage 使用 Floyd–Steinberg 误差扩散将图片映射到固定调色板. 输出为调色板图片, PNG 输出时保留调色板
+func ditherImage(img image.Image, levels int) *image.Paletted {
+	b := img.Bounds()
+	dst := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), uniformPalette(levels, hasAlpha(img)))
+	draw.FloydSteinberg.Draw(dst, dst.Bounds(), img, b.Min)
+	return dst
+}
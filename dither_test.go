@@ -0,0 +1,54 @@
+package caddy_thumbs
+
+import (
+	"image"
+	"image/color"
+	"net/http"
+	"testing"
+)
+
+// TestDither dither 标记将输出减为固定调色板, 平坦的中间色由调色板颜色交错组成, 平均值接近原色; 色阶数超出范围时返回 400
+func TestDither(t *testing.T) {
+	ts, src, _ := newTestServer(t, nil)
+	src.put("/gray.png", encodePNG(t, solidImage(64, 64, color.NRGBA{0x80, 0x80, 0x80, 0xFF})))
+
+	w := get(t, ts, "/c32x32,dither2/gray.png")
+	mustStatus(t, w, http.StatusOK)
+	img, _ := decodeBody(t, w.Body.Bytes())
+	paletted, ok := img.(*image.Paletted)
+	if !ok {
+		t.Fatalf("decoded %T, want a palette image", img)
+	}
+	if len(paletted.Palette) != 8 {
+		t.Errorf("palette has %d colors, want 8 for 2 levels", len(paletted.Palette))
+	}
+	// 两级调色板中没有灰色, 必须由黑白像素交错组成
+	var sum, black, white int
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			switch {
+			case c.R == 0 && c.G == 0 && c.B == 0:
+				black++
+			case c.R == 0xFF && c.G == 0xFF && c.B == 0xFF:
+				white++
+			default:
+				t.Fatalf("pixel (%d,%d) = %v, want black or white", x, y, c)
+			}
+			sum += int(c.R)
+		}
+	}
+	if black == 0 || white == 0 {
+		t.Errorf("%d black and %d white pixels, want a dithered mix", black, white)
+	}
+	if mean := sum / (32 * 32); mean < 0x70 || mean > 0x90 {
+		t.Errorf("mean = %#x, want close to 0x80", mean)
+	}
+
+	plain := get(t, ts, "/c32x32/gray.png")
+	mustStatus(t, plain, http.StatusOK)
+	if plainImg, _ := decodeBody(t, plain.Body.Bytes()); distinctColors(plainImg) != 1 {
+		t.Errorf("without dither the output has %d colors, want 1", distinctColors(plainImg))
+	}
+	mustStatus(t, get(t, ts, "/c32x32,dither7/gray.png"), http.StatusBadRequest)
+}
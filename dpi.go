@@ -0,0 +1,81 @@
+package caddy_thumbs
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+const (
+	jpegSOISize    = 2  // JPEG SOI 标记的长度, JFIF 段紧跟其后
+	pngIHDREndSize = 33 // PNG 签名(8) + IHDR 块(25), pHYs 块紧跟其后
+)
+
+// jfifSegment 构造声明分辨率的 JFIF APP0 段, 单位为每英寸像素数
+func jfifSegment(dpi int) []byte {
+	seg := []byte{
+		0xFF, 0xE0, 0x00, 0x10, // APP0, 长度 16
+		'J', 'F', 'I', 'F', 0x00,
+		0x01, 0x02, // 版本 1.02
+		0x01,                   // 单位: dots per inch
+		0x00, 0x00, 0x00, 0x00, // X/Y 分辨率
+		0x00, 0x00, // 无缩略图
+	}
+	binary.BigEndian.PutUint16(seg[12:], uint16(dpi))
+	binary.BigEndian.PutUint16(seg[14:], uint16(dpi))
+	return seg
+}
+
+// pHYsChunk 构造 PNG pHYs 块, PNG 以每米像素数记录分辨率
+func pHYsChunk(dpi int) []byte {
+	ppm := uint32(math.Round(float64(dpi) / 0.0254))
+	chunk := make([]byte, 21)
+	binary.BigEndian.PutUint32(chunk[0:], 9)
+	copy(chunk[4:], "pHYs")
+	binary.BigEndian.PutUint32(chunk[8:], ppm)
+	binary.BigEndian.PutUint32(chunk[12:], ppm)
+	chunk[16] = 1 // 单位: 米
+	binary.BigEndian.PutUint32(chunk[17:], crc32.ChecksumIEEE(chunk[4:17]))
+	return chunk
+}
+
+// dpiWriter 返回在编码输出中插入分辨率信息的 writer, 不支持的格式或未配置时原样返回
+func dpiWriter(w io.Writer, format string, dpi int) io.Writer {
+	if dpi <= 0 {
+		return w
+	}
+	switch format {
+	case ".jpg", ".jpeg":
+		return &insertWriter{w: w, offset: jpegSOISize, insert: jfifSegment(dpi)}
+	case ".png":
+		return &insertWriter{w: w, offset: pngIHDREndSize, insert: pHYsChunk(dpi)}
+	}
+	return w
+}
+
+// insertWriter 在写出的第 offset 个字节处插入一段数据, 支持流式写出
+type insertWriter struct {
+	w       io.Writer
+	offset  int
+	insert  []byte
+	written int
+}
+
+func (iw *insertWriter) Write(p []byte) (int, error) {
+	if iw.insert == nil || iw.written+len(p) < iw.offset {
+		iw.written += len(p)
+		return iw.w.Write(p)
+	}
+	head := iw.offset - iw.written
+	if _, err := iw.w.Write(p[:head]); err != nil {
+		return 0, err
+	}
+	if _, err := iw.w.Write(iw.insert); err != nil {
+		return head, err
+	}
+	iw.insert = nil
+	n, err := iw.w.Write(p[head:])
+	iw.written += head + n
+	return head + n, err
+}
@@ -0,0 +1,76 @@
+package caddy_thumbs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/color"
+	"net/http"
+	"testing"
+)
+
+// pngPHYs 返回 PNG 中 pHYs 块的数据, 没有时返回 nil
+func pngPHYs(data []byte) []byte {
+	for pos := 8; pos+12 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		if pos+12+length > len(data) {
+			break
+		}
+		if string(data[pos+4:pos+8]) == "pHYs" {
+			return data[pos+8 : pos+8+length]
+		}
+		pos += 12 + length
+	}
+	return nil
+}
+
+// jpegJFIF 返回 JPEG 中 JFIF APP0 段的数据, 没有时返回 nil
+func jpegJFIF(data []byte) []byte {
+	for pos := 2; pos+4 <= len(data) && data[pos] == 0xFF && data[pos+1] != 0xDA; {
+		size := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if pos+2+size > len(data) {
+			break
+		}
+		if segment := data[pos+4 : pos+2+size]; data[pos+1] == 0xE0 && bytes.HasPrefix(segment, []byte("JFIF\x00")) {
+			return segment
+		}
+		pos += 2 + size
+	}
+	return nil
+}
+
+// TestOutputDPI 配置 output_dpi 后 PNG 输出带 pHYs 块, JPEG 输出带 JFIF 分辨率, 未配置时不写入
+func TestOutputDPI(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.OutputDPI = 300 })
+	src.put("/a.png", encodePNG(t, solidImage(40, 40, color.White)))
+	src.put("/a.jpg", encodeJPEG(t, solidImage(40, 40, color.White), 90))
+
+	w := get(t, ts, "/c20x20/a.png")
+	mustStatus(t, w, http.StatusOK)
+	phys := pngPHYs(w.Body.Bytes())
+	// 300 DPI = 11811 像素每米, 单位 1 为米
+	if len(phys) != 9 || binary.BigEndian.Uint32(phys) != 11811 || binary.BigEndian.Uint32(phys[4:]) != 11811 || phys[8] != 1 {
+		t.Errorf("pHYs = %x, want 11811 pixels per metre", phys)
+	}
+	// 插入的数据不影响解码
+	if width, height := imageSize(t, w.Body.Bytes()); width != 20 || height != 20 {
+		t.Errorf("size = %dx%d, want 20x20", width, height)
+	}
+
+	w = get(t, ts, "/c20x20/a.jpg")
+	mustStatus(t, w, http.StatusOK)
+	jfif := jpegJFIF(w.Body.Bytes())
+	// 标识(5) + 版本(2) 之后是单位和 X/Y 分辨率
+	if len(jfif) < 12 || jfif[7] != 1 || binary.BigEndian.Uint16(jfif[8:]) != 300 || binary.BigEndian.Uint16(jfif[10:]) != 300 {
+		t.Errorf("JFIF segment = %x, want 300 dots per inch", jfif)
+	}
+	// 插入的数据不影响解码
+	if width, height := imageSize(t, w.Body.Bytes()); width != 20 || height != 20 {
+		t.Errorf("size = %dx%d, want 20x20", width, height)
+	}
+
+	ts, src, _ = newTestServer(t, nil)
+	src.put("/a.png", encodePNG(t, solidImage(40, 40, color.White)))
+	if phys := pngPHYs(get(t, ts, "/c20x20/a.png").Body.Bytes()); phys != nil {
+		t.Errorf("pHYs written without output_dpi: %x", phys)
+	}
+}
@@ -0,0 +1,217 @@
+package caddy_thumbs
+
+import (
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// 错误响应模式
+const (
+	ERROR_RESPONSE_JSON  = "json"  // 输出 JSON 结构的错误信息
+	ERROR_RESPONSE_IMAGE = "image" // 将错误信息绘制到请求尺寸的占位图上
+)
+
+// 错误占位图的尺寸和颜色
+const (
+	errorImageDefaultSize = 200
+	errorImageMaxSize     = 400  // 占位图的最大边长, 更大的请求尺寸按比例缩小
+	maxErrorImages        = 1000 // 最多缓存的占位图数量, 超过后清空
+)
+
+var (
+	errorImageBackground = color.RGBA{0xEE, 0xEE, 0xEE, 0xFF}
+	errorImageForeground = color.RGBA{0x66, 0x66, 0x66, 0xFF}
+)
+
+// errorBody JSON 错误响应
+type errorBody struct {
+	Status  int    `json:"status"`
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+// errorImageKey 占位图按状态码、尺寸和格式缓存
+type errorImageKey struct {
+	status, width, height int
+	format                string
+}
+
+// errorImageCache 已编码的错误占位图. 占位图只包含状态码和对应的状态文本, 相同的键内容相同
+type errorImageCache struct {
+	mu     sync.Mutex
+	images map[errorImageKey][]byte
+}
+
+func newErrorImageCache() *errorImageCache {
+	return &errorImageCache{images: make(map[errorImageKey][]byte)}
+}
+
+// get 返回缓存的占位图, 不存在时调用 render 生成并缓存
+func (c *errorImageCache) get(key errorImageKey, render func() ([]byte, error)) ([]byte, error) {
+	c.mu.Lock()
+	data, ok := c.images[key]
+	c.mu.Unlock()
+	if ok {
+		return data, nil
+	}
+	data, err := render()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if len(c.images) >= maxErrorImages {
+		clear(c.images)
+	}
+	c.images[key] = data
+	c.mu.Unlock()
+	return data, nil
+}
+
+// splitHandlerError 拆分出错误对应的 HTTP 状态码和错误信息. 服务端错误(5xx)的原始信息可能包含存储路径等内部细节,
+// 只返回状态文本
+func splitHandlerError(err error) (int, string) {
+	status, message := http.StatusInternalServerError, ""
+	var handlerErr caddyhttp.HandlerError
+	if errors.As(err, &handlerErr) {
+		if handlerErr.StatusCode != 0 {
+			status = handlerErr.StatusCode
+		}
+		if handlerErr.Err != nil {
+			message = handlerErr.Err.Error()
+		}
+	}
+	if message == "" || status >= http.StatusInternalServerError {
+		message = http.StatusText(status)
+	}
+	return status, message
+}
+
+// writeErrorResponse 按 error_response 配置输出错误
+func (t ThumbsServer) writeErrorResponse(w http.ResponseWriter, r *http.Request, err error) error {
+	status, message := splitHandlerError(err)
+	w.Header().Set("Cache-Control", "no-store")
+
+	switch t.ErrorResponse {
+	case ERROR_RESPONSE_JSON:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		return json.NewEncoder(w).Encode(errorBody{Status: status, Error: http.StatusText(status), Message: message})
+	case ERROR_RESPONSE_IMAGE:
+		// 占位图只绘制状态码和状态文本, 不包含错误信息
+		width, height, format := t.errorImageSize(r.URL.Path)
+		key := errorImageKey{status: status, width: width, height: height, format: format}
+		data, encErr := t.errorImages.get(key, func() ([]byte, error) {
+			return t.encodeImage(renderErrorImage(width, height, strconv.Itoa(status)+" "+http.StatusText(status)), float32(t.DefaultQuality), format)
+		})
+		if encErr != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", http.DetectContentType(data))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		_, werr := w.Write(data)
+		return werr
+	}
+	return err
+}
+
+// errorImageSize 尽量从请求路径中获取占位图的尺寸和格式, 无法解析时使用默认值. 尺寸超过 errorImageMaxSize 时按比例缩小
+func (t ThumbsServer) errorImageSize(path string) (int, int, string) {
+	width, height, format := errorImageDefaultSize, errorImageDefaultSize, ".png"
+	matches := t.regex.FindStringSubmatch(t.stripPathPrefix(path))
+	if len(matches) < 12 {
+		return width, height, format
+	}
+	// long/short 模式只有一个尺寸, 占位图使用正方形
+	widthStr, heightStr := matches[3], matches[4]
+	if matches[6] != "" {
+		widthStr, heightStr = matches[6], matches[6]
+	}
+	if w, err := strconv.Atoi(widthStr); err == nil && w > 0 && w <= t.MaxDimension {
+		width = w
+	}
+	if h, err := strconv.Atoi(heightStr); err == nil && h > 0 && h <= t.MaxDimension {
+		height = h
+	}
+	switch matches[11] {
+	case ".jpg", ".jpeg", ".png", ".webp":
+		format = matches[11]
+	}
+	if longest := max(width, height); longest > errorImageMaxSize {
+		width = max(1, width*errorImageMaxSize/longest)
+		height = max(1, height*errorImageMaxSize/longest)
+	}
+	return width, height, format
+}
+
+// renderErrorImage 绘制带错误信息的占位图, 文字按宽度自动换行
+func renderErrorImage(width, height int, message string) image.Image {
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(canvas, canvas.Bounds(), &image.Uniform{errorImageBackground}, image.Point{}, draw.Src)
+
+	var (
+		face       = basicfont.Face7x13
+		lineHeight = face.Metrics().Height.Ceil()
+		charWidth  = face.Advance
+		maxChars   = max(1, (width-8)/charWidth)
+		lines      = wrapText(message, maxChars)
+		y          = max(lineHeight, (height-len(lines)*lineHeight)/2+face.Metrics().Ascent.Ceil())
+	)
+	drawer := &font.Drawer{Dst: canvas, Src: &image.Uniform{errorImageForeground}, Face: face}
+	for _, line := range lines {
+		if y > height {
+			break
+		}
+		x := max(4, (width-len(line)*charWidth)/2)
+		drawer.Dot = fixed.P(x, y)
+		drawer.DrawString(line)
+		y += lineHeight
+	}
+	return canvas
+}
+
+// wrapText 按最大字符数对文字换行
+func wrapText(text string, maxChars int) []string {
+	var (
+		lines []string
+		line  string
+	)
+	for _, word := range strings.Fields(text) {
+		for len(word) > maxChars {
+			if line != "" {
+				lines = append(lines, line)
+				line = ""
+			}
+			lines = append(lines, word[:maxChars])
+			word = word[maxChars:]
+		}
+		if word == "" {
+			continue
+		}
+		switch {
+		case line == "":
+			line = word
+		case len(line)+1+len(word) <= maxChars:
+			line += " " + word
+		default:
+			lines = append(lines, line)
+			line = word
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,73 @@
+package caddy_thumbs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// TestErrorResponseJSON json 模式返回结构化的错误
+func TestErrorResponseJSON(t *testing.T) {
+	ts, _, _ := newTestServer(t, func(ts *ThumbsServer) { ts.ErrorResponse = ERROR_RESPONSE_JSON })
+
+	w := get(t, ts, "/c20x20/missing.jpg")
+	mustStatus(t, w, http.StatusNotFound)
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %s, want application/json", ct)
+	}
+	var body errorBody
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body is not JSON: %v", err)
+	}
+	if body.Status != http.StatusNotFound || body.Error != "Not Found" || body.Message == "" {
+		t.Errorf("body = %+v", body)
+	}
+}
+
+// TestErrorResponseImage image 模式返回请求格式的占位图, 超大尺寸按比例缩小, 相同的错误使用缓存的占位图
+func TestErrorResponseImage(t *testing.T) {
+	ts, _, _ := newTestServer(t, func(ts *ThumbsServer) { ts.ErrorResponse = ERROR_RESPONSE_IMAGE })
+
+	w := get(t, ts, "/c300x150/missing.png")
+	mustStatus(t, w, http.StatusNotFound)
+	img, format := decodeBody(t, w.Body.Bytes())
+	if format != "png" || img.Bounds().Dx() != 300 || img.Bounds().Dy() != 150 {
+		t.Errorf("got %s %dx%d, want png 300x150", format, img.Bounds().Dx(), img.Bounds().Dy())
+	}
+	if again := get(t, ts, "/c300x150/other.png"); !bytes.Equal(again.Body.Bytes(), w.Body.Bytes()) {
+		t.Errorf("placeholder differs for the same status and size")
+	}
+	if n := len(ts.errorImages.images); n != 1 {
+		t.Errorf("cached %d placeholders, want 1", n)
+	}
+
+	w = get(t, ts, "/c1600x800/missing.jpg")
+	mustStatus(t, w, http.StatusNotFound)
+	img, format = decodeBody(t, w.Body.Bytes())
+	if format != "jpeg" || img.Bounds().Dx() != errorImageMaxSize || img.Bounds().Dy() != errorImageMaxSize/2 {
+		t.Errorf("got %s %dx%d, want jpeg %dx%d", format, img.Bounds().Dx(), img.Bounds().Dy(), errorImageMaxSize, errorImageMaxSize/2)
+	}
+}
+
+// TestSplitHandlerError 服务端错误不返回原始错误信息
+func TestSplitHandlerError(t *testing.T) {
+	tests := []struct {
+		err     error
+		status  int
+		message string
+	}{
+		{caddyhttp.Error(http.StatusBadRequest, errors.New("invalid maxbytes: x")), http.StatusBadRequest, "invalid maxbytes: x"},
+		{caddyhttp.Error(http.StatusInternalServerError, errors.New("open /data/thumbs/a.jpg: permission denied")), http.StatusInternalServerError, "Internal Server Error"},
+		{errors.New("s3: access key AKIA... rejected"), http.StatusInternalServerError, "Internal Server Error"},
+		{caddyhttp.Error(http.StatusNotFound, nil), http.StatusNotFound, "Not Found"},
+	}
+	for _, tt := range tests {
+		if status, message := splitHandlerError(tt.err); status != tt.status || message != tt.message {
+			t.Errorf("splitHandlerError(%v) = %d %q, want %d %q", tt.err, status, message, tt.status, tt.message)
+		}
+	}
+}
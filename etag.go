@@ -0,0 +1,100 @@
+package caddy_thumbs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// thumbMetaSuffix 缩略图校验信息在缩略图存储中的后缀
+const thumbMetaSuffix = ".meta"
+
+// thumbMeta 缩略图的校验信息, 条件请求命中时不必读取缩略图本身
+type thumbMeta struct {
+	ETag     string    `json:"etag"`
+	Modified time.Time `json:"modified"`
+}
+
+// thumbETag 以缩略图内容的哈希作为 ETag
+func thumbETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return formatETag(sum[:])
+}
+
+// formatETag 取哈希的前 16 字节生成强校验 ETag
+func formatETag(sum []byte) string {
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// thumbMetaEntries 开启 etag_sidecar 时返回缩略图的校验信息条目, 与缩略图一同写入
+func (t ThumbsServer) thumbMetaEntries(key, etag string) []thumbEntry {
+	return t.thumbMetaEntriesAt(key, etag, time.Now())
+}
+
+// thumbMetaEntriesAt 同 thumbMetaEntries, 使用指定的修改时间
+func (t ThumbsServer) thumbMetaEntriesAt(key, etag string, modified time.Time) []thumbEntry {
+	if !t.ETagSidecar {
+		return nil
+	}
+	data, _ := json.Marshal(thumbMeta{ETag: etag, Modified: modified})
+	return []thumbEntry{{key: key + thumbMetaSuffix, data: data}}
+}
+
+// storeThumbMeta 单独保存缩略图的校验信息, 用于流式写入后才能得到哈希的场景, 修改时间与已发送的 Last-Modified 一致.
+// 保存失败只记录日志
+func (t ThumbsServer) storeThumbMeta(key, etag string, modified time.Time) {
+	if t.NoCache {
+		return
+	}
+	for _, entry := range t.thumbMetaEntriesAt(key, etag, modified) {
+		if err := t.storeThumb(entry.key, entry.data); err != nil {
+			t.logger.Warn("Failed to store thumbnail metadata", zap.String("path", key), zap.Error(err))
+		}
+	}
+}
+
+// serveNotModified 缓存命中的条件请求只读取校验信息, 校验通过时直接返回 304 而不读取缩略图.
+// 校验信息不存在或不匹配时返回 false, 按普通命中处理
+func (t ThumbsServer) serveNotModified(w http.ResponseWriter, r *http.Request, req *thumbRequest, cachedPath string) bool {
+	if !t.ETagSidecar || (r.Header.Get("If-None-Match") == "" && r.Header.Get("If-Modified-Since") == "") {
+		return false
+	}
+	data, err := t.thumbsStorage.Load(t.ctx, cachedPath+thumbMetaSuffix)
+	if err != nil {
+		return false
+	}
+	var meta thumbMeta
+	if err := json.Unmarshal(data, &meta); err != nil || !notModified(r, &meta) {
+		return false
+	}
+	if t.index != nil {
+		t.index.touch(cachedPath)
+	}
+	w.Header().Set("ETag", meta.ETag)
+	t.setCacheHeaders(w, req)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// notModified 按 If-None-Match 或 If-Modified-Since 判断客户端的缓存是否仍然有效, 两者都有时以 If-None-Match 为准
+func notModified(r *http.Request, meta *thumbMeta) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == meta.ETag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !meta.Modified.Truncate(time.Second).After(ims)
+}
@@ -0,0 +1,53 @@
+package caddy_thumbs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestETagSidecar 开启 etag_sidecar 时, 校验通过的条件请求只读取校验信息, 不读取缩略图即返回 304;
+// 校验不通过时读取缩略图正常返回
+func TestETagSidecar(t *testing.T) {
+	ts, src, thumbs := newTestServer(t, func(ts *ThumbsServer) { ts.ETagSidecar = true })
+	src.put("/a.png", encodePNG(t, gradientImage(40, 40)))
+
+	w := get(t, ts, "/c20x20/a.png")
+	mustStatus(t, w, http.StatusOK)
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("response has no ETag")
+	}
+	if _, ok := thumbs.get("/c20x20/a.png" + thumbMetaSuffix); !ok {
+		t.Fatalf("metadata sidecar not stored, keys: %v", thumbs.keys())
+	}
+
+	conditional := func(header, value string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/c20x20/a.png", nil)
+		r.Header.Set(header, value)
+		return serve(t, ts, r)
+	}
+	for header, value := range map[string]string{
+		"If-None-Match":     etag,
+		"If-Modified-Since": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat),
+	} {
+		loads := thumbs.count("Load")
+		w := conditional(header, value)
+		mustStatus(t, w, http.StatusNotModified)
+		// 只读取了校验信息
+		if n := thumbs.count("Load") - loads; n != 1 {
+			t.Errorf("%s: thumbs storage Load called %d times, want only the sidecar", header, n)
+		}
+		if got := w.Header().Get("ETag"); got != etag {
+			t.Errorf("%s: 304 ETag = %s, want %s", header, got, etag)
+		}
+	}
+
+	loads := thumbs.count("Load")
+	w = conditional("If-None-Match", `"stale"`)
+	mustStatus(t, w, http.StatusOK)
+	if n := thumbs.count("Load") - loads; n != 2 || w.Body.Len() == 0 {
+		t.Errorf("stale validator: Load called %d times with %d bytes, want the sidecar and the thumbnail", n, w.Body.Len())
+	}
+}
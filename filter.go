@@ -0,0 +1,49 @@
+package caddy_thumbs
+
+import (
+	"fmt"
+	"image"
+	"regexp"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// ImageFilter 由第三方 Caddy 模块实现的缩放后处理操作, 如锐化、自定义 LUT.
+// 模块注册在 http.handlers.thumbs_server.filters 命名空间下, 模块名即 URL 中的操作名,
+// 与内置操作一样写在模式目录中, 如 m200x200.sepia 或 m200x200.lut3
+type ImageFilter interface {
+	// FilterArgs 返回参数范围, 均为 0 时表示不带参数
+	FilterArgs() (min, max int)
+	// ApplyFilter 处理以 (0,0) 为原点的 RGBA 图片, 可以原地修改并返回同一图片
+	ApplyFilter(img *image.RGBA, arg int) *image.RGBA
+}
+
+// filterNamePattern 操作名只能由小写字母组成, 与 URL 中的操作格式一致
+var filterNamePattern = regexp.MustCompile(`^[a-z]+$`)
+
+// buildPipelineOps 合并内置操作和配置的外部操作, 外部操作不能与内置操作或其他外部操作同名
+func buildPipelineOps(filters []any) (map[string]pipelineOpSpec, error) {
+	ops := make(map[string]pipelineOpSpec, len(pipelineOps)+len(filters))
+	for name, spec := range pipelineOps {
+		ops[name] = spec
+	}
+	for _, mod := range filters {
+		filter, ok := mod.(ImageFilter)
+		if !ok {
+			return nil, fmt.Errorf("module %T is not an ImageFilter", mod)
+		}
+		name := mod.(caddy.Module).CaddyModule().ID.Name()
+		if !filterNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("image filter name must be lowercase letters only: %s", name)
+		}
+		if _, exists := ops[name]; exists {
+			return nil, fmt.Errorf("duplicate image filter: %s", name)
+		}
+		minArg, maxArg := filter.FilterArgs()
+		if minArg < 0 || minArg > maxArg {
+			return nil, fmt.Errorf("invalid argument range for image filter %s: %d-%d", name, minArg, maxArg)
+		}
+		ops[name] = pipelineOpSpec{minArg: minArg, maxArg: maxArg, apply: filter.ApplyFilter}
+	}
+	return ops, nil
+}
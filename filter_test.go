@@ -0,0 +1,82 @@
+package caddy_thumbs
+
+import (
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(redFilter{})
+	caddy.RegisterModule(grayFilter{})
+}
+
+// redFilter 测试用的外部操作, 将红色通道设为参数值
+type redFilter struct{}
+
+func (redFilter) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.thumbs_server.filters.red",
+		New: func() caddy.Module { return new(redFilter) },
+	}
+}
+
+func (redFilter) FilterArgs() (int, int) { return 0, 255 }
+
+func (redFilter) ApplyFilter(img *image.RGBA, arg int) *image.RGBA {
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i] = uint8(arg)
+	}
+	return img
+}
+
+// grayFilter 与内置操作 gray 同名的外部操作
+type grayFilter struct{ redFilter }
+
+func (grayFilter) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.thumbs_server.filters.gray",
+		New: func() caddy.Module { return new(grayFilter) },
+	}
+}
+
+// TestImageFilters 配置的外部操作按 URL 中的操作名在缩放后执行, 参数超出范围或未配置时返回 400, 不能与内置操作同名
+func TestImageFilters(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) {
+		ts.ImageFiltersRaw = []json.RawMessage{json.RawMessage(`{"filter":"red"}`)}
+	})
+	src.put("/a.png", encodePNG(t, solidImage(80, 80, color.NRGBA{0, 0, 255, 255})))
+
+	w := get(t, ts, "/m40x40.red200/a.png")
+	mustStatus(t, w, http.StatusOK)
+	img, _ := decodeBody(t, w.Body.Bytes())
+	if w, h := img.Bounds().Dx(), img.Bounds().Dy(); w != 40 || h != 40 {
+		t.Errorf("size = %dx%d, want 40x40", w, h)
+	}
+	if got := color.NRGBAModel.Convert(img.At(20, 20)).(color.NRGBA); got != (color.NRGBA{200, 0, 255, 255}) {
+		t.Errorf("color = %v, want {200 0 255 255}", got)
+	}
+	// 外部操作与内置操作组合使用
+	mustStatus(t, get(t, ts, "/m40x40.red200.gray/a.png"), http.StatusOK)
+	mustStatus(t, get(t, ts, "/m40x40.red300/a.png"), http.StatusBadRequest)
+
+	plain, plainSrc, _ := newTestServer(t, nil)
+	plainSrc.put("/a.png", encodePNG(t, solidImage(80, 80, color.White)))
+	mustStatus(t, get(t, plain, "/m40x40.red200/a.png"), http.StatusBadRequest)
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	dup := &ThumbsServer{
+		ImageStorageRaw:  registerStorage(t, "src", newMemStorage()),
+		ThumbsStorageRaw: registerStorage(t, "thumbs", newMemStorage()),
+		ImageFiltersRaw:  []json.RawMessage{json.RawMessage(`{"filter":"gray"}`)},
+	}
+	if err := dup.Provision(ctx); err == nil {
+		t.Error("filter named like the built-in gray operation was accepted")
+	}
+}
@@ -0,0 +1,187 @@
+package caddy_thumbs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// hashedKeyManifestSuffix 记录逻辑键的清单条目后缀, 与缩略图存放在同一目录
+const hashedKeyManifestSuffix = ".key"
+
+// hashedStorage 将缩略图的逻辑键(缩略图路径)哈希后分散到固定层数的目录中, 如 ab/cd/<哈希>,
+// 避免原图路径在文件系统存储中形成很深或很宽的目录树. 每个条目旁的清单条目记录其逻辑键,
+// 列举存储时据此还原逻辑键, 索引、缓存统计和孤立缩略图清理仍按逻辑键工作
+type hashedStorage struct {
+	certmagic.Storage
+	depth int
+	keys  *hashedKeys
+}
+
+// hashedKeys 内存中的逻辑键集合. 首次列举时读取所有清单条目建立, 之后随写入和删除更新,
+// 列举不再读取清单条目. 其他实例写入同一存储的条目在重启前不会出现在列举结果中
+type hashedKeys struct {
+	mu     sync.Mutex
+	loaded bool
+	keys   map[string]struct{}
+}
+
+func newHashedStorage(storage certmagic.Storage, depth int) hashedStorage {
+	return hashedStorage{Storage: storage, depth: depth, keys: &hashedKeys{keys: make(map[string]struct{})}}
+}
+
+// add 记录写入的逻辑键
+func (k *hashedKeys) add(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[key] = struct{}{}
+}
+
+// remove 移除删除的逻辑键
+func (k *hashedKeys) remove(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.keys, key)
+}
+
+// load 尚未建立时读取所有清单条目, 返回逻辑键的快照
+func (k *hashedKeys) load(ctx context.Context, storage certmagic.Storage) ([]string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if !k.loaded {
+		keys, err := storage.List(ctx, "/", true)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		for _, key := range keys {
+			if !strings.HasSuffix(key, hashedKeyManifestSuffix) {
+				continue
+			}
+			data, err := storage.Load(ctx, key)
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					continue
+				}
+				return nil, err
+			}
+			k.keys[string(data)] = struct{}{}
+		}
+		k.loaded = true
+	}
+	keys := make([]string, 0, len(k.keys))
+	for key := range k.keys {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// physicalKey 逻辑键对应的存储键, 每层目录取哈希的两个十六进制字符
+func (s hashedStorage) physicalKey(key string) string {
+	sum := sha256.Sum256([]byte(path.Join("/", key)))
+	hash := hex.EncodeToString(sum[:])
+	parts := make([]string, 0, s.depth+1)
+	for i := range s.depth {
+		parts = append(parts, hash[2*i:2*i+2])
+	}
+	return "/" + path.Join(append(parts, hash)...)
+}
+
+// Store 先写清单条目再写数据, 中途失败时不会留下无法还原逻辑键的数据
+func (s hashedStorage) Store(ctx context.Context, key string, value []byte) error {
+	physical := s.physicalKey(key)
+	if err := s.Storage.Store(ctx, physical+hashedKeyManifestSuffix, []byte(path.Join("/", key))); err != nil {
+		return err
+	}
+	if err := s.Storage.Store(ctx, physical, value); err != nil {
+		return err
+	}
+	s.keys.add(path.Join("/", key))
+	return nil
+}
+
+// StoreWriter 底层存储支持流式写入时先写清单条目, 再流式写入数据
+func (s hashedStorage) StoreWriter(ctx context.Context, key string) (io.WriteCloser, error) {
+	streaming, ok := s.Storage.(StreamingStorage)
+	if !ok {
+		return nil, errStreamingUnsupported
+	}
+	physical := s.physicalKey(key)
+	if err := s.Storage.Store(ctx, physical+hashedKeyManifestSuffix, []byte(path.Join("/", key))); err != nil {
+		return nil, err
+	}
+	w, err := streaming.StoreWriter(ctx, physical)
+	if err != nil {
+		return nil, err
+	}
+	return hashedWriter{WriteCloser: w, keys: s.keys, key: path.Join("/", key)}, nil
+}
+
+// hashedWriter 写入成功关闭后记录逻辑键
+type hashedWriter struct {
+	io.WriteCloser
+	keys *hashedKeys
+	key  string
+}
+
+func (w hashedWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	w.keys.add(w.key)
+	return nil
+}
+
+func (s hashedStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	return s.Storage.Load(ctx, s.physicalKey(key))
+}
+
+func (s hashedStorage) Exists(ctx context.Context, key string) bool {
+	return s.Storage.Exists(ctx, s.physicalKey(key))
+}
+
+// Delete 删除数据和清单条目, 清单条目删除失败不影响结果
+func (s hashedStorage) Delete(ctx context.Context, key string) error {
+	physical := s.physicalKey(key)
+	err := s.Storage.Delete(ctx, physical)
+	_ = s.Storage.Delete(ctx, physical+hashedKeyManifestSuffix)
+	s.keys.remove(path.Join("/", key))
+	return err
+}
+
+// Stat 返回的 Key 为逻辑键
+func (s hashedStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	info, err := s.Storage.Stat(ctx, s.physicalKey(key))
+	info.Key = path.Join("/", key)
+	return info, err
+}
+
+// List 按内存中的逻辑键列举, 结果与文件系统存储一致: prefix 按路径边界匹配, 不递归时只返回直接的子目录和文件
+func (s hashedStorage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	keys, err := s.keys.load(ctx, s.Storage)
+	if err != nil {
+		return nil, err
+	}
+	prefix = path.Join("/", prefix)
+	var logical []string
+	for _, key := range keys {
+		rel, ok := strings.CutPrefix(key, strings.TrimSuffix(prefix, "/")+"/")
+		if !ok {
+			continue
+		}
+		if !recursive {
+			rel, _, _ = strings.Cut(rel, "/")
+		}
+		logical = append(logical, path.Join(prefix, rel))
+	}
+	slices.Sort(logical)
+	return slices.Compact(logical), nil
+}
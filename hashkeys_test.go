@@ -0,0 +1,73 @@
+package caddy_thumbs
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"slices"
+	"testing"
+)
+
+// TestHashStorageKeys 缩略图按哈希分散存储, 可以再次命中; 列举按逻辑键进行, 支持非递归和路径边界,
+// 重新创建的存储从清单条目还原逻辑键
+func TestHashStorageKeys(t *testing.T) {
+	ts, src, thumbs := newTestServer(t, func(ts *ThumbsServer) {
+		ts.HashStorageKeys = 2
+		ts.DebugHeaders = true
+	})
+	src.put("/a.png", encodePNG(t, gradientImage(40, 40)))
+	src.put("/dir/b.png", encodePNG(t, gradientImage(40, 40)))
+	for _, target := range []string{"/c20x20/a.png", "/c20x20/dir/b.png", "/c20x200/a.png"} {
+		mustStatus(t, get(t, ts, target), http.StatusOK)
+	}
+
+	sharded := regexp.MustCompile(`^/[0-9a-f]{2}/[0-9a-f]{2}/[0-9a-f]{64}(\.key)?$`)
+	for _, key := range thumbs.keys() {
+		if !sharded.MatchString(key) {
+			t.Errorf("key %s not in the sharded layout", key)
+		}
+	}
+	if n := len(thumbs.keys()); n != 6 {
+		t.Errorf("stored %d entries, want 3 thumbnails and 3 manifests: %v", n, thumbs.keys())
+	}
+
+	w := get(t, ts, "/c20x20/dir/b.png")
+	mustStatus(t, w, http.StatusOK)
+	if cache := w.Header().Get(debugCacheHeader); cache != "HIT" {
+		t.Errorf("%s = %s, want HIT", debugCacheHeader, cache)
+	}
+	if w, h := imageSize(t, w.Body.Bytes()); w != 20 || h != 20 {
+		t.Errorf("size = %dx%d, want 20x20", w, h)
+	}
+
+	tests := []struct {
+		prefix    string
+		recursive bool
+		want      []string
+	}{
+		{"/", false, []string{"/c20x20", "/c20x200"}},
+		{"/c20x20", false, []string{"/c20x20/a.png", "/c20x20/dir"}},
+		{"/c20x20", true, []string{"/c20x20/a.png", "/c20x20/dir/b.png"}},
+		{"/c20x2", true, nil},
+	}
+	for _, storage := range []hashedStorage{ts.thumbsStorage.(hashedStorage), newHashedStorage(thumbs, 2)} {
+		for _, tt := range tests {
+			keys, err := storage.List(context.Background(), tt.prefix, tt.recursive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(keys, tt.want) {
+				t.Errorf("List(%s, %v) = %v, want %v", tt.prefix, tt.recursive, keys, tt.want)
+			}
+		}
+	}
+
+	// 列举建立索引后不再读取清单条目
+	loads := thumbs.count("Load")
+	if _, err := ts.thumbsStorage.List(context.Background(), "/", true); err != nil {
+		t.Fatal(err)
+	}
+	if thumbs.count("Load") != loads {
+		t.Error("List read manifest entries again")
+	}
+}
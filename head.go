@@ -0,0 +1,132 @@
+package caddy_thumbs
+
+import (
+	"bytes"
+	"image"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+const (
+	imageWidthHeader  = "X-Image-Width"  // 缩略图宽度
+	imageHeightHeader = "X-Image-Height" // 缩略图高度
+)
+
+// serveHead 处理 HEAD 请求. 已缓存时读取缩略图的尺寸和大小; 未缓存时只解析原图头部推算输出尺寸,
+// 无法推算(瓦片、矢量图等)时才生成缩略图
+func (t ThumbsServer) serveHead(w http.ResponseWriter, r *http.Request, req *thumbRequest, denied bool) error {
+	if cachedPath, ok := t.lookupCache(req); ok {
+		if err := t.requireSource(req); err != nil {
+			return err
+		}
+		data, err := t.loadThumb(cachedPath)
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+		setDimensionHeaders(w, data)
+		t.setCacheHeaders(w, req)
+		http.ServeContent(w, r, filepath.Base(cachedPath), time.Now(), bytes.NewReader(data))
+		return nil
+	}
+
+	source, err := t.loadSource(req.imagePath, req.sourceToken)
+	if err != nil {
+		return err
+	}
+	width, height, ok, err := t.predictDimensions(req, source)
+	if err != nil {
+		return err
+	}
+	if ok {
+		w.Header().Set(imageWidthHeader, strconv.Itoa(width))
+		w.Header().Set(imageHeightHeader, strconv.Itoa(height))
+		w.Header().Set("Content-Type", mime.TypeByExtension(req.format))
+		t.setCacheHeaders(w, req)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	if denied {
+		return t.denyGeneration(r, req)
+	}
+	result, err := t.renderThumb(req)
+	if err != nil {
+		return err
+	}
+	setDimensionHeaders(w, result.data)
+	t.setCacheHeaders(w, req)
+	http.ServeContent(w, r, filepath.Base(result.storePath), time.Now(), bytes.NewReader(result.data))
+	return nil
+}
+
+// setDimensionHeaders 读取编码后图片的尺寸写入响应头, 无法解析(如 SVG)时不写入
+func setDimensionHeaders(w http.ResponseWriter, data []byte) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	w.Header().Set(imageWidthHeader, strconv.Itoa(cfg.Width))
+	w.Header().Set(imageHeightHeader, strconv.Itoa(cfg.Height))
+}
+
+// predictDimensions 根据原图头部信息推算输出尺寸, 与 generateThumbnail 的计算保持一致
+func (t ThumbsServer) predictDimensions(req *thumbRequest, source []byte) (int, int, bool, error) {
+	if req.tile != nil || req.format == "" || req.format == ".svg" {
+		return 0, 0, false, nil
+	}
+	modeId, ok := cropModeMap[req.mode]
+	if !ok {
+		return 0, 0, false, nil
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(source))
+	if err != nil {
+		return 0, 0, false, nil
+	}
+	// 按 EXIF 方向旋转 90° 的 JPEG 宽高互换
+	srcW, srcH := cfg.Width, cfg.Height
+	if sniffFormat(source[:min(len(source), sniffHeaderSize)], t.ContainerFormatOrder) == ".jpg" && jpegOrientation(source) >= 5 {
+		srcW, srcH = srcH, srcW
+	}
+
+	var (
+		bounds        = image.Rect(0, 0, srcW, srcH)
+		width, height = uint(req.width), uint(req.height)
+	)
+	if req.widthPercent || req.heightPercent {
+		if width, height, err = t.resolvePercentDimensions(bounds, req); err != nil {
+			return 0, 0, false, err
+		}
+	}
+	if modeId == SCALE_MODE_LONG || modeId == SCALE_MODE_SHORT {
+		if width, height, err = t.resolveEdgeDimensions(bounds, req, modeId); err != nil {
+			return 0, 0, false, err
+		}
+	}
+	if width, height, err = t.applyUpscalePolicy(bounds, modeId, width, height); err != nil {
+		return 0, 0, false, err
+	}
+	if modeId == SCALE_MODE_M && !t.MPad {
+		width, height = thumbnailSize(uint(srcW), uint(srcH), width, height)
+	}
+	return int(width), int(height), true, nil
+}
+
+// thumbnailSize 与 resize.Thumbnail 相同的尺寸计算: 原图在目标尺寸以内时不缩放, 否则保持纵横比缩小
+func thumbnailSize(origW, origH, maxW, maxH uint) (uint, uint) {
+	newW, newH := origW, origH
+	if origW <= maxW && origH <= maxH {
+		return newW, newH
+	}
+	if origW > maxW {
+		newW, newH = maxW, max(1, origH*maxW/origW)
+	}
+	if newH > maxH {
+		newW, newH = max(1, newW*maxH/newH), maxH
+	}
+	return newW, newH
+}
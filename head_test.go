@@ -0,0 +1,58 @@
+package caddy_thumbs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestHead HEAD 请求返回尺寸响应头且没有响应体, 未缓存时不生成缩略图
+func TestHead(t *testing.T) {
+	ts, src, thumbs := newTestServer(t, nil)
+	src.put("/a.png", encodePNG(t, gradientImage(200, 100)))
+
+	head := func() *httptest.ResponseRecorder {
+		w := serve(t, ts, httptest.NewRequest(http.MethodHead, "/m50x50/a.png", nil))
+		mustStatus(t, w, http.StatusOK)
+		if w.Header().Get(imageWidthHeader) != "50" || w.Header().Get(imageHeightHeader) != "25" {
+			t.Errorf("dimensions = %sx%s, want 50x25", w.Header().Get(imageWidthHeader), w.Header().Get(imageHeightHeader))
+		}
+		if w.Body.Len() != 0 {
+			t.Errorf("HEAD response has a %d byte body", w.Body.Len())
+		}
+		return w
+	}
+
+	head()
+	if thumbs.count("Store") != 0 {
+		t.Error("HEAD generated the thumbnail")
+	}
+	mustStatus(t, get(t, ts, "/m50x50/a.png"), http.StatusOK)
+	if w := head(); w.Header().Get("Content-Length") == "" {
+		t.Error("cached HEAD response has no Content-Length")
+	}
+}
+
+// TestMethods OPTIONS 返回 204 和允许的方法, 不读取原图; POST、PUT 等返回 405
+func TestMethods(t *testing.T) {
+	ts, src, _ := newTestServer(t, nil)
+	src.put("/a.png", encodePNG(t, gradientImage(40, 40)))
+
+	w := serve(t, ts, httptest.NewRequest(http.MethodOptions, "/c20x20/a.png", nil))
+	mustStatus(t, w, http.StatusNoContent)
+	if allow := w.Header().Get("Allow"); allow != "GET, HEAD, OPTIONS" {
+		t.Errorf("Allow = %q, want GET, HEAD, OPTIONS", allow)
+	}
+	if n := src.count("Load"); n != 0 {
+		t.Errorf("OPTIONS loaded the source %d times", n)
+	}
+
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+		w := serve(t, ts, httptest.NewRequest(method, "/c20x20/a.png", nil))
+		mustStatus(t, w, http.StatusMethodNotAllowed)
+		if allow := w.Header().Get("Allow"); allow != "GET, HEAD, OPTIONS" {
+			t.Errorf("%s: Allow = %q, want GET, HEAD, OPTIONS", method, allow)
+		}
+	}
+	mustStatus(t, get(t, ts, "/c20x20/a.png"), http.StatusOK)
+}
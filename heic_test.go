@@ -0,0 +1,58 @@
+package caddy_thumbs
+
+import (
+	"net/http"
+	"os"
+	"testing"
+)
+
+// TestHEICSource HEIC 原图按 ftyp 品牌识别并解码, 输出为 JPEG 缩略图. 测试图片来自 github.com/gen2brain/heic (MIT)
+func TestHEICSource(t *testing.T) {
+	data, err := os.ReadFile("testdata/tiny.heic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, src, _ := newTestServer(t, nil)
+	src.put("/a.heic", data)
+
+	w := get(t, ts, "/m120x160/a.heic")
+	mustStatus(t, w, http.StatusOK)
+	img, format := decodeBody(t, w.Body.Bytes())
+	if format != "jpeg" || img.Bounds().Dx() != 120 || img.Bounds().Dy() != 160 {
+		t.Errorf("got %s %dx%d, want jpeg 120x160", format, img.Bounds().Dx(), img.Bounds().Dy())
+	}
+	// 测试图片中部为紫色
+	if r, g, b, _ := img.At(60, 80).RGBA(); r>>8 < 0x60 || g>>8 > 0x20 || b>>8 < 0x60 {
+		t.Errorf("center color = %v, want purple", img.At(60, 80))
+	}
+}
+
+// TestSniffISOBMFF 按 ftyp 的主品牌和兼容品牌区分 HEIC 与 AVIF, AVIF 不支持解码
+func TestSniffISOBMFF(t *testing.T) {
+	ftyp := func(major string, compatible ...string) []byte {
+		box := []byte{0, 0, 0, byte(16 + 4*len(compatible))}
+		box = append(box, "ftyp"+major+"\x00\x00\x00\x00"...)
+		for _, brand := range compatible {
+			box = append(box, brand...)
+		}
+		return box
+	}
+	for _, tt := range []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{"heic", ftyp("heic", "mif1", "heic"), ".heic"},
+		{"hevc sequence", ftyp("hevc", "msf1", "hevc"), ".heic"},
+		{"generic heic", ftyp("mif1", "mif1", "heic"), ".heic"},
+		{"generic only", ftyp("mif1", "mif1", "miaf"), ".heic"},
+		{"avif", ftyp("avif", "mif1", "avif"), ""},
+		{"generic avif", ftyp("mif1", "mif1", "avif", "miaf"), ""},
+		{"jxl", ftyp("jxl "), ".jxl"},
+		{"mp4", ftyp("isom", "isom", "mp41"), ""},
+	} {
+		if got := sniffISOBMFF(tt.header, defaultContainerFormatOrder); got != tt.want {
+			t.Errorf("%s: format = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package caddy_thumbs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/fs"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(testStorage{})
+}
+
+// testStorages 按名称登记测试用的存储, 由 caddy.storage.thumbs_test 模块返回
+var testStorages sync.Map
+
+// testStorage 测试用的存储模块, 返回 testStorages 中同名的存储
+type testStorage struct {
+	Name string `json:"name"`
+}
+
+func (testStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.storage.thumbs_test",
+		New: func() caddy.Module { return new(testStorage) },
+	}
+}
+
+func (s testStorage) CertMagicStorage() (certmagic.Storage, error) {
+	storage, ok := testStorages.Load(s.Name)
+	if !ok {
+		return nil, fmt.Errorf("test storage %s not registered", s.Name)
+	}
+	return storage.(certmagic.Storage), nil
+}
+
+// registerStorage 登记存储并返回引用它的模块配置, 测试结束时注销
+func registerStorage(t *testing.T, name string, storage certmagic.Storage) json.RawMessage {
+	t.Helper()
+	key := t.Name() + "/" + name
+	testStorages.Store(key, storage)
+	t.Cleanup(func() { testStorages.Delete(key) })
+	return json.RawMessage(fmt.Sprintf(`{"module":"thumbs_test","name":%q}`, key))
+}
+
+// memStorage 内存中的存储, 记录每种操作的调用次数. 键按 path.Join("/", key) 统一
+type memStorage struct {
+	mu       sync.Mutex
+	data     map[string][]byte
+	modified map[string]time.Time
+	calls    map[string]int
+	storeErr error // 不为空时 Store 返回该错误
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{
+		data:     make(map[string][]byte),
+		modified: make(map[string]time.Time),
+		calls:    make(map[string]int),
+	}
+}
+
+// put 直接写入数据, 不计入调用次数
+func (s *memStorage) put(key string, value []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key = path.Join("/", key)
+	s.data[key] = value
+	s.modified[key] = time.Now()
+}
+
+// get 直接读取数据, 不计入调用次数
+func (s *memStorage) get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.data[path.Join("/", key)]
+	return value, ok
+}
+
+// keys 返回所有键, 按字典序排列
+func (s *memStorage) keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(s.data))
+	for key := range s.data {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// count 返回操作的调用次数
+func (s *memStorage) count(op string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[op]
+}
+
+func (s *memStorage) record(op string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls[op]++
+}
+
+func (s *memStorage) Store(_ context.Context, key string, value []byte) error {
+	s.record("Store")
+	if s.storeErr != nil {
+		return s.storeErr
+	}
+	s.put(key, bytes.Clone(value))
+	return nil
+}
+
+func (s *memStorage) Load(_ context.Context, key string) ([]byte, error) {
+	s.record("Load")
+	value, ok := s.get(key)
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return bytes.Clone(value), nil
+}
+
+func (s *memStorage) Delete(_ context.Context, key string) error {
+	s.record("Delete")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key = path.Join("/", key)
+	if _, ok := s.data[key]; !ok {
+		return fs.ErrNotExist
+	}
+	delete(s.data, key)
+	delete(s.modified, key)
+	return nil
+}
+
+func (s *memStorage) Exists(_ context.Context, key string) bool {
+	s.record("Exists")
+	_, ok := s.get(key)
+	return ok
+}
+
+// List 与文件系统存储一致: 返回的键带前缀, 不递归时返回直接的子目录和文件
+func (s *memStorage) List(_ context.Context, prefix string, recursive bool) ([]string, error) {
+	s.record("List")
+	prefix = path.Join("/", prefix)
+	var keys []string
+	for _, key := range s.keys() {
+		rel, ok := strings.CutPrefix(key, strings.TrimSuffix(prefix, "/")+"/")
+		if !ok {
+			continue
+		}
+		if !recursive {
+			rel, _, _ = strings.Cut(rel, "/")
+		}
+		if key := path.Join(prefix, rel); !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	return keys, nil
+}
+
+func (s *memStorage) Stat(_ context.Context, key string) (certmagic.KeyInfo, error) {
+	s.record("Stat")
+	key = path.Join("/", key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if value, ok := s.data[key]; ok {
+		return certmagic.KeyInfo{Key: key, Modified: s.modified[key], Size: int64(len(value)), IsTerminal: true}, nil
+	}
+	for k := range s.data {
+		if strings.HasPrefix(k, key+"/") {
+			return certmagic.KeyInfo{Key: key}, nil
+		}
+	}
+	return certmagic.KeyInfo{}, fs.ErrNotExist
+}
+
+func (s *memStorage) Lock(context.Context, string) error   { return nil }
+func (s *memStorage) Unlock(context.Context, string) error { return nil }
+
+// newTestServer 使用内存原图存储和缩略图存储创建并初始化 ThumbsServer, setup 可以在初始化前修改配置
+func newTestServer(t *testing.T, setup func(*ThumbsServer)) (*ThumbsServer, *memStorage, *memStorage) {
+	t.Helper()
+	src, thumbs := newMemStorage(), newMemStorage()
+	ts := &ThumbsServer{
+		ImageStorageRaw:  registerStorage(t, "src", src),
+		ThumbsStorageRaw: registerStorage(t, "thumbs", thumbs),
+	}
+	if setup != nil {
+		setup(ts)
+	}
+	provisionServer(t, ts)
+	return ts, src, thumbs
+}
+
+// provisionServer 初始化并验证配置, 测试结束时取消上下文以停止后台任务
+func provisionServer(t *testing.T, ts *ThumbsServer) {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := ts.Provision(ctx); err != nil {
+		t.Fatalf("Provision: %v", err)
+	}
+	ts.logger = zap.NewNop()
+	if err := ts.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+}
+
+// serve 发送请求, 处理器返回的错误按其状态码写入响应
+func serve(t *testing.T, ts *ThumbsServer, r *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+	if err := ts.ServeHTTP(w, r, next); err != nil {
+		var handlerErr caddyhttp.HandlerError
+		if errors.As(err, &handlerErr) {
+			w.Code = handlerErr.StatusCode
+		} else {
+			w.Code = http.StatusInternalServerError
+		}
+		w.Body.WriteString(err.Error())
+	}
+	return w
+}
+
+// get 发送 GET 请求
+func get(t *testing.T, ts *ThumbsServer, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	return serve(t, ts, httptest.NewRequest(http.MethodGet, target, nil))
+}
+
+// mustStatus 检查响应的状态码
+func mustStatus(t *testing.T, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status = %d, want %d (body: %.200s)", w.Code, status, w.Body.String())
+	}
+}
+
+// solidImage 纯色图片
+func solidImage(w, h int, c color.Color) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+// gradientImage 横向红色、纵向绿色渐变的图片, 可以由像素颜色反推其在原图中的位置
+func gradientImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 255 / max(1, w-1)), uint8(y * 255 / max(1, h-1)), 0x80, 0xFF})
+		}
+	}
+	return img
+}
+
+// noiseImage 随机颜色的不透明图片, 难以压缩, 编码结果较大
+func noiseImage(w, h int) *image.NRGBA {
+	rnd := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		if i%4 == 3 {
+			img.Pix[i] = 0xFF
+		} else {
+			img.Pix[i] = byte(rnd.Intn(256))
+		}
+	}
+	return img
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeJPEG(t *testing.T, img image.Image, quality int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// decodeBody 解码响应中的图片, 返回图片和格式名
+func decodeBody(t *testing.T, data []byte) (image.Image, string) {
+	t.Helper()
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	return img, format
+}
+
+// imageSize 解码图片并返回尺寸
+func imageSize(t *testing.T, data []byte) (int, int) {
+	t.Helper()
+	img, _ := decodeBody(t, data)
+	return img.Bounds().Dx(), img.Bounds().Dy()
+}
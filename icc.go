@@ -0,0 +1,294 @@
+package caddy_thumbs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"io"
+	"math"
+)
+
+// iccJPEGMarker JPEG APP2 段中 ICC 配置文件的标识
+var iccJPEGMarker = []byte("ICC_PROFILE\x00")
+
+// sRGB 在 D50 白点下 RGB 到 XYZ 矩阵的逆矩阵, ICC 配置文件的连接空间为 D50
+var xyzD50ToSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// sRGB 的 D50 原色, 用于判断配置文件是否已经是 sRGB
+var srgbD50Primaries = [3][3]float64{
+	{0.4361, 0.2225, 0.0139},
+	{0.3851, 0.7169, 0.0971},
+	{0.1431, 0.0606, 0.7141},
+}
+
+// extractICCProfile 从 JPEG、PNG 或 WebP 数据中提取内嵌的 ICC 配置文件, 没有时返回 nil
+func extractICCProfile(data []byte, format string) []byte {
+	switch format {
+	case ".jpg":
+		return jpegICCProfile(data)
+	case ".png":
+		return pngICCProfile(data)
+	case ".webp":
+		return webpICCProfile(data)
+	}
+	return nil
+}
+
+// jpegICCProfile 拼接 JPEG 中的所有 APP2 ICC 分段
+func jpegICCProfile(data []byte) []byte {
+	var profile []byte
+	for pos := 2; pos+4 <= len(data) && data[pos] == 0xFF; {
+		marker := data[pos+1]
+		if marker == 0xDA {
+			break
+		}
+		size := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if size < 2 || pos+2+size > len(data) {
+			break
+		}
+		segment := data[pos+4 : pos+2+size]
+		// 标识之后是分段序号和分段总数各一个字节
+		if marker == 0xE2 && bytes.HasPrefix(segment, iccJPEGMarker) && len(segment) > len(iccJPEGMarker)+2 {
+			profile = append(profile, segment[len(iccJPEGMarker)+2:]...)
+		}
+		pos += 2 + size
+	}
+	return profile
+}
+
+// pngICCProfile 读取 PNG 的 iCCP 块: 名称, 0 结尾, 压缩方式, zlib 压缩的配置文件
+func pngICCProfile(data []byte) []byte {
+	for pos := 8; pos+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+		if length < 0 || pos+12+length > len(data) || chunkType == "IDAT" {
+			break
+		}
+		if chunkType == "iCCP" {
+			chunk := data[pos+8 : pos+8+length]
+			nameEnd := bytes.IndexByte(chunk, 0)
+			if nameEnd < 0 || nameEnd+2 > len(chunk) {
+				return nil
+			}
+			r, err := zlib.NewReader(bytes.NewReader(chunk[nameEnd+2:]))
+			if err != nil {
+				return nil
+			}
+			defer r.Close()
+			profile, err := io.ReadAll(r)
+			if err != nil {
+				return nil
+			}
+			return profile
+		}
+		pos += 12 + length
+	}
+	return nil
+}
+
+// webpICCProfile 读取 WebP 扩展格式中的 ICCP 块
+func webpICCProfile(data []byte) []byte {
+	for pos := 12; pos+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if size < 0 || pos+8+size > len(data) {
+			break
+		}
+		if string(data[pos:pos+4]) == "ICCP" {
+			return data[pos+8 : pos+8+size]
+		}
+		pos += 8 + size + size%2
+	}
+	return nil
+}
+
+// iccTransform 将 RGB 矩阵/TRC 类型的配置文件转换到 sRGB
+type iccTransform struct {
+	linear [3][256]float64 // 各通道的线性化查找表
+	matrix [3][3]float64   // 线性 RGB 到线性 sRGB
+}
+
+// parseICCTransform 解析 ICC 配置文件中的原色和色调曲线. 不支持的配置文件(如 LUT 类型、CMYK)或已经是 sRGB 时返回 nil
+func parseICCTransform(profile []byte) *iccTransform {
+	if len(profile) < 132 || string(profile[16:20]) != "RGB " {
+		return nil
+	}
+	tags := make(map[string][]byte)
+	count := int(binary.BigEndian.Uint32(profile[128:]))
+	for i := 0; i < count; i++ {
+		entry := 132 + i*12
+		if entry+12 > len(profile) {
+			return nil
+		}
+		offset := int(binary.BigEndian.Uint32(profile[entry+4:]))
+		size := int(binary.BigEndian.Uint32(profile[entry+8:]))
+		if offset < 0 || size < 0 || offset+size > len(profile) {
+			return nil
+		}
+		tags[string(profile[entry:entry+4])] = profile[offset : offset+size]
+	}
+
+	var (
+		primaries [3][3]float64
+		tr        = new(iccTransform)
+		isSRGB    = true
+	)
+	for ch, name := range []string{"r", "g", "b"} {
+		xyz, ok := parseICCXYZ(tags[name+"XYZ"])
+		if !ok {
+			return nil
+		}
+		primaries[ch] = xyz
+		for k := 0; k < 3; k++ {
+			if math.Abs(xyz[k]-srgbD50Primaries[ch][k]) > 0.002 {
+				isSRGB = false
+			}
+		}
+		curve, ok := parseICCCurve(tags[name+"TRC"])
+		if !ok {
+			return nil
+		}
+		for v := 0; v < 256; v++ {
+			tr.linear[ch][v] = curve(float64(v) / 255)
+		}
+	}
+	if isSRGB {
+		return nil
+	}
+
+	// matrix = xyzD50ToSRGB × (原色按列组成的 RGB 到 XYZ 矩阵)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				tr.matrix[i][j] += xyzD50ToSRGB[i][k] * primaries[j][k]
+			}
+		}
+	}
+	return tr
+}
+
+// parseICCXYZ 解析 XYZType 标签
+func parseICCXYZ(tag []byte) ([3]float64, bool) {
+	var xyz [3]float64
+	if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+		return xyz, false
+	}
+	for i := range xyz {
+		xyz[i] = s15Fixed16(tag[8+i*4:])
+	}
+	return xyz, true
+}
+
+// parseICCCurve 解析 curveType 或 parametricCurveType 标签, 返回输入输出均为 0-1 的曲线
+func parseICCCurve(tag []byte) (func(float64) float64, bool) {
+	if len(tag) < 12 {
+		return nil, false
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		switch {
+		case n == 0:
+			return func(x float64) float64 { return x }, true
+		case n == 1 && len(tag) >= 14:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, true
+		case len(tag) >= 12+n*2:
+			table := make([]float64, n)
+			for i := range table {
+				table[i] = float64(binary.BigEndian.Uint16(tag[12+i*2:])) / 65535
+			}
+			return func(x float64) float64 {
+				pos := x * float64(n-1)
+				i := min(int(pos), n-2)
+				return table[i] + (table[i+1]-table[i])*(pos-float64(i))
+			}, true
+		}
+	case "para":
+		var (
+			funcType   = binary.BigEndian.Uint16(tag[8:])
+			paramCount = []int{1, 3, 4, 5, 7}
+		)
+		if int(funcType) >= len(paramCount) || len(tag) < 12+paramCount[funcType]*4 {
+			return nil, false
+		}
+		var p [7]float64
+		for i := 0; i < paramCount[funcType]; i++ {
+			p[i] = s15Fixed16(tag[12+i*4:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		pow := func(x float64) float64 { return math.Pow(math.Max(0, a*x+b), g) }
+		switch funcType {
+		case 0:
+			return func(x float64) float64 { return math.Pow(x, g) }, true
+		case 1:
+			return func(x float64) float64 {
+				if x >= -b/a {
+					return pow(x)
+				}
+				return 0
+			}, true
+		case 2:
+			return func(x float64) float64 {
+				if x >= -b/a {
+					return pow(x) + c
+				}
+				return c
+			}, true
+		case 3:
+			return func(x float64) float64 {
+				if x >= d {
+					return pow(x)
+				}
+				return c * x
+			}, true
+		case 4:
+			return func(x float64) float64 {
+				if x >= d {
+					return pow(x) + e
+				}
+				return c*x + f
+			}, true
+		}
+	}
+	return nil, false
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// apply 将图片转换到 sRGB, 透明通道保持不变
+func (tr *iccTransform) apply(img image.Image) image.Image {
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	for i := 0; i+3 < len(dst.Pix); i += 4 {
+		var lin [3]float64
+		for ch := 0; ch < 3; ch++ {
+			lin[ch] = tr.linear[ch][dst.Pix[i+ch]]
+		}
+		for ch := 0; ch < 3; ch++ {
+			v := tr.matrix[ch][0]*lin[0] + tr.matrix[ch][1]*lin[1] + tr.matrix[ch][2]*lin[2]
+			dst.Pix[i+ch] = uint8(linearToSRGB(v))
+		}
+	}
+	return dst
+}
+
+// convertToSRGB 按内嵌的 ICC 配置文件将图片转换到 sRGB, 没有配置文件或无法解析时原样返回
+func convertToSRGB(img image.Image, profile []byte) image.Image {
+	if len(profile) == 0 {
+		return img
+	}
+	tr := parseICCTransform(profile)
+	if tr == nil {
+		return img
+	}
+	return tr.apply(img)
+}
@@ -0,0 +1,119 @@
+package caddy_thumbs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image/color"
+	"net/http"
+	"testing"
+)
+
+// displayP3Profile 构造只含原色和 sRGB 色调曲线的 Display P3 配置文件
+func displayP3Profile() []byte {
+	xyz := func(v [3]float64) []byte {
+		tag := append([]byte("XYZ "), 0, 0, 0, 0)
+		for _, f := range v {
+			tag = binary.BigEndian.AppendUint32(tag, uint32(int32(f*65536)))
+		}
+		return tag
+	}
+	// parametricCurveType 3: sRGB 曲线
+	trc := append([]byte("para"), 0, 0, 0, 0, 0, 3, 0, 0)
+	for _, f := range []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045} {
+		trc = binary.BigEndian.AppendUint32(trc, uint32(int32(f*65536)))
+	}
+	tags := []struct {
+		sig  string
+		data []byte
+	}{
+		{"rXYZ", xyz([3]float64{0.5151, 0.2412, -0.0011})},
+		{"gXYZ", xyz([3]float64{0.2920, 0.6922, 0.0419})},
+		{"bXYZ", xyz([3]float64{0.1571, 0.0666, 0.7841})},
+		{"rTRC", trc}, {"gTRC", trc}, {"bTRC", trc},
+	}
+
+	profile := make([]byte, 128)
+	copy(profile[16:], "RGB ")
+	copy(profile[20:], "XYZ ")
+	copy(profile[36:], "acsp")
+	profile = binary.BigEndian.AppendUint32(profile, uint32(len(tags)))
+	offset := len(profile) + len(tags)*12
+	var data []byte
+	for _, tag := range tags {
+		profile = append(profile, tag.sig...)
+		profile = binary.BigEndian.AppendUint32(profile, uint32(offset+len(data)))
+		profile = binary.BigEndian.AppendUint32(profile, uint32(len(tag.data)))
+		data = append(data, tag.data...)
+	}
+	profile = append(profile, data...)
+	binary.BigEndian.PutUint32(profile, uint32(len(profile)))
+	return profile
+}
+
+// withICCProfile 在 PNG 的 IHDR 块之后插入 iCCP 块
+func withICCProfile(t *testing.T, pngData, profile []byte) []byte {
+	t.Helper()
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	if _, err := zw.Write(profile); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	chunk := append([]byte("iCCP"), "P3\x00\x00"...)
+	chunk = append(chunk, compressed.Bytes()...)
+
+	// 8 字节签名 + IHDR 块(4 长度 + 4 类型 + 13 数据 + 4 CRC)
+	const ihdrEnd = 8 + 25
+	out := append([]byte(nil), pngData[:ihdrEnd]...)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(chunk)-4))
+	out = append(out, chunk...)
+	out = binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(chunk))
+	return append(out, pngData[ihdrEnd:]...)
+}
+
+// TestConvertToSRGB 内嵌 Display P3 配置文件的原图转换到 sRGB 后饱和度更高的颜色移向 sRGB 的取值,
+// 没有配置文件或关闭转换时颜色不变
+func TestConvertToSRGB(t *testing.T) {
+	profile := displayP3Profile()
+	if parseICCTransform(profile) == nil {
+		t.Fatal("Display P3 profile was not parsed")
+	}
+	source := solidImage(64, 64, color.NRGBA{200, 100, 100, 255})
+	plain := encodePNG(t, source)
+	tagged := withICCProfile(t, plain, profile)
+	if !bytes.Equal(extractICCProfile(tagged, ".png"), profile) {
+		t.Fatal("iCCP profile was not extracted from the fixture")
+	}
+
+	pixel := func(ts *ThumbsServer, target string) color.NRGBA {
+		t.Helper()
+		w := get(t, ts, target)
+		mustStatus(t, w, http.StatusOK)
+		img, _ := decodeBody(t, w.Body.Bytes())
+		return color.NRGBAModel.Convert(img.At(16, 16)).(color.NRGBA)
+	}
+
+	ts, src, _ := newTestServer(t, nil)
+	src.put("/p3.png", tagged)
+	src.put("/plain.png", plain)
+
+	if got := pixel(ts, "/m32x32/plain.png"); got != (color.NRGBA{200, 100, 100, 255}) {
+		t.Errorf("untagged source = %v, want unchanged", got)
+	}
+	// P3 中的红色在 sRGB 中更饱和: 红色通道升高, 绿色和蓝色通道降低
+	got := pixel(ts, "/m32x32/p3.png")
+	if got.R <= 205 || got.G >= 100 || got.B >= 100 {
+		t.Errorf("P3 source = %v, want shifted from {200 100 100} toward sRGB", got)
+	}
+
+	off := false
+	ts, src, _ = newTestServer(t, func(ts *ThumbsServer) { ts.ConvertToSRGB = &off })
+	src.put("/p3.png", tagged)
+	if got := pixel(ts, "/m32x32/p3.png"); got != (color.NRGBA{200, 100, 100, 255}) {
+		t.Errorf("convert_to_srgb off = %v, want unchanged", got)
+	}
+}
@@ -0,0 +1,263 @@
+package caddy_thumbs
+
+import (
+	"errors"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// janitorInterval 缓存容量检查周期
+const janitorInterval = time.Minute
+
+// companionSuffixes 附属条目在缩略图键后追加的后缀
+var companionSuffixes = []string{lqipSuffix, colorSuffix, thumbMetaSuffix}
+
+// companionOwner 返回附属条目所属缩略图的键, 不是附属条目时返回键本身
+func companionOwner(key string) string {
+	for _, suffix := range companionSuffixes {
+		if owner, ok := strings.CutSuffix(key, suffix); ok {
+			return owner
+		}
+	}
+	return key
+}
+
+// indexEntry 缩略图存储中单个条目的信息
+type indexEntry struct {
+	size       int64
+	lastAccess time.Time
+}
+
+// thumbIndex 记录缩略图存储中每个条目的大小和最近访问时间, 用于缓存容量控制
+type thumbIndex struct {
+	mu      sync.Mutex
+	entries map[string]*indexEntry
+	total   int64
+}
+
+func newThumbIndex() *thumbIndex {
+	return &thumbIndex{entries: make(map[string]*indexEntry)}
+}
+
+// record 记录(或更新)一个已写入存储的条目
+func (idx *thumbIndex) record(key string, size int64, accessed time.Time) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if e, ok := idx.entries[key]; ok {
+		idx.total -= e.size
+	}
+	idx.entries[key] = &indexEntry{size: size, lastAccess: accessed}
+	idx.total += size
+}
+
+// touch 更新条目的最近访问时间
+func (idx *thumbIndex) touch(key string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if e, ok := idx.entries[key]; ok {
+		e.lastAccess = time.Now()
+	}
+}
+
+// remove 从索引中删除条目
+func (idx *thumbIndex) remove(key string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if e, ok := idx.entries[key]; ok {
+		idx.total -= e.size
+		delete(idx.entries, key)
+	}
+}
+
+// each 依次访问索引中的所有条目, 访问期间持有锁
+func (idx *thumbIndex) each(fn func(key string, size int64)) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for key, e := range idx.entries {
+		fn(key, e.size)
+	}
+}
+
+// totalBytes 返回索引中所有条目的总大小
+func (idx *thumbIndex) totalBytes() int64 {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.total
+}
+
+// evictionCandidates 按最近访问时间从旧到新返回需要淘汰的条目, 使总大小不超过 limit.
+// 缩略图与其附属条目作为一组淘汰, 一组的大小为各条目之和, 最近访问时间取组内最晚的一个
+func (idx *thumbIndex) evictionCandidates(limit int64) []string {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.total <= limit {
+		return nil
+	}
+	type entryGroup struct {
+		keys       []string
+		size       int64
+		lastAccess time.Time
+	}
+	groups := make(map[string]*entryGroup)
+	for key, e := range idx.entries {
+		owner := companionOwner(key)
+		g, ok := groups[owner]
+		if !ok {
+			g = &entryGroup{}
+			groups[owner] = g
+		}
+		g.keys = append(g.keys, key)
+		g.size += e.size
+		if e.lastAccess.After(g.lastAccess) {
+			g.lastAccess = e.lastAccess
+		}
+	}
+	sorted := make([]*entryGroup, 0, len(groups))
+	for _, g := range groups {
+		sorted = append(sorted, g)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].lastAccess.Before(sorted[j].lastAccess)
+	})
+	var (
+		over       = idx.total - limit
+		candidates []string
+	)
+	for _, g := range sorted {
+		if over <= 0 {
+			break
+		}
+		// 缩略图排在附属条目之后删除, 中途失败时不会留下缺少附属条目的缩略图
+		sort.Slice(g.keys, func(i, j int) bool { return len(g.keys[i]) > len(g.keys[j]) })
+		candidates = append(candidates, g.keys...)
+		over -= g.size
+	}
+	return candidates
+}
+
+// storeThumb 写入缩略图存储并更新索引, 无缓存模式下不写入
+func (t ThumbsServer) storeThumb(key string, data []byte) error {
+	if t.NoCache {
+		return nil
+	}
+	if err := t.thumbsStorage.Store(t.ctx, key, data); err != nil {
+		return err
+	}
+	if t.index != nil {
+		t.index.record(key, int64(len(data)), time.Now())
+	}
+	return nil
+}
+
+// thumbEntry 与缩略图一同保存的附属条目, 如校验信息、低质量占位图
+type thumbEntry struct {
+	key  string
+	data []byte
+}
+
+// storeThumbSet 将缩略图及其附属条目作为一组写入. 查找缓存只以缩略图是否存在为准, 因此先写附属条目,
+// 最后写缩略图作为提交点: 中途崩溃只会留下没有缩略图的附属条目, 下次请求重新生成时覆盖, 不会命中残缺的一组.
+// 附属条目写入失败只记录日志; 缩略图写入失败时删除本次写入的附属条目
+func (t ThumbsServer) storeThumbSet(key string, data []byte, companions ...thumbEntry) error {
+	if t.NoCache {
+		return nil
+	}
+	stored := make([]string, 0, len(companions))
+	for _, c := range companions {
+		if err := t.storeThumb(c.key, c.data); err != nil {
+			t.logger.Warn("Failed to store thumbnail companion", zap.String("path", c.key), zap.Error(err))
+			continue
+		}
+		stored = append(stored, c.key)
+	}
+	if err := t.storeThumb(key, data); err != nil {
+		for _, companion := range stored {
+			if err := t.thumbsStorage.Delete(t.ctx, companion); err == nil && t.index != nil {
+				t.index.remove(companion)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// deleteThumbSet 删除缩略图及其附属条目并更新索引, 缩略图删除失败时返回错误, 附属条目不存在时忽略
+func (t ThumbsServer) deleteThumbSet(key string) error {
+	for _, suffix := range companionSuffixes {
+		if err := t.thumbsStorage.Delete(t.ctx, key+suffix); err == nil && t.index != nil {
+			t.index.remove(key + suffix)
+		}
+	}
+	if err := t.thumbsStorage.Delete(t.ctx, key); err != nil {
+		return err
+	}
+	if t.index != nil {
+		t.index.remove(key)
+	}
+	t.forgetVariant(key)
+	return nil
+}
+
+// loadThumb 从缩略图存储读取条目并更新最近访问时间
+func (t ThumbsServer) loadThumb(key string) ([]byte, error) {
+	data, err := t.thumbsStorage.Load(t.ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if t.index != nil {
+		t.index.touch(key)
+	}
+	return data, nil
+}
+
+// seedIndex 遍历缩略图存储, 用已有条目初始化索引, 以修改时间作为最近访问时间
+func (t ThumbsServer) seedIndex() {
+	keys, err := t.thumbsStorage.List(t.ctx, "/", true)
+	if err != nil {
+		t.logger.Warn("Failed to list thumbs storage", zap.Error(err))
+		return
+	}
+	entries := 0
+	for _, key := range keys {
+		info, err := t.thumbsStorage.Stat(t.ctx, key)
+		if err != nil || !info.IsTerminal {
+			continue
+		}
+		t.index.record(key, info.Size, info.Modified)
+		entries++
+	}
+	t.logger.Info("Thumbs index loaded", zap.Int("entries", entries), zap.Int64("bytes", t.index.totalBytes()))
+}
+
+// runJanitor 周期性检查缓存总大小, 超过 max_cache_bytes 时淘汰最久未访问的条目
+func (t ThumbsServer) runJanitor() {
+	t.seedIndex()
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+			t.evictOverQuota()
+		}
+	}
+}
+
+// evictOverQuota 淘汰超出容量的缓存条目
+func (t ThumbsServer) evictOverQuota() {
+	for _, key := range t.index.evictionCandidates(t.MaxCacheBytes) {
+		if err := t.thumbsStorage.Delete(t.ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			t.logger.Warn("Failed to evict thumbnail", zap.String("path", key), zap.Error(err))
+			continue
+		}
+		t.index.remove(key)
+		t.forgetVariant(key)
+		t.logger.Debug("Evicted thumbnail", zap.String("path", key))
+	}
+}
@@ -0,0 +1,101 @@
+package caddy_thumbs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestEvictOverQuota 超出容量时按组淘汰最久未访问的缩略图, 附属条目随缩略图一起删除
+func TestEvictOverQuota(t *testing.T) {
+	// 不启动后台清理, 避免加载索引时覆盖访问时间
+	ts, _, thumbs := newTestServer(t, nil)
+	ts.index, ts.ETagSidecar = newThumbIndex(), true
+	for _, key := range []string{"/c10x10/a.jpg", "/c10x10/b.jpg", "/c10x10/c.jpg"} {
+		companions := append(ts.thumbMetaEntries(key, `"x"`), thumbEntry{key: key + lqipSuffix, data: make([]byte, 10)})
+		if err := ts.storeThumbSet(key, bytes.Repeat([]byte{1}, 100), companions...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 只访问 a 的缩略图, 附属条目的访问时间不变
+	if _, err := ts.loadThumb("/c10x10/a.jpg"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 超出一个字节, 只需要淘汰一组
+	ts.MaxCacheBytes = ts.index.totalBytes() - 1
+	ts.evictOverQuota()
+	for _, key := range []string{"/c10x10/b.jpg", "/c10x10/b.jpg" + lqipSuffix, "/c10x10/b.jpg" + thumbMetaSuffix} {
+		if _, ok := thumbs.get(key); ok {
+			t.Errorf("%s not evicted", key)
+		}
+	}
+	for _, key := range []string{"/c10x10/a.jpg", "/c10x10/a.jpg" + lqipSuffix, "/c10x10/a.jpg" + thumbMetaSuffix, "/c10x10/c.jpg"} {
+		if _, ok := thumbs.get(key); !ok {
+			t.Errorf("%s evicted", key)
+		}
+	}
+	if total := ts.index.totalBytes(); total > ts.MaxCacheBytes {
+		t.Errorf("index total = %d, want <= %d", total, ts.MaxCacheBytes)
+	}
+}
+
+// commitFailStorage 缩略图本身(组的提交点)写入失败的存储, 附属条目正常写入
+type commitFailStorage struct {
+	*memStorage
+	fail bool
+}
+
+func (s *commitFailStorage) Store(ctx context.Context, key string, value []byte) error {
+	if s.fail && !slices.ContainsFunc(companionSuffixes, func(suffix string) bool { return strings.HasSuffix(key, suffix) }) {
+		s.record("Store")
+		return errors.New("simulated crash before commit")
+	}
+	return s.memStorage.Store(ctx, key, value)
+}
+
+// TestStoreThumbSetAtomic 缩略图与校验信息、占位图作为一组写入: 缩略图写入失败时撤销已写入的附属条目;
+// 中途崩溃只留下附属条目时不会命中残缺的一组, 下次请求重新生成并补全
+func TestStoreThumbSetAtomic(t *testing.T) {
+	src := newMemStorage()
+	thumbs := &commitFailStorage{memStorage: newMemStorage(), fail: true}
+	ts := &ThumbsServer{
+		ImageStorageRaw:  registerStorage(t, "src", src),
+		ThumbsStorageRaw: registerStorage(t, "thumbs", thumbs),
+		ETagSidecar:      true,
+		LQIP:             true,
+	}
+	provisionServer(t, ts)
+	src.put("/a.jpg", encodeJPEG(t, gradientImage(80, 80), 90))
+
+	mustStatus(t, get(t, ts, "/c40x40/a.jpg"), http.StatusOK)
+	if keys := thumbs.keys(); len(keys) != 0 {
+		t.Fatalf("failed commit left partial entries: %v", keys)
+	}
+
+	// 崩溃发生在附属条目写入之后、缩略图写入之前
+	thumbs.put("/c40x40/a.jpg"+thumbMetaSuffix, []byte(`{"etag":"\"stale\""}`))
+	thumbs.put("/c40x40/a.jpg"+lqipSuffix, []byte("stale"))
+	thumbs.fail = false
+	loads := src.count("Load")
+	r := httptest.NewRequest(http.MethodGet, "/c40x40/a.jpg", nil)
+	r.Header.Set("If-None-Match", `"stale"`)
+	w := serve(t, ts, r)
+	mustStatus(t, w, http.StatusOK)
+	if src.count("Load") == loads {
+		t.Error("partial set was served instead of regenerating")
+	}
+	if etag := w.Header().Get("ETag"); etag == `"stale"` {
+		t.Error("response used the stale sidecar ETag")
+	}
+	for _, key := range []string{"/c40x40/a.jpg", "/c40x40/a.jpg" + thumbMetaSuffix, "/c40x40/a.jpg" + lqipSuffix} {
+		if data, ok := thumbs.get(key); !ok || bytes.Contains(data, []byte("stale")) {
+			t.Errorf("%s not rewritten after regeneration", key)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package caddy_thumbs
+
+import (
+	"encoding/binary"
+	"slices"
+)
+
+// sniffHeaderSize 识别格式时读取的文件头长度, 需要容纳 ISOBMFF 的 ftyp 盒及其兼容品牌列表,
+// 以及 SVG 根元素之前的 XML 声明、注释和 DOCTYPE
+const sniffHeaderSize = 512
+
+// isobmffBrands ISOBMFF 品牌对应的格式. AVIF 只用于区分, 不支持解码
+var isobmffBrands = map[string]string{
+	"heic": ".heic", "heix": ".heic", "heim": ".heic", "heis": ".heic", "hevc": ".heic", "hevx": ".heic",
+	"avif": ".avif", "avis": ".avif",
+	"jxl ": ".jxl",
+}
+
+// genericHEIFBrands HEIF 的通用图片品牌, AVIF 和 HEIC 都会使用, 需要结合兼容品牌判断
+var genericHEIFBrands = []string{"mif1", "msf1", "miaf"}
+
+// containerFormats container_format_order 可以使用的格式
+var containerFormats = []string{".heic", ".avif", ".jxl"}
+
+// defaultContainerFormatOrder 兼容品牌同时包含多种格式时的默认优先顺序
+var defaultContainerFormatOrder = []string{".heic", ".avif", ".jxl"}
+
+// sniffISOBMFF 解析 ftyp 盒判断容器格式: 主品牌能确定格式时直接使用, 否则(如主品牌为 mif1)按 order 的顺序
+// 在兼容品牌中选择. 只有通用品牌时视为 HEIC. 不是 ftyp 盒或无法识别时返回空字符串, AVIF 同样返回空字符串
+func sniffISOBMFF(header []byte, order []string) string {
+	if len(header) < 12 || string(header[4:8]) != "ftyp" {
+		return ""
+	}
+	// 盒长度之外的数据属于下一个盒; 文件头被截断时只解析已读取的部分
+	end := int(binary.BigEndian.Uint32(header))
+	if end < 16 || end > len(header) {
+		end = len(header)
+	}
+	if format, ok := isobmffBrands[string(header[8:12])]; ok {
+		return supportedContainerFormat(format)
+	}
+	generic := slices.Contains(genericHEIFBrands, string(header[8:12]))
+	var found []string
+	for i := 16; i+4 <= end; i += 4 {
+		brand := string(header[i : i+4])
+		if format, ok := isobmffBrands[brand]; ok {
+			found = append(found, format)
+		} else if slices.Contains(genericHEIFBrands, brand) {
+			generic = true
+		}
+	}
+	for _, format := range order {
+		if slices.Contains(found, format) {
+			return supportedContainerFormat(format)
+		}
+	}
+	if generic {
+		return ".heic"
+	}
+	return ""
+}
+
+// supportedContainerFormat 过滤不支持解码的容器格式
+func supportedContainerFormat(format string) string {
+	if format == ".avif" {
+		return ""
+	}
+	return format
+}
@@ -0,0 +1,69 @@
+package caddy_thumbs
+
+import (
+	"context"
+	"encoding/binary"
+	"slices"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// ftypBox 构造带主品牌和兼容品牌的 ftyp 盒, 之后附加一个 meta 盒的开头, 检查解析不会越过 ftyp 盒
+func ftypBox(major string, compatible ...string) []byte {
+	box := binary.BigEndian.AppendUint32(nil, uint32(16+4*len(compatible)))
+	box = append(box, "ftyp"...)
+	box = append(box, major...)
+	box = append(box, 0, 0, 0, 0)
+	for _, brand := range compatible {
+		box = append(box, brand...)
+	}
+	return append(box, 0, 0, 0, 0x20, 'm', 'e', 't', 'a', 'h', 'e', 'i', 'c')
+}
+
+// TestContainerFormatOrder ftyp 盒相同而品牌不同的文件按主品牌、兼容品牌和 container_format_order 识别, 只解析 ftyp 盒之内的品牌
+func TestContainerFormatOrder(t *testing.T) {
+	heicFirst := []string{".heic", ".avif", ".jxl"}
+	avifFirst := []string{".avif", ".heic", ".jxl"}
+	jxlFirst := []string{".jxl", ".heic", ".avif"}
+	for _, tc := range []struct {
+		name   string
+		header []byte
+		order  []string
+		want   string
+	}{
+		{"heix major", ftypBox("heix", "mif1"), avifFirst, ".heic"},
+		{"avif major", ftypBox("avif", "mif1", "heic"), heicFirst, ""},
+		{"both, heic first", ftypBox("mif1", "avif", "heic"), heicFirst, ".heic"},
+		{"both, avif first", ftypBox("mif1", "heic", "avif"), avifFirst, ""},
+		{"heic and jxl, heic first", ftypBox("mif1", "jxl ", "heic"), heicFirst, ".heic"},
+		{"heic and jxl, jxl first", ftypBox("mif1", "heic", "jxl "), jxlFirst, ".jxl"},
+		{"avif and jxl, avif first", ftypBox("miaf", "avif", "jxl "), avifFirst, ""},
+		// 盒之后的 meta 盒中的 heic 不是兼容品牌
+		{"brand after box", ftypBox("isom"), heicFirst, ""},
+		{"truncated", ftypBox("isom", "heic")[:18], heicFirst, ""},
+	} {
+		if got := sniffFormat(tc.header, tc.order); got != tc.want {
+			t.Errorf("%s: format = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	ts, _, _ := newTestServer(t, func(ts *ThumbsServer) { ts.ContainerFormatOrder = []string{"JXL", "heic"} })
+	if !slices.Equal(ts.ContainerFormatOrder, []string{".jxl", ".heic"}) {
+		t.Errorf("container_format_order = %v, want normalized [.jxl .heic]", ts.ContainerFormatOrder)
+	}
+	for _, order := range [][]string{{".png"}, {".heic", "heic"}} {
+		ts := &ThumbsServer{ContainerFormatOrder: order}
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		ts.ImageStorageRaw = registerStorage(t, "src", newMemStorage())
+		ts.ThumbsStorageRaw = registerStorage(t, "thumbs", newMemStorage())
+		err := ts.Provision(ctx)
+		if err == nil {
+			err = ts.Validate()
+		}
+		cancel()
+		if err == nil {
+			t.Errorf("container_format_order %v was accepted", order)
+		}
+	}
+}
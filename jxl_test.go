@@ -0,0 +1,69 @@
+package caddy_thumbs
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"net/http"
+	"testing"
+
+	"github.com/gen2brain/jpegxl"
+)
+
+// encodeJXL 编码 JPEG XL 测试原图
+func encodeJXL(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpegxl.Encode(&buf, img, jpegxl.Options{Lossless: true}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestJXLSource JPEG XL 原图按文件头识别并解码, 生成正确尺寸和颜色的缩略图
+func TestJXLSource(t *testing.T) {
+	ts, src, _ := newTestServer(t, nil)
+	src.put("/a.jxl", encodeJXL(t, solidImage(80, 60, color.NRGBA{0, 0, 255, 255})))
+
+	w := get(t, ts, "/c40x30/a.jxl")
+	mustStatus(t, w, http.StatusOK)
+	img, format := decodeBody(t, w.Body.Bytes())
+	if img.Bounds().Dx() != 40 || img.Bounds().Dy() != 30 {
+		t.Errorf("size = %dx%d, want 40x30", img.Bounds().Dx(), img.Bounds().Dy())
+	}
+	if r, g, b, _ := img.At(20, 15).RGBA(); r>>8 > 0x10 || g>>8 > 0x10 || b>>8 < 0xF0 {
+		t.Errorf("%s thumbnail color = %v, want blue", format, img.At(20, 15))
+	}
+}
+
+// TestJXLOutput JPEG XL 输出带有效的文件签名并解码为请求的尺寸, q100 为无损编码
+func TestJXLOutput(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.FormatRule = "jxl" })
+	src.put("/foo", encodePNG(t, gradientImage(80, 60)))
+
+	for _, target := range []string{"/c40x30/foo", "/c40x30,q100/foo"} {
+		w := get(t, ts, target)
+		mustStatus(t, w, http.StatusOK)
+		data := w.Body.Bytes()
+		// 裸码流以 FF 0A 开头, 容器格式以 "JXL " 签名盒开头
+		if !bytes.HasPrefix(data, []byte{0xFF, 0x0A}) && !bytes.HasPrefix(data, []byte("\x00\x00\x00\x0cJXL \r\n\x87\n")) {
+			t.Fatalf("%s: response does not start with a JXL signature: %x", target, data[:min(len(data), 12)])
+		}
+		img, format := decodeBody(t, data)
+		if format != "jxl" || img.Bounds().Dx() != 40 || img.Bounds().Dy() != 30 {
+			t.Errorf("%s: got %s %dx%d, want jxl 40x30", target, format, img.Bounds().Dx(), img.Bounds().Dy())
+		}
+	}
+
+	// 无损编码的输出与 PNG 输出逐像素相同
+	lossless, _ := decodeBody(t, get(t, ts, "/c40x30,q100/foo").Body.Bytes())
+	ts.FormatRule = ".png"
+	reference, _ := decodeBody(t, get(t, ts, "/c40x30,q100/foo").Body.Bytes())
+	for y := 0; y < 30; y++ {
+		for x := 0; x < 40; x++ {
+			if got, want := color.NRGBAModel.Convert(lossless.At(x, y)), color.NRGBAModel.Convert(reference.At(x, y)); got != want {
+				t.Fatalf("q100 pixel (%d,%d) = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package caddy_thumbs
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+
+	"github.com/nfnt/resize"
+)
+
+const (
+	lqipHeader  = "X-Thumbs-LQIP" // 低质量占位图响应头, 内容为 base64 编码的 JPEG
+	lqipSuffix  = ".lqip"         // 占位图在缩略图存储中的后缀
+	lqipSize    = 16              // 占位图最长边像素
+	lqipQuality = 40
+)
+
+// makeLQIP 生成一个极小的模糊 JPEG 占位图, 前端可内联作为图片加载前的占位
+func makeLQIP(img image.Image) ([]byte, error) {
+	small := boxBlur(resize.Thumbnail(lqipSize, lqipSize, img, resize.Bilinear))
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, small, &jpeg.Options{Quality: lqipQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// boxBlur 3x3 均值模糊
+func boxBlur(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			var r, g, bl, a, n uint32
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					sx, sy := x+dx, y+dy
+					if sx < 0 || sy < 0 || sx >= b.Dx() || sy >= b.Dy() {
+						continue
+					}
+					cr, cg, cb, ca := img.At(b.Min.X+sx, b.Min.Y+sy).RGBA()
+					r, g, bl, a, n = r+cr, g+cg, bl+cb, a+ca, n+1
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(bl / n >> 8), uint8(a / n >> 8)})
+		}
+	}
+	return dst
+}
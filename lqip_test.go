@@ -0,0 +1,35 @@
+package caddy_thumbs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image/jpeg"
+	"net/http"
+	"testing"
+)
+
+// TestLQIP 生成和缓存命中时都返回占位图响应头, 内容解码为最长边不超过 lqipSize 的 JPEG
+func TestLQIP(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.LQIP = true })
+	src.put("/a.png", encodePNG(t, gradientImage(200, 100)))
+
+	for _, state := range []string{"miss", "hit"} {
+		w := get(t, ts, "/c100x50/a.png")
+		mustStatus(t, w, http.StatusOK)
+		header := w.Header().Get(lqipHeader)
+		if header == "" {
+			t.Fatalf("%s: no %s header", state, lqipHeader)
+		}
+		data, err := base64.StdEncoding.DecodeString(header)
+		if err != nil {
+			t.Fatalf("%s: header is not base64: %v", state, err)
+		}
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: header is not a JPEG: %v", state, err)
+		}
+		if b := img.Bounds(); b.Dx() != lqipSize || b.Dy() != lqipSize/2 {
+			t.Errorf("%s: preview size = %dx%d, want %dx%d", state, b.Dx(), b.Dy(), lqipSize, lqipSize/2)
+		}
+	}
+}
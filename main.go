@@ -2,6 +2,12 @@ package caddy_thumbs
 
 import (
 	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,13 +17,24 @@ import (
 	"image/jpeg"
 	"image/png"
 	"io"
+	"io/fs"
+	"math"
+	"mime"
 	"net/http"
+	"net/url"
+	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/chai2010/webp"
+	"github.com/dustin/go-humanize"
+	"github.com/gen2brain/heic"
+	"github.com/gen2brain/jpegxl"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
@@ -49,52 +66,200 @@ const (
 	CROP_MODE_CENTERTOP    = 16
 	CROP_MODE_CENTERCENTER = 17
 	CROP_MODE_CENTERBOTTOM = 18
+	SCALE_MODE_LONG        = 19 // 长边缩放到指定尺寸, 短边按纵横比计算
+	SCALE_MODE_SHORT       = 20 // 短边缩放到指定尺寸, 长边按纵横比计算
+)
+
+// SHORT_CACHE_FLAG URL 中标记可变图片的参数, 如 c200x200,short
+const SHORT_CACHE_FLAG = "short"
+
+// NEAR_LOSSLESS_FLAG_PREFIX URL 中指定 WebP 近无损等级的参数前缀, 如 c200x200,nl60
+const NEAR_LOSSLESS_FLAG_PREFIX = "nl"
+
+// FOCAL_POINT_FLAG_PREFIX URL 中指定裁剪焦点的参数前缀, 横纵坐标为原图尺寸的百分比, 如 c200x200,fp30x70
+const FOCAL_POINT_FLAG_PREFIX = "fp"
+
+// FORMAT_RULE_SOURCE URL 未带扩展名时输出格式与原图格式一致
+const FORMAT_RULE_SOURCE = "source"
+
+// 请求尺寸超过原图尺寸时的处理策略
+const (
+	UPSCALE_POLICY_ALLOW = "allow" // 允许放大(默认)
+	UPSCALE_POLICY_DENY  = "deny"  // 拒绝请求, 返回 400
+	UPSCALE_POLICY_CLAMP = "clamp" // 限制为原图尺寸
 )
 
 var cropModeMap = map[string]int{
-	"m":   SCALE_MODE_M,
-	"w":   SCALE_MODE_WCC,
-	"wlt": SCALE_MODE_WLT,
-	"wlc": SCALE_MODE_WLC,
-	"wlb": SCALE_MODE_WLB,
-	"wrt": SCALE_MODE_WRT,
-	"wrc": SCALE_MODE_WRC,
-	"wrb": SCALE_MODE_WRB,
-	"wct": SCALE_MODE_WCT,
-	"wcc": SCALE_MODE_WCC,
-	"wcb": SCALE_MODE_WCB,
-	"wc":  SCALE_MODE_WCC,
-	"lt":  CROP_MODE_LEFTTOP,
-	"lc":  CROP_MODE_LEFTMIDDLE,
-	"lb":  CROP_MODE_LEFTBOTTOM,
-	"rt":  CROP_MODE_RIGHTTOP,
-	"rc":  CROP_MODE_RIGHTMIDDLE,
-	"rb":  CROP_MODE_RIGHTBOTTOM,
-	"ct":  CROP_MODE_CENTERTOP,
-	"cc":  CROP_MODE_CENTERCENTER,
-	"cb":  CROP_MODE_CENTERBOTTOM,
-	"c":   CROP_MODE_CENTERCENTER,
+	"m":     SCALE_MODE_M,
+	"w":     SCALE_MODE_WCC,
+	"wlt":   SCALE_MODE_WLT,
+	"wlc":   SCALE_MODE_WLC,
+	"wlb":   SCALE_MODE_WLB,
+	"wrt":   SCALE_MODE_WRT,
+	"wrc":   SCALE_MODE_WRC,
+	"wrb":   SCALE_MODE_WRB,
+	"wct":   SCALE_MODE_WCT,
+	"wcc":   SCALE_MODE_WCC,
+	"wcb":   SCALE_MODE_WCB,
+	"wc":    SCALE_MODE_WCC,
+	"lt":    CROP_MODE_LEFTTOP,
+	"lc":    CROP_MODE_LEFTMIDDLE,
+	"lb":    CROP_MODE_LEFTBOTTOM,
+	"rt":    CROP_MODE_RIGHTTOP,
+	"rc":    CROP_MODE_RIGHTMIDDLE,
+	"rb":    CROP_MODE_RIGHTBOTTOM,
+	"ct":    CROP_MODE_CENTERTOP,
+	"cc":    CROP_MODE_CENTERCENTER,
+	"cb":    CROP_MODE_CENTERBOTTOM,
+	"c":     CROP_MODE_CENTERCENTER,
+	"long":  SCALE_MODE_LONG,
+	"short": SCALE_MODE_SHORT,
+}
+
+// 对齐锚点: 水平方向 -1 居左, 0 居中, 1 居右; 垂直方向 -1 居上, 0 居中, 1 居下
+var modeAnchors = map[int][2]int{
+	CROP_MODE_LEFTTOP:      {-1, -1},
+	CROP_MODE_LEFTMIDDLE:   {-1, 0},
+	CROP_MODE_LEFTBOTTOM:   {-1, 1},
+	CROP_MODE_RIGHTTOP:     {1, -1},
+	CROP_MODE_RIGHTMIDDLE:  {1, 0},
+	CROP_MODE_RIGHTBOTTOM:  {1, 1},
+	CROP_MODE_CENTERTOP:    {0, -1},
+	CROP_MODE_CENTERCENTER: {0, 0},
+	CROP_MODE_CENTERBOTTOM: {0, 1},
+	SCALE_MODE_WLT:         {-1, -1},
+	SCALE_MODE_WLC:         {-1, 0},
+	SCALE_MODE_WLB:         {-1, 1},
+	SCALE_MODE_WRT:         {1, -1},
+	SCALE_MODE_WRC:         {1, 0},
+	SCALE_MODE_WRB:         {1, 1},
+	SCALE_MODE_WCT:         {0, -1},
+	SCALE_MODE_WCC:         {0, 0},
+	SCALE_MODE_WCB:         {0, 1},
+}
+
+// anchorOffset 按锚点计算偏移, extra 为超出(裁剪)或不足(填充)目标尺寸的部分
+func anchorOffset(extra, anchor int) int {
+	switch anchor {
+	case -1:
+		return 0
+	case 1:
+		return extra
+	}
+	return extra / 2
 }
 
 func init() {
 	caddy.RegisterModule(ThumbsServer{})
 	httpcaddyfile.RegisterHandlerDirective("thumbs_server", parseCaddyfile)
+	// 标准库内置的类型表中没有 JPEG XL
+	mime.AddExtensionType(".jxl", "image/jxl")
 }
 
 // ThumbsServer 实现一个缩略图生成服务器
 type ThumbsServer struct {
-	ImageStorageRaw  json.RawMessage `json:"image_storage,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
-	ThumbsStorageRaw json.RawMessage `json:"thumbs_storage,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+	ImageStorageRaw json.RawMessage `json:"image_storage,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+	// 备用原图存储, 主存储中没有原图或读取出错时按顺序尝试
+	FallbackImageStoragesRaw []json.RawMessage `json:"fallback_image_storages,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+	ArchiveSource            string            `json:"archive_source,omitempty"`      // 主原图存储中的 zip/tar 归档, 原图路径作为归档内的条目查找
+	SourceTokenHeader        string            `json:"source_token_header,omitempty"` // 将该请求头的值作为凭据转交给实现了 TokenStorage 的原图存储
+	ThumbsStorageRaw         json.RawMessage   `json:"thumbs_storage,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+	// 慢速缩略图存储(如 S3), 配置后 thumbs_storage 作为其前面的快速存储
+	ThumbsSlowStorageRaw json.RawMessage `json:"thumbs_slow_storage,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+	HashStorageKeys      int             `json:"hash_storage_keys,omitempty"` // 缩略图存储键哈希后分散的目录层数(1-4), 为 0 时按缩略图路径存储
+	// 缩放后可在 URL 中选用的外部处理操作, 需实现 ImageFilter
+	ImageFiltersRaw []json.RawMessage `json:"image_filters,omitempty" caddy:"namespace=http.handlers.thumbs_server.filters inline_key=filter"`
+	// 解码前依次处理原图字节的模块, 需实现 SourceTransformer
+	SourceTransformersRaw []json.RawMessage `json:"source_transformers,omitempty" caddy:"namespace=http.handlers.thumbs_server.transformers inline_key=transformer"`
 
-	imageStorage  certmagic.Storage
+	imageStorages []certmagic.Storage       // 主存储和备用存储, 按顺序查找原图
+	archive       *sourceArchive            // 原图归档, 仅在配置 archive_source 时创建
+	transformers  []SourceTransformer       // 原图处理器, 按配置顺序执行
+	pipelineOps   map[string]pipelineOpSpec // 内置操作和外部 ImageFilter, Provision 之后只读
 	thumbsStorage certmagic.Storage
 	ctx           caddy.Context
 
-	MaxDimension   int    `json:"max_dimension,omitempty"`
-	DefaultQuality int    `json:"default_quality,omitempty"`
-	CacheControl   string `json:"cache_control,omitempty"`
-	logger         *zap.Logger
-	regex          *regexp.Regexp // 实例特定的正则表达式
+	MaxDimension         int                      `json:"max_dimension,omitempty"`
+	ModeMaxDimension     map[string]int           `json:"mode_max_dimension,omitempty"`      // 按模式(如 c、lt、w、m)限制最大尺寸, 同义的模式(如 c 和 cc)共用限制, 未配置的模式使用 max_dimension
+	SizeStep             int                      `json:"size_step,omitempty"`               // 将请求的像素尺寸取整到该步长的最近倍数(如 50), 减少不同尺寸的缓存数量
+	MaxPathLength        int                      `json:"max_path_length,omitempty"`         // 请求路径的最大长度(字节), 超过时返回 414, 为 0 时不限制
+	MaxVariantsPerSource int                      `json:"max_variants_per_source,omitempty"` // 每个原图最多缓存的缩略图数量, 超出的尺寸照常生成返回但不缓存, 为 0 时不限制
+	DefaultQuality       int                      `json:"default_quality,omitempty"`
+	MinQuality           int                      `json:"min_quality,omitempty"`         // 按字节预算降低质量时的下限, 达不到预算时返回该质量的结果而不是 422
+	QualityRange         map[string]QualityRange  `json:"quality_range,omitempty"`       // 按输出格式限制质量的范围, 超出范围的质量参数被限制到边界
+	QualityPresets       map[string]QualityPreset `json:"quality_presets,omitempty"`     // URL 中具名质量(如 qhigh)对应的质量, 内置 low、med、high
+	AlphaQualityBoost    int                      `json:"alpha_quality_boost,omitempty"` // 带透明通道的 WebP 输出在编码器质量上增加的值, 减少透明边缘的瑕疵
+	CacheControl         string                   `json:"cache_control,omitempty"`
+	ShortCacheControl    string                   `json:"short_cache_control,omitempty"` // 带 short 标记的请求使用的 Cache-Control
+	UpscalePolicy        string                   `json:"upscale_policy,omitempty"`
+	LQIP                 bool                     `json:"lqip,omitempty"`
+	ColorHeader          bool                     `json:"color_header,omitempty"` // 在 X-Thumbs-Color 响应头中返回缩略图的平均颜色, 与缩略图一同缓存
+	PreferSmaller        bool                     `json:"prefer_smaller,omitempty"`
+	EncodeFallback       bool                     `json:"encode_fallback,omitempty"`         // 输出格式编码失败(包括编码器 panic)时改用 JPEG 输出, 降级结果不缓存
+	DebugHeaders         bool                     `json:"debug_headers,omitempty"`           // 响应中添加 X-Thumbs-Cache、X-Thumbs-Mode 和 X-Thumbs-Gen-Ms 诊断头
+	MinModernFormatBytes int                      `json:"min_modern_format_bytes,omitempty"` // 原图或输出小于该字节数时, 请求的 WebP/JPEG XL 改用 JPEG(有透明通道时 PNG)输出
+	MaxCacheBytes        int64                    `json:"max_cache_bytes,omitempty"`
+	NoCache              bool                     `json:"no_cache,omitempty"`               // 无缓存模式: 不读写缩略图存储, 每次请求都重新生成
+	ETagSidecar          bool                     `json:"etag_sidecar,omitempty"`           // 缓存缩略图时另存 ETag 和生成时间, 命中的条件请求无需读取缩略图即可返回 304
+	TranscodeFromCache   bool                     `json:"transcode_from_cache,omitempty"`   // 缓存中有同尺寸其他格式的缩略图时直接转码, 不再读取原图
+	FormatRule           string                   `json:"format_rule,omitempty"`            // URL 未带扩展名时的输出格式规则: source 与原图格式一致, 或固定的扩展名
+	DefaultFormat        string                   `json:"default_format,omitempty"`         // URL 没有扩展名或扩展名不是支持的输出格式时使用的输出格式
+	DefaultVariant       string                   `json:"default_variant,omitempty"`        // 不带模式目录的原图路径(如 /foo.jpg)使用的模式目录, 如 m800x800,q80
+	ErrorResponse        string                   `json:"error_response,omitempty"`         // 错误响应模式: json 或 image, 为空时使用 Caddy 默认错误处理
+	AllowedFormats       []string                 `json:"allowed_formats,omitempty"`        // 允许输出的格式扩展名, 为空时允许所有支持的格式
+	Immutable            bool                     `json:"immutable,omitempty"`              // 在 Cache-Control 后追加 immutable, 仅适用于内容寻址或签名的 URL
+	DecodeTimeout        caddy.Duration           `json:"decode_timeout,omitempty"`         // 单次解码的超时时间, 为 0 时不限制
+	DecodeConcurrency    map[string]int           `json:"decode_concurrency,omitempty"`     // 按原图格式(扩展名)限制同时解码的数量, 未配置的格式不限制
+	ContainerFormatOrder []string                 `json:"container_format_order,omitempty"` // ISOBMFF 容器的兼容品牌同时包含多种格式(heic、avif、jxl)时的优先顺序
+	StrictDimensions     bool                     `json:"strict_dimensions,omitempty"`      // 检查裁剪和填充模式的输出尺寸与请求一致, 因取整产生偏差时自动修正
+	MPad                 bool                     `json:"m_pad,omitempty"`                  // m 模式缩放后居中填充到请求的尺寸, 填充区域使用背景色, 与 w 模式相同
+	UpscaleFilter        string                   `json:"upscale_filter,omitempty"`         // 放大时使用的插值算法, 默认 lanczos3
+	DownscaleFilter      string                   `json:"downscale_filter,omitempty"`       // 缩小时使用的插值算法, 默认 lanczos3
+	QualityFilters       []QualityFilter          `json:"quality_filters,omitempty"`        // 按请求质量选择插值算法, 低质量的缩略图使用更快的算法
+	ModeFilters          map[string]string        `json:"mode_filters,omitempty"`           // 按模式(如 m、c)覆盖 upscale_filter 和 downscale_filter, 同义的模式共用配置
+	NormalizeQuality     *QualityNormalization    `json:"normalize_quality,omitempty"`      // 将请求的感知质量按曲线映射为各有损编码器的质量
+	WebPNearLossless     *int                     `json:"webp_near_lossless,omitempty"`     // WebP 近无损等级 0-100, 未设置时使用有损编码
+	NormalizePath        bool                     `json:"normalize_path,omitempty"`         // 合并路径中连续的斜杠、去掉末尾斜杠, 扩展名不区分大小写
+	StripPrefix          string                   `json:"strip_prefix,omitempty"`           // 匹配前从请求路径中去掉的前缀(如 /media), 设置后模式目录必须紧跟在前缀之后
+	RefreshSecret        string                   `json:"refresh_secret,omitempty"`         // 开启 ?refresh=1 强制重新生成, 请求需在 X-Thumbs-Refresh-Secret 头中携带该密钥
+	CacheKeyHeader       string                   `json:"cache_key_header,omitempty"`       // 按该请求头的值(如租户)分区缓存缩略图, 未携带时使用 default 分区
+	CheckerSize          int                      `json:"checker_size,omitempty"`           // 棋盘格背景的格子边长, 默认 8
+
+	Optimizers         map[string]*OptimizerConfig `json:"optimizers,omitempty"`           // 按输出格式(扩展名)配置的外部优化程序
+	OptimizerTimeout   caddy.Duration              `json:"optimizer_timeout,omitempty"`    // 外部优化程序的超时时间, 默认 10s
+	StrictSourceType   bool                        `json:"strict_source_type,omitempty"`   // 原图实际格式与扩展名不一致时返回 415, 默认只记录警告
+	RequireSource      bool                        `json:"require_source,omitempty"`       // 缓存命中时也检查原图是否存在, 原图已删除时返回 404, 默认直接返回缓存
+	StrictTokens       bool                        `json:"strict_tokens,omitempty"`        // 对当前模式或输出格式不起作用的 URL 参数返回 400, 默认忽略
+	StrictQuality      bool                        `json:"strict_quality,omitempty"`       // URL 中超出 0-100 的质量参数返回 400, 默认使用 default_quality
+	PNGQuantize        bool                        `json:"png_quantize,omitempty"`         // PNG 输出量化为调色板图片, 颜色数由质量参数决定
+	MatchSourceQuality bool                        `json:"match_source_quality,omitempty"` // 按 JPEG 原图量化表估算的质量限制有损输出的质量
+	OutputDPI          int                         `json:"output_dpi,omitempty"`           // 写入 JPEG(JFIF)和 PNG(pHYs)输出的分辨率, 为 0 时不写入
+	ConvertToSRGB      *bool                       `json:"convert_to_srgb,omitempty"`      // 按内嵌的 ICC 配置文件将原图转换到 sRGB, 默认开启
+	PDFSources         bool                        `json:"pdf_sources,omitempty"`          // 栅格化 PDF 原图的第一页生成缩略图, 需要使用 pdf 构建标签编译
+
+	Pregenerate      *PregenerateConfig   `json:"pregenerate,omitempty"`
+	Srcset           *SrcsetConfig        `json:"srcset,omitempty"`
+	Warmer           *WarmerConfig        `json:"cache_warmer,omitempty"`
+	AsyncGeneration  *AsyncConfig         `json:"async_generation,omitempty"`
+	Approximate      *ApproximateConfig   `json:"approximate_from_cache,omitempty"` // 缓存未命中时从更大尺寸的缓存缩放返回近似结果
+	OrphanPurge      *OrphanPurgeConfig   `json:"orphan_purge,omitempty"`
+	GenerationUADeny *UserAgentDenyConfig `json:"generation_user_agent_deny,omitempty"` // 禁止 User-Agent 匹配的请求触发生成
+	BlurHashPath     string               `json:"blurhash_path,omitempty"`              // BlurHash 接口路径, 为空时不开启
+	DebugPath        string               `json:"debug_path,omitempty"`                 // 运行时统计接口路径, 为空时不开启
+	CacheStatsPath   string               `json:"cache_stats_path,omitempty"`           // 缓存统计接口路径, 为空时不开启
+	CapabilitiesPath string               `json:"capabilities_path,omitempty"`          // 能力查询接口路径, 为空时不开启
+
+	logger      *zap.Logger
+	regex       *regexp.Regexp           // 实例特定的正则表达式
+	tileRegex   *regexp.Regexp           // 瓦片请求的正则表达式
+	index       *thumbIndex              // 缩略图存储索引, 仅在开启 max_cache_bytes 或缓存统计接口时创建
+	stats       *serverStats             // 运行时统计
+	warmer      *recentRequests          // 最近访问的缩略图请求, 仅在开启 cache_warmer 时创建
+	async       *asyncJobs               // 后台生成任务, 仅在开启 async_generation 时创建
+	approximate *asyncJobs               // 近似结果的后台重新生成任务, 仅在开启 approximate_from_cache 的 regenerate 时创建
+	variants    *variantIndex            // 每个原图已缓存的缩略图, 仅在开启 max_variants_per_source 时创建
+	errorImages *errorImageCache         // 已编码的错误占位图, 仅在 error_response 为 image 时创建
+	decodeSlots map[string]chan struct{} // 按原图格式的解码信号量, Provision 之后只读
 }
 
 // CaddyModule 返回模块信息
@@ -119,29 +284,250 @@ func (t *ThumbsServer) Provision(ctx caddy.Context) error {
 	if t.CacheControl == "" {
 		t.CacheControl = "public, max-age=31536000" // 默认缓存一年
 	}
+	if t.ShortCacheControl == "" {
+		t.ShortCacheControl = "public, max-age=60"
+	}
+	if t.UpscaleFilter == "" {
+		t.UpscaleFilter = "lanczos3"
+	}
+	if t.DownscaleFilter == "" {
+		t.DownscaleFilter = "lanczos3"
+	}
+	slices.SortFunc(t.QualityFilters, func(a, b QualityFilter) int {
+		return cmp.Compare(a.MaxQuality, b.MaxQuality)
+	})
+	if t.OptimizerTimeout == 0 {
+		t.OptimizerTimeout = caddy.Duration(10 * time.Second)
+	}
+	for format, opt := range t.Optimizers {
+		if normalized := "." + strings.TrimPrefix(strings.ToLower(format), "."); normalized != format {
+			delete(t.Optimizers, format)
+			t.Optimizers[normalized] = opt
+		}
+	}
+	if t.NormalizeQuality != nil {
+		t.NormalizeQuality.provision()
+	}
+	t.provisionQualityPresets()
+	if len(t.QualityRange) > 0 {
+		normalized := make(map[string]QualityRange, len(t.QualityRange))
+		for format, r := range t.QualityRange {
+			normalized[formatKey(format)] = r
+		}
+		t.QualityRange = normalized
+	}
+	if len(t.ContainerFormatOrder) == 0 {
+		t.ContainerFormatOrder = defaultContainerFormatOrder
+	} else {
+		for i, format := range t.ContainerFormatOrder {
+			t.ContainerFormatOrder[i] = formatKey(format)
+		}
+	}
+	if len(t.DecodeConcurrency) > 0 {
+		normalized := make(map[string]int, len(t.DecodeConcurrency))
+		for format, limit := range t.DecodeConcurrency {
+			normalized[formatKey(format)] = limit
+		}
+		t.DecodeConcurrency = normalized
+		t.decodeSlots = make(map[string]chan struct{}, len(normalized))
+		for format, limit := range normalized {
+			if limit > 0 {
+				t.decodeSlots[format] = make(chan struct{}, limit)
+			}
+		}
+	}
+	if t.CheckerSize == 0 {
+		t.CheckerSize = 8
+	}
+	if t.UpscalePolicy == "" {
+		t.UpscalePolicy = UPSCALE_POLICY_ALLOW
+	}
+	if t.FormatRule != "" && t.FormatRule != FORMAT_RULE_SOURCE && !strings.HasPrefix(t.FormatRule, ".") {
+		t.FormatRule = "." + t.FormatRule
+	}
+	t.DefaultVariant = strings.Trim(t.DefaultVariant, "/")
+	if t.DefaultFormat != "" {
+		t.DefaultFormat = strings.ToLower(t.DefaultFormat)
+		if !strings.HasPrefix(t.DefaultFormat, ".") {
+			t.DefaultFormat = "." + t.DefaultFormat
+		}
+	}
+	for i, format := range t.AllowedFormats {
+		t.AllowedFormats[i] = strings.ToLower(format)
+		if !strings.HasPrefix(format, ".") {
+			t.AllowedFormats[i] = "." + t.AllowedFormats[i]
+		}
+	}
+	if t.Pregenerate != nil && t.Pregenerate.Concurrency == 0 {
+		t.Pregenerate.Concurrency = 4
+	}
+	if t.Srcset != nil {
+		if t.Srcset.Mode == "" {
+			t.Srcset.Mode = "m"
+		}
+		if t.Srcset.Prefix == "" {
+			t.Srcset.Prefix = path.Dir(t.Srcset.Path)
+		}
+		if t.Srcset.Concurrency == 0 {
+			t.Srcset.Concurrency = 4
+		}
+	}
+	if t.Warmer != nil {
+		if t.Warmer.Interval == 0 {
+			t.Warmer.Interval = caddy.Duration(5 * time.Minute)
+		}
+		if t.Warmer.Size == 0 {
+			t.Warmer.Size = 1000
+		}
+		if t.Warmer.Concurrency == 0 {
+			t.Warmer.Concurrency = 2
+		}
+		if t.Warmer.MaxPerRound == 0 {
+			t.Warmer.MaxPerRound = 100
+		}
+	}
+	if t.OrphanPurge != nil {
+		if t.OrphanPurge.Interval == 0 {
+			t.OrphanPurge.Interval = caddy.Duration(time.Hour)
+		}
+		if t.OrphanPurge.Rate == 0 {
+			t.OrphanPurge.Rate = 20
+		}
+	}
+	if t.GenerationUADeny != nil {
+		if err := t.GenerationUADeny.provision(); err != nil {
+			return err
+		}
+	}
+	if t.AsyncGeneration != nil {
+		if t.AsyncGeneration.RetryAfter == 0 {
+			t.AsyncGeneration.RetryAfter = caddy.Duration(2 * time.Second)
+		}
+		if t.AsyncGeneration.Concurrency == 0 {
+			t.AsyncGeneration.Concurrency = 4
+		}
+	}
+	if t.Approximate != nil && t.Approximate.Concurrency == 0 {
+		t.Approximate.Concurrency = 2
+	}
 
 	if t.ImageStorageRaw != nil {
 		storageMod, err := ctx.LoadModule(t, "ImageStorageRaw")
 		if err != nil {
 			return fmt.Errorf("loading image storage module: %v", err)
 		}
-		t.imageStorage, _ = storageMod.(caddy.StorageConverter).CertMagicStorage()
+		storage, _ := storageMod.(caddy.StorageConverter).CertMagicStorage()
+		t.imageStorages = append(t.imageStorages, storage)
 	} else {
 		return fmt.Errorf("image_storage is required")
 	}
 
-	if t.ThumbsStorageRaw != nil {
+	if t.FallbackImageStoragesRaw != nil {
+		storageMods, err := ctx.LoadModule(t, "FallbackImageStoragesRaw")
+		if err != nil {
+			return fmt.Errorf("loading fallback image storage modules: %v", err)
+		}
+		for _, storageMod := range storageMods.([]any) {
+			storage, _ := storageMod.(caddy.StorageConverter).CertMagicStorage()
+			t.imageStorages = append(t.imageStorages, storage)
+		}
+	}
+	if t.SourceTransformersRaw != nil {
+		mods, err := ctx.LoadModule(t, "SourceTransformersRaw")
+		if err != nil {
+			return fmt.Errorf("loading source transformer modules: %v", err)
+		}
+		for _, mod := range mods.([]any) {
+			transformer, ok := mod.(SourceTransformer)
+			if !ok {
+				return fmt.Errorf("module %T is not a SourceTransformer", mod)
+			}
+			t.transformers = append(t.transformers, transformer)
+		}
+	}
+	var filters []any
+	if t.ImageFiltersRaw != nil {
+		mods, err := ctx.LoadModule(t, "ImageFiltersRaw")
+		if err != nil {
+			return fmt.Errorf("loading image filter modules: %v", err)
+		}
+		filters = mods.([]any)
+	}
+	pipelineOps, err := buildPipelineOps(filters)
+	if err != nil {
+		return err
+	}
+	t.pipelineOps = pipelineOps
+	// 归档位于主原图存储中
+	if t.ArchiveSource != "" {
+		t.archive = newSourceArchive(ctx, t.imageStorages[0], t.ArchiveSource, t.logger)
+	}
+
+	// 无缓存模式下不需要缩略图存储
+	if t.ThumbsStorageRaw != nil && !t.NoCache {
 		storageMod, err := ctx.LoadModule(t, "ThumbsStorageRaw")
 		if err != nil {
 			return fmt.Errorf("loading image storage module: %v", err)
 		}
 		t.thumbsStorage, _ = storageMod.(caddy.StorageConverter).CertMagicStorage()
-	} else {
+		if t.ThumbsSlowStorageRaw != nil {
+			slowMod, err := ctx.LoadModule(t, "ThumbsSlowStorageRaw")
+			if err != nil {
+				return fmt.Errorf("loading thumbs slow storage module: %v", err)
+			}
+			slow, _ := slowMod.(caddy.StorageConverter).CertMagicStorage()
+			t.thumbsStorage = tieredStorage{Storage: t.thumbsStorage, slow: slow, logger: t.logger}
+		}
+		// 两层存储使用相同的哈希键, 超出范围的层数由 Validate 拒绝
+		if t.HashStorageKeys > 0 && t.HashStorageKeys <= 4 {
+			t.thumbsStorage = newHashedStorage(t.thumbsStorage, t.HashStorageKeys)
+		}
+	} else if !t.NoCache {
 		return fmt.Errorf("thumbs_storage is required")
 	}
 
-	t.regex = regexp.MustCompile(`^.*\/(([a-z]+)(\d+)x(\d+)(?:,([a-fA-F0-9]{6}|[a-fA-F0-9]{8}))?(?:,q(\d+))?(?:,(\w+))?)\/((?:.+)(\.\w+))$`)
+	// 默认模式目录可以位于任意层级之下; 设置 strip_prefix 后去掉前缀的路径必须以模式目录开头,
+	// 避免原图路径中形如模式目录的部分被误认为模式目录
+	pathPrefix := `^.*\/`
+	if t.StripPrefix != "" {
+		t.StripPrefix = "/" + strings.Trim(t.StripPrefix, "/")
+		pathPrefix = `^\/`
+	}
+	// long 和 short 模式只有一个尺寸, 如 long800
+	t.regex = regexp.MustCompile(pathPrefix + `((?:([a-z]+)(\d+p?)x(\d+p?)|(long|short)(\d+))(?:\.[a-z]+\d*)*(?:,([a-fA-F0-9]{6}|[a-fA-F0-9]{8}))?(?:,q(\d+(?:\.\d+)?|[a-z]+))?((?:,\w+)*))\/((?:.+?)(\.\w+)?)$`)
+	t.tileRegex = regexp.MustCompile(pathPrefix + tilePattern)
 	t.ctx = ctx
+	t.stats = newServerStats()
+
+	// 开启缓存容量限制时启动后台清理, 只开启缓存统计、孤立缩略图清理或近似结果时只需要加载索引
+	if t.MaxCacheBytes > 0 {
+		t.index = newThumbIndex()
+		go t.runJanitor()
+	} else if t.CacheStatsPath != "" || t.OrphanPurge != nil || t.Approximate != nil {
+		t.index = newThumbIndex()
+		go t.seedIndex()
+	}
+	if t.OrphanPurge != nil && t.OrphanPurge.Interval > 0 && t.OrphanPurge.Rate > 0 {
+		go t.runOrphanPurge()
+	}
+	// 开启缓存预热时记录最近访问的请求并启动后台预热
+	if t.Warmer != nil && t.Warmer.Size > 0 {
+		t.warmer = newRecentRequests(t.Warmer.Size)
+		go t.runWarmer()
+	}
+	if t.AsyncGeneration != nil && t.AsyncGeneration.Concurrency > 0 {
+		t.async = newAsyncJobs(t.AsyncGeneration.Concurrency)
+	}
+	if t.Approximate != nil && t.Approximate.Regenerate && t.Approximate.Concurrency > 0 {
+		t.approximate = newAsyncJobs(t.Approximate.Concurrency)
+	}
+	if t.MaxVariantsPerSource > 0 {
+		t.variants = newVariantIndex()
+		go t.seedVariants()
+	}
+	if t.ErrorResponse == ERROR_RESPONSE_IMAGE {
+		t.errorImages = newErrorImageCache()
+	}
 	return nil
 }
 
@@ -153,202 +539,1400 @@ func (t *ThumbsServer) Validate() error {
 	if t.DefaultQuality < 0 || t.DefaultQuality > 100 {
 		return errors.New("default_quality must be between 0 and 100")
 	}
+	if t.AlphaQualityBoost < 0 || t.AlphaQualityBoost > 100 {
+		return errors.New("alpha_quality_boost must be between 0 and 100")
+	}
+	if t.MinQuality < 0 || t.MinQuality > 100 {
+		return errors.New("min_quality must be between 0 and 100")
+	}
+	if t.WebPNearLossless != nil && (*t.WebPNearLossless < 0 || *t.WebPNearLossless > 100) {
+		return errors.New("webp_near_lossless must be between 0 and 100")
+	}
+	if t.DecodeTimeout < 0 {
+		return errors.New("decode_timeout must not be negative")
+	}
+	for mode, limit := range t.ModeMaxDimension {
+		if _, ok := cropModeMap[mode]; !ok {
+			return fmt.Errorf("invalid mode_max_dimension mode: %s", mode)
+		}
+		if limit <= 0 || limit > t.MaxDimension {
+			return fmt.Errorf("mode_max_dimension for %s must be between 1 and max_dimension (%d)", mode, t.MaxDimension)
+		}
+	}
+	if err := t.validateQualityPresets(); err != nil {
+		return err
+	}
+	for format, r := range t.QualityRange {
+		if !slices.Contains(outputFormats, format) || format == ".svg" {
+			return fmt.Errorf("invalid quality_range format: %s", format)
+		}
+		if r.Min < 0 || r.Max > 100 || r.Min > r.Max {
+			return fmt.Errorf("quality_range for %s must satisfy 0 <= min <= max <= 100", format)
+		}
+	}
+	for i, format := range t.ContainerFormatOrder {
+		if !slices.Contains(containerFormats, format) || slices.Contains(t.ContainerFormatOrder[:i], format) {
+			return fmt.Errorf("invalid or duplicate container_format_order format: %s", format)
+		}
+	}
+	for format, limit := range t.DecodeConcurrency {
+		if !slices.Contains(sourceFormats, format) {
+			return fmt.Errorf("invalid decode_concurrency format: %s", format)
+		}
+		if limit <= 0 {
+			return fmt.Errorf("decode_concurrency for %s must be positive", format)
+		}
+	}
+	for format, opt := range t.Optimizers {
+		if opt == nil || opt.Command == "" {
+			return fmt.Errorf("optimizer for %s requires a command", format)
+		}
+	}
+	if t.OptimizerTimeout < 0 {
+		return errors.New("optimizer_timeout must not be negative")
+	}
+	if t.ArchiveSource != "" && !isArchiveKey(t.ArchiveSource) {
+		return fmt.Errorf("unsupported archive_source %s, expected .zip, .tar, .tar.gz or .tgz", t.ArchiveSource)
+	}
+	if t.CheckerSize <= 0 {
+		return errors.New("checker_size must be positive")
+	}
+	if t.MaxPathLength < 0 {
+		return errors.New("max_path_length must not be negative")
+	}
+	if t.HashStorageKeys < 0 || t.HashStorageKeys > 4 {
+		return errors.New("hash_storage_keys depth must be between 0 and 4")
+	}
+	if t.SizeStep < 0 || t.SizeStep > t.MaxDimension {
+		return fmt.Errorf("size_step must be between 0 and max_dimension (%d)", t.MaxDimension)
+	}
+	// JFIF 以 16 位整数记录分辨率
+	if t.OutputDPI < 0 || t.OutputDPI > math.MaxUint16 {
+		return fmt.Errorf("output_dpi must be between 0 and %d", math.MaxUint16)
+	}
+	if t.MaxCacheBytes < 0 {
+		return errors.New("max_cache_bytes must not be negative")
+	}
+	if t.NoCache && (t.MaxCacheBytes > 0 || t.Pregenerate != nil || t.Warmer != nil || t.Srcset != nil || t.CacheStatsPath != "" || t.AsyncGeneration != nil || t.ETagSidecar || t.OrphanPurge != nil) {
+		return errors.New("max_cache_bytes, pregenerate, cache_warmer, srcset, cache_stats_path, async_generation, etag_sidecar and orphan_purge cannot be used with no_cache")
+	}
+	if t.Srcset != nil {
+		if t.Srcset.Path == "" || len(t.Srcset.Widths) == 0 {
+			return errors.New("srcset requires a path and at least one width")
+		}
+		for _, width := range t.Srcset.Widths {
+			if width <= 0 || width > t.MaxDimension {
+				return fmt.Errorf("srcset width must be between 1 and %d: %d", t.MaxDimension, width)
+			}
+		}
+		// srcset 的变体形如 <模式><宽>x<max_dimension>, 只有等比缩放的 m 模式按宽度约束输出;
+		// 填充和裁剪模式会输出宽 x max_dimension 的画布, 开启 m_pad 的 m 模式同样如此
+		if modeId, ok := cropModeMap[t.Srcset.Mode]; !ok || modeId != SCALE_MODE_M || t.MPad {
+			return fmt.Errorf("invalid srcset mode, only m without m_pad is supported: %s", t.Srcset.Mode)
+		}
+		if t.Srcset.Concurrency <= 0 {
+			return errors.New("srcset concurrency must be positive")
+		}
+	}
+	if t.Warmer != nil && (t.Warmer.Interval <= 0 || t.Warmer.Size <= 0 || t.Warmer.Concurrency <= 0 || t.Warmer.MaxPerRound <= 0) {
+		return errors.New("cache_warmer interval, size, concurrency and max_per_round must be positive")
+	}
+	if t.AsyncGeneration != nil && (t.AsyncGeneration.RetryAfter <= 0 || t.AsyncGeneration.Concurrency <= 0) {
+		return errors.New("async_generation retry_after and concurrency must be positive")
+	}
+	if t.OrphanPurge != nil && (t.OrphanPurge.Interval <= 0 || t.OrphanPurge.Rate <= 0 || t.OrphanPurge.Rate > 1000) {
+		return errors.New("orphan_purge interval must be positive and rate must be between 1 and 1000")
+	}
+	if t.GenerationUADeny != nil {
+		if err := t.GenerationUADeny.validate(); err != nil {
+			return err
+		}
+	}
+	// 降级结果不缓存, 异步生成的请求永远等不到缓存
+	if t.AsyncGeneration != nil && t.EncodeFallback {
+		return errors.New("encode_fallback cannot be used with async_generation")
+	}
+	if t.MaxVariantsPerSource < 0 {
+		return errors.New("max_variants_per_source must not be negative")
+	}
+	// 超出限制的缩略图不缓存, 同样不能异步生成
+	if t.MaxVariantsPerSource > 0 && (t.AsyncGeneration != nil || t.NoCache) {
+		return errors.New("max_variants_per_source cannot be used with async_generation or no_cache")
+	}
+	if t.ThumbsSlowStorageRaw != nil && t.NoCache {
+		return errors.New("thumbs_slow_storage cannot be used with no_cache")
+	}
+	if t.Approximate != nil && t.NoCache {
+		return errors.New("approximate_from_cache cannot be used with no_cache")
+	}
+	if t.Approximate != nil && t.Approximate.Concurrency <= 0 {
+		return errors.New("approximate_from_cache concurrency must be positive")
+	}
+	if t.Pregenerate != nil {
+		if t.Pregenerate.Path == "" || len(t.Pregenerate.Variants) == 0 {
+			return errors.New("pregenerate requires a path and at least one variant")
+		}
+		if t.Pregenerate.Concurrency <= 0 {
+			return errors.New("pregenerate concurrency must be positive")
+		}
+		if t.Pregenerate.Secret == "" {
+			return errors.New("pregenerate requires a secret")
+		}
+	}
+	switch t.UpscalePolicy {
+	case UPSCALE_POLICY_ALLOW, UPSCALE_POLICY_DENY, UPSCALE_POLICY_CLAMP:
+	default:
+		return fmt.Errorf("invalid upscale_policy: %s", t.UpscalePolicy)
+	}
+	if _, ok := interpolationFilters[t.UpscaleFilter]; !ok {
+		return fmt.Errorf("invalid upscale_filter: %s", t.UpscaleFilter)
+	}
+	if _, ok := interpolationFilters[t.DownscaleFilter]; !ok {
+		return fmt.Errorf("invalid downscale_filter: %s", t.DownscaleFilter)
+	}
+	if t.NormalizeQuality != nil {
+		if err := t.NormalizeQuality.validate(); err != nil {
+			return err
+		}
+	}
+	for mode, filter := range t.ModeFilters {
+		if _, ok := cropModeMap[mode]; !ok {
+			return fmt.Errorf("invalid mode_filter mode: %s", mode)
+		}
+		if _, ok := interpolationFilters[filter]; !ok {
+			return fmt.Errorf("invalid mode_filter filter: %s", filter)
+		}
+	}
+	for _, rule := range t.QualityFilters {
+		if _, ok := interpolationFilters[rule.Filter]; !ok {
+			return fmt.Errorf("invalid quality_filter filter: %s", rule.Filter)
+		}
+		if rule.MaxQuality < 0 || rule.MaxQuality > 100 {
+			return fmt.Errorf("quality_filter threshold must be between 0 and 100: %g", rule.MaxQuality)
+		}
+	}
+	switch t.ErrorResponse {
+	case "", ERROR_RESPONSE_JSON, ERROR_RESPONSE_IMAGE:
+	default:
+		return fmt.Errorf("invalid error_response: %s", t.ErrorResponse)
+	}
+	switch t.FormatRule {
+	case "", FORMAT_RULE_SOURCE, ".jpg", ".jpeg", ".png", ".webp", ".jxl":
+	default:
+		return fmt.Errorf("invalid format_rule: %s", t.FormatRule)
+	}
+	for _, format := range t.AllowedFormats {
+		if !slices.Contains(outputFormats, format) {
+			return fmt.Errorf("invalid allowed_formats entry: %s", format)
+		}
+	}
+	if t.FormatRule != "" && t.FormatRule != FORMAT_RULE_SOURCE && !t.formatAllowed(t.FormatRule) {
+		return fmt.Errorf("format_rule %s is not in allowed_formats", t.FormatRule)
+	}
+	if t.DefaultFormat != "" {
+		// SVG 只能透传矢量原图, 不能作为任意原图的默认格式
+		if t.DefaultFormat == ".svg" || !slices.Contains(outputFormats, t.DefaultFormat) {
+			return fmt.Errorf("invalid default_format: %s", t.DefaultFormat)
+		}
+		if !t.formatAllowed(t.DefaultFormat) {
+			return fmt.Errorf("default_format %s is not in allowed_formats", t.DefaultFormat)
+		}
+	}
+	if t.DefaultVariant != "" {
+		matches := t.regex.FindStringSubmatch("/" + t.DefaultVariant + "/x.jpg")
+		if matches == nil || matches[1] != t.DefaultVariant {
+			return fmt.Errorf("invalid default_variant: %s", t.DefaultVariant)
+		}
+		// 模式位于 WxH 形式或单一尺寸形式的分组中, 另一个为空
+		if _, ok := cropModeMap[matches[2]+matches[5]]; !ok {
+			return fmt.Errorf("invalid default_variant mode: %s", matches[2]+matches[5])
+		}
+	}
 	return nil
 }
 
+// thumbRequest 解析后的缩略图请求
+type thumbRequest struct {
+	modeDir        string       // 模式目录, 如 c200x200,q85
+	mode           string       // 模式字符
+	width          int          // 目标宽度
+	height         int          // 目标高度
+	bgColor        color.Color  // 背景颜色
+	quality        float32      // 输出质量, WebP 支持小数, JPEG 四舍五入为整数
+	qualityPreset  string       // URL 中的具名质量, 输出格式确定后按格式取值
+	imagePath      string       // 原始图片路径(相对)
+	format         string       // 输出格式(扩展名)
+	formatInferred bool         // 输出格式不是取自 URL 扩展名, 追加在原图路径之后
+	thumbPath      string       // 缩略图存储路径
+	originalPath   string       // 原始图片存储路径
+	shortCache     bool         // 是否使用短缓存(可变图片)
+	maxBytes       int          // 输出字节预算, 0 表示不限制
+	budgetExceeded bool         // 字节预算在 min_quality 下仍无法满足, 返回的是最低质量的结果
+	tile           *tileSpec    // 瓦片坐标, 仅瓦片请求有效
+	widthPercent   bool         // width 为原图宽度的百分比
+	heightPercent  bool         // height 为原图高度的百分比
+	ops            []pipelineOp // 缩放后依次执行的操作
+	nearLossless   *int         // URL 中指定的 WebP 近无损等级, 覆盖 webp_near_lossless
+	focal          *focalPoint  // 裁剪焦点, 覆盖裁剪模式的锚点
+	checker        bool         // 使用棋盘格背景代替纯色背景
+	fallbackFormat string       // 开启 encode_fallback 且请求的格式编码失败时实际输出的格式
+	dither         int          // 抖动减色时每个通道的色阶数, 0 表示不减色
+	download       string       // ?download 指定的下载文件名, 为空时内联显示
+	sourceToken    string       // 读取原图时转交给存储的凭据, 来自 source_token_header
+}
+
+// thumbResult 生成并缓存后的缩略图
+type thumbResult struct {
+	data      []byte // 编码后的缩略图
+	storePath string // 缩略图实际存储路径
+	lqip      []byte // 低质量占位图, 未开启 lqip 时为空
+	color     string // 平均颜色, 未开启 color_header 时为空
+	storeErr  error  // 写入缓存失败的错误, 不影响本次响应
+}
+
 // ServeHTTP 处理HTTP请求
 func (t ThumbsServer) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	// 解析请求路径，提取模式、尺寸信息和原始图片路径
-	path := r.URL.Path
-	matches := t.regex.FindStringSubmatch(path)
-
-	if len(matches) < 8 {
-		return caddyhttp.Error(http.StatusNotFound, errors.New("invalid thumbnail request format"))
+	err := t.serveRequest(w, r)
+	if err != nil && t.ErrorResponse != "" {
+		return t.writeErrorResponse(w, r, err)
 	}
+	return err
+}
 
-	modeDir := matches[1]
-	mode := matches[2] // 获取模式字符
-	width, _ := strconv.Atoi(matches[3])
-	height, _ := strconv.Atoi(matches[4])
-	bgColorHex := matches[5]
-	qualityStr := matches[6]
-	imagePath := matches[8]
-	format := matches[9]
+// serveRequest 处理缩略图及各接口请求
+func (t ThumbsServer) serveRequest(w http.ResponseWriter, r *http.Request) (err error) {
+	// 过长的路径在正则匹配之前直接拒绝
+	if t.MaxPathLength > 0 && len(r.URL.Path) > t.MaxPathLength {
+		return caddyhttp.Error(http.StatusRequestURITooLong, fmt.Errorf("request path length %d exceeds max_path_length %d", len(r.URL.Path), t.MaxPathLength))
+	}
+	// 预生成接口
+	if t.Pregenerate != nil && r.URL.Path == t.Pregenerate.Path {
+		return t.servePregenerate(w, r)
+	}
+	// srcset 接口
+	if t.Srcset != nil && r.URL.Path == t.Srcset.Path {
+		return t.serveSrcset(w, r)
+	}
+	// BlurHash 接口
+	if t.BlurHashPath != "" && r.URL.Path == t.BlurHashPath {
+		return t.serveBlurHash(w, r)
+	}
+	// 运行时统计接口
+	if t.DebugPath != "" && r.URL.Path == t.DebugPath {
+		return t.serveDebug(w, r)
+	}
+	// 缓存统计接口
+	if t.CacheStatsPath != "" && r.URL.Path == t.CacheStatsPath {
+		return t.serveCacheStats(w, r)
+	}
+	// 能力查询接口
+	if t.CapabilitiesPath != "" && r.URL.Path == t.CapabilitiesPath {
+		return t.serveCapabilities(w, r)
+	}
 
-	// 验证尺寸是否超过限制
-	if err := t.validateDimensions(width, height); err != nil {
-		t.logger.Warn("Dimension validation failed", zap.Error(err))
-		return caddyhttp.Error(http.StatusBadRequest, err)
+	// 缩略图只支持 GET 和 HEAD, OPTIONS(包括 CORS 预检)返回允许的方法
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions:
+		w.Header().Set("Allow", thumbAllowedMethods)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		w.Header().Set("Allow", thumbAllowedMethods)
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
 	}
 
-	// 解析质量参数
-	quality := t.DefaultQuality
-	if qualityStr != "" {
-		if q, err := strconv.Atoi(qualityStr); err == nil && q >= 0 && q <= 100 {
-			quality = q
-		}
+	// 解析请求路径，提取模式、尺寸信息和原始图片路径
+	req, err := t.parseRequest(r.URL.Path, r.URL.Query())
+	if err != nil {
+		return err
+	}
+	setContentSecurityHeaders(w)
+	t.applyCacheKey(w, r, req)
+	req.sourceToken = t.sourceToken(r)
+	// 只记录成功的请求, 并记录分区和凭据, 预热时按相同的缓存键生成. 禁止生成的请求不记录, 避免缓存预热替爬虫生成缩略图
+	denied := t.generationDenied(r)
+	if t.warmer != nil && !denied {
+		defer func() {
+			if err == nil {
+				t.warmer.record(t.recentRequest(r))
+			}
+		}()
 	}
 
-	// 解析背景颜色
-	var bgColor color.Color = color.White
-	if bgColorHex != "" {
-		if c, err := parseHexColor(bgColorHex); err == nil {
-			bgColor = c
-		}
+	// HEAD 请求只返回尺寸等信息, 尽量不生成缩略图
+	if r.Method == http.MethodHead {
+		return t.serveHead(w, r, req, denied)
 	}
 
-	// 构建缩略图路径和原始图片路径
-	thumbPath := filepath.Join("/", modeDir, imagePath)
-	originalPath := filepath.Join("/", imagePath)
+	// 强制重新生成时忽略已有缓存
+	refresh, err := t.refreshRequested(r)
+	if err != nil {
+		return err
+	}
 
 	// 检查缩略图是否已存在
-	if t.thumbsStorage.Exists(t.ctx, thumbPath) {
-		t.logger.Info("Serving existing thumbnail", zap.String("path", thumbPath))
+	cachedPath, cached := t.lookupCache(req)
+	if cached && !refresh {
+		if err := t.requireSource(req); err != nil {
+			return err
+		}
+		t.logger.Info("Serving existing thumbnail", zap.String("path", cachedPath))
+		t.stats.hits.Add(1)
+		t.setDebugHeaders(w, req, "HIT", 0)
+
+		// 条件请求先比对校验信息, 客户端缓存有效时不必读取缩略图
+		if t.serveNotModified(w, r, req, cachedPath) {
+			return nil
+		}
 
-		gobytes, err := t.thumbsStorage.Load(t.ctx, thumbPath)
+		gobytes, err := t.loadThumb(cachedPath)
 		if err != nil {
 			return caddyhttp.Error(http.StatusInternalServerError, err)
 		}
 		reader := bytes.NewReader(gobytes)
+		w.Header().Set("ETag", thumbETag(gobytes))
+
+		// 读取缓存的低质量占位图
+		if t.LQIP {
+			if lqip, err := t.loadThumb(req.thumbPath + lqipSuffix); err == nil {
+				w.Header().Set(lqipHeader, base64.StdEncoding.EncodeToString(lqip))
+			}
+		}
+		// 读取缓存的平均颜色
+		if t.ColorHeader {
+			if avg, err := t.loadThumb(req.thumbPath + colorSuffix); err == nil {
+				w.Header().Set(colorHeader, string(avg))
+			}
+		}
 
 		// 设置缓存头,写出文件内容
-		t.setCacheHeaders(w)
-		http.ServeContent(w, r, filepath.Base(thumbPath), time.Now(), reader)
+		t.setCacheHeaders(w, req)
+		http.ServeContent(w, r, filepath.Base(cachedPath), time.Now(), reader)
 		return nil
 	}
 
-	t.logger.Info("Thumbnail not found, generating new one", zap.String("path", thumbPath))
-
-	// 检查原始图片是否存在
-	if !t.imageStorage.Exists(t.ctx, originalPath) {
-		t.logger.Error("Original image not found", zap.String("path", originalPath))
-		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("original image not found: %s", imagePath))
+	t.stats.misses.Add(1)
+	// 禁止生成的 User-Agent 只能读取已有缓存
+	if denied {
+		t.logger.Debug("Thumbnail generation denied for user agent", zap.String("path", req.thumbPath), zap.String("user_agent", r.UserAgent()))
+		return t.denyGeneration(r, req)
 	}
+	t.logger.Info("Thumbnail not found, generating new one", zap.String("path", req.thumbPath))
 
-	// 从存储中读取原始图片
-	gobytes, err := t.imageStorage.Load(t.ctx, imagePath)
-	if err != nil {
-		return caddyhttp.Error(http.StatusInternalServerError, err)
+	// 有同模式的更大尺寸缓存时缩放后返回近似结果, 强制重新生成的请求仍然生成精确尺寸
+	if t.Approximate != nil && !refresh {
+		if data, fromDir, ok := t.approximateFromCache(req); ok {
+			return t.serveApproximate(w, r, req, data, fromDir)
+		}
 	}
-	reader := bytes.NewReader(gobytes)
 
-	result, err := t.generateThumbnail(reader, uint(width), uint(height), mode, bgColor, quality, format)
-	if err != nil {
-		t.logger.Error("Failed to generate thumbnail", zap.Error(err))
-		return fmt.Errorf("unsupported thumbnail mode: %s", mode)
+	// 异步生成时在后台生成, 立即返回 202, 强制重新生成的请求仍然同步处理
+	if t.async != nil && !refresh {
+		t.setDebugHeaders(w, req, "MISS", 0)
+		return t.serveAsync(w, req)
 	}
 
-	t.logger.Info("Generated and served new thumbnail",
-		zap.String("path", thumbPath),
-		zap.String("mode", mode),
-		zap.Int("quality", quality),
-		zap.String("format", format))
+	// 存储支持流式写入时边编码边写入存储和响应
+	if t.canStream(req) {
+		return t.streamThumb(w, req)
+	}
 
-	// 保存缩略图到存储
-	err = t.thumbsStorage.Store(t.ctx, thumbPath, result)
+	start := time.Now()
+	result, err := t.renderThumb(req)
 	if err != nil {
-		return caddyhttp.Error(http.StatusInternalServerError, err)
+		return err
+	}
+	t.setDebugHeaders(w, req, "MISS", time.Since(start))
+	// 重新生成的缩略图可能存放在不同的路径(如 prefer_smaller 改变了输出格式), 删除旧的缓存
+	if refresh && cached && cachedPath != result.storePath {
+		if err := t.deleteThumbSet(cachedPath); err != nil {
+			t.logger.Warn("Failed to delete stale thumbnail", zap.String("path", cachedPath), zap.Error(err))
+		}
+	}
+
+	if result.lqip != nil {
+		w.Header().Set(lqipHeader, base64.StdEncoding.EncodeToString(result.lqip))
+	}
+	if result.color != "" {
+		w.Header().Set(colorHeader, result.color)
+	}
+	if req.budgetExceeded {
+		w.Header().Set(budgetExceededHeader, strconv.Itoa(len(result.data)))
+	}
+	// 降级结果使用短缓存, 以便编码恢复正常后客户端重新获取
+	if req.fallbackFormat != "" {
+		w.Header().Set(encodeFallbackHeader, strings.TrimPrefix(req.format, "."))
+		req.shortCache = true
 	}
 
 	// 发送缩略图到客户端
-	t.setCacheHeaders(w)
-	http.ServeContent(w, r, filepath.Base(thumbPath), time.Now(), bytes.NewReader(result))
+	w.Header().Set("ETag", thumbETag(result.data))
+	t.setCacheHeaders(w, req)
+	http.ServeContent(w, r, filepath.Base(result.storePath), time.Now(), bytes.NewReader(result.data))
 	return nil
 }
 
-// setCacheHeaders 设置缓存头
-func (t ThumbsServer) setCacheHeaders(w http.ResponseWriter) {
-	if t.CacheControl != "" {
-		w.Header().Set("Cache-Control", t.CacheControl)
-		w.Header().Set("Expires", time.Now().AddDate(1, 0, 0).Format(http.TimeFormat))
-	}
-}
+// refreshHeader 强制重新生成时携带密钥的请求头
+const refreshHeader = "X-Thumbs-Refresh-Secret"
 
-// validateDimensions 验证尺寸是否超过限制
-func (t ThumbsServer) validateDimensions(width, height int) error {
-	if width > t.MaxDimension || height > t.MaxDimension {
-		return fmt.Errorf("dimensions too large: %dx%d (max: %dx%d)", width, height, t.MaxDimension, t.MaxDimension)
+// refreshRequested 判断请求是否要求强制重新生成, 未配置 refresh_secret 时忽略 refresh 参数, 密钥错误返回 403
+func (t ThumbsServer) refreshRequested(r *http.Request) (bool, error) {
+	if t.RefreshSecret == "" || t.NoCache || r.URL.Query().Get("refresh") != "1" {
+		return false, nil
 	}
-
-	if width <= 0 || height <= 0 {
-		return fmt.Errorf("invalid dimensions: %dx%d", width, height)
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(refreshHeader)), []byte(t.RefreshSecret)) != 1 {
+		return false, caddyhttp.Error(http.StatusForbidden, errors.New("invalid refresh secret"))
 	}
-
-	return nil
+	t.logger.Info("Forced thumbnail refresh", zap.String("path", r.URL.Path))
+	return true, nil
 }
 
-func (t ThumbsServer) generateThumbnail(reader io.Reader, width, height uint, mode string, bgColor color.Color, quality int, format string) (buf []byte, err error) {
-	// 解码图片
-	var img image.Image
-	img, err = t.decodeImage(reader)
-	if err != nil {
-		return nil, err
+// thumbAllowedMethods 缩略图请求允许的方法
+const thumbAllowedMethods = "GET, HEAD, OPTIONS"
+
+const (
+	debugCacheHeader = "X-Thumbs-Cache"  // HIT 或 MISS
+	debugModeHeader  = "X-Thumbs-Mode"   // 请求的模式
+	debugGenMsHeader = "X-Thumbs-Gen-Ms" // 生成耗时(毫秒), 仅未命中缓存时返回
+)
+
+// setDebugHeaders 开启 debug_headers 时写入缓存诊断头, genTime 为 0 时不写入生成耗时
+func (t ThumbsServer) setDebugHeaders(w http.ResponseWriter, req *thumbRequest, cache string, genTime time.Duration) {
+	if !t.DebugHeaders {
+		return
 	}
-	// 解析裁剪模式
-	modeId, ok := cropModeMap[mode]
-	if !ok {
-		return nil, fmt.Errorf("unsupported thumbnail mode: %s", mode)
+	w.Header().Set(debugCacheHeader, cache)
+	mode := req.mode
+	if req.tile != nil {
+		mode = "tile"
 	}
-	// 根据模式生成缩略图
-	switch modeId {
-	case SCALE_MODE_M:
-		newImg := resize.Thumbnail(width, height, img, resize.Lanczos3)
-		return t.encodeImage(newImg, quality, format)
-	case SCALE_MODE_WLT, SCALE_MODE_WLC, SCALE_MODE_WLB, SCALE_MODE_WRT, SCALE_MODE_WRC, SCALE_MODE_WRB, SCALE_MODE_WCC, SCALE_MODE_WCT, SCALE_MODE_WCB:
-		newImg := t.generateThumbnailModeW(img, width, height, bgColor, modeId)
-		return t.encodeImage(newImg, quality, format)
-	case CROP_MODE_LEFTTOP, CROP_MODE_LEFTMIDDLE, CROP_MODE_LEFTBOTTOM, CROP_MODE_RIGHTTOP, CROP_MODE_RIGHTMIDDLE, CROP_MODE_RIGHTBOTTOM, CROP_MODE_CENTERTOP, CROP_MODE_CENTERCENTER, CROP_MODE_CENTERBOTTOM:
-		newImg := t.generateThumbnailModeCrop(img, width, height, modeId)
-		return t.encodeImage(newImg, quality, format)
+	w.Header().Set(debugModeHeader, mode)
+	if genTime > 0 {
+		w.Header().Set(debugGenMsHeader, strconv.FormatInt(genTime.Milliseconds(), 10))
 	}
-	return nil, fmt.Errorf("unsupported thumbnail mode: %s", mode)
 }
 
-// generateThumbnailModeW 模式w：保持纵横比，缩放到目标尺寸以内，然后将不足的部分填充为指定颜色
-func (t ThumbsServer) generateThumbnailModeW(img image.Image, width, height uint, bgColor color.Color, modeId int) image.Image {
-	// 生成缩略图（保持纵横比）
-	resized := resize.Thumbnail(width, height, img, resize.Lanczos3)
+// encodeFallbackHeader 请求的格式编码失败、改用 JPEG 输出时的响应头, 内容为编码失败的格式
+const encodeFallbackHeader = "X-Thumbs-Encode-Fallback"
 
-	// 创建目标大小的画布,根据颜色值填充背景色
-	canvas := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
-	draw.Draw(canvas, canvas.Bounds(), &image.Uniform{bgColor}, image.Point{}, draw.Src)
-	var (
-		resizedBounds                   = resized.Bounds()
-		resizedWidth, resizedHeight     = resizedBounds.Dx(), resizedBounds.Dy()
-		x, y                        int = (int(width) - resizedWidth) / 2, (int(height) - resizedHeight) / 2
-	)
-	if resizedWidth == int(width) {
-		x = 0
-		switch modeId {
-		case SCALE_MODE_WLT, SCALE_MODE_WCT, SCALE_MODE_WRT:
-			y = 0
-		case SCALE_MODE_WLC, SCALE_MODE_WCC, SCALE_MODE_WRC:
-			y = (int(height) - resizedHeight) / 2
-		case SCALE_MODE_WLB, SCALE_MODE_WRB, SCALE_MODE_WCB:
-			y = (int(height) - resizedHeight)
-		}
-	}
-	if resizedHeight == int(height) {
-		y = 0
-		switch modeId {
-		case SCALE_MODE_WLT, SCALE_MODE_WRT, SCALE_MODE_WCT:
-			x = 0
-		case SCALE_MODE_WLC, SCALE_MODE_WCC, SCALE_MODE_WRC:
-			x = (int(width) - resizedWidth) / 2
-		case SCALE_MODE_WLB, SCALE_MODE_WRB, SCALE_MODE_WCB:
-			x = (int(width) - resizedWidth)
-		}
+// budgetExceededHeader 字节预算在 min_quality 下仍无法满足时的响应头, 内容为实际字节数
+const budgetExceededHeader = "X-Thumbs-Budget-Exceeded"
+
+const (
+	cacheBucketPrefix  = "@"       // 缓存分区目录的前缀, 与模式目录区分
+	defaultCacheBucket = "default" // 请求未携带 cache_key_header 时使用的分区
+	// inferredFormatSuffix 输出格式不是取自 URL 扩展名时缓存目录的后缀. URL 中的模式目录不能包含 @,
+	// 推断格式的缩略图(如 foo 按 format_rule 输出为 foo.jpg)不会与同名原图(foo.jpg)的缩略图共用缓存
+	inferredFormatSuffix = "@"
+)
+
+// cacheBucketPattern 可以直接作为目录名的分区值, 其他值使用哈希
+var cacheBucketPattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]{0,63}$`)
+
+// applyCacheKey 按 cache_key_header 请求头的值将缩略图缓存到独立的分区目录, 原图路径不变
+func (t ThumbsServer) applyCacheKey(w http.ResponseWriter, r *http.Request, req *thumbRequest) {
+	if t.CacheKeyHeader == "" {
+		return
 	}
-	// 将缩略图绘制到画布上
-	draw.Draw(canvas, image.Rect(x, y, x+resizedWidth, y+resizedHeight), resized, image.Point{0, 0}, draw.Over)
-	return canvas
+	w.Header().Add("Vary", t.CacheKeyHeader)
+	t.applyCacheBucket(r, req)
 }
 
-func (t ThumbsServer) generateThumbnailModeCrop(img image.Image, width, height uint, cropMode int) image.Image {
-	// 原始尺寸
-	origBounds := img.Bounds()
-	origWidth := uint(origBounds.Dx())
-	origHeight := uint(origBounds.Dy())
+// applyCacheBucket 将缩略图路径放到请求所属的缓存分区目录中, 不设置响应头
+func (t ThumbsServer) applyCacheBucket(r *http.Request, req *thumbRequest) {
+	if t.CacheKeyHeader == "" {
+		return
+	}
+	t.setCacheBucket(req, r.Header.Get(t.CacheKeyHeader))
+}
+
+// setCacheBucket 按 cache_key_header 请求头的值将缩略图路径放到分区目录中
+func (t ThumbsServer) setCacheBucket(req *thumbRequest, bucket string) {
+	switch {
+	case bucket == "":
+		bucket = defaultCacheBucket
+	case !cacheBucketPattern.MatchString(bucket):
+		sum := sha256.Sum256([]byte(bucket))
+		bucket = hex.EncodeToString(sum[:8])
+	}
+	req.thumbPath = path.Join("/", cacheBucketPrefix+bucket, req.thumbPath)
+}
+
+// parseRequest 解析请求路径和查询参数, 提取模式、尺寸信息和原始图片路径
+func (t ThumbsServer) parseRequest(path string, query url.Values) (*thumbRequest, error) {
+	if t.NormalizePath {
+		path = normalizeRequestPath(path)
+	}
+	path = t.stripPathPrefix(path)
+
+	// 瓦片请求使用单独的路径格式
+	if req, err := t.parseTileRequest(path); req != nil || err != nil {
+		return req, err
+	}
+
+	matches := t.regex.FindStringSubmatch(path)
+	// 不带模式目录的原图路径按 default_variant 生成, 与显式请求该模式目录的缩略图共用缓存
+	if matches == nil && t.DefaultVariant != "" {
+		matches = t.regex.FindStringSubmatch("/" + t.DefaultVariant + "/" + strings.TrimPrefix(path, "/"))
+	}
+
+	if len(matches) < 12 || (matches[11] == "" && t.FormatRule == "" && t.DefaultFormat == "") {
+		return nil, caddyhttp.Error(http.StatusNotFound, errors.New("invalid thumbnail request format"))
+	}
+
+	req := &thumbRequest{
+		modeDir:   matches[1],
+		mode:      matches[2], // 获取模式字符
+		imagePath: matches[10],
+		format:    t.normalizeFormat(matches[11]),
+	}
+	if matches[5] != "" {
+		// long/short 只有一个尺寸, 宽高都记为该尺寸, 生成时按原图纵横比换算
+		req.mode = matches[5]
+		req.width, _ = strconv.Atoi(matches[6])
+		req.height = req.width
+	} else {
+		if modeId := cropModeMap[req.mode]; modeId == SCALE_MODE_LONG || modeId == SCALE_MODE_SHORT {
+			return nil, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("mode %s takes a single size, e.g. %s800", req.mode, req.mode))
+		}
+		req.width, req.widthPercent = parseDimension(matches[3])
+		req.height, req.heightPercent = parseDimension(matches[4])
+	}
+	t.roundSize(req, matches)
+	bgColorHex := matches[7]
+	qualityStr := matches[8]
+	if err := parseFlags(req, matches[9]); err != nil {
+		return nil, caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	// 没有扩展名(且未配置 format_rule)或扩展名不是支持的输出格式时使用 default_format, 扩展名保留在原图路径中
+	useDefault := t.DefaultFormat != "" &&
+		((req.format == "" && t.FormatRule == "") || (req.format != "" && !slices.Contains(outputFormats, req.format)))
+	if useDefault {
+		req.format = ""
+	}
+	// HEIC、PDF 原图只能解码, 扩展名为 .heic/.heif/.pdf 时按 format_rule 输出, 未配置或为 source 时输出 JPEG
+	decodeOnly := !useDefault && slices.Contains(decodeOnlyFormats, strings.ToLower(req.format))
+	if decodeOnly {
+		req.format = t.FormatRule
+		if req.format == "" || req.format == FORMAT_RULE_SOURCE {
+			req.format = decodeOnlyOutputFormat
+		}
+	}
+
+	// 检查输出格式是否允许
+	if req.format != "" && !t.formatAllowed(req.format) {
+		return nil, caddyhttp.Error(http.StatusUnsupportedMediaType, fmt.Errorf("output format not allowed: %s", req.format))
+	}
+
+	// 验证尺寸是否超过限制, 百分比尺寸需要解码原图后换算, 此处只检查是否为正数
+	checkWidth, checkHeight := req.width, req.height
+	if req.widthPercent {
+		checkWidth = min(checkWidth, 1)
+	}
+	if req.heightPercent {
+		checkHeight = min(checkHeight, 1)
+	}
+	if err := t.validateDimensions(req.mode, checkWidth, checkHeight); err != nil {
+		t.logger.Warn("Dimension validation failed", zap.Error(err))
+		return nil, caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	// 解析质量参数, strict_quality 时超出范围的质量返回 400 而不是使用默认质量
+	// 具名质量按预设取值, 未知的预设名与超出范围的质量一样处理
+	if qualityPresetName.MatchString(qualityStr) {
+		q, ok := t.presetQuality(qualityStr, req.format)
+		if !ok && t.StrictQuality {
+			return nil, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("unknown quality preset: q%s", qualityStr))
+		}
+		if ok {
+			req.quality, req.qualityPreset = q, qualityStr
+		} else {
+			req.quality = float32(t.DefaultQuality)
+		}
+	} else {
+		if t.StrictQuality && qualityStr != "" {
+			if q, err := strconv.ParseFloat(qualityStr, 32); err != nil || q < 0 || q > 100 {
+				return nil, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("quality must be between 0 and 100: q%s", qualityStr))
+			}
+		}
+		req.quality = parseQuality(qualityStr, t.DefaultQuality)
+	}
+	t.clampQuality(req)
+
+	// 解析操作流水线
+	ops, err := parsePipeline(req.modeDir, t.pipelineOps)
+	if err != nil {
+		return nil, caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	req.ops = ops
+
+	// 解析背景颜色
+	req.bgColor = color.White
+	if bgColorHex != "" {
+		if c, err := parseHexColor(bgColorHex); err == nil {
+			req.bgColor = c
+		}
+	}
+
+	// 解析字节预算参数
+	if v := query.Get("maxbytes"); v != "" {
+		maxBytes, err := strconv.Atoi(v)
+		if err != nil || maxBytes <= 0 {
+			return nil, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid maxbytes: %s", v))
+		}
+		req.maxBytes = maxBytes
+	}
+
+	// 构建缩略图路径和原始图片路径, 字节预算会影响输出, 需要体现在缓存路径中
+	cacheDir := req.modeDir
+	if req.maxBytes > 0 {
+		cacheDir += ",b" + strconv.Itoa(req.maxBytes)
+	}
+	// 推断的输出格式追加在原图路径之后
+	if req.format == "" || decodeOnly {
+		req.formatInferred = true
+		cacheDir += inferredFormatSuffix
+	}
+	req.thumbPath = filepath.Join("/", cacheDir, req.imagePath)
+
+	// URL 未带扩展名时按 format_rule 推断输出格式, source 规则需要读取原图后才能确定
+	if decodeOnly {
+		req.thumbPath += req.format
+	} else if req.format == "" && (useDefault || t.FormatRule != FORMAT_RULE_SOURCE) {
+		req.format = t.FormatRule
+		if useDefault {
+			req.format = t.DefaultFormat
+		}
+		req.thumbPath += req.format
+		t.applyQualityPreset(req)
+		t.clampQuality(req)
+	}
+	req.originalPath = filepath.Join("/", req.imagePath)
+	if query.Has("download") {
+		req.download = downloadName(query.Get("download"), req)
+	}
+
+	if t.StrictTokens {
+		if err := t.checkTokens(req, bgColorHex != "", qualityStr != ""); err != nil {
+			return nil, caddyhttp.Error(http.StatusBadRequest, err)
+		}
+	}
+	return req, nil
+}
+
+// loadSource 读取原图并依次执行配置的原图处理器, 解码、格式检查等都使用处理后的数据
+func (t ThumbsServer) loadSource(imagePath, token string) ([]byte, error) {
+	data, err := t.readSource(imagePath, token)
+	if err != nil || len(t.transformers) == 0 {
+		return data, err
+	}
+	return t.transformSource(imagePath, data)
+}
+
+// readSource 按顺序从原图存储中读取原始图片, 原图不存在或读取出错时尝试下一个存储.
+// 带凭据时实现了 TokenStorage 的存储使用凭据读取
+func (t ThumbsServer) readSource(imagePath, token string) ([]byte, error) {
+	var (
+		originalPath = filepath.Join("/", imagePath)
+		lastErr      error
+	)
+	// 优先从归档中查找, 归档中没有的原图继续在存储中查找
+	if t.archive != nil {
+		data, ok, err := t.archive.load(imagePath)
+		if err != nil {
+			t.logger.Warn("Failed to load original image from archive", zap.String("path", originalPath), zap.Error(err))
+			lastErr = err
+		} else if ok {
+			if len(data) == 0 {
+				return nil, corruptSourceError(imagePath, "empty file")
+			}
+			return data, nil
+		}
+	}
+	for i, storage := range t.imageStorages {
+		var (
+			gobytes []byte
+			err     error
+		)
+		if tokenStorage, ok := storage.(TokenStorage); ok && token != "" {
+			// 私有存储不带凭据时无法检查是否存在, 直接读取
+			gobytes, err = tokenStorage.LoadWithToken(t.ctx, imagePath, token)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+		} else {
+			// 检查原始图片是否存在
+			if !storage.Exists(t.ctx, originalPath) {
+				continue
+			}
+			// 从存储中读取原始图片
+			gobytes, err = storage.Load(t.ctx, imagePath)
+		}
+		if err != nil {
+			t.logger.Warn("Failed to load original image", zap.String("path", originalPath), zap.Int("storage", i), zap.Error(err))
+			lastErr = err
+			continue
+		}
+		if len(gobytes) == 0 {
+			return nil, corruptSourceError(imagePath, "empty file")
+		}
+		return gobytes, nil
+	}
+	if lastErr != nil {
+		return nil, caddyhttp.Error(http.StatusInternalServerError, lastErr)
+	}
+	t.logger.Error("Original image not found", zap.String("path", originalPath))
+	return nil, caddyhttp.Error(http.StatusNotFound, fmt.Errorf("original image not found: %s", imagePath))
+}
+
+// corruptSourceError 原图为空或损坏(如文件被截断)时返回 422, 与不支持的格式(415)区分
+func corruptSourceError(imagePath, reason string) error {
+	return caddyhttp.Error(http.StatusUnprocessableEntity, fmt.Errorf("corrupt or empty source %s: %s", imagePath, reason))
+}
+
+// checkSourceType 检查原图的实际格式是否与扩展名一致, 扩展名不是已知的原图格式时不检查
+func (t ThumbsServer) checkSourceType(imagePath string, data []byte) error {
+	ext := formatKey(filepath.Ext(imagePath))
+	if !slices.Contains(sourceFormats, ext) {
+		return nil
+	}
+	sniffed := sniffFormat(data[:min(len(data), sniffHeaderSize)], t.ContainerFormatOrder)
+	if sniffed == ext {
+		return nil
+	}
+	t.logger.Warn("Source content does not match its extension",
+		zap.String("path", imagePath), zap.String("extension", ext), zap.String("sniffed", sniffed))
+	if t.StrictSourceType {
+		return caddyhttp.Error(http.StatusUnsupportedMediaType, fmt.Errorf("source %s is not a valid %s image", imagePath, ext))
+	}
+	return nil
+}
+
+// renderThumb 读取原图生成缩略图并写入缓存
+func (t ThumbsServer) renderThumb(req *thumbRequest) (*thumbResult, error) {
+	defer t.stats.begin(req.thumbPath)()
+
+	// 优先从同尺寸、同模式的其他格式缓存转码
+	if t.TranscodeFromCache && req.format != "" && req.formatInferred {
+		if result := t.transcodeFromCache(req); result != nil {
+			return result, nil
+		}
+	}
+
+	gobytes, err := t.loadSource(req.imagePath, req.sourceToken)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.checkSourceType(req.imagePath, gobytes); err != nil {
+		return nil, err
+	}
+	reader := bytes.NewReader(gobytes)
+
+	// 输出格式与原图格式一致
+	if req.format == "" {
+		if req.format = sniffFormat(gobytes[:min(len(gobytes), sniffHeaderSize)], t.ContainerFormatOrder); req.format == "" {
+			return nil, caddyhttp.Error(http.StatusUnsupportedMediaType, errors.New("unsupported image format"))
+		}
+		if slices.Contains(decodeOnlyFormats, req.format) {
+			req.format = decodeOnlyOutputFormat
+		}
+		if !t.formatAllowed(req.format) {
+			return nil, caddyhttp.Error(http.StatusUnsupportedMediaType, fmt.Errorf("output format not allowed: %s", req.format))
+		}
+		req.thumbPath += req.format
+		t.applyQualityPreset(req)
+		t.clampQuality(req)
+	}
+	t.matchSourceQuality(req, gobytes)
+
+	data, thumb, err := t.generateThumbnail(reader, req)
+	if err != nil {
+		t.logger.Error("Failed to generate thumbnail", zap.Error(err))
+		var handlerErr caddyhttp.HandlerError
+		if errors.As(err, &handlerErr) {
+			return nil, handlerErr
+		}
+		return nil, fmt.Errorf("unsupported thumbnail mode: %s", req.mode)
+	}
+	// 编码结果已复制, 返回前回收画布
+	defer releaseCanvas(thumb)
+	result := &thumbResult{data: data, storePath: req.thumbPath}
+	actualFormat := req.format
+
+	// 降级编码的结果不缓存, 下一次请求重新尝试请求的格式
+	if req.fallbackFormat != "" {
+		result.storePath = req.thumbPath + req.fallbackFormat
+		return result, nil
+	}
+
+	// 小图改用传统格式输出, 缓存键追加实际格式后缀
+	if thumb != nil && t.belowModernThreshold(req.format, len(gobytes), len(result.data)) {
+		result.data, actualFormat = t.legacyFallback(thumb, result.data, req.quality, req.format)
+	}
+	// 如果 JPEG 更小则改用 JPEG 输出, 缓存键追加实际格式后缀
+	if t.PreferSmaller && thumb != nil {
+		result.data, actualFormat = t.preferSmaller(thumb, result.data, req.quality, actualFormat)
+	}
+	if actualFormat != req.format {
+		result.storePath = req.thumbPath + actualFormat
+	}
+
+	t.logger.Info("Generated and served new thumbnail",
+		zap.String("path", result.storePath),
+		zap.String("mode", req.mode),
+		zap.Float32("quality", req.quality),
+		zap.String("format", req.format))
+
+	// 生成低质量占位图, 与缩略图一同缓存
+	companions := t.thumbMetaEntries(result.storePath, thumbETag(result.data))
+	if t.LQIP && thumb != nil {
+		if lqip, err := makeLQIP(thumb); err != nil {
+			t.logger.Warn("Failed to generate LQIP", zap.String("path", req.thumbPath), zap.Error(err))
+		} else {
+			companions = append(companions, thumbEntry{key: req.thumbPath + lqipSuffix, data: lqip})
+			result.lqip = lqip
+		}
+	}
+	// 计算平均颜色, 与缩略图一同缓存
+	if t.ColorHeader && thumb != nil {
+		result.color = averageColor(thumb)
+		companions = append(companions, thumbEntry{key: req.thumbPath + colorSuffix, data: []byte(result.color)})
+	}
+
+	// 保存缩略图到存储, 保存失败时仍然返回生成的缩略图
+	if !t.reserveVariant(req, result.storePath) {
+		return result, nil
+	}
+	if err := t.storeThumbSet(result.storePath, result.data, companions...); err != nil {
+		t.logger.Error("Failed to store thumbnail", zap.String("path", result.storePath), zap.Error(err))
+		t.forgetVariant(result.storePath)
+		result.storeErr = err
+	}
+	return result, nil
+}
+
+// transcodeFormats transcode_from_cache 查找的候选格式
+var transcodeFormats = []string{".jpg", ".jpeg", ".png", ".webp"}
+
+// transcodeFromCache 查找同一原图同尺寸同模式的其他格式缓存并转码为请求的格式, 找不到或转码失败时返回 nil.
+// 只用于推断输出格式的请求: 其缓存键为原图路径加输出格式, 去掉格式即为原图对应的键, 不会找到其他原图的缩略图.
+// URL 带扩展名时扩展名是原图路径的一部分, a.webp 与 a.jpg 是不同的原图
+func (t ThumbsServer) transcodeFromCache(req *thumbRequest) *thumbResult {
+	if !req.formatInferred {
+		return nil
+	}
+	base := strings.TrimSuffix(req.thumbPath, req.format)
+	for _, ext := range transcodeFormats {
+		if ext == req.format {
+			continue
+		}
+		cachedPath, ok := t.findCachedThumb(base + ext)
+		if !ok {
+			continue
+		}
+		cached, err := t.loadThumb(cachedPath)
+		if err != nil {
+			continue
+		}
+		img, err := t.decodeImage(bytes.NewReader(cached), uint(req.width), uint(req.height))
+		if err != nil {
+			t.logger.Warn("Failed to decode cached thumbnail for transcoding", zap.String("path", cachedPath), zap.Error(err))
+			continue
+		}
+		data, err := t.encodeForRequest(img, req)
+		if err != nil {
+			t.logger.Warn("Failed to transcode cached thumbnail", zap.String("path", cachedPath), zap.Error(err))
+			continue
+		}
+		t.logger.Info("Transcoded thumbnail from cache", zap.String("from", cachedPath), zap.String("path", req.thumbPath))
+		result := &thumbResult{data: data, storePath: req.thumbPath}
+		if req.fallbackFormat != "" {
+			result.storePath = req.thumbPath + req.fallbackFormat
+			return result
+		}
+		if !t.reserveVariant(req, result.storePath) {
+			return result
+		}
+		if err := t.storeThumbSet(result.storePath, data, t.thumbMetaEntries(result.storePath, thumbETag(data))...); err != nil {
+			t.logger.Error("Failed to store thumbnail", zap.String("path", result.storePath), zap.Error(err))
+			t.forgetVariant(result.storePath)
+			result.storeErr = err
+		}
+		return result
+	}
+	return nil
+}
+
+// lookupCache 查找请求对应的缓存, 输出格式尚未确定时逐个尝试候选格式
+func (t ThumbsServer) lookupCache(req *thumbRequest) (string, bool) {
+	if req.format != "" {
+		return t.findCachedThumb(req.thumbPath)
+	}
+	for _, ext := range sourceFormats {
+		if cachedPath, ok := t.findCachedThumb(req.thumbPath + ext); ok {
+			return cachedPath, true
+		}
+	}
+	return "", false
+}
+
+// requireSource 开启 require_source 时检查缓存命中的缩略图的原图是否仍然存在
+func (t ThumbsServer) requireSource(req *thumbRequest) error {
+	if !t.RequireSource || t.sourceExists(req.imagePath) {
+		return nil
+	}
+	return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("original image not found: %s", req.imagePath))
+}
+
+// findCachedThumb 查找已缓存的缩略图, 开启 prefer_smaller 时还会查找降级为 JPEG 的版本
+func (t ThumbsServer) findCachedThumb(thumbPath string) (string, bool) {
+	if t.NoCache {
+		return "", false
+	}
+	if t.thumbsStorage.Exists(t.ctx, thumbPath) {
+		return thumbPath, true
+	}
+	if t.PreferSmaller || (t.MinModernFormatBytes > 0 && isModernFormat(filepath.Ext(thumbPath))) {
+		if jpgPath := thumbPath + ".jpg"; t.thumbsStorage.Exists(t.ctx, jpgPath) {
+			return jpgPath, true
+		}
+	}
+	if t.MinModernFormatBytes > 0 && isModernFormat(filepath.Ext(thumbPath)) {
+		if pngPath := thumbPath + ".png"; t.thumbsStorage.Exists(t.ctx, pngPath) {
+			return pngPath, true
+		}
+	}
+	return "", false
+}
+
+// isModernFormat 判断是否为 min_modern_format_bytes 作用的现代格式
+func isModernFormat(format string) bool {
+	return format == ".webp" || format == ".jxl"
+}
+
+// belowModernThreshold 判断请求的现代格式输出是否应改用传统格式: 原图或输出小于 min_modern_format_bytes
+func (t ThumbsServer) belowModernThreshold(format string, sourceSize, outputSize int) bool {
+	return t.MinModernFormatBytes > 0 && isModernFormat(format) &&
+		(sourceSize < t.MinModernFormatBytes || outputSize < t.MinModernFormatBytes)
+}
+
+// legacyFallback 将小图重新编码为 JPEG, 带透明通道时编码为 PNG, 编码失败时保留原结果
+func (t ThumbsServer) legacyFallback(thumb image.Image, result []byte, quality float32, format string) ([]byte, string) {
+	fallback := ".jpg"
+	if hasAlpha(thumb) {
+		fallback = ".png"
+	}
+	data, err := t.encodeImage(thumb, quality, fallback)
+	if err != nil {
+		t.logger.Warn("Failed to encode fallback for min_modern_format_bytes", zap.String("format", fallback), zap.Error(err))
+		return result, format
+	}
+	return data, fallback
+}
+
+// preferSmaller 同时编码 JPEG, 若 JPEG 比请求格式更小则返回 JPEG 数据, 带透明通道的图片不降级
+func (t ThumbsServer) preferSmaller(thumb image.Image, result []byte, quality float32, format string) ([]byte, string) {
+	if format == ".jpg" || format == ".jpeg" || hasAlpha(thumb) {
+		return result, format
+	}
+	jpg, err := t.encodeImage(thumb, quality, ".jpg")
+	if err != nil {
+		t.logger.Warn("Failed to encode jpeg for prefer_smaller", zap.Error(err))
+		return result, format
+	}
+	if len(jpg) < len(result) {
+		return jpg, ".jpg"
+	}
+	return result, format
+}
+
+// setCacheHeaders 设置缓存头, 带 short 标记的请求使用短缓存且不设置 Expires. 所有返回缩略图的响应都经过这里,
+// 因此下载请求的 Content-Disposition 也在这里设置
+func (t ThumbsServer) setCacheHeaders(w http.ResponseWriter, req *thumbRequest) {
+	if req.download != "" {
+		disposition := mime.FormatMediaType("attachment", map[string]string{"filename": req.download})
+		if disposition == "" {
+			disposition = "attachment"
+		}
+		w.Header().Set("Content-Disposition", disposition)
+	}
+	if req.shortCache {
+		w.Header().Set("Cache-Control", t.ShortCacheControl)
+		return
+	}
+	if t.CacheControl != "" {
+		cacheControl := t.CacheControl
+		if t.Immutable && !strings.Contains(cacheControl, "immutable") {
+			cacheControl += ", immutable"
+		}
+		w.Header().Set("Cache-Control", cacheControl)
+		w.Header().Set("Expires", time.Now().AddDate(1, 0, 0).Format(http.TimeFormat))
+	}
+}
+
+// maxDimensionFor 返回模式的最大尺寸. 优先使用同名的配置, 其次按模式编号匹配同义的模式, 因此 c 的限制同样作用于 cc
+func (t ThumbsServer) maxDimensionFor(mode string) int {
+	if limit, ok := t.ModeMaxDimension[mode]; ok {
+		return limit
+	}
+	modeId, ok := cropModeMap[mode]
+	if !ok {
+		return t.MaxDimension
+	}
+	for name, limit := range t.ModeMaxDimension {
+		if cropModeMap[name] == modeId {
+			return limit
+		}
+	}
+	return t.MaxDimension
+}
+
+// validateDimensions 验证尺寸是否超过限制, 模式配置了 mode_max_dimension 时使用该模式的限制
+func (t ThumbsServer) validateDimensions(mode string, width, height int) error {
+	if limit := t.maxDimensionFor(mode); width > limit || height > limit {
+		return fmt.Errorf("dimensions too large for mode %s: %dx%d (max: %dx%d)", mode, width, height, limit, limit)
+	}
+
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("invalid dimensions: %dx%d", width, height)
+	}
+
+	return nil
+}
+
+// normalizeRequestPath 合并连续的斜杠并去掉末尾的斜杠, 缓存路径同样由规范化后的路径生成
+func normalizeRequestPath(p string) string {
+	for strings.Contains(p, "//") {
+		p = strings.ReplaceAll(p, "//", "/")
+	}
+	if len(p) > 1 {
+		p = strings.TrimSuffix(p, "/")
+	}
+	return p
+}
+
+// stripPathPrefix 去掉 strip_prefix 配置的前缀. 不带前缀的路径(如预生成接口拼出的路径)原样返回
+func (t ThumbsServer) stripPathPrefix(p string) string {
+	if t.StripPrefix == "" || t.StripPrefix == "/" {
+		return p
+	}
+	if rest, ok := strings.CutPrefix(p, t.StripPrefix); ok && strings.HasPrefix(rest, "/") {
+		return rest
+	}
+	return p
+}
+
+// normalizeFormat 开启 normalize_path 时输出格式不区分大小写, 如 .JPG 按 .jpg 处理.
+// 原图路径保持原样, 以便读取大小写敏感的存储
+func (t ThumbsServer) normalizeFormat(format string) string {
+	if t.NormalizePath {
+		return strings.ToLower(format)
+	}
+	return format
+}
+
+// focalPoint 裁剪焦点, 坐标为原图尺寸的百分比
+type focalPoint struct {
+	x, y int
+}
+
+// parseFlags 解析 URL 中以逗号分隔的标记, 如 ,short,nl60,fp30x70
+func parseFlags(req *thumbRequest, flags string) error {
+	for _, flag := range strings.Split(strings.TrimPrefix(flags, ","), ",") {
+		switch {
+		case flag == "":
+		case flag == SHORT_CACHE_FLAG:
+			req.shortCache = true
+		case flag == CHECKER_FLAG:
+			req.checker = true
+		case strings.HasPrefix(flag, DITHER_FLAG):
+			levels := defaultDitherLevels
+			if s := strings.TrimPrefix(flag, DITHER_FLAG); s != "" {
+				n, err := strconv.Atoi(s)
+				if err != nil || n < minDitherLevels || n > maxDitherLevels {
+					return fmt.Errorf("invalid dither levels: %s (must be between %d and %d)", s, minDitherLevels, maxDitherLevels)
+				}
+				levels = n
+			}
+			req.dither = levels
+		case strings.HasPrefix(flag, NEAR_LOSSLESS_FLAG_PREFIX):
+			level := strings.TrimPrefix(flag, NEAR_LOSSLESS_FLAG_PREFIX)
+			n, err := strconv.Atoi(level)
+			if err != nil || n < 0 || n > 100 {
+				return fmt.Errorf("invalid near-lossless level: %s", level)
+			}
+			req.nearLossless = &n
+		case strings.HasPrefix(flag, FOCAL_POINT_FLAG_PREFIX):
+			xs, ys, ok := strings.Cut(strings.TrimPrefix(flag, FOCAL_POINT_FLAG_PREFIX), "x")
+			fx, errX := strconv.Atoi(xs)
+			fy, errY := strconv.Atoi(ys)
+			if !ok || errX != nil || errY != nil || fx < 0 || fx > 100 || fy < 0 || fy > 100 {
+				return fmt.Errorf("invalid focal point: %s", flag)
+			}
+			req.focal = &focalPoint{x: fx, y: fy}
+		}
+	}
+	return nil
+}
+
+// focalOffset 使焦点位于裁剪窗口中央, 并限制在有效范围内
+func focalOffset(percent, scaled, target int) int {
+	offset := scaled*percent/100 - target/2
+	return max(0, min(offset, scaled-target))
+}
+
+// roundSize 开启 size_step 时将像素尺寸取整到步长的倍数, 并改写模式目录中的尺寸, 使相近的尺寸共用缓存.
+// 百分比尺寸不取整
+func (t ThumbsServer) roundSize(req *thumbRequest, matches []string) {
+	if t.SizeStep <= 0 {
+		return
+	}
+	limit := t.maxDimensionFor(req.mode)
+	if matches[5] != "" {
+		req.width = roundDimension(req.width, t.SizeStep, limit)
+		req.height = req.width
+		req.modeDir = req.mode + strconv.Itoa(req.width) + strings.TrimPrefix(req.modeDir, matches[5]+matches[6])
+		return
+	}
+	size := func(n int, percent bool, raw string) (int, string) {
+		if percent {
+			return n, raw
+		}
+		n = roundDimension(n, t.SizeStep, limit)
+		return n, strconv.Itoa(n)
+	}
+	var w, h string
+	req.width, w = size(req.width, req.widthPercent, matches[3])
+	req.height, h = size(req.height, req.heightPercent, matches[4])
+	req.modeDir = req.mode + w + "x" + h + strings.TrimPrefix(req.modeDir, matches[2]+matches[3]+"x"+matches[4])
+}
+
+// roundDimension 取整到 step 最近的倍数, 至少为一个步长. 原尺寸未超过 limit 而取整后超过时向下取整,
+// 原尺寸已超过 limit 时保持超出, 由尺寸检查拒绝
+func roundDimension(n, step, limit int) int {
+	rounded := max(step, (n+step/2)/step*step)
+	if rounded > limit && n <= limit && rounded-step > 0 {
+		rounded -= step
+	}
+	return rounded
+}
+
+// downloadName 下载文件名, 只保留最后一级路径. 未指定时使用原图文件名, 扩展名改为输出格式
+func downloadName(name string, req *thumbRequest) string {
+	name = path.Base(strings.ReplaceAll(strings.TrimSpace(name), "\\", "/"))
+	if name != "." && name != "/" && name != ".." {
+		return name
+	}
+	name = path.Base(req.imagePath)
+	if req.format != "" && !strings.EqualFold(path.Ext(name), req.format) {
+		name = strings.TrimSuffix(name, path.Ext(name)) + req.format
+	}
+	return name
+}
+
+// parseDimension 解析 URL 中的尺寸, 带 p 后缀时为百分比
+func parseDimension(s string) (int, bool) {
+	value, percent := strings.CutSuffix(s, "p")
+	n, _ := strconv.Atoi(value)
+	return n, percent
+}
+
+// resolvePercentDimensions 按原图尺寸将百分比尺寸换算为像素, 换算后的尺寸同样受 max_dimension 限制
+func (t ThumbsServer) resolvePercentDimensions(bounds image.Rectangle, req *thumbRequest) (uint, uint, error) {
+	width, height := req.width, req.height
+	if req.widthPercent {
+		width = max(1, int(math.Round(float64(bounds.Dx())*float64(req.width)/100)))
+	}
+	if req.heightPercent {
+		height = max(1, int(math.Round(float64(bounds.Dy())*float64(req.height)/100)))
+	}
+	if err := t.validateDimensions(req.mode, width, height); err != nil {
+		return 0, 0, caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	return uint(width), uint(height), nil
+}
+
+// resolveEdgeDimensions 将 long/short 模式的尺寸作为原图长边或短边的目标尺寸, 按纵横比换算宽高.
+// 换算后的另一边同样受 max_dimension 限制
+func (t ThumbsServer) resolveEdgeDimensions(bounds image.Rectangle, req *thumbRequest, modeId int) (uint, uint, error) {
+	width, height := edgeDimensions(bounds.Dx(), bounds.Dy(), req.width, modeId)
+	if err := t.validateDimensions(req.mode, width, height); err != nil {
+		return 0, 0, caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	return uint(width), uint(height), nil
+}
+
+// edgeDimensions 按长边(SCALE_MODE_LONG)或短边(SCALE_MODE_SHORT)缩放到 edge 时的宽高
+func edgeDimensions(srcW, srcH, edge, modeId int) (int, int) {
+	ref := max(srcW, srcH)
+	if modeId == SCALE_MODE_SHORT {
+		ref = min(srcW, srcH)
+	}
+	scale := float64(edge) / float64(ref)
+	return max(1, int(math.Round(float64(srcW)*scale))), max(1, int(math.Round(float64(srcH)*scale)))
+}
+
+// generateThumbnail 生成缩略图, 返回编码后的数据和编码前的缩略图(SVG 透传时为 nil)
+func (t ThumbsServer) generateThumbnail(reader io.Reader, req *thumbRequest) ([]byte, image.Image, error) {
+	// SVG 输出直接透传矢量图
+	if req.format == ".svg" {
+		buf, err := passthroughSVG(reader)
+		return buf, nil, err
+	}
+	thumb, err := t.buildThumbnail(reader, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	buf, err := t.encodeForRequest(thumb, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf, thumb, nil
+}
+
+// buildThumbnail 解码原图并按请求缩放、裁剪和处理, 返回编码前的缩略图
+func (t ThumbsServer) buildThumbnail(reader io.Reader, req *thumbRequest) (thumb image.Image, err error) {
+	var (
+		width, height = uint(req.width), uint(req.height)
+		mode, format  = req.mode, req.format
+	)
+	// 模式配置的插值算法覆盖 upscale_filter 和 downscale_filter, quality_filter 仍然优先. 瓦片不按模式区分
+	var modeFilter string
+	if req.tile == nil {
+		modeFilter, _ = t.filterForMode(mode)
+	}
+	// 瓦片、百分比尺寸和 long/short 模式按原图最大尺寸解码, 以便矢量图栅格化后有足够的精度
+	modeId, ok := cropModeMap[mode]
+	if req.tile != nil || req.widthPercent || req.heightPercent || modeId == SCALE_MODE_LONG || modeId == SCALE_MODE_SHORT {
+		width, height = uint(t.MaxDimension), uint(t.MaxDimension)
+	}
+	// 解码图片
+	var img image.Image
+	img, err = t.decodeImage(reader, width, height)
+	if err != nil {
+		return nil, err
+	}
+	// 部分损坏的图片解码出 0 尺寸的图片, 后续按原图宽高计算比例时会除以 0
+	if img.Bounds().Empty() {
+		return nil, corruptSourceError(req.imagePath, fmt.Sprintf("decoded image has zero size %dx%d", img.Bounds().Dx(), img.Bounds().Dy()))
+	}
+	// 瓦片请求直接从原图截取对应区域
+	if req.tile != nil {
+		return t.extractTile(img, req.tile, req.quality)
+	}
+	// 按原图尺寸换算百分比尺寸
+	if req.widthPercent || req.heightPercent {
+		if width, height, err = t.resolvePercentDimensions(img.Bounds(), req); err != nil {
+			return nil, err
+		}
+	}
+	// 按原图纵横比换算 long/short 的宽高
+	if modeId == SCALE_MODE_LONG || modeId == SCALE_MODE_SHORT {
+		if width, height, err = t.resolveEdgeDimensions(img.Bounds(), req, modeId); err != nil {
+			return nil, err
+		}
+	}
+	// 处理超过原图尺寸的请求
+	width, height, err = t.applyUpscalePolicy(img.Bounds(), modeId, width, height)
+	if err != nil {
+		return nil, err
+	}
+	// 解析裁剪模式
+	if !ok {
+		return nil, fmt.Errorf("unsupported thumbnail mode: %s", mode)
+	}
+	// 根据模式生成缩略图
+	switch modeId {
+	case SCALE_MODE_M:
+		if t.MPad {
+			thumb = t.generateThumbnailModeW(img, width, height, t.background(req), SCALE_MODE_WCC, req.quality, modeFilter)
+		} else {
+			thumb = t.thumbnailImage(width, height, img, req.quality, modeFilter)
+		}
+	case SCALE_MODE_LONG, SCALE_MODE_SHORT:
+		thumb = t.resizeImage(width, height, img, req.quality, modeFilter)
+	case SCALE_MODE_WLT, SCALE_MODE_WLC, SCALE_MODE_WLB, SCALE_MODE_WRT, SCALE_MODE_WRC, SCALE_MODE_WRB, SCALE_MODE_WCC, SCALE_MODE_WCT, SCALE_MODE_WCB:
+		thumb = t.generateThumbnailModeW(img, width, height, t.background(req), modeId, req.quality, modeFilter)
+	case CROP_MODE_LEFTTOP, CROP_MODE_LEFTMIDDLE, CROP_MODE_LEFTBOTTOM, CROP_MODE_RIGHTTOP, CROP_MODE_RIGHTMIDDLE, CROP_MODE_RIGHTBOTTOM, CROP_MODE_CENTERTOP, CROP_MODE_CENTERCENTER, CROP_MODE_CENTERBOTTOM:
+		thumb = t.generateThumbnailModeCrop(img, width, height, modeId, req.focal, req.quality, modeFilter)
+	default:
+		return nil, fmt.Errorf("unsupported thumbnail mode: %s", mode)
+	}
+	// m 模式本身不保证精确尺寸, 开启 m_pad 时才做检查
+	if t.StrictDimensions && (modeId != SCALE_MODE_M || t.MPad) {
+		thumb = t.enforceDimensions(thumb, width, height, t.background(req))
+	}
+	thumb = applyPipeline(thumb, req.ops)
+	// 不支持透明通道的格式(如 JPEG)将透明区域合成到背景色或棋盘格上, 否则编码后透明区域会变成黑色.
+	// 支持透明通道的格式保留裁剪和缩放后的透明区域
+	if !formatSupportsAlpha(format) && hasAlpha(thumb) {
+		flat := flattenOnto(thumb, t.background(req))
+		releaseCanvas(thumb)
+		thumb = flat
+	}
+	// 抖动减色在缩放和其他处理之后进行
+	if req.dither > 0 {
+		dithered := ditherImage(thumb, req.dither)
+		releaseCanvas(thumb)
+		thumb = dithered
+	}
+	return thumb, nil
+}
+
+// applyUpscalePolicy 根据 upscale_policy 处理需要放大原图的请求. 是否放大按模式实际的缩放比例判断:
+// m/w 模式缩放到目标尺寸以内, 取两个方向中较小的比例; 裁剪模式覆盖目标尺寸, 取较大的比例.
+// clamp 将宽高按同一比例缩小到原图尺寸, 保持请求的纵横比
+func (t ThumbsServer) applyUpscalePolicy(bounds image.Rectangle, modeId int, width, height uint) (uint, uint, error) {
+	var (
+		origW, origH = uint(bounds.Dx()), uint(bounds.Dy())
+		scaleW       = float64(width) / float64(origW)
+		scaleH       = float64(height) / float64(origH)
+		scale        = math.Min(scaleW, scaleH)
+	)
+	if modeId >= CROP_MODE_LEFTTOP && modeId <= CROP_MODE_CENTERBOTTOM || modeId == SCALE_MODE_LONG || modeId == SCALE_MODE_SHORT {
+		scale = math.Max(scaleW, scaleH)
+	}
+	if scale <= 1 {
+		return width, height, nil
+	}
+	switch t.UpscalePolicy {
+	case UPSCALE_POLICY_DENY:
+		return 0, 0, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("requested size %dx%d exceeds source size %dx%d", width, height, origW, origH))
+	case UPSCALE_POLICY_CLAMP:
+		width = max(1, uint(math.Round(float64(width)/scale)))
+		height = max(1, uint(math.Round(float64(height)/scale)))
+	}
+	return width, height, nil
+}
+
+// generateThumbnailModeW 模式w：保持纵横比，缩放到目标尺寸以内，然后将不足的部分填充为指定颜色
+func (t ThumbsServer) generateThumbnailModeW(img image.Image, width, height uint, background image.Image, modeId int, quality float32, modeFilter string) image.Image {
+	// 生成缩略图（保持纵横比）
+	resized := t.thumbnailImage(width, height, img, quality, modeFilter)
+
+	// 创建目标大小的画布,填充背景色或棋盘格
+	canvas := newCanvas(int(width), int(height))
+	draw.Draw(canvas, canvas.Bounds(), background, image.Point{}, draw.Src)
+	// 计算绘制位置, 水平和垂直方向分别按锚点对齐. 取整可能使两个方向都略小于目标尺寸, 因此两个方向都要按锚点处理
+	var (
+		resizedBounds               = resized.Bounds()
+		resizedWidth, resizedHeight = resizedBounds.Dx(), resizedBounds.Dy()
+		anchor                      = modeAnchors[modeId]
+		x                           = anchorOffset(int(width)-resizedWidth, anchor[0])
+		y                           = anchorOffset(int(height)-resizedHeight, anchor[1])
+	)
+	// 将缩略图绘制到画布上
+	draw.Draw(canvas, image.Rect(x, y, x+resizedWidth, y+resizedHeight), resized, image.Point{0, 0}, draw.Over)
+	return canvas
+}
+
+func (t ThumbsServer) generateThumbnailModeCrop(img image.Image, width, height uint, cropMode int, focal *focalPoint, quality float32, modeFilter string) image.Image {
+	// 原始尺寸
+	origBounds := img.Bounds()
+	origWidth := uint(origBounds.Dx())
+	origHeight := uint(origBounds.Dy())
 
 	// 计算缩放比例
 	widthRatio := float64(width) / float64(origWidth)
@@ -358,113 +1942,504 @@ func (t ThumbsServer) generateThumbnailModeCrop(img image.Image, width, height u
 		scale = heightRatio
 	}
 
-	// 缩放图片
-	scaledWidth := uint(float64(origWidth) * scale)
-	scaledHeight := uint(float64(origHeight) * scale)
-	resized := resize.Resize(scaledWidth, scaledHeight, img, resize.Lanczos3)
-	// 计算裁剪位置
+	// 缩放图片
+	scaledWidth := uint(float64(origWidth) * scale)
+	scaledHeight := uint(float64(origHeight) * scale)
+	// 取整可能导致缩放后的图片比目标尺寸少一个像素, 无法覆盖画布
+	if t.StrictDimensions && (scaledWidth < width || scaledHeight < height) {
+		t.logger.Warn("Scaled image smaller than crop target, correcting",
+			zap.Uint("scaled_width", scaledWidth), zap.Uint("scaled_height", scaledHeight),
+			zap.Uint("width", width), zap.Uint("height", height))
+		scaledWidth, scaledHeight = max(scaledWidth, width), max(scaledHeight, height)
+	}
+	resized := t.resizeImage(scaledWidth, scaledHeight, img, quality, modeFilter)
+	// 计算裁剪位置, 水平和垂直方向分别按锚点对齐
+	var (
+		resizedBounds               = resized.Bounds()
+		resizedWidth, resizedHeight = resizedBounds.Dx(), resizedBounds.Dy()
+		anchor                      = modeAnchors[cropMode]
+		x                           = anchorOffset(resizedWidth-int(width), anchor[0])
+		y                           = anchorOffset(resizedHeight-int(height), anchor[1])
+	)
+	// 指定了焦点时以焦点为中心裁剪
+	if focal != nil {
+		x = focalOffset(focal.x, resizedWidth, int(width))
+		y = focalOffset(focal.y, resizedHeight, int(height))
+	}
+
+	// 创建目标大小的画布
+	canvas := newCanvas(int(width), int(height))
+	// t.logger.Info("x,y,w,h", zap.Int("x", x), zap.Int("y", y), zap.Int("width", resizedWidth), zap.Int("height", resizedHeight))
+	// 绘制裁剪后的图片
+	draw.Draw(canvas, canvas.Bounds(), resized, image.Point{x, y}, draw.Over)
+	return canvas
+}
+
+// enforceDimensions 输出尺寸与请求不一致时, 以背景色填充不足部分并裁掉多余部分
+func (t ThumbsServer) enforceDimensions(img image.Image, width, height uint, background image.Image) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() == int(width) && bounds.Dy() == int(height) {
+		return img
+	}
+	t.logger.Warn("Thumbnail dimensions differ from request, correcting",
+		zap.Int("actual_width", bounds.Dx()), zap.Int("actual_height", bounds.Dy()),
+		zap.Uint("width", width), zap.Uint("height", height))
+	canvas := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
+	draw.Draw(canvas, canvas.Bounds(), background, image.Point{}, draw.Src)
+	draw.Draw(canvas, canvas.Bounds(), img, bounds.Min, draw.Over)
+	return canvas
+}
+
+// resizeImage 缩放图片到指定尺寸, modeFilter 为模式配置的插值算法, 为空时按缩放方向选择.
+// resize 在插值前会将 NRGBA 等非预乘的图片预乘 alpha, 透明边缘不会出现暗色光晕
+func (t ThumbsServer) resizeImage(width, height uint, img image.Image, quality float32, modeFilter string) image.Image {
+	var (
+		bounds = img.Bounds()
+		interp = t.interpolation(width > uint(bounds.Dx()) || height > uint(bounds.Dy()), quality, modeFilter)
+	)
+	// 尺寸不变时返回原图, 保留调色板等原有的像素格式
+	if int(width) == bounds.Dx() && int(height) == bounds.Dy() {
+		return img
+	}
+	return resize.Resize(width, height, img, interp)
+}
+
+// thumbnailImage 保持纵横比缩放到目标尺寸以内, 透明通道处理同 resizeImage
+//
+// resize.Thumbnail 不会放大图片, 因此总是使用缩小插值算法
+func (t ThumbsServer) thumbnailImage(maxWidth, maxHeight uint, img image.Image, quality float32, modeFilter string) image.Image {
+	interp := t.interpolation(false, quality, modeFilter)
+	// 原图在目标尺寸以内时不缩放, 直接返回原图, 保留调色板等原有的像素格式
+	if bounds := img.Bounds(); uint(bounds.Dx()) <= maxWidth && uint(bounds.Dy()) <= maxHeight {
+		return img
+	}
+	return resize.Thumbnail(maxWidth, maxHeight, img, interp)
+}
+
+// QualityFilter 质量不高于 MaxQuality 的请求使用 Filter 插值, 覆盖 upscale_filter 和 downscale_filter.
+// 配置多条时使用阈值最低的匹配项
+type QualityFilter struct {
+	MaxQuality float32 `json:"max_quality"`
+	Filter     string  `json:"filter"`
+}
+
+// interpolationFilters 可配置的插值算法
+var interpolationFilters = map[string]resize.InterpolationFunction{
+	"nearest":  resize.NearestNeighbor,
+	"bilinear": resize.Bilinear,
+	"bicubic":  resize.Bicubic,
+	"mitchell": resize.MitchellNetravali,
+	"lanczos2": resize.Lanczos2,
+	"lanczos3": resize.Lanczos3,
+}
+
+// filterForMode 返回模式配置的插值算法, 匹配规则同 maxDimensionFor
+func (t ThumbsServer) filterForMode(mode string) (string, bool) {
+	if filter, ok := t.ModeFilters[mode]; ok {
+		return filter, true
+	}
+	modeId, ok := cropModeMap[mode]
+	if !ok {
+		return "", false
+	}
+	for name, filter := range t.ModeFilters {
+		if cropModeMap[name] == modeId {
+			return filter, true
+		}
+	}
+	return "", false
+}
+
+// interpolation 按缩放方向和请求质量返回配置的插值算法. modeFilter 不为空时代替缩放方向配置的算法
+func (t ThumbsServer) interpolation(upscale bool, quality float32, modeFilter string) resize.InterpolationFunction {
+	name := t.DownscaleFilter
+	if upscale {
+		name = t.UpscaleFilter
+	}
+	if modeFilter != "" {
+		name = modeFilter
+	}
+	// QualityFilters 已按阈值升序排列
+	for _, rule := range t.QualityFilters {
+		if quality <= rule.MaxQuality {
+			name = rule.Filter
+			break
+		}
+	}
+	if interp, ok := interpolationFilters[name]; ok {
+		return interp
+	}
+	return resize.Lanczos3
+}
+
+// hasAlpha 判断图片是否含有非不透明的像素
+func hasAlpha(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return !o.Opaque()
+	}
+	return true
+}
+
+var (
+	jpegHeader  = []byte{0xFF, 0xD8}
+	pngHeader   = []byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A}
+	webpHeader  = []byte("RIFF")
+	webpHeader2 = []byte("WEBP")
+	ftypHeader  = []byte("ftyp") // ISOBMFF 容器(HEIC、AVIF 等)的 ftyp 盒
+	// JPEG XL 裸码流和 ISOBMFF 容器两种封装
+	jxlHeader          = []byte{0xFF, 0x0A}
+	jxlContainerHeader = []byte{0x00, 0x00, 0x00, 0x0C, 'J', 'X', 'L', ' ', 0x0D, 0x0A, 0x87, 0x0A}
+)
+
+// sourceFormats 可识别的原图格式
+var sourceFormats = []string{".jpg", ".png", ".webp", ".jxl", ".svg", ".heic", ".pdf"}
+
+// decodeOnlyFormats 只能解码不能编码的原图格式, 缩略图输出为 JPEG 或 format_rule 指定的格式
+var decodeOnlyFormats = []string{".heic", ".heif", ".pdf"}
+
+// decodeOnlyOutputFormat 只能解码的原图未指定输出格式时使用的格式
+const decodeOnlyOutputFormat = ".jpg"
+
+// sniffFormat 根据文件头判断图片格式, 返回对应的扩展名, 无法识别时返回空字符串.
+// order 为 ISOBMFF 容器兼容品牌同时包含多种格式时的优先顺序
+func sniffFormat(header []byte, order []string) string {
+	switch {
+	case bytes.HasPrefix(header, jpegHeader):
+		return ".jpg"
+	case bytes.HasPrefix(header, pngHeader):
+		return ".png"
+	// RIFF 也用于 WAV、AVI 等, 需要检查其中的格式标识
+	case bytes.HasPrefix(header, webpHeader) && len(header) >= 12 && bytes.Equal(header[8:12], webpHeader2), bytes.HasPrefix(header, webpHeader2):
+		return ".webp"
+	case bytes.HasPrefix(header, jxlHeader), bytes.HasPrefix(header, jxlContainerHeader):
+		return ".jxl"
+	case len(header) >= 12 && bytes.Equal(header[4:8], ftypHeader):
+		return sniffISOBMFF(header, order)
+	case isSVG(header):
+		return ".svg"
+	case bytes.HasPrefix(header, pdfHeader):
+		return ".pdf"
+	}
+	return ""
+}
+
+// decodeImage 解码图片, 配置了 decode_timeout 时在独立的 goroutine 中解码, 超时后立即返回 422
+func (t ThumbsServer) decodeImage(reader io.Reader, width, height uint) (image.Image, error) {
+	if t.DecodeTimeout <= 0 {
+		return t.decodeImageSync(reader, width, height)
+	}
+
+	type decodeResult struct {
+		img image.Image
+		err error
+	}
+	ctx, cancel := context.WithTimeout(t.ctx, time.Duration(t.DecodeTimeout))
+	defer cancel()
+	// 解码器无法中途取消, 超时后 goroutine 会继续运行到解码结束, 结果直接丢弃
+	done := make(chan decodeResult, 1)
+	go func() {
+		img, err := t.decodeImageSync(reader, width, height)
+		done <- decodeResult{img, err}
+	}()
+	select {
+	case res := <-done:
+		return res.img, res.err
+	case <-ctx.Done():
+		t.logger.Warn("Image decode timed out", zap.Duration("timeout", time.Duration(t.DecodeTimeout)))
+		return nil, caddyhttp.Error(http.StatusUnprocessableEntity, fmt.Errorf("image decode timed out after %s", time.Duration(t.DecodeTimeout)))
+	}
+}
+
+// decodeImageSync 解码图片, width 和 height 为目标尺寸, 用于矢量图栅格化
+func (t ThumbsServer) decodeImageSync(reader io.Reader, width, height uint) (image.Image, error) {
+	var (
+		buf     = make([]byte, sniffHeaderSize)
+		numRead int
+		err     error
+	)
+	numRead, err = io.ReadFull(reader, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("failed to read file header: %v", err)
+	}
+	if numRead == 0 {
+		return nil, caddyhttp.Error(http.StatusUnprocessableEntity, errors.New("corrupt or empty source: empty file"))
+	}
+
+	multiReader := io.MultiReader(bytes.NewReader(buf[:numRead]), reader)
+
+	if numRead >= 2 {
+		format := sniffFormat(buf[:numRead], t.ContainerFormatOrder)
+		// 按原图格式限制同时解码的数量
+		if slots := t.decodeSlots[format]; slots != nil {
+			slots <- struct{}{}
+			defer func() { <-slots }()
+		}
+		switch format {
+		case ".jpg", ".png", ".webp", ".jxl", ".heic":
+			data, err := io.ReadAll(multiReader)
+			if err != nil {
+				return nil, err
+			}
+			img, err := decodeRaster(data, format)
+			if err != nil {
+				// 文件头已识别为支持的格式, 解码失败说明文件损坏或被截断
+				if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+					return nil, caddyhttp.Error(http.StatusUnprocessableEntity, fmt.Errorf("corrupt or empty source: truncated %s data", format))
+				}
+				return nil, caddyhttp.Error(http.StatusUnprocessableEntity, fmt.Errorf("corrupt or empty source: %v", err))
+			}
+			if !t.convertsToSRGB() {
+				return img, nil
+			}
+			return convertToSRGB(img, extractICCProfile(data, format)), nil
+		case ".svg":
+			return t.rasterizeSVG(multiReader, width, height)
+		case ".pdf":
+			data, err := io.ReadAll(multiReader)
+			if err != nil {
+				return nil, err
+			}
+			return t.rasterizePDF(data, width, height)
+		default:
+			return nil, caddyhttp.Error(http.StatusUnsupportedMediaType, errors.New("unsupported image format"))
+		}
+	}
+	return nil, caddyhttp.Error(http.StatusUnsupportedMediaType, fmt.Errorf("unsupported image format, file header: %x", buf[:numRead]))
+}
+
+// decodeRaster 解码位图格式
+func decodeRaster(data []byte, format string) (image.Image, error) {
+	switch format {
+	case ".jpg":
+		return decodeJPEGOriented(data)
+	case ".png":
+		return png.Decode(bytes.NewReader(data))
+	case ".jxl":
+		return jpegxl.Decode(bytes.NewReader(data))
+	case ".heic":
+		return heic.Decode(bytes.NewReader(data))
+	default:
+		return webp.Decode(bytes.NewReader(data))
+	}
+}
+
+// convertsToSRGB 是否开启 sRGB 转换, 未配置时默认开启
+func (t ThumbsServer) convertsToSRGB() bool {
+	return t.ConvertToSRGB == nil || *t.ConvertToSRGB
+}
+
+// encodeImage 编码并保存图片
+func (t ThumbsServer) encodeImage(img image.Image, quality float32, format string) ([]byte, error) {
+	buf := encodeBufferPool.Get().(*bytes.Buffer)
+	defer putEncodeBuffer(buf)
+	if err := t.encodeImageTo(buf, img, quality, format); err != nil {
+		return nil, err
+	}
+	// 返回副本, 缓冲区放回池中后会被其他请求复用
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+// maxPooledBufferSize 超过该容量的缓冲区不放回池中, 避免偶发的大图长期占用内存
+const maxPooledBufferSize = 4 << 20
+
+// encodeBufferPool 编码输出缓冲区池, 减少高并发下反复扩容带来的分配
+var encodeBufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// putEncodeBuffer 清空缓冲区并放回池中
+func putEncodeBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	buf.Reset()
+	encodeBufferPool.Put(buf)
+}
+
+// encodeImageTo 按格式编码图片并写出到 writer
+func (t ThumbsServer) encodeImageTo(writer io.Writer, img image.Image, quality float32, format string) error {
+	var err error
+	// 配置了 output_dpi 时在 JPEG/PNG 输出中写入分辨率
+	writer = dpiWriter(writer, format, t.OutputDPI)
+	// 配置了 normalize_quality 时有损格式使用映射后的编码器质量
+	native := t.encoderQuality(quality, format)
+	// 根据格式保存图片
+	switch format {
+	case ".jpg", ".jpeg":
+		err = jpeg.Encode(writer, img, &jpeg.Options{Quality: int(math.Round(float64(native)))})
+	case ".png":
+		// 颜色数不超过调色板大小的调色板图片(如未缩放的调色板 PNG 原图)不再量化, 保留原有调色板
+		if paletted, ok := img.(*image.Paletted); t.PNGQuantize && (!ok || len(paletted.Palette) > pngPaletteSize(quality)) {
+			img = quantizeImage(img, pngPaletteSize(quality))
+		}
+		err = png.Encode(writer, img)
+	case ".webp":
+		// 带透明通道的图片(多为图标、插画等平面图)需要更高的质量避免边缘瑕疵
+		if t.AlphaQualityBoost > 0 && hasAlpha(img) {
+			native = min(100, native+float32(t.AlphaQualityBoost))
+		}
+		err = webp.Encode(writer, img, &webp.Options{Quality: native})
+	case ".jxl":
+		// q100 使用无损编码
+		err = jpegxl.Encode(writer, img, jpegxl.Options{Quality: int(math.Round(float64(native))), Lossless: quality >= 100})
+	default:
+		return fmt.Errorf("unsupported output format: %s", format)
+	}
+	return err
+}
+
+// encodeForRequest 按请求的格式、质量和字节预算编码, 再交给外部优化程序处理.
+// 开启 encode_fallback 时编码失败改用 JPEG, 并在 req.fallbackFormat 中记录实际格式
+func (t ThumbsServer) encodeForRequest(img image.Image, req *thumbRequest) ([]byte, error) {
+	buf, err := t.encodeRecovered(img, req)
+	if err == nil {
+		return t.optimize(buf, req.format), nil
+	}
+	if !t.EncodeFallback || req.format == ".jpg" || req.format == ".jpeg" {
+		return nil, err
+	}
+	t.logger.Warn("Failed to encode thumbnail, falling back to JPEG",
+		zap.String("path", req.thumbPath), zap.String("format", req.format), zap.Error(err))
+	flat := img
+	if hasAlpha(img) {
+		flat = flattenOnto(img, t.background(req))
+		defer releaseCanvas(flat)
+	}
+	if buf, err = t.encodeImage(flat, req.quality, ".jpg"); err != nil {
+		return nil, err
+	}
+	req.fallbackFormat = ".jpg"
+	return t.optimize(buf, ".jpg"), nil
+}
+
+// encodeRecovered 调用编码器, 将编码器的 panic 转为错误
+func (t ThumbsServer) encodeRecovered(img image.Image, req *thumbRequest) (buf []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s encoder panicked: %v", req.format, r)
+		}
+	}()
+	return t.encodeRequestFormat(img, req)
+}
+
+// encodeRequestFormat 按请求的格式选择编码方式
+func (t ThumbsServer) encodeRequestFormat(img image.Image, req *thumbRequest) ([]byte, error) {
+	// 近无损编码不使用质量参数, 也不受字节预算影响
+	if req.format == ".webp" {
+		level := t.WebPNearLossless
+		if req.nearLossless != nil {
+			level = req.nearLossless
+		}
+		if level != nil {
+			return encodeWebPNearLossless(img, *level)
+		}
+	}
+	if req.maxBytes > 0 {
+		buf, err := t.encodeWithBudget(img, req.quality, req.format, req.maxBytes)
+		req.budgetExceeded = err == nil && isLossyFormat(req.format) && len(buf) > req.maxBytes
+		return buf, err
+	}
+	return t.encodeImage(img, req.quality, req.format)
+}
+
+// maxBudgetIterations 按字节预算搜索质量时的最大编码次数
+const maxBudgetIterations = 7
+
+// encodeWithBudget 在不超过 maxBytes 的前提下二分查找最高的质量进行编码, 仅对有损格式有效
+func (t ThumbsServer) encodeWithBudget(img image.Image, quality float32, format string, maxBytes int) ([]byte, error) {
+	buf, err := t.encodeImage(img, quality, format)
+	if err != nil || len(buf) <= maxBytes || !isLossyFormat(format) {
+		return buf, err
+	}
 	var (
-		resizedBounds               = resized.Bounds()
-		resizedWidth, resizedHeight = resizedBounds.Dx(), resizedBounds.Dy()
-		// 计算裁剪位置
-		x = (resizedWidth - int(width)) / 2
-		y = (resizedHeight - int(height)) / 2
+		best   []byte
+		lo, hi = max(1, t.MinQuality), int(math.Ceil(float64(quality))) - 1
 	)
-	if resizedWidth == int(width) {
-		x = 0
-		switch cropMode {
-		case CROP_MODE_LEFTTOP, CROP_MODE_CENTERTOP, CROP_MODE_RIGHTTOP:
-			y = 0
-		case CROP_MODE_LEFTMIDDLE, CROP_MODE_CENTERCENTER, CROP_MODE_RIGHTMIDDLE:
-			y = int((resizedHeight - int(height)) / 2)
-		case CROP_MODE_LEFTBOTTOM, CROP_MODE_CENTERBOTTOM, CROP_MODE_RIGHTBOTTOM:
-			y = int((resizedHeight - int(height)))
+	for i := 0; i < maxBudgetIterations && lo <= hi; i++ {
+		mid := (lo + hi) / 2
+		candidate, err := t.encodeImage(img, float32(mid), format)
+		if err != nil {
+			return nil, err
+		}
+		if len(candidate) <= maxBytes {
+			best, lo = candidate, mid+1
+		} else {
+			hi = mid - 1
 		}
 	}
-	if resizedHeight == int(height) {
-		y = 0
-		switch cropMode {
-		case CROP_MODE_LEFTTOP, CROP_MODE_LEFTMIDDLE, CROP_MODE_LEFTBOTTOM:
-			x = 0
-		case CROP_MODE_RIGHTTOP, CROP_MODE_RIGHTMIDDLE, CROP_MODE_RIGHTBOTTOM:
-			x = int(resizedWidth - int(width))
-		case CROP_MODE_CENTERTOP, CROP_MODE_CENTERCENTER, CROP_MODE_CENTERBOTTOM:
-			x = int((resizedWidth - int(width)) / 2)
+	if best == nil {
+		if t.MinQuality == 0 {
+			return nil, caddyhttp.Error(http.StatusUnprocessableEntity, fmt.Errorf("cannot encode within %d bytes", maxBytes))
+		}
+		// 配置了 min_quality 时不再降低质量, 返回最低质量的结果
+		t.logger.Warn("Byte budget not met at min_quality",
+			zap.Int("max_bytes", maxBytes), zap.Int("min_quality", t.MinQuality), zap.String("format", format))
+		if quality <= float32(t.MinQuality) {
+			return buf, nil
 		}
+		return t.encodeImage(img, float32(t.MinQuality), format)
 	}
-
-	// 创建目标大小的画布
-	canvas := image.NewRGBA(image.Rect(0, 0, int(width), int(height)))
-	// t.logger.Info("x,y,w,h", zap.Int("x", x), zap.Int("y", y), zap.Int("width", resizedWidth), zap.Int("height", resizedHeight))
-	// 绘制裁剪后的图片
-	draw.Draw(canvas, canvas.Bounds(), resized, image.Point{x, y}, draw.Over)
-	return canvas
+	return best, nil
 }
 
-var (
-	jpegHeader  = []byte{0xFF, 0xD8}
-	pngHeader   = []byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A}
-	webpHeader  = []byte("RIFF")
-	webpHeader2 = []byte("WEBP")
-	avifHeader  = []byte("ftyp")
-)
+// QualityRange 输出格式允许的质量范围
+type QualityRange struct {
+	Min float32 `json:"min"`
+	Max float32 `json:"max"`
+}
 
-// decodeImage 解码图片
-func (t ThumbsServer) decodeImage(reader io.Reader) (image.Image, error) {
-	var (
-		buf     = make([]byte, 16)
-		numRead int
-		err     error
-	)
-	numRead, err = reader.Read(buf)
-	if err != nil && err != io.EOF {
-		return nil, fmt.Errorf("failed to read file header: %v", err)
+// formatKey 统一配置中的格式名: 小写、带点, jpeg 按 jpg 处理
+func formatKey(format string) string {
+	format = "." + strings.TrimPrefix(strings.ToLower(format), ".")
+	switch format {
+	case ".jpeg":
+		format = ".jpg"
+	case ".heif":
+		format = ".heic"
 	}
+	return format
+}
 
-	multiReader := io.MultiReader(bytes.NewReader(buf[:numRead]), reader)
-
-	if numRead >= 2 {
-		switch {
-		case bytes.HasPrefix(buf, jpegHeader):
-			return jpeg.Decode(multiReader)
-		case bytes.HasPrefix(buf, pngHeader):
-			return png.Decode(multiReader)
-		case bytes.HasPrefix(buf, webpHeader):
-			return webp.Decode(reader)
-		case bytes.HasPrefix(buf, webpHeader2):
-			return webp.Decode(reader)
-		default:
-			return nil, fmt.Errorf("unsupported image format")
-		}
+// clampQuality 按 quality_range 将请求的质量限制在输出格式允许的范围内, 输出格式未确定时不处理
+func (t ThumbsServer) clampQuality(req *thumbRequest) {
+	if req.format == "" {
+		return
+	}
+	r, ok := t.QualityRange[formatKey(req.format)]
+	if !ok {
+		return
 	}
-	return nil, fmt.Errorf("unsupported image format, file header: %x", buf[:numRead])
+	req.quality = min(max(req.quality, r.Min), r.Max)
 }
 
-// encodeImage 编码并保存图片
-func (t ThumbsServer) encodeImage(img image.Image, quality int, format string) ([]byte, error) {
-	// 写出到 io.Writer 最后返回 []byte
+// outputFormats 支持输出的所有格式
+var outputFormats = []string{".jpg", ".jpeg", ".png", ".webp", ".jxl", ".svg"}
 
-	var (
-		buf    []byte
-		err    error
-		writer io.Writer = bytes.NewBuffer(buf)
-	)
+// formatAllowed 判断输出格式是否在 allowed_formats 中, 未配置时允许所有支持的格式
+func (t ThumbsServer) formatAllowed(format string) bool {
+	if len(t.AllowedFormats) == 0 {
+		return slices.Contains(outputFormats, format)
+	}
+	return slices.Contains(t.AllowedFormats, format)
+}
 
-	// 根据格式保存图片
+// isLossyFormat 判断输出格式是否支持质量参数
+func isLossyFormat(format string) bool {
 	switch format {
-	case ".jpg", ".jpeg":
-		err = jpeg.Encode(writer, img, &jpeg.Options{Quality: quality})
-	case ".png":
-		err = png.Encode(writer, img)
-	case ".webp":
-		err = webp.Encode(writer, img, &webp.Options{Quality: float32(quality)})
-	default:
-		return nil, fmt.Errorf("unsupported output format: %s", format)
+	case ".jpg", ".jpeg", ".webp", ".jxl":
+		return true
 	}
-	if err != nil {
-		return nil, err
+	return false
+}
+
+// parseQuality 解析质量参数, 支持小数, 无效或超出 0-100 时返回默认质量
+func parseQuality(s string, defaultQuality int) float32 {
+	if s != "" {
+		if q, err := strconv.ParseFloat(s, 32); err == nil && q >= 0 && q <= 100 {
+			return float32(q)
+		}
 	}
-	return writer.(*bytes.Buffer).Bytes(), nil
+	return float32(defaultQuality)
 }
 
 // parseHexColor 解析十六进制颜色代码
@@ -518,11 +2493,151 @@ func (t *ThumbsServer) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				} else {
 					return d.Errf("invalid default_quality value: %s", d.Val())
 				}
+			case "quality_preset":
+				name, preset, err := unmarshalQualityPreset(d)
+				if err != nil {
+					return err
+				}
+				if t.QualityPresets == nil {
+					t.QualityPresets = make(map[string]QualityPreset)
+				}
+				t.QualityPresets[name] = preset
+			case "quality_range":
+				args := d.RemainingArgs()
+				if len(args) != 3 {
+					return d.ArgErr()
+				}
+				lo, err1 := strconv.ParseFloat(args[1], 32)
+				hi, err2 := strconv.ParseFloat(args[2], 32)
+				if err1 != nil || err2 != nil {
+					return d.Errf("invalid quality_range values: %s %s", args[1], args[2])
+				}
+				if t.QualityRange == nil {
+					t.QualityRange = make(map[string]QualityRange)
+				}
+				t.QualityRange[args[0]] = QualityRange{Min: float32(lo), Max: float32(hi)}
+			case "alpha_quality_boost":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				val, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid alpha_quality_boost value: %s", d.Val())
+				}
+				t.AlphaQualityBoost = val
+			case "min_quality":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				val, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid min_quality value: %s", d.Val())
+				}
+				t.MinQuality = val
 			case "cache_control":
 				if !d.NextArg() {
 					return d.ArgErr()
 				}
 				t.CacheControl = d.Val()
+			case "short_cache_control":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				t.ShortCacheControl = d.Val()
+			case "upscale_policy":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				t.UpscalePolicy = d.Val()
+			case "lqip":
+				t.LQIP = true
+			case "min_modern_format_bytes":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("invalid min_modern_format_bytes value: %s", d.Val())
+				}
+				t.MinModernFormatBytes = int(size)
+			case "require_source":
+				t.RequireSource = true
+			case "color_header":
+				t.ColorHeader = true
+			case "m_pad":
+				t.MPad = true
+			case "hash_storage_keys":
+				t.HashStorageKeys = 2
+				if d.NextArg() {
+					val, err := strconv.Atoi(d.Val())
+					if err != nil {
+						return d.Errf("invalid hash_storage_keys depth: %s", d.Val())
+					}
+					t.HashStorageKeys = val
+				}
+			case "max_path_length":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				val, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_path_length value: %s", d.Val())
+				}
+				t.MaxPathLength = val
+			case "max_variants_per_source":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				val, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_variants_per_source value: %s", d.Val())
+				}
+				t.MaxVariantsPerSource = val
+			case "size_step":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				val, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid size_step value: %s", d.Val())
+				}
+				t.SizeStep = val
+			case "match_source_quality":
+				t.MatchSourceQuality = true
+			case "strict_quality":
+				t.StrictQuality = true
+			case "pdf_sources":
+				t.PDFSources = true
+			case "prefer_smaller":
+				t.PreferSmaller = true
+			case "encode_fallback":
+				t.EncodeFallback = true
+			case "debug_headers":
+				t.DebugHeaders = true
+			case "no_cache":
+				t.NoCache = true
+			case "etag_sidecar":
+				t.ETagSidecar = true
+			case "max_cache_bytes":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := humanize.ParseBytes(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_cache_bytes value: %s", d.Val())
+				}
+				t.MaxCacheBytes = int64(size)
+			case "pregenerate":
+				cfg, err := unmarshalPregenerate(d)
+				if err != nil {
+					return err
+				}
+				t.Pregenerate = cfg
+			case "blurhash_path":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				t.BlurHashPath = d.Val()
 			case "thumbs_storage":
 				if t.ThumbsStorageRaw != nil {
 					return d.Err("ThumbsStorageRaw already set.")
@@ -541,6 +2656,23 @@ func (t *ThumbsServer) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					return d.Errf("module %s is not a caddy.StorageConverter", modID)
 				}
 				t.ThumbsStorageRaw = caddyconfig.JSONModuleObject(storage, "module", storage.(caddy.Module).CaddyModule().ID.Name(), nil)
+			case "thumbs_slow_storage":
+				if t.ThumbsSlowStorageRaw != nil {
+					return d.Err("ThumbsSlowStorageRaw already set.")
+				}
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				modID := "caddy.storage." + d.Val()
+				unm, err := caddyfile.UnmarshalModule(d, modID)
+				if err != nil {
+					return err
+				}
+				storage, ok := unm.(caddy.StorageConverter)
+				if !ok {
+					return d.Errf("module %s is not a caddy.StorageConverter", modID)
+				}
+				t.ThumbsSlowStorageRaw = caddyconfig.JSONModuleObject(storage, "module", storage.(caddy.Module).CaddyModule().ID.Name(), nil)
 
 			case "image_storage":
 				if !d.NextArg() {
@@ -556,7 +2688,289 @@ func (t *ThumbsServer) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				if !ok {
 					return d.Errf("module %s is not a caddy.StorageConverter", modID)
 				}
-				t.ImageStorageRaw = caddyconfig.JSONModuleObject(storage, "module", storage.(caddy.Module).CaddyModule().ID.Name(), nil)
+				// 重复配置 image_storage 时, 第一个为主存储, 其余按顺序作为备用存储
+				raw := caddyconfig.JSONModuleObject(storage, "module", storage.(caddy.Module).CaddyModule().ID.Name(), nil)
+				if t.ImageStorageRaw == nil {
+					t.ImageStorageRaw = raw
+				} else {
+					t.FallbackImageStoragesRaw = append(t.FallbackImageStoragesRaw, raw)
+				}
+			case "image_filter":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				name := d.Val()
+				modID := "http.handlers.thumbs_server.filters." + name
+				unm, err := caddyfile.UnmarshalModule(d, modID)
+				if err != nil {
+					return err
+				}
+				if _, ok := unm.(ImageFilter); !ok {
+					return d.Errf("module %s is not an ImageFilter", modID)
+				}
+				t.ImageFiltersRaw = append(t.ImageFiltersRaw, caddyconfig.JSONModuleObject(unm, "filter", name, nil))
+			case "source_transformer":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				name := d.Val()
+				modID := "http.handlers.thumbs_server.transformers." + name
+				unm, err := caddyfile.UnmarshalModule(d, modID)
+				if err != nil {
+					return err
+				}
+				if _, ok := unm.(SourceTransformer); !ok {
+					return d.Errf("module %s is not a SourceTransformer", modID)
+				}
+				t.SourceTransformersRaw = append(t.SourceTransformersRaw, caddyconfig.JSONModuleObject(unm, "transformer", name, nil))
+			case "source_token_header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				t.SourceTokenHeader = d.Val()
+			case "debug_path":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				t.DebugPath = d.Val()
+			case "cache_stats_path":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				t.CacheStatsPath = d.Val()
+			case "capabilities_path":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				t.CapabilitiesPath = d.Val()
+			case "transcode_from_cache":
+				t.TranscodeFromCache = true
+			case "format_rule":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				t.FormatRule = d.Val()
+			case "archive_source":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				t.ArchiveSource = d.Val()
+			case "default_format":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				t.DefaultFormat = d.Val()
+			case "default_variant":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				t.DefaultVariant = d.Val()
+			case "error_response":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				t.ErrorResponse = d.Val()
+			case "allowed_formats":
+				t.AllowedFormats = d.RemainingArgs()
+				if len(t.AllowedFormats) == 0 {
+					return d.ArgErr()
+				}
+			case "cache_warmer":
+				cfg, err := unmarshalWarmer(d)
+				if err != nil {
+					return err
+				}
+				t.Warmer = cfg
+			case "generation_user_agent_deny":
+				cfg, err := unmarshalUserAgentDeny(d)
+				if err != nil {
+					return err
+				}
+				t.GenerationUADeny = cfg
+			case "orphan_purge":
+				cfg, err := unmarshalOrphanPurge(d)
+				if err != nil {
+					return err
+				}
+				t.OrphanPurge = cfg
+			case "normalize_quality":
+				cfg, err := unmarshalQualityNormalization(d)
+				if err != nil {
+					return err
+				}
+				t.NormalizeQuality = cfg
+			case "async_generation":
+				cfg, err := unmarshalAsync(d)
+				if err != nil {
+					return err
+				}
+				t.AsyncGeneration = cfg
+			case "approximate_from_cache":
+				cfg, err := unmarshalApproximate(d)
+				if err != nil {
+					return err
+				}
+				t.Approximate = cfg
+			case "immutable":
+				t.Immutable = true
+			case "decode_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid decode_timeout value: %s", d.Val())
+				}
+				t.DecodeTimeout = caddy.Duration(dur)
+			case "mode_max_dimension":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				limit, err := strconv.Atoi(args[1])
+				if err != nil {
+					return d.Errf("invalid mode_max_dimension value: %s", args[1])
+				}
+				if t.ModeMaxDimension == nil {
+					t.ModeMaxDimension = make(map[string]int)
+				}
+				t.ModeMaxDimension[args[0]] = limit
+			case "decode_concurrency":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				limit, err := strconv.Atoi(args[1])
+				if err != nil {
+					return d.Errf("invalid decode_concurrency value: %s", args[1])
+				}
+				if t.DecodeConcurrency == nil {
+					t.DecodeConcurrency = make(map[string]int)
+				}
+				t.DecodeConcurrency[args[0]] = limit
+			case "container_format_order":
+				t.ContainerFormatOrder = d.RemainingArgs()
+				if len(t.ContainerFormatOrder) == 0 {
+					return d.ArgErr()
+				}
+			case "strict_dimensions":
+				t.StrictDimensions = true
+			case "upscale_filter", "downscale_filter":
+				key := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if key == "upscale_filter" {
+					t.UpscaleFilter = d.Val()
+				} else {
+					t.DownscaleFilter = d.Val()
+				}
+			case "mode_filter":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				if t.ModeFilters == nil {
+					t.ModeFilters = make(map[string]string)
+				}
+				t.ModeFilters[args[0]] = args[1]
+			case "quality_filter":
+				args := d.RemainingArgs()
+				if len(args) != 2 {
+					return d.ArgErr()
+				}
+				threshold, err := strconv.ParseFloat(args[0], 32)
+				if err != nil {
+					return d.Errf("invalid quality_filter threshold: %s", args[0])
+				}
+				t.QualityFilters = append(t.QualityFilters, QualityFilter{MaxQuality: float32(threshold), Filter: args[1]})
+			case "webp_near_lossless":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				val, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid webp_near_lossless value: %s", d.Val())
+				}
+				t.WebPNearLossless = &val
+			case "normalize_path":
+				t.NormalizePath = true
+			case "strip_prefix":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				t.StripPrefix = d.Val()
+			case "refresh_secret":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				t.RefreshSecret = d.Val()
+			case "cache_key_header":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				t.CacheKeyHeader = d.Val()
+			case "checker_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				val, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid checker_size value: %s", d.Val())
+				}
+				t.CheckerSize = val
+			case "optimizer":
+				args := d.RemainingArgs()
+				if len(args) < 2 {
+					return d.ArgErr()
+				}
+				if t.Optimizers == nil {
+					t.Optimizers = make(map[string]*OptimizerConfig)
+				}
+				t.Optimizers[args[0]] = &OptimizerConfig{Command: args[1], Args: args[2:]}
+			case "optimizer_timeout":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid optimizer_timeout value: %s", d.Val())
+				}
+				t.OptimizerTimeout = caddy.Duration(dur)
+			case "strict_source_type":
+				t.StrictSourceType = true
+			case "strict_tokens":
+				t.StrictTokens = true
+			case "png_quantize":
+				t.PNGQuantize = true
+			case "output_dpi":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				val, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid output_dpi value: %s", d.Val())
+				}
+				t.OutputDPI = val
+			case "convert_to_srgb":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				switch d.Val() {
+				case "on":
+					t.ConvertToSRGB = nil
+				case "off":
+					off := false
+					t.ConvertToSRGB = &off
+				default:
+					return d.Errf("invalid convert_to_srgb value: %s (must be on or off)", d.Val())
+				}
+			case "srcset":
+				cfg, err := unmarshalSrcset(d)
+				if err != nil {
+					return err
+				}
+				t.Srcset = cfg
 			default:
 				return d.Errf("unrecognized subdirective: %s", d.Val())
 			}
@@ -0,0 +1,1405 @@
+package caddy_thumbs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/chai2010/webp"
+	"github.com/nfnt/resize"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// TestResizeTransparentEdges 左侧不透明红色、右侧全透明的原图缩小后, 半透明边缘还原为非预乘颜色时仍为红色.
+// 对照组按非预乘的通道直接插值, 透明像素的黑色会把边缘拉暗
+func TestResizeTransparentEdges(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 30; x++ {
+			src.SetNRGBA(x, y, color.NRGBA{0xFF, 0, 0, 0xFF})
+		}
+	}
+	// 对照组: 颜色通道按不透明图片插值, 相当于没有预乘 alpha
+	straight := image.NewRGBA(src.Rect)
+	copy(straight.Pix, src.Pix)
+	for i := 3; i < len(straight.Pix); i += 4 {
+		straight.Pix[i] = 0xFF
+	}
+	naive := resize.Resize(16, 16, straight, resize.Lanczos3)
+
+	ts := ThumbsServer{UpscaleFilter: "lanczos3", DownscaleFilter: "lanczos3"}
+	for name, resized := range map[string]image.Image{
+		"resizeImage":    ts.resizeImage(16, 16, src, 85, ""),
+		"thumbnailImage": ts.thumbnailImage(16, 16, src, 85, ""),
+	} {
+		edges := 0
+		for y := 0; y < 16; y++ {
+			for x := 0; x < 16; x++ {
+				c := color.NRGBAModel.Convert(resized.At(x, y)).(color.NRGBA)
+				if c.A < 0x20 || c.A > 0xE0 {
+					continue
+				}
+				edges++
+				if c.R < 0xF0 || c.G > 0x10 || c.B > 0x10 {
+					t.Errorf("%s: edge pixel (%d,%d) = %v, want red", name, x, y, c)
+				}
+				if r, _, _, _ := naive.At(x, y).RGBA(); uint8(r>>8) > c.R-0x40 {
+					t.Errorf("%s: edge pixel (%d,%d) red %d not brighter than straight-alpha %d", name, x, y, c.R, r>>8)
+				}
+			}
+		}
+		if edges == 0 {
+			t.Errorf("%s: no semi-transparent edge pixels", name)
+		}
+	}
+}
+
+// TestUpscalePolicy 按模式实际的缩放比例判断是否放大, clamp 按同一比例缩小宽高
+func TestUpscalePolicy(t *testing.T) {
+	tests := []struct {
+		policy, path string
+		status       int
+		w, h         int
+	}{
+		{UPSCALE_POLICY_ALLOW, "/c200x100/a.png", http.StatusOK, 200, 100},
+		{UPSCALE_POLICY_ALLOW, "/w400x200/a.png", http.StatusOK, 400, 200},
+		{UPSCALE_POLICY_DENY, "/c200x100/a.png", http.StatusBadRequest, 0, 0},
+		{UPSCALE_POLICY_DENY, "/w400x200/a.png", http.StatusBadRequest, 0, 0},
+		// 宽度缩小到 1/5, m 模式不会放大高度
+		{UPSCALE_POLICY_DENY, "/m20x2000/a.png", http.StatusOK, 20, 20},
+		// 裁剪模式按较大的比例 2 缩放, 宽高都除以 2
+		{UPSCALE_POLICY_CLAMP, "/c200x100/a.png", http.StatusOK, 100, 50},
+		// w 模式按较小的比例 2 缩放
+		{UPSCALE_POLICY_CLAMP, "/w400x200/a.png", http.StatusOK, 200, 100},
+		{UPSCALE_POLICY_CLAMP, "/c50x50/a.png", http.StatusOK, 50, 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+tt.path, func(t *testing.T) {
+			ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.UpscalePolicy = tt.policy })
+			src.put("/a.png", encodePNG(t, gradientImage(100, 100)))
+			w := get(t, ts, tt.path)
+			mustStatus(t, w, tt.status)
+			if tt.status != http.StatusOK {
+				return
+			}
+			if w, h := imageSize(t, w.Body.Bytes()); w != tt.w || h != tt.h {
+				t.Errorf("size = %dx%d, want %dx%d", w, h, tt.w, tt.h)
+			}
+		})
+	}
+}
+
+// TestFormatRule URL 不带扩展名时按 format_rule 推断输出格式, 缓存键与同名带扩展名的原图不冲突
+func TestFormatRule(t *testing.T) {
+	tests := []struct {
+		rule, defaultFormat, path string
+		want                      string // image.Decode 返回的格式名
+		key                       string
+	}{
+		{"webp", "", "/c20x20/foo", "webp", "/c20x20@/foo.webp"},
+		{".jpg", "", "/c20x20/foo", "jpeg", "/c20x20@/foo.jpg"},
+		{FORMAT_RULE_SOURCE, "", "/c20x20/foo", "png", "/c20x20@/foo.png"},
+		{"", "webp", "/c20x20/foo", "webp", "/c20x20@/foo.webp"},
+		{"", "png", "/c20x20/foo.v2", "png", "/c20x20@/foo.v2.png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule+tt.defaultFormat+tt.path, func(t *testing.T) {
+			ts, src, thumbs := newTestServer(t, func(ts *ThumbsServer) {
+				ts.FormatRule, ts.DefaultFormat = tt.rule, tt.defaultFormat
+			})
+			// 与推断结果同名的原图内容不同, 两者的缩略图不能互相命中
+			src.put("/foo", encodePNG(t, solidImage(40, 40, color.White)))
+			src.put("/foo.v2", encodePNG(t, solidImage(40, 40, color.White)))
+			named := path.Base(tt.key)
+			src.put(named, encodePNG(t, solidImage(40, 40, color.Black)))
+			mustStatus(t, get(t, ts, "/c20x20/"+named), http.StatusOK)
+
+			w := get(t, ts, tt.path)
+			mustStatus(t, w, http.StatusOK)
+			img, format := decodeBody(t, w.Body.Bytes())
+			if format != tt.want {
+				t.Errorf("format = %s, want %s", format, tt.want)
+			}
+			if r, _, _, _ := img.At(10, 10).RGBA(); r>>8 < 0xF0 {
+				t.Errorf("served the thumbnail of %s", named)
+			}
+			if _, ok := thumbs.get(tt.key); !ok {
+				t.Errorf("thumbnail not stored at %s, keys: %v", tt.key, thumbs.keys())
+			}
+		})
+	}
+}
+
+// TestDefaultFormat 没有扩展名或扩展名不是输出格式时使用 default_format, default_format 必须在 allowed_formats 中
+func TestDefaultFormat(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.DefaultFormat = "WEBP" })
+	src.put("/foo", encodePNG(t, gradientImage(40, 40)))
+	src.put("/foo.bin", encodePNG(t, gradientImage(40, 40)))
+	src.put("/foo.png", encodePNG(t, gradientImage(40, 40)))
+	for target, want := range map[string]string{"/c20x20/foo": "webp", "/c20x20/foo.bin": "webp", "/c20x20/foo.png": "png"} {
+		w := get(t, ts, target)
+		mustStatus(t, w, http.StatusOK)
+		if _, format := decodeBody(t, w.Body.Bytes()); format != want {
+			t.Errorf("%s: format = %s, want %s", target, format, want)
+		}
+	}
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	for _, tt := range []struct {
+		defaultFormat string
+		allowed       []string
+	}{
+		{"webp", []string{"jpg", "png"}},
+		{"svg", nil},
+		{"gif", nil},
+	} {
+		ts := &ThumbsServer{
+			ImageStorageRaw:  registerStorage(t, "src", newMemStorage()),
+			ThumbsStorageRaw: registerStorage(t, "thumbs", newMemStorage()),
+			DefaultFormat:    tt.defaultFormat,
+			AllowedFormats:   tt.allowed,
+		}
+		if err := ts.Provision(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := ts.Validate(); err == nil {
+			t.Errorf("default_format %s with allowed_formats %v passed validation", tt.defaultFormat, tt.allowed)
+		}
+	}
+}
+
+// TestTranscodeFromCache 已缓存同一原图同尺寸的其他格式时直接转码, 不读取原图
+func TestTranscodeFromCache(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) {
+		ts.FormatRule, ts.TranscodeFromCache = "jpg", true
+	})
+	src.put("/foo", encodePNG(t, gradientImage(40, 40)))
+	mustStatus(t, get(t, ts, "/c20x20/foo"), http.StatusOK)
+
+	// format_rule 改为 webp 后, 同一 URL 由缓存的 JPEG 转码
+	ts.FormatRule = ".webp"
+	loads := src.count("Load")
+	w := get(t, ts, "/c20x20/foo")
+	mustStatus(t, w, http.StatusOK)
+	img, format := decodeBody(t, w.Body.Bytes())
+	if format != "webp" || img.Bounds().Dx() != 20 || img.Bounds().Dy() != 20 {
+		t.Errorf("got %s %dx%d, want webp 20x20", format, img.Bounds().Dx(), img.Bounds().Dy())
+	}
+	if src.count("Load") != loads {
+		t.Errorf("source decoded although a same-size cached variant exists")
+	}
+}
+
+// TestTranscodeFromCacheOtherSource 同名不同扩展名的原图是不同的原图, 不能互相转码
+func TestTranscodeFromCacheOtherSource(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.TranscodeFromCache = true })
+	src.put("/a.jpg", encodeJPEG(t, solidImage(40, 40, color.Black), 90))
+	src.put("/a.webp", encodePNG(t, solidImage(40, 40, color.White)))
+	src.put("/a", encodePNG(t, solidImage(40, 40, color.White)))
+	mustStatus(t, get(t, ts, "/c20x20/a.jpg"), http.StatusOK)
+
+	for _, target := range []string{"/c20x20/a.webp", "/c20x20/a"} {
+		ts.FormatRule = ".webp"
+		w := get(t, ts, target)
+		mustStatus(t, w, http.StatusOK)
+		img, _ := decodeBody(t, w.Body.Bytes())
+		if r, _, _, _ := img.At(10, 10).RGBA(); r>>8 < 0xF0 {
+			t.Errorf("%s served the thumbnail of a.jpg", target)
+		}
+	}
+}
+
+// TestPreferSmaller 原图的 JPEG 编码比请求的 PNG 更小时返回 JPEG, 缓存键追加 .jpg 并在之后命中
+func TestPreferSmaller(t *testing.T) {
+	ts, src, thumbs := newTestServer(t, func(ts *ThumbsServer) { ts.PreferSmaller = true })
+	src.put("/a.png", encodePNG(t, noiseImage(128, 128)))
+
+	for range 2 {
+		w := get(t, ts, "/c64x64/a.png")
+		mustStatus(t, w, http.StatusOK)
+		if _, format := decodeBody(t, w.Body.Bytes()); format != "jpeg" {
+			t.Errorf("format = %s, want jpeg", format)
+		}
+	}
+	if _, ok := thumbs.get("/c64x64/a.png.jpg"); !ok {
+		t.Errorf("JPEG not stored under the suffixed key, keys: %v", thumbs.keys())
+	}
+}
+
+// TestMinModernFormatBytes 原图或输出小于 min_modern_format_bytes 时请求的 WebP 改用 JPEG, 带透明通道时改用 PNG;
+// 较大的图片仍输出 WebP, 缓存命中时返回降级后的格式
+func TestMinModernFormatBytes(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) {
+		ts.FormatRule, ts.MinModernFormatBytes = "webp", 4096
+	})
+	transparent := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	transparent.SetNRGBA(8, 8, color.NRGBA{255, 0, 0, 255})
+	src.put("/icon", encodePNG(t, solidImage(16, 16, color.NRGBA{255, 0, 0, 255})))
+	src.put("/alpha", encodePNG(t, transparent))
+	src.put("/photo", encodePNG(t, noiseImage(256, 256)))
+
+	for target, want := range map[string]string{"/c16x16/icon": "jpeg", "/c16x16/alpha": "png", "/c200x200/photo": "webp"} {
+		for range 2 {
+			w := get(t, ts, target)
+			mustStatus(t, w, http.StatusOK)
+			if _, format := decodeBody(t, w.Body.Bytes()); format != want {
+				t.Errorf("%s: format = %s, want %s", target, format, want)
+			}
+		}
+	}
+}
+
+// TestShortCacheFlag 带 short 标记的请求使用较短的 max-age 且不设置 Expires
+func TestShortCacheFlag(t *testing.T) {
+	ts, src, _ := newTestServer(t, nil)
+	src.put("/a.png", encodePNG(t, gradientImage(40, 40)))
+
+	w := get(t, ts, "/c20x20,short/a.png")
+	mustStatus(t, w, http.StatusOK)
+	if cc := w.Header().Get("Cache-Control"); cc != "public, max-age=60" {
+		t.Errorf("short Cache-Control = %q, want public, max-age=60", cc)
+	}
+	if expires := w.Header().Get("Expires"); expires != "" {
+		t.Errorf("short response has Expires %s", expires)
+	}
+
+	w = get(t, ts, "/c20x20/a.png")
+	mustStatus(t, w, http.StatusOK)
+	if cc := w.Header().Get("Cache-Control"); cc != "public, max-age=31536000" {
+		t.Errorf("Cache-Control = %q, want the one-year default", cc)
+	}
+}
+
+// TestStoreFailure 缩略图存储写入失败时仍然返回生成的缩略图
+func TestStoreFailure(t *testing.T) {
+	ts, src, thumbs := newTestServer(t, nil)
+	src.put("/a.png", encodePNG(t, gradientImage(40, 40)))
+	thumbs.storeErr = errors.New("disk full")
+
+	w := get(t, ts, "/c20x20/a.png")
+	mustStatus(t, w, http.StatusOK)
+	if w, h := imageSize(t, w.Body.Bytes()); w != 20 || h != 20 {
+		t.Errorf("size = %dx%d, want 20x20", w, h)
+	}
+	if thumbs.count("Store") == 0 {
+		t.Error("Store not attempted")
+	}
+}
+
+// TestMaxBytes 按字节预算降低质量, 输出不超过预算
+func TestMaxBytes(t *testing.T) {
+	const budget = 3000
+	ts, src, _ := newTestServer(t, nil)
+	src.put("/a.jpg", encodeJPEG(t, noiseImage(200, 200), 95))
+
+	w := get(t, ts, "/c100x100/a.jpg")
+	mustStatus(t, w, http.StatusOK)
+	if w.Body.Len() <= budget {
+		t.Fatalf("unbudgeted output is %d bytes, the budget has no effect", w.Body.Len())
+	}
+	w = get(t, ts, "/c100x100/a.jpg?maxbytes=3000")
+	mustStatus(t, w, http.StatusOK)
+	if w.Body.Len() > budget {
+		t.Errorf("output is %d bytes, want at most %d", w.Body.Len(), budget)
+	}
+	if w, h := imageSize(t, w.Body.Bytes()); w != 100 || h != 100 {
+		t.Errorf("size = %dx%d, want 100x100", w, h)
+	}
+}
+
+// TestMinQuality 字节预算无法满足时不低于 min_quality, 返回该质量的结果并带上实际字节数的响应头; 未配置时返回 422
+func TestMinQuality(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.MinQuality = 40 })
+	src.put("/a.jpg", encodeJPEG(t, noiseImage(200, 200), 95))
+
+	w := get(t, ts, "/c100x100/a.jpg?maxbytes=100")
+	mustStatus(t, w, http.StatusOK)
+	if got := w.Header().Get(budgetExceededHeader); got != strconv.Itoa(w.Body.Len()) {
+		t.Errorf("%s = %q, want %d", budgetExceededHeader, got, w.Body.Len())
+	}
+	floor := get(t, ts, "/c100x100,q40/a.jpg")
+	mustStatus(t, floor, http.StatusOK)
+	if !bytes.Equal(w.Body.Bytes(), floor.Body.Bytes()) {
+		t.Errorf("budgeted output is %d bytes, want the q40 output of %d bytes", w.Body.Len(), floor.Body.Len())
+	}
+	if got := floor.Header().Get(budgetExceededHeader); got != "" {
+		t.Errorf("unbudgeted response has %s: %s", budgetExceededHeader, got)
+	}
+
+	ts, src, _ = newTestServer(t, nil)
+	src.put("/a.jpg", encodeJPEG(t, noiseImage(200, 200), 95))
+	mustStatus(t, get(t, ts, "/c100x100/a.jpg?maxbytes=100"), http.StatusUnprocessableEntity)
+}
+
+// TestNoCache 无缓存模式不访问缩略图存储, 每次请求都重新生成
+func TestNoCache(t *testing.T) {
+	ts, src, thumbs := newTestServer(t, func(ts *ThumbsServer) { ts.NoCache = true })
+	src.put("/a.png", encodePNG(t, gradientImage(40, 40)))
+
+	for i := 1; i <= 2; i++ {
+		mustStatus(t, get(t, ts, "/c20x20/a.png"), http.StatusOK)
+		if n := src.count("Load"); n != i {
+			t.Errorf("after %d requests the source was loaded %d times", i, n)
+		}
+	}
+	for _, op := range []string{"Store", "Exists", "Load", "Stat"} {
+		if n := thumbs.count(op); n != 0 {
+			t.Errorf("thumbs storage %s called %d times", op, n)
+		}
+	}
+}
+
+// TestAllowedFormats 不允许的输出格式返回 415, 允许的格式正常生成
+func TestAllowedFormats(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.AllowedFormats = []string{"jpg", "PNG"} })
+	src.put("/a.png", encodePNG(t, gradientImage(40, 40)))
+	src.put("/a.webp", encodePNG(t, gradientImage(40, 40)))
+
+	mustStatus(t, get(t, ts, "/c20x20/a.png"), http.StatusOK)
+	mustStatus(t, get(t, ts, "/c20x20/a.webp"), http.StatusUnsupportedMediaType)
+}
+
+// TestImmutable 开启后缓存头带 immutable, 生成和缓存命中相同, short 请求不带
+func TestImmutable(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.Immutable = true })
+	src.put("/a.png", encodePNG(t, gradientImage(40, 40)))
+
+	for range 2 {
+		w := get(t, ts, "/c20x20/a.png")
+		mustStatus(t, w, http.StatusOK)
+		if cc := w.Header().Get("Cache-Control"); cc != "public, max-age=31536000, immutable" {
+			t.Errorf("Cache-Control = %q, want immutable", cc)
+		}
+	}
+	w := get(t, ts, "/c20x20,short/a.png")
+	mustStatus(t, w, http.StatusOK)
+	if cc := w.Header().Get("Cache-Control"); strings.Contains(cc, "immutable") {
+		t.Errorf("short Cache-Control = %q, want no immutable", cc)
+	}
+}
+
+// stallingReader 返回部分数据后阻塞, 直到 release 关闭
+type stallingReader struct {
+	data    []byte
+	release chan struct{}
+}
+
+func (r *stallingReader) Read(p []byte) (int, error) {
+	if len(r.data) > 0 {
+		n := copy(p, r.data)
+		r.data = r.data[n:]
+		return n, nil
+	}
+	<-r.release
+	return 0, io.EOF
+}
+
+// TestDecodeTimeout 解码超过 decode_timeout 时返回 422, 不等待读取结束
+func TestDecodeTimeout(t *testing.T) {
+	ts, _, _ := newTestServer(t, func(ts *ThumbsServer) {
+		ts.DecodeTimeout = caddy.Duration(50 * time.Millisecond)
+	})
+	data := encodePNG(t, gradientImage(100, 100))
+	reader := &stallingReader{data: data[:len(data)/2], release: make(chan struct{})}
+	defer close(reader.release)
+
+	start := time.Now()
+	_, err := ts.decodeImage(reader, 0, 0)
+	var handlerErr caddyhttp.HandlerError
+	if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("err = %v, want 422", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("decode returned after %s", elapsed)
+	}
+}
+
+// TestDecodeConcurrency WebP 解码受 decode_concurrency 中单独的限制, 占满后新的 WebP 解码等待, JPEG 解码不受影响
+func TestDecodeConcurrency(t *testing.T) {
+	ts, _, _ := newTestServer(t, func(ts *ThumbsServer) {
+		ts.DecodeConcurrency = map[string]int{"WebP": 1, "jpeg": 2}
+	})
+	var buf bytes.Buffer
+	// 数据需大于文件头嗅探的长度, 阻塞发生在读取剩余数据时
+	if err := webp.Encode(&buf, noiseImage(64, 64), &webp.Options{Quality: 80}); err != nil {
+		t.Fatal(err)
+	}
+	webpData := buf.Bytes()
+	jpegData := encodeJPEG(t, gradientImage(40, 40), 80)
+
+	// 第一个 WebP 解码读完数据后阻塞, 一直占用 WebP 的名额
+	stalled := &stallingReader{data: webpData, release: make(chan struct{})}
+	firstDone := make(chan error, 1)
+	go func() {
+		_, err := ts.decodeImage(stalled, 0, 0)
+		firstDone <- err
+	}()
+	for deadline := time.Now().Add(time.Second); len(ts.decodeSlots[".webp"]) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("first WebP decode did not take its slot")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	secondDone := make(chan error, 1)
+	go func() {
+		_, err := ts.decodeImage(bytes.NewReader(webpData), 0, 0)
+		secondDone <- err
+	}()
+	// WebP 名额占满时 JPEG 照常解码
+	for range 3 {
+		if _, err := ts.decodeImage(bytes.NewReader(jpegData), 0, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case err := <-secondDone:
+		t.Fatalf("second WebP decode finished while the limit was taken: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(stalled.release)
+	for _, done := range []chan error{firstDone, secondDone} {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("WebP decode did not finish after the slot was released")
+		}
+	}
+}
+
+// TestFractionalWebPQuality 小数质量参数原样传给 WebP 编码器
+func TestFractionalWebPQuality(t *testing.T) {
+	ts, _, _ := newTestServer(t, nil)
+	req, err := ts.parseRequest("/c20x20,q85.5/a.webp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.quality != 85.5 {
+		t.Fatalf("quality = %v, want 85.5", req.quality)
+	}
+
+	img := noiseImage(64, 64)
+	got, err := ts.encodeImage(img, req.quality, ".webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want, rounded bytes.Buffer
+	if err := webp.Encode(&want, img, &webp.Options{Quality: 85.5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := webp.Encode(&rounded, img, &webp.Options{Quality: 85}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Error("output differs from encoding at quality 85.5")
+	}
+	if bytes.Equal(got, rounded.Bytes()) {
+		t.Error("output equals encoding at quality 85, the fraction was dropped")
+	}
+}
+
+// TestStrictDimensions 51x51 的原图裁剪为 31x31 时缩放比例取整后只有 30x30, 无法覆盖画布的最后一行和一列.
+// 开启 strict_dimensions 后修正为完整覆盖
+func TestStrictDimensions(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.StrictDimensions = strict })
+		src.put("/a.png", encodePNG(t, solidImage(51, 51, color.Black)))
+
+		w := get(t, ts, "/c31x31/a.png")
+		mustStatus(t, w, http.StatusOK)
+		img, _ := decodeBody(t, w.Body.Bytes())
+		if b := img.Bounds(); b.Dx() != 31 || b.Dy() != 31 {
+			t.Fatalf("strict=%v: size = %dx%d, want 31x31", strict, b.Dx(), b.Dy())
+		}
+		_, _, _, a := img.At(30, 30).RGBA()
+		if covered := a>>8 == 0xFF; covered != strict {
+			t.Errorf("strict=%v: corner alpha = %d", strict, a>>8)
+		}
+	}
+}
+
+// TestCropAnchors 43x53 的原图裁剪为 31x31 时缩放结果为 30x38, 宽高都与目标不一致, 垂直方向仍按锚点对齐.
+// 原图纵向为绿色渐变, 由顶行和底行的绿色判断裁剪位置
+func TestCropAnchors(t *testing.T) {
+	tests := []struct {
+		mode  string
+		row   int
+		green func(uint32) bool
+	}{
+		{"lt", 0, func(g uint32) bool { return g < 8 }},
+		{"rb", 30, func(g uint32) bool { return g > 245 }},
+		{"cb", 30, func(g uint32) bool { return g > 245 }},
+	}
+	ts, src, _ := newTestServer(t, nil)
+	src.put("/a.png", encodePNG(t, gradientImage(43, 53)))
+	for _, tt := range tests {
+		w := get(t, ts, "/"+tt.mode+"31x31/a.png")
+		mustStatus(t, w, http.StatusOK)
+		img, _ := decodeBody(t, w.Body.Bytes())
+		if _, g, _, _ := img.At(10, tt.row).RGBA(); !tt.green(g >> 8) {
+			t.Errorf("%s: row %d green = %d", tt.mode, tt.row, g>>8)
+		}
+	}
+}
+
+// checkerImage 黑白相间的棋盘格, 每格 cell 像素
+func checkerImage(w, h, cell int) *image.NRGBA {
+	img := solidImage(w, h, color.White)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if (x/cell+y/cell)%2 == 0 {
+				img.Set(x, y, color.Black)
+			}
+		}
+	}
+	return img
+}
+
+// hasGray 判断图片中是否有介于黑白之间的像素
+func hasGray(img image.Image) bool {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if r, _, _, _ := img.At(x, y).RGBA(); r>>8 > 0x10 && r>>8 < 0xF0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TestScaleFilters 原图小于目标尺寸时使用 upscale_filter, 否则使用 downscale_filter.
+// 最近邻插值放大棋盘格只有黑白两色, 双线性插值缩小会混合出灰色
+func TestScaleFilters(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) {
+		ts.UpscaleFilter, ts.DownscaleFilter = "nearest", "bilinear"
+	})
+	src.put("/small.png", encodePNG(t, checkerImage(4, 4, 1)))
+	src.put("/large.png", encodePNG(t, checkerImage(64, 64, 1)))
+
+	w := get(t, ts, "/c32x32/small.png")
+	mustStatus(t, w, http.StatusOK)
+	if img, _ := decodeBody(t, w.Body.Bytes()); hasGray(img) {
+		t.Error("upscaled output has gray pixels, upscale_filter nearest not used")
+	}
+	w = get(t, ts, "/c32x32/large.png")
+	mustStatus(t, w, http.StatusOK)
+	if img, _ := decodeBody(t, w.Body.Bytes()); !hasGray(img) {
+		t.Error("downscaled output has no gray pixels, downscale_filter bilinear not used")
+	}
+}
+
+// TestQualityFilters 按请求质量选择 quality_filters 中阈值最低的匹配项, 没有匹配时使用缩放方向配置的插值算法
+func TestQualityFilters(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) {
+		ts.QualityFilters = []QualityFilter{{MaxQuality: 60, Filter: "bilinear"}, {MaxQuality: 30, Filter: "nearest"}}
+	})
+	filterName := func(interp resize.InterpolationFunction) string {
+		for name, f := range interpolationFilters {
+			if f == interp {
+				return name
+			}
+		}
+		return "unknown"
+	}
+	for _, tt := range []struct {
+		quality float32
+		want    string
+	}{{20, "nearest"}, {30, "nearest"}, {45, "bilinear"}, {60, "bilinear"}, {90, "lanczos3"}} {
+		for _, upscale := range []bool{false, true} {
+			if got := filterName(ts.interpolation(upscale, tt.quality, "")); got != tt.want {
+				t.Errorf("q%g upscale=%v: filter = %s, want %s", tt.quality, upscale, got, tt.want)
+			}
+		}
+	}
+
+	// 放大棋盘格: nearest 不产生灰色, lanczos3 产生灰色
+	src.put("/small.png", encodePNG(t, checkerImage(4, 4, 1)))
+	for target, gray := range map[string]bool{"/c32x32,q30/small.png": false, "/c32x32,q90/small.png": true} {
+		w := get(t, ts, target)
+		mustStatus(t, w, http.StatusOK)
+		if img, _ := decodeBody(t, w.Body.Bytes()); hasGray(img) != gray {
+			t.Errorf("%s: gray pixels = %v, want %v", target, !gray, gray)
+		}
+	}
+}
+
+// TestPercentSize 百分比尺寸按原图尺寸计算, 400x300 的 50% 为 200x150
+func TestPercentSize(t *testing.T) {
+	ts, src, _ := newTestServer(t, nil)
+	src.put("/a.png", encodePNG(t, gradientImage(400, 300)))
+
+	w := get(t, ts, "/c50px50p/a.png")
+	mustStatus(t, w, http.StatusOK)
+	if w, h := imageSize(t, w.Body.Bytes()); w != 200 || h != 150 {
+		t.Errorf("size = %dx%d, want 200x150", w, h)
+	}
+}
+
+// TestFallbackImageStorage 主原图存储中没有的原图从备用存储读取
+func TestFallbackImageStorage(t *testing.T) {
+	secondary := newMemStorage()
+	ts, primary, _ := newTestServer(t, func(ts *ThumbsServer) {
+		ts.FallbackImageStoragesRaw = []json.RawMessage{registerStorage(t, "secondary", secondary)}
+	})
+	secondary.put("/a.png", encodePNG(t, gradientImage(40, 40)))
+
+	w := get(t, ts, "/c20x20/a.png")
+	mustStatus(t, w, http.StatusOK)
+	if w, h := imageSize(t, w.Body.Bytes()); w != 20 || h != 20 {
+		t.Errorf("size = %dx%d, want 20x20", w, h)
+	}
+	if primary.count("Load")+primary.count("Exists")+primary.count("Stat") == 0 {
+		t.Error("primary storage not consulted")
+	}
+	mustStatus(t, get(t, ts, "/c20x20/missing.png"), http.StatusNotFound)
+}
+
+// TestNormalizePath 大写扩展名和连续的斜杠都能正常处理, 并使用同一个缓存条目
+func TestNormalizePath(t *testing.T) {
+	ts, src, thumbs := newTestServer(t, func(ts *ThumbsServer) { ts.NormalizePath = true })
+	src.put("/photos/a.JPG", encodeJPEG(t, gradientImage(40, 40), 90))
+
+	for _, target := range []string{"/c20x20/photos/a.JPG", "//c20x20//photos/a.JPG", "/c20x20/photos//a.JPG/"} {
+		w := get(t, ts, target)
+		mustStatus(t, w, http.StatusOK)
+		if _, format := decodeBody(t, w.Body.Bytes()); format != "jpeg" {
+			t.Errorf("%s: format = %s, want jpeg", target, format)
+		}
+	}
+	if n := thumbs.count("Store"); n != 1 {
+		t.Errorf("stored %d thumbnails, want 1: %v", n, thumbs.keys())
+	}
+}
+
+// TestRefresh 带正确密钥的 ?refresh=1 重新生成并覆盖缓存, 密钥错误时返回 403
+func TestRefresh(t *testing.T) {
+	ts, src, thumbs := newTestServer(t, func(ts *ThumbsServer) { ts.RefreshSecret = "s3cret" })
+	src.put("/a.png", encodePNG(t, solidImage(40, 40, color.Black)))
+	mustStatus(t, get(t, ts, "/c20x20/a.png"), http.StatusOK)
+	before, _ := thumbs.get("/c20x20/a.png")
+
+	// 原图更新后, 普通请求仍返回旧的缓存
+	src.put("/a.png", encodePNG(t, solidImage(40, 40, color.White)))
+	refresh := func(secret string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/c20x20/a.png?refresh=1", nil)
+		r.Header.Set(refreshHeader, secret)
+		return serve(t, ts, r)
+	}
+	mustStatus(t, refresh("wrong"), http.StatusForbidden)
+	if after, _ := thumbs.get("/c20x20/a.png"); !bytes.Equal(after, before) {
+		t.Fatal("cache replaced by a request with the wrong secret")
+	}
+
+	w := refresh("s3cret")
+	mustStatus(t, w, http.StatusOK)
+	after, _ := thumbs.get("/c20x20/a.png")
+	if bytes.Equal(after, before) {
+		t.Fatal("cached bytes not replaced")
+	}
+	if !bytes.Equal(after, w.Body.Bytes()) {
+		t.Error("cache differs from the refreshed response")
+	}
+	img, _ := decodeBody(t, after)
+	if r, _, _, _ := img.At(10, 10).RGBA(); r>>8 < 0xF0 {
+		t.Error("refreshed thumbnail not generated from the updated source")
+	}
+}
+
+// TestFocalPoint 裁剪窗口以焦点为中心. 200x100 的横向渐变裁剪为 50x50 时缩放为 100x50,
+// fp60x50 的中心位于缩放后的 x=60, 对应原图 x=120
+func TestFocalPoint(t *testing.T) {
+	ts, src, _ := newTestServer(t, nil)
+	src.put("/a.png", encodePNG(t, gradientImage(200, 100)))
+
+	tests := []struct {
+		path string
+		x    int // 输出中心对应的原图横坐标
+	}{
+		{"/c50x50,fp60x50/a.png", 120},
+		// 窗口超出左边缘时贴齐左边缘, 中心为缩放后的 x=25
+		{"/c50x50,fp20x50/a.png", 50},
+		{"/c50x50/a.png", 100},
+	}
+	for _, tt := range tests {
+		w := get(t, ts, tt.path)
+		mustStatus(t, w, http.StatusOK)
+		img, _ := decodeBody(t, w.Body.Bytes())
+		r, _, _, _ := img.At(25, 25).RGBA()
+		if want := tt.x * 255 / 199; int(r>>8) < want-8 || int(r>>8) > want+8 {
+			t.Errorf("%s: center red = %d, want about %d", tt.path, r>>8, want)
+		}
+	}
+}
+
+// TestStrictSourceType 内容与扩展名不符的原图默认只记录警告, 开启 strict_source_type 时返回 415
+func TestStrictSourceType(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.StrictSourceType = strict })
+		core, logs := observer.New(zap.WarnLevel)
+		ts.logger = zap.New(core)
+		src.put("/photo.jpg", encodePNG(t, gradientImage(40, 40)))
+
+		w := get(t, ts, "/c20x20/photo.jpg")
+		if strict {
+			mustStatus(t, w, http.StatusUnsupportedMediaType)
+			continue
+		}
+		mustStatus(t, w, http.StatusOK)
+		if logs.FilterMessage("Source content does not match its extension").Len() != 1 {
+			t.Errorf("mismatch not logged, logs: %v", logs.All())
+		}
+	}
+}
+
+// TestEncodeImage 每种输出格式都编码为可解码的同尺寸图片, 返回的数据不受缓冲区放回池中后复用的影响
+func TestEncodeImage(t *testing.T) {
+	ts, _, _ := newTestServer(t, nil)
+	img := gradientImage(48, 32)
+	for _, tt := range []struct{ format, name string }{
+		{".jpg", "jpeg"}, {".jpeg", "jpeg"}, {".png", "png"}, {".webp", "webp"}, {".jxl", "jxl"},
+	} {
+		t.Run(tt.format, func(t *testing.T) {
+			data, err := ts.encodeImage(img, 80, tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			kept := bytes.Clone(data)
+			// 下一次编码复用池中的缓冲区, 不能改写已返回的数据
+			if _, err := ts.encodeImage(noiseImage(48, 32), 80, tt.format); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, kept) {
+				t.Fatal("returned data was overwritten by the next encode")
+			}
+			got, format := decodeBody(t, data)
+			if format != tt.name || got.Bounds().Dx() != 48 || got.Bounds().Dy() != 32 {
+				t.Errorf("got %s %dx%d, want %s 48x32", format, got.Bounds().Dx(), got.Bounds().Dy(), tt.name)
+			}
+		})
+	}
+	if _, err := ts.encodeImage(img, 80, ".bmp"); err == nil {
+		t.Error("unsupported format encoded without error")
+	}
+}
+
+// TestTransparentCrop 透明原图裁剪为 PNG 时保留透明区域, 裁剪为 JPEG 时透明区域合成到背景色上而不是黑色
+func TestTransparentCrop(t *testing.T) {
+	ts, src, _ := newTestServer(t, nil)
+	// 左半透明, 右半不透明蓝色
+	img := image.NewNRGBA(image.Rect(0, 0, 80, 60))
+	for y := 0; y < 60; y++ {
+		for x := 40; x < 80; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{0, 0, 255, 255})
+		}
+	}
+	src.put("/t", encodePNG(t, img))
+
+	ts.FormatRule = ".png"
+	w := get(t, ts, "/c40x40,ff0000/t")
+	mustStatus(t, w, http.StatusOK)
+	thumb, format := decodeBody(t, w.Body.Bytes())
+	if _, _, _, a := thumb.At(2, 20).RGBA(); format != "png" || a != 0 {
+		t.Errorf("%s left pixel alpha = %d, want transparent png", format, a>>8)
+	}
+	if r, g, b, a := thumb.At(37, 20).RGBA(); r>>8 > 0x10 || g>>8 > 0x10 || b>>8 < 0xF0 || a>>8 != 0xFF {
+		t.Errorf("png right pixel = %v, want opaque blue", thumb.At(37, 20))
+	}
+
+	ts.FormatRule = ".jpg"
+	for target, want := range map[string]color.NRGBA{
+		"/c40x40,ff0000/t": {0xFF, 0, 0, 0xFF},
+		"/c40x40/t":        {0xFF, 0xFF, 0xFF, 0xFF},
+	} {
+		w := get(t, ts, target)
+		mustStatus(t, w, http.StatusOK)
+		thumb, format := decodeBody(t, w.Body.Bytes())
+		got := color.NRGBAModel.Convert(thumb.At(2, 20)).(color.NRGBA)
+		near := func(a, b uint8) bool { return max(a, b)-min(a, b) < 16 }
+		if format != "jpeg" || !near(got.R, want.R) || !near(got.G, want.G) || !near(got.B, want.B) {
+			t.Errorf("%s: %s left pixel = %v, want %v", target, format, got, want)
+		}
+	}
+}
+
+// TestCacheKeyHeader 不同 cache_key_header 请求头的值缓存到不同的分区, 未携带时使用 default 分区, 响应带 Vary
+func TestCacheKeyHeader(t *testing.T) {
+	ts, src, thumbs := newTestServer(t, func(ts *ThumbsServer) { ts.CacheKeyHeader = "X-Tenant" })
+	src.put("/a.png", encodePNG(t, gradientImage(40, 40)))
+
+	request := func(tenant string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/c20x20/a.png", nil)
+		if tenant != "" {
+			r.Header.Set("X-Tenant", tenant)
+		}
+		w := serve(t, ts, r)
+		mustStatus(t, w, http.StatusOK)
+		return w
+	}
+	w := request("acme")
+	if vary := w.Header().Values("Vary"); !slices.Contains(vary, "X-Tenant") {
+		t.Errorf("Vary = %v, want X-Tenant", vary)
+	}
+	request("globex")
+	request("")
+	// 不能作为目录名的值使用哈希
+	request("../etc")
+
+	keys := thumbs.keys()
+	for _, want := range []string{"/@acme/c20x20/a.png", "/@globex/c20x20/a.png", "/@default/c20x20/a.png"} {
+		if !slices.Contains(keys, want) {
+			t.Errorf("missing cache entry %s, keys: %v", want, keys)
+		}
+	}
+	if len(keys) != 4 {
+		t.Errorf("got %d cache entries, want 4: %v", len(keys), keys)
+	}
+	// 同一分区再次请求命中缓存
+	loads := src.count("Load")
+	request("acme")
+	if n := src.count("Load"); n != loads {
+		t.Error("second request for the same tenant reloaded the source")
+	}
+}
+
+// TestStripPrefix 配置 strip_prefix 后去掉前缀再匹配, 原图路径不含前缀, 原图路径中像模式的目录不影响匹配
+func TestStripPrefix(t *testing.T) {
+	ts, src, thumbs := newTestServer(t, func(ts *ThumbsServer) { ts.StripPrefix = "media/" })
+	src.put("/foo.jpg", encodeJPEG(t, solidImage(200, 200, color.NRGBA{0, 0, 255, 255}), 90))
+	src.put("/media/foo.jpg", encodeJPEG(t, solidImage(200, 200, color.NRGBA{255, 0, 0, 255}), 90))
+	src.put("/photos/w50x50/bar.jpg", encodeJPEG(t, solidImage(200, 200, color.White), 90))
+
+	w := get(t, ts, "/media/w100x100/foo.jpg")
+	mustStatus(t, w, http.StatusOK)
+	img, _ := decodeBody(t, w.Body.Bytes())
+	if r, _, b, _ := img.At(50, 50).RGBA(); r>>8 > 0x20 || b>>8 < 0xE0 {
+		t.Errorf("color = %v, want the blue /foo.jpg", img.At(50, 50))
+	}
+	if _, ok := thumbs.get("/w100x100/foo.jpg"); !ok {
+		t.Errorf("thumbnail not stored at /w100x100/foo.jpg, keys: %v", thumbs.keys())
+	}
+
+	w = get(t, ts, "/media/w100x100/photos/w50x50/bar.jpg")
+	mustStatus(t, w, http.StatusOK)
+	if w, h := imageSize(t, w.Body.Bytes()); w != 100 || h != 100 {
+		t.Errorf("size = %dx%d, want 100x100", w, h)
+	}
+}
+
+// TestWModeAnchors w 模式缩放结果两个方向都小于目标尺寸时(原图小于目标, 不放大), 填充仍按 wlt/wrb 的锚点对齐
+func TestWModeAnchors(t *testing.T) {
+	ts, src, _ := newTestServer(t, nil)
+	src.put("/a.png", encodePNG(t, solidImage(30, 20, color.NRGBA{255, 0, 0, 255})))
+
+	isRed := func(c color.Color) bool {
+		r, g, b, _ := c.RGBA()
+		return r>>8 > 0xF0 && g>>8 < 0x10 && b>>8 < 0x10
+	}
+	for _, tt := range []struct {
+		mode         string
+		image, blank image.Point // 原图所在角和对角的像素
+	}{
+		{"wlt", image.Pt(2, 2), image.Pt(97, 97)},
+		{"wrb", image.Pt(97, 97), image.Pt(2, 2)},
+		{"wcc", image.Pt(50, 50), image.Pt(2, 2)},
+	} {
+		w := get(t, ts, "/"+tt.mode+"100x100,ffffff/a.png")
+		mustStatus(t, w, http.StatusOK)
+		img, _ := decodeBody(t, w.Body.Bytes())
+		if b := img.Bounds(); b.Dx() != 100 || b.Dy() != 100 {
+			t.Fatalf("%s: size = %dx%d, want 100x100", tt.mode, b.Dx(), b.Dy())
+		}
+		if !isRed(img.At(tt.image.X, tt.image.Y)) {
+			t.Errorf("%s: pixel %v = %v, want the source", tt.mode, tt.image, img.At(tt.image.X, tt.image.Y))
+		}
+		if isRed(img.At(tt.blank.X, tt.blank.Y)) {
+			t.Errorf("%s: pixel %v is the source, want padding", tt.mode, tt.blank)
+		}
+	}
+}
+
+// TestModeMaxDimension 裁剪模式超过 mode_max_dimension 时返回 400, 同义的模式共用限制, 同样尺寸的 m 模式使用 max_dimension
+func TestModeMaxDimension(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) {
+		ts.MaxDimension, ts.ModeMaxDimension = 1000, map[string]int{"c": 300}
+	})
+	src.put("/a.png", encodePNG(t, gradientImage(500, 500)))
+
+	for target, status := range map[string]int{
+		"/c400x400/a.png":  http.StatusBadRequest,
+		"/cc400x400/a.png": http.StatusBadRequest,
+		"/c300x300/a.png":  http.StatusOK,
+		"/m400x400/a.png":  http.StatusOK,
+		"/m1200x400/a.png": http.StatusBadRequest,
+	} {
+		if w := get(t, ts, target); w.Code != status {
+			t.Errorf("%s: status = %d, want %d (body: %.200s)", target, w.Code, status, w.Body.String())
+		}
+	}
+}
+
+// TestEncodeFallback 开启 encode_fallback 时 WebP 编码失败(宽度超过 WebP 的上限)改用 JPEG 输出并记录警告,
+// 降级的结果不缓存, 每次请求都重新尝试 WebP; 未开启时返回错误
+func TestEncodeFallback(t *testing.T) {
+	setup := func(fallback bool) func(*ThumbsServer) {
+		return func(ts *ThumbsServer) {
+			ts.FormatRule, ts.MaxDimension, ts.EncodeFallback = "webp", 20000, fallback
+		}
+	}
+	// WebP 最大支持 16383 像素宽
+	source := encodePNG(t, gradientImage(16400, 2))
+
+	ts, src, thumbs := newTestServer(t, setup(true))
+	src.put("/wide", source)
+	core, logs := observer.New(zap.WarnLevel)
+	ts.logger = zap.New(core)
+	for range 2 {
+		w := get(t, ts, "/m16400x2/wide")
+		mustStatus(t, w, http.StatusOK)
+		if _, format := decodeBody(t, w.Body.Bytes()); format != "jpeg" {
+			t.Errorf("format = %s, want the jpeg fallback", format)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "image/jpeg" {
+			t.Errorf("Content-Type = %s, want image/jpeg", ct)
+		}
+	}
+	if n := logs.FilterMessageSnippet("falling back to JPEG").Len(); n != 2 {
+		t.Errorf("fallback logged %d times, want once per request", n)
+	}
+	if keys := thumbs.keys(); len(keys) != 0 {
+		t.Errorf("fallback result was cached: %v", keys)
+	}
+
+	ts, src, _ = newTestServer(t, setup(false))
+	src.put("/wide", source)
+	if w := get(t, ts, "/m16400x2/wide"); w.Code < http.StatusInternalServerError {
+		t.Errorf("status = %d without encode_fallback, want an error", w.Code)
+	}
+}
+
+// TestDefaultVariant 不带模式目录的原图路径按 default_variant 生成缩略图, 与显式请求该模式目录共用缓存; 未配置时不匹配
+func TestDefaultVariant(t *testing.T) {
+	ts, src, thumbs := newTestServer(t, func(ts *ThumbsServer) { ts.DefaultVariant = "/m100x100,q80/" })
+	src.put("/foo.jpg", encodeJPEG(t, gradientImage(400, 200), 90))
+	src.put("/photos/bar.jpg", encodeJPEG(t, gradientImage(200, 400), 90))
+
+	w := get(t, ts, "/foo.jpg")
+	mustStatus(t, w, http.StatusOK)
+	img, format := decodeBody(t, w.Body.Bytes())
+	if format != "jpeg" || img.Bounds().Dx() != 100 || img.Bounds().Dy() != 50 {
+		t.Errorf("got %s %dx%d, want jpeg 100x50", format, img.Bounds().Dx(), img.Bounds().Dy())
+	}
+	if w, h := imageSize(t, get(t, ts, "/photos/bar.jpg").Body.Bytes()); w != 50 || h != 100 {
+		t.Errorf("nested source size = %dx%d, want 50x100", w, h)
+	}
+	loads := src.count("Load")
+	explicit := get(t, ts, "/m100x100,q80/foo.jpg")
+	mustStatus(t, explicit, http.StatusOK)
+	if src.count("Load") != loads || !bytes.Equal(explicit.Body.Bytes(), w.Body.Bytes()) {
+		t.Errorf("explicit variant did not hit the default variant's cache entry, keys: %v", thumbs.keys())
+	}
+
+	ts, src, _ = newTestServer(t, nil)
+	src.put("/foo.jpg", encodeJPEG(t, gradientImage(400, 200), 90))
+	if w := get(t, ts, "/foo.jpg"); w.Code == http.StatusOK {
+		t.Error("bare source path served without default_variant")
+	}
+}
+
+// TestDebugHeaders 开启 debug_headers 时首次请求返回 MISS 和生成耗时, 再次请求返回 HIT 且没有生成耗时; 未开启时不返回
+func TestDebugHeaders(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.DebugHeaders = true })
+	src.put("/a.jpg", encodeJPEG(t, noiseImage(400, 400), 90))
+
+	w := get(t, ts, "/c200x200/a.jpg")
+	mustStatus(t, w, http.StatusOK)
+	if got := w.Header().Get(debugCacheHeader); got != "MISS" {
+		t.Errorf("first %s = %q, want MISS", debugCacheHeader, got)
+	}
+	if ms, err := strconv.Atoi(w.Header().Get(debugGenMsHeader)); err != nil || ms < 0 {
+		t.Errorf("first %s = %q, want the generation time in milliseconds", debugGenMsHeader, w.Header().Get(debugGenMsHeader))
+	}
+	if got := w.Header().Get(debugModeHeader); got != "c" {
+		t.Errorf("%s = %q, want c", debugModeHeader, got)
+	}
+
+	w = get(t, ts, "/c200x200/a.jpg")
+	mustStatus(t, w, http.StatusOK)
+	if got := w.Header().Get(debugCacheHeader); got != "HIT" {
+		t.Errorf("second %s = %q, want HIT", debugCacheHeader, got)
+	}
+	if got := w.Header().Get(debugGenMsHeader); got != "" {
+		t.Errorf("cache hit has %s %s", debugGenMsHeader, got)
+	}
+
+	ts, src, _ = newTestServer(t, nil)
+	src.put("/a.jpg", encodeJPEG(t, noiseImage(40, 40), 90))
+	w = get(t, ts, "/c20x20/a.jpg")
+	for _, header := range []string{debugCacheHeader, debugModeHeader, debugGenMsHeader} {
+		if got := w.Header().Get(header); got != "" {
+			t.Errorf("%s = %q without debug_headers", header, got)
+		}
+	}
+}
+
+// TestEdgeModes long 按长边、short 按短边缩放, 另一边按比例计算, 横图和竖图都适用; long/short 只接受单一尺寸
+func TestEdgeModes(t *testing.T) {
+	ts, src, _ := newTestServer(t, nil)
+	src.put("/landscape.png", encodePNG(t, gradientImage(400, 200)))
+	src.put("/portrait.png", encodePNG(t, gradientImage(200, 400)))
+
+	for _, tt := range []struct {
+		target string
+		w, h   int
+	}{
+		{"/long100/landscape.png", 100, 50},
+		{"/long100/portrait.png", 50, 100},
+		{"/short100/landscape.png", 200, 100},
+		{"/short100/portrait.png", 100, 200},
+	} {
+		w := get(t, ts, tt.target)
+		mustStatus(t, w, http.StatusOK)
+		if w, h := imageSize(t, w.Body.Bytes()); w != tt.w || h != tt.h {
+			t.Errorf("%s: size = %dx%d, want %dx%d", tt.target, w, h, tt.w, tt.h)
+		}
+	}
+	mustStatus(t, get(t, ts, "/long100x100/landscape.png"), http.StatusBadRequest)
+}
+
+// TestCorruptSource 空文件和截断的 JPEG 返回 422 并说明原图损坏或为空, 与不支持的格式(415)区分
+func TestCorruptSource(t *testing.T) {
+	ts, src, _ := newTestServer(t, nil)
+	jpg := encodeJPEG(t, noiseImage(100, 100), 90)
+	src.put("/empty.jpg", nil)
+	src.put("/truncated.jpg", jpg[:len(jpg)/2])
+	src.put("/header.jpg", jpg[:4])
+	src.put("/text.jpg", []byte("this is not an image at all"))
+
+	for _, target := range []string{"/c20x20/empty.jpg", "/c20x20/truncated.jpg", "/c20x20/header.jpg"} {
+		w := get(t, ts, target)
+		mustStatus(t, w, http.StatusUnprocessableEntity)
+		if !strings.Contains(w.Body.String(), "corrupt or empty source") {
+			t.Errorf("%s: error %q does not mention a corrupt or empty source", target, w.Body.String())
+		}
+	}
+	w := get(t, ts, "/c20x20/text.jpg")
+	mustStatus(t, w, http.StatusUnsupportedMediaType)
+	if strings.Contains(w.Body.String(), "corrupt or empty source") {
+		t.Errorf("unsupported format reported as corrupt: %s", w.Body.String())
+	}
+}
+
+// TestQualityRange quality_range 将超出范围的质量参数限制到边界, 同一格式的 jpeg 扩展名共用范围, 其他格式不受影响
+func TestQualityRange(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) {
+		ts.QualityRange = map[string]QualityRange{"JPG": {Min: 40, Max: 90}}
+	})
+	src.put("/a.jpg", encodeJPEG(t, noiseImage(100, 100), 95))
+	src.put("/a.jpeg", encodeJPEG(t, noiseImage(100, 100), 95))
+	src.put("/b", encodePNG(t, noiseImage(100, 100)))
+	body := func(target string) []byte {
+		t.Helper()
+		w := get(t, ts, target)
+		mustStatus(t, w, http.StatusOK)
+		return w.Body.Bytes()
+	}
+
+	for clamped, bound := range map[string]string{
+		"/c50x50,q100/a.jpg":  "/c50x50,q90/a.jpg",
+		"/c50x50,q10/a.jpg":   "/c50x50,q40/a.jpg",
+		"/c50x50,q100/a.jpeg": "/c50x50,q90/a.jpeg",
+	} {
+		if !bytes.Equal(body(clamped), body(bound)) {
+			t.Errorf("%s was not clamped to %s", clamped, bound)
+		}
+	}
+	if bytes.Equal(body("/c50x50,q60/a.jpg"), body("/c50x50,q90/a.jpg")) {
+		t.Error("quality within the range was changed")
+	}
+	ts.FormatRule = ".webp"
+	if bytes.Equal(body("/c50x50,q100/b"), body("/c50x50,q90/b")) {
+		t.Error("webp quality was clamped by the jpg range")
+	}
+}
+
+// TestRequireSource 原图删除后默认仍返回已缓存的尺寸, 新尺寸返回 404; 开启 require_source 时已缓存的尺寸同样返回 404
+func TestRequireSource(t *testing.T) {
+	for _, require := range []bool{false, true} {
+		ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.RequireSource = require })
+		src.put("/a.png", encodePNG(t, gradientImage(40, 40)))
+		mustStatus(t, get(t, ts, "/c20x20/a.png"), http.StatusOK)
+		if err := src.Delete(ts.ctx, "/a.png"); err != nil {
+			t.Fatal(err)
+		}
+
+		cached := http.StatusOK
+		if require {
+			cached = http.StatusNotFound
+		}
+		if w := get(t, ts, "/c20x20/a.png"); w.Code != cached {
+			t.Errorf("require_source %v: cached size status = %d, want %d", require, w.Code, cached)
+		}
+		if w := get(t, ts, "/c10x10/a.png"); w.Code != http.StatusNotFound {
+			t.Errorf("require_source %v: new size status = %d, want 404", require, w.Code)
+		}
+	}
+}
+
+// TestMPad 开启 m_pad 时 m 模式的输出精确为请求的尺寸, 上下的填充区域使用 URL 中的背景色; 未开启时保持等比缩放的尺寸
+func TestMPad(t *testing.T) {
+	source := encodePNG(t, solidImage(200, 100, color.NRGBA{0, 0, 0xFF, 0xFF}))
+
+	plain, plainSrc, _ := newTestServer(t, nil)
+	plainSrc.put("/a.png", source)
+	w := get(t, plain, "/m100x100/a.png")
+	mustStatus(t, w, http.StatusOK)
+	if width, height := imageSize(t, w.Body.Bytes()); width != 100 || height != 50 {
+		t.Errorf("plain m = %dx%d, want 100x50", width, height)
+	}
+
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.MPad = true })
+	src.put("/a.png", source)
+	w = get(t, ts, "/m100x100,ff0000/a.png")
+	mustStatus(t, w, http.StatusOK)
+	img, _ := decodeBody(t, w.Body.Bytes())
+	if b := img.Bounds(); b.Dx() != 100 || b.Dy() != 100 {
+		t.Fatalf("m_pad = %dx%d, want 100x100", b.Dx(), b.Dy())
+	}
+	if got := color.NRGBAModel.Convert(img.At(50, 5)).(color.NRGBA); got != (color.NRGBA{0xFF, 0, 0, 0xFF}) {
+		t.Errorf("padding = %v, want the background color", got)
+	}
+	if got := color.NRGBAModel.Convert(img.At(50, 50)).(color.NRGBA); got != (color.NRGBA{0, 0, 0xFF, 0xFF}) {
+		t.Errorf("center = %v, want the source color", got)
+	}
+}
+
+// TestSizeStep 开启 size_step 时相近的尺寸取整到同一尺寸, 共用一个缓存条目, 输出为取整后的尺寸
+func TestSizeStep(t *testing.T) {
+	ts, src, thumbs := newTestServer(t, func(ts *ThumbsServer) { ts.SizeStep = 50 })
+	src.put("/a.png", encodePNG(t, gradientImage(400, 400)))
+
+	for _, target := range []string{"/wcc203x198/a.png", "/wcc199x204/a.png", "/wcc220x180/a.png"} {
+		w := get(t, ts, target)
+		mustStatus(t, w, http.StatusOK)
+		if width, height := imageSize(t, w.Body.Bytes()); width != 200 || height != 200 {
+			t.Errorf("%s = %dx%d, want 200x200", target, width, height)
+		}
+	}
+	if keys := thumbs.keys(); !slices.Equal(keys, []string{"/wcc200x200/a.png"}) {
+		t.Errorf("cached keys = %v, want only /wcc200x200/a.png", keys)
+	}
+	if n := thumbs.count("Store"); n != 1 {
+		t.Errorf("Store called %d times, want 1", n)
+	}
+
+	w := get(t, ts, "/long226/a.png")
+	mustStatus(t, w, http.StatusOK)
+	if width, height := imageSize(t, w.Body.Bytes()); width != 250 || height != 250 {
+		t.Errorf("long226 = %dx%d, want 250x250", width, height)
+	}
+}
+
+// TestMaxPathLength 请求路径超过 max_path_length 时在匹配之前返回 414, 未超过时正常处理
+func TestMaxPathLength(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.MaxPathLength = 64 })
+	src.put("/a.png", encodePNG(t, gradientImage(40, 40)))
+
+	mustStatus(t, get(t, ts, "/m20x20/a.png"), http.StatusOK)
+	accesses := func() int { return src.count("Load") + src.count("Stat") + src.count("Exists") }
+	before := accesses()
+	long := "/m20x20/" + strings.Repeat("a", 64) + ".png"
+	mustStatus(t, get(t, ts, long), http.StatusRequestURITooLong)
+	if n := accesses() - before; n != 0 {
+		t.Errorf("source storage accessed %d times for the long path, want 0", n)
+	}
+
+	unlimited, _, _ := newTestServer(t, nil)
+	mustStatus(t, get(t, unlimited, long), http.StatusNotFound)
+}
+
+// TestDownload ?download 参数以附件形式返回, Content-Disposition 中包含指定的文件名, 未指定文件名时使用原图文件名和输出格式;
+// 默认不设置 Content-Disposition
+func TestDownload(t *testing.T) {
+	ts, src, _ := newTestServer(t, nil)
+	src.put("/dir/a.png", encodePNG(t, gradientImage(40, 40)))
+
+	for _, tc := range []struct{ target, want string }{
+		{"/m20x20/dir/a.png?download=photo.png", `attachment; filename=photo.png`},
+		{"/m20x20/dir/a.png?download=../../etc/x.png", `attachment; filename=x.png`},
+		{"/m20x20/dir/a.png?download", `attachment; filename=a.png`},
+		{"/m20x20/dir/a.png?download=" + url.QueryEscape("相册 1.png"), `attachment; filename*=utf-8''%E7%9B%B8%E5%86%8C%201.png`},
+	} {
+		// 生成和缓存命中的响应都带有下载头
+		for _, state := range []string{"first", "second"} {
+			w := get(t, ts, tc.target)
+			mustStatus(t, w, http.StatusOK)
+			if got := w.Header().Get("Content-Disposition"); got != tc.want {
+				t.Errorf("%s %s: Content-Disposition = %q, want %q", state, tc.target, got, tc.want)
+			}
+		}
+	}
+
+	w := get(t, ts, "/m20x20/dir/a.png")
+	mustStatus(t, w, http.StatusOK)
+	if got := w.Header().Get("Content-Disposition"); got != "" {
+		t.Errorf("inline request: Content-Disposition = %q, want empty", got)
+	}
+}
+
+// TestStrictQuality 默认超出 0-100 的质量参数使用 default_quality; 开启 strict_quality 时返回 400, 范围内的质量不受影响
+func TestStrictQuality(t *testing.T) {
+	source := encodeJPEG(t, gradientImage(80, 80), 95)
+
+	lenient, lenientSrc, _ := newTestServer(t, func(ts *ThumbsServer) { ts.DefaultQuality = 60 })
+	lenientSrc.put("/a.jpg", source)
+	w := get(t, lenient, "/m40x40,q150/a.jpg")
+	mustStatus(t, w, http.StatusOK)
+	if got := jpegQuality(w.Body.Bytes()); got < 59 || got > 61 {
+		t.Errorf("q150 output quality = %d, want default_quality 60", got)
+	}
+
+	strict, strictSrc, _ := newTestServer(t, func(ts *ThumbsServer) { ts.StrictQuality = true })
+	strictSrc.put("/a.jpg", source)
+	mustStatus(t, get(t, strict, "/m40x40,q150/a.jpg"), http.StatusBadRequest)
+	mustStatus(t, get(t, strict, "/m40x40,q100.5/a.jpg"), http.StatusBadRequest)
+	w = get(t, strict, "/m40x40,q70/a.jpg")
+	mustStatus(t, w, http.StatusOK)
+	if got := jpegQuality(w.Body.Bytes()); got < 69 || got > 71 {
+		t.Errorf("q70 output quality = %d, want 70", got)
+	}
+}
+
+// TestAnimatedGIFSource 不支持 GIF 原图, 多帧 GIF 在识别格式时即返回 415, 不会逐帧解码和缩放
+func TestAnimatedGIFSource(t *testing.T) {
+	anim := &gif.GIF{}
+	for i := 0; i < 200; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 64, 64), palette.Plan9)
+		for j := range frame.Pix {
+			frame.Pix[j] = uint8(i + j)
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 1)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+
+	ts, src, thumbs := newTestServer(t, func(ts *ThumbsServer) { ts.FormatRule = ".jpg" })
+	src.put("/anim.gif", buf.Bytes())
+	src.put("/anim", buf.Bytes())
+	for _, target := range []string{"/m32x32/anim.gif", "/m32x32/anim"} {
+		mustStatus(t, get(t, ts, target), http.StatusUnsupportedMediaType)
+	}
+	if n := thumbs.count("Store"); n != 0 {
+		t.Errorf("Store called %d times, want 0", n)
+	}
+}
+
+// TestZeroSizeSource 解码为 0x0 的原图在所有模式和 BlurHash 请求中返回 422 并说明尺寸为 0, 不会在比例计算中除以 0
+func TestZeroSizeSource(t *testing.T) {
+	ts, src, thumbs := newTestServer(t, func(ts *ThumbsServer) { ts.BlurHashPath = "/_blurhash" })
+	src.put("/zero.jpg", encodeJPEG(t, image.NewNRGBA(image.Rect(0, 0, 0, 0)), 90))
+
+	for _, target := range []string{"/m20x20/zero.jpg", "/c20x20/zero.jpg", "/wcc20x20/zero.jpg", "/long20/zero.jpg", "/m50px50p/zero.jpg", "/_blurhash?source=zero.jpg"} {
+		w := get(t, ts, target)
+		mustStatus(t, w, http.StatusUnprocessableEntity)
+		if !strings.Contains(w.Body.String(), "zero size") {
+			t.Errorf("%s: error %q does not mention the zero size", target, w.Body.String())
+		}
+	}
+	if n := thumbs.count("Store"); n != 0 {
+		t.Errorf("Store called %d times, want 0", n)
+	}
+}
+
+// TestModeFilters mode_filters 中配置的模式使用覆盖的插值算法, 其他模式仍使用默认的 lanczos3; 同义的模式共用配置
+func TestModeFilters(t *testing.T) {
+	source := noiseImage(64, 64)
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.ModeFilters = map[string]string{"m": "nearest", "w": "bilinear"} })
+	plain, plainSrc, _ := newTestServer(t, nil)
+	src.put("/a.png", encodePNG(t, source))
+	plainSrc.put("/a.png", encodePNG(t, source))
+
+	render := func(ts *ThumbsServer, target string) image.Image {
+		t.Helper()
+		w := get(t, ts, target)
+		mustStatus(t, w, http.StatusOK)
+		img, _ := decodeBody(t, w.Body.Bytes())
+		return img
+	}
+	for target, filter := range map[string]resize.InterpolationFunction{
+		"/m32x32/a.png":   resize.NearestNeighbor,
+		"/wcc32x32/a.png": resize.Bilinear,
+	} {
+		want := resize.Thumbnail(32, 32, source, filter)
+		if diff := maxChannelDiff(render(ts, target), want); diff > 1 {
+			t.Errorf("%s: differs from the overridden filter by %d", target, diff)
+		}
+		if diff := maxChannelDiff(render(plain, target), want); diff <= 1 {
+			t.Errorf("%s: default output matches the overridden filter", target)
+		}
+	}
+	for _, target := range []string{"/c32x32/a.png", "/long32/a.png"} {
+		if diff := maxChannelDiff(render(ts, target), render(plain, target)); diff != 0 {
+			t.Errorf("%s: differs from the default filter by %d", target, diff)
+		}
+	}
+	// 模式的插值算法代替缩放方向的配置, quality_filters 仍然优先
+	ts.QualityFilters = []QualityFilter{{MaxQuality: 30, Filter: "bicubic"}}
+	if got := ts.interpolation(true, 85, "nearest"); got != resize.NearestNeighbor {
+		t.Error("mode filter did not override upscale_filter")
+	}
+	if got := ts.interpolation(false, 20, "nearest"); got != resize.Bicubic {
+		t.Error("quality filter did not take precedence over the mode filter")
+	}
+}
+
+// BenchmarkEncodeImage 对比使用 encodeBufferPool 和每次新建缓冲区的编码, 池化后省去缓冲区反复扩容的分配
+func BenchmarkEncodeImage(b *testing.B) {
+	var (
+		ts  ThumbsServer
+		img = toRGBA(noiseImage(256, 256))
+	)
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := ts.encodeImage(img, 85, ".jpg"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var buf bytes.Buffer
+			if err := ts.encodeImageTo(&buf, img, 85, ".jpg"); err != nil {
+				b.Fatal(err)
+			}
+			_ = bytes.Clone(buf.Bytes())
+		}
+	})
+}
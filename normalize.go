@@ -0,0 +1,123 @@
+package caddy_thumbs
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// QualityNormalization 将统一的感知质量映射为各编码器的原生质量, 使同一质量在不同格式下的观感接近.
+// 未配置曲线的有损格式使用内置曲线
+type QualityNormalization struct {
+	// 按输出格式配置的映射曲线, 如 webp、jxl
+	Curves map[string][]QualityPoint `json:"curves,omitempty"`
+}
+
+// QualityPoint 曲线上的一个点: 感知质量 Quality 对应编码器质量 Native, 点之间线性插值
+type QualityPoint struct {
+	Quality float32 `json:"quality"`
+	Native  float32 `json:"native"`
+}
+
+// defaultQualityCurves 以 JPEG 质量为感知基准的内置曲线. 同等观感下 WebP 和 JPEG XL 所需的质量值更低
+var defaultQualityCurves = map[string][]QualityPoint{
+	".webp": {{0, 0}, {50, 40}, {80, 74}, {90, 86}, {100, 100}},
+	".jxl":  {{0, 0}, {50, 45}, {80, 75}, {90, 88}, {100, 100}},
+}
+
+// provision 统一格式名, 按感知质量排序, 并补充未配置格式的内置曲线
+func (n *QualityNormalization) provision() {
+	curves := make(map[string][]QualityPoint, len(n.Curves)+len(defaultQualityCurves))
+	for format, points := range n.Curves {
+		format = formatKey(format)
+		slices.SortFunc(points, func(a, b QualityPoint) int { return cmp.Compare(a.Quality, b.Quality) })
+		curves[format] = points
+	}
+	for format, points := range defaultQualityCurves {
+		if _, ok := curves[format]; !ok {
+			curves[format] = points
+		}
+	}
+	n.Curves = curves
+}
+
+// validate 曲线只能用于有损格式, 且必须单调, 否则按字节预算搜索质量时结果不可预期
+func (n *QualityNormalization) validate() error {
+	for format, points := range n.Curves {
+		if !isLossyFormat(format) {
+			return fmt.Errorf("normalize_quality only applies to lossy formats (jpg, webp, jxl): %s", format)
+		}
+		if len(points) == 0 {
+			return fmt.Errorf("normalize_quality curve for %s is empty", format)
+		}
+		for i, p := range points {
+			if p.Quality < 0 || p.Quality > 100 || p.Native < 0 || p.Native > 100 {
+				return fmt.Errorf("normalize_quality values for %s must be between 0 and 100", format)
+			}
+			if i > 0 && (p.Quality == points[i-1].Quality || p.Native < points[i-1].Native) {
+				return fmt.Errorf("normalize_quality curve for %s must be strictly increasing in quality and not decreasing in native quality", format)
+			}
+		}
+	}
+	return nil
+}
+
+// native 返回格式的编码器质量, 没有曲线的格式原样返回. 超出曲线范围时取端点的值
+func (n *QualityNormalization) native(quality float32, format string) float32 {
+	points := n.Curves[format]
+	if len(points) == 0 {
+		return quality
+	}
+	if quality <= points[0].Quality {
+		return points[0].Native
+	}
+	for i := 1; i < len(points); i++ {
+		if quality <= points[i].Quality {
+			a, b := points[i-1], points[i]
+			return a.Native + (quality-a.Quality)*(b.Native-a.Native)/(b.Quality-a.Quality)
+		}
+	}
+	return points[len(points)-1].Native
+}
+
+// encoderQuality 开启 normalize_quality 时将请求的感知质量映射为编码器质量
+func (t ThumbsServer) encoderQuality(quality float32, format string) float32 {
+	if t.NormalizeQuality == nil {
+		return quality
+	}
+	return t.NormalizeQuality.native(quality, formatKey(format))
+}
+
+// unmarshalQualityNormalization 解析 normalize_quality 块, 每行为 <格式> <感知质量>:<编码器质量>...
+func unmarshalQualityNormalization(d *caddyfile.Dispenser) (*QualityNormalization, error) {
+	cfg := new(QualityNormalization)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		format := d.Val()
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return nil, d.ArgErr()
+		}
+		points := make([]QualityPoint, 0, len(args))
+		for _, arg := range args {
+			q, native, ok := strings.Cut(arg, ":")
+			if !ok {
+				return nil, d.Errf("invalid normalize_quality point, expected quality:native: %s", arg)
+			}
+			qv, err1 := strconv.ParseFloat(q, 32)
+			nv, err2 := strconv.ParseFloat(native, 32)
+			if err1 != nil || err2 != nil {
+				return nil, d.Errf("invalid normalize_quality point: %s", arg)
+			}
+			points = append(points, QualityPoint{Quality: float32(qv), Native: float32(nv)})
+		}
+		if cfg.Curves == nil {
+			cfg.Curves = make(map[string][]QualityPoint)
+		}
+		cfg.Curves[format] = points
+	}
+	return cfg, nil
+}
@@ -0,0 +1,53 @@
+package caddy_thumbs
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestNormalizeQuality 同一感知质量映射为各格式不同的编码器质量: JPEG 原样使用, WebP 使用配置的曲线, JPEG XL 使用内置曲线;
+// 未开启时所有格式使用请求的质量
+func TestNormalizeQuality(t *testing.T) {
+	ts, _, _ := newTestServer(t, func(ts *ThumbsServer) {
+		ts.NormalizeQuality = &QualityNormalization{Curves: map[string][]QualityPoint{
+			"WebP": {{100, 60}, {0, 0}},
+		}}
+	})
+	want := map[string]float32{".jpg": 80, ".jpeg": 80, ".webp": 48, ".jxl": 75, ".png": 80}
+	seen := make(map[float32]bool)
+	for format, native := range want {
+		got := ts.encoderQuality(80, format)
+		if got != native {
+			t.Errorf("%s: encoder quality = %g, want %g", format, got, native)
+		}
+		seen[got] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("q80 mapped to %d distinct encoder qualities, want 3", len(seen))
+	}
+	// 曲线范围之外取端点的值
+	if got := ts.encoderQuality(100, ".webp"); got != 60 {
+		t.Errorf("webp q100 = %g, want 60", got)
+	}
+
+	plain, _, _ := newTestServer(t, nil)
+	for format := range want {
+		if got := plain.encoderQuality(80, format); got != 80 {
+			t.Errorf("without normalize_quality %s: encoder quality = %g, want 80", format, got)
+		}
+	}
+
+	// 编码器收到的是映射后的质量
+	img := noiseImage(64, 64)
+	normalized, err := ts.encodeImage(img, 80, ".webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	native, err := plain.encodeImage(img, 48, ".webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(normalized, native) {
+		t.Errorf("normalized q80 webp is %d bytes, want the q48 output of %d bytes", len(normalized), len(native))
+	}
+}
@@ -0,0 +1,45 @@
+package caddy_thumbs
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// OptimizerConfig 外部优化程序配置, 编码后的图片通过标准输入传入, 从标准输出读取优化结果
+type OptimizerConfig struct {
+	// 程序路径, 如 /usr/bin/jpegtran
+	Command string `json:"command,omitempty"`
+	// 命令行参数, 如 -copy none -optimize
+	Args []string `json:"args,omitempty"`
+}
+
+// optimize 使用输出格式对应的外部程序优化编码结果. 程序出错、超时或结果没有变小时使用原始数据
+func (t ThumbsServer) optimize(data []byte, format string) []byte {
+	opt, ok := t.Optimizers[format]
+	if !ok || opt == nil {
+		return data
+	}
+
+	ctx, cancel := context.WithTimeout(t.ctx, time.Duration(t.OptimizerTimeout))
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, opt.Command, opt.Args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.logger.Warn("External optimizer failed, using unoptimized output",
+			zap.String("command", opt.Command), zap.String("stderr", strings.TrimSpace(stderr.String())), zap.Error(err))
+		return data
+	}
+	if stdout.Len() == 0 || stdout.Len() >= len(data) {
+		return data
+	}
+	t.logger.Debug("Optimized thumbnail", zap.String("format", format), zap.Int("before", len(data)), zap.Int("after", stdout.Len()))
+	return stdout.Bytes()
+}
@@ -0,0 +1,33 @@
+package caddy_thumbs
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestOptimizer 输出格式配置了外部优化程序时使用程序的输出, 程序失败时使用原始编码结果
+func TestOptimizer(t *testing.T) {
+	ts, src, thumbs := newTestServer(t, func(ts *ThumbsServer) {
+		ts.Optimizers = map[string]*OptimizerConfig{
+			"png": {Command: "/bin/sh", Args: []string{"-c", "cat >/dev/null; printf optimized"}},
+			"jpg": {Command: "/bin/sh", Args: []string{"-c", "exit 1"}},
+		}
+	})
+	src.put("/a.png", encodePNG(t, gradientImage(40, 40)))
+	src.put("/a.jpg", encodeJPEG(t, gradientImage(40, 40), 90))
+
+	w := get(t, ts, "/c20x20/a.png")
+	mustStatus(t, w, http.StatusOK)
+	if body := w.Body.String(); body != "optimized" {
+		t.Errorf("body = %.40q, want the optimizer output", body)
+	}
+	if data, _ := thumbs.get("/c20x20/a.png"); string(data) != "optimized" {
+		t.Error("cached thumbnail is not the optimizer output")
+	}
+
+	w = get(t, ts, "/c20x20/a.jpg")
+	mustStatus(t, w, http.StatusOK)
+	if w, h := imageSize(t, w.Body.Bytes()); w != 20 || h != 20 {
+		t.Errorf("fallback size = %dx%d, want 20x20", w, h)
+	}
+}
@@ -0,0 +1,71 @@
+package caddy_thumbs
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"testing"
+)
+
+// withEXIFOrientation 在 JPEG 的 SOI 之后插入只含方向标签的 EXIF APP1 段
+func withEXIFOrientation(jpg []byte, orientation uint16) []byte {
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	tiff = binary.LittleEndian.AppendUint16(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, exifOrientationTag)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 3) // SHORT
+	tiff = binary.LittleEndian.AppendUint32(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+
+	out := append([]byte{}, jpg[:2]...)
+	out = append(out, 0xFF, 0xE1)
+	out = binary.BigEndian.AppendUint16(out, uint16(len(payload)+2))
+	out = append(out, payload...)
+	return append(out, jpg[2:]...)
+}
+
+// hasAPP1 判断 JPEG 在图像数据之前是否有 APP1 段
+func hasAPP1(jpg []byte) bool {
+	for i := 2; i+4 <= len(jpg) && jpg[i] == 0xFF; {
+		marker := jpg[i+1]
+		if marker == 0xE1 {
+			return true
+		}
+		if marker == 0xDA {
+			return false
+		}
+		i += 2 + int(binary.BigEndian.Uint16(jpg[i+2:]))
+	}
+	return false
+}
+
+// TestAutoOrient 方向为 6 (顺时针旋转 90 度) 的横向原图输出为纵向, 原图左侧的红色在顶部, 输出不带 EXIF
+func TestAutoOrient(t *testing.T) {
+	ts, src, _ := newTestServer(t, nil)
+	img := solidImage(80, 40, color.NRGBA{0, 0, 0xFF, 0xFF})
+	draw.Draw(img, image.Rect(0, 0, 20, 40), image.NewUniform(color.NRGBA{0xFF, 0, 0, 0xFF}), image.Point{}, draw.Src)
+	source := withEXIFOrientation(encodeJPEG(t, img, 95), 6)
+	if orientation := jpegOrientation(source); orientation != 6 {
+		t.Fatalf("fixture orientation = %d, want 6", orientation)
+	}
+	src.put("/a.jpg", source)
+
+	w := get(t, ts, "/m40x40/a.jpg")
+	mustStatus(t, w, http.StatusOK)
+	if hasAPP1(w.Body.Bytes()) {
+		t.Error("output JPEG has an APP1 segment")
+	}
+	out, _ := decodeBody(t, w.Body.Bytes())
+	if b := out.Bounds(); b.Dx() != 20 || b.Dy() != 40 {
+		t.Fatalf("size = %dx%d, want 20x40", b.Dx(), b.Dy())
+	}
+	if r, _, b, _ := out.At(10, 2).RGBA(); r>>8 < 0xC0 || b>>8 > 0x40 {
+		t.Errorf("top pixel = %d,%d, want red", r>>8, b>>8)
+	}
+	if r, _, b, _ := out.At(10, 37).RGBA(); r>>8 > 0x40 || b>>8 < 0xC0 {
+		t.Errorf("bottom pixel = %d,%d, want blue", r>>8, b>>8)
+	}
+}
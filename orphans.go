@@ -0,0 +1,153 @@
+package caddy_thumbs
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// OrphanPurgeConfig 周期性删除原图已不存在的缩略图
+type OrphanPurgeConfig struct {
+	// 清理周期, 默认 1h
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// 每秒最多检查的原图数量, 默认 20
+	Rate int `json:"rate,omitempty"`
+}
+
+// runOrphanPurge 按周期清理孤立的缩略图
+func (t ThumbsServer) runOrphanPurge() {
+	ticker := time.NewTicker(time.Duration(t.OrphanPurge.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+			t.purgeOrphans()
+		}
+	}
+}
+
+// purgeOrphans 遍历索引, 删除原图已不存在的缩略图及其占位图、校验信息. 每个原图只检查一次,
+// 检查按 rate 限速, 避免对原图存储造成压力. 无法确定原图是否存在时保留缩略图
+func (t ThumbsServer) purgeOrphans() {
+	var keys []string
+	t.index.each(func(key string, _ int64) {
+		keys = append(keys, key)
+	})
+	var (
+		limiter = time.NewTicker(time.Second / time.Duration(t.OrphanPurge.Rate))
+		exists  = make(map[string]bool)
+		removed int
+	)
+	defer limiter.Stop()
+	for _, key := range keys {
+		orphan := true
+		for _, source := range orphanSourceCandidates(key) {
+			found, checked := exists[source]
+			if !checked {
+				select {
+				case <-t.ctx.Done():
+					return
+				case <-limiter.C:
+				}
+				found = t.sourceExists(source)
+				exists[source] = found
+			}
+			if found {
+				orphan = false
+				break
+			}
+		}
+		if !orphan {
+			continue
+		}
+		if err := t.thumbsStorage.Delete(t.ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			t.logger.Warn("Failed to delete orphaned thumbnail", zap.String("path", key), zap.Error(err))
+			continue
+		}
+		t.index.remove(key)
+		t.forgetVariant(key)
+		removed++
+		t.logger.Debug("Deleted orphaned thumbnail", zap.String("path", key))
+	}
+	if removed > 0 {
+		t.logger.Info("Orphaned thumbnails purged", zap.Int("removed", removed), zap.Int("checked_sources", len(exists)))
+	}
+}
+
+// sourceExists 检查原图是否存在于归档或任一原图存储中. 存储返回除不存在以外的错误时视为存在
+func (t ThumbsServer) sourceExists(imagePath string) bool {
+	if t.archive != nil {
+		open, err := t.archive.lookup(archiveEntryName(imagePath))
+		if err != nil || open != nil {
+			return true
+		}
+	}
+	for _, storage := range t.imageStorages {
+		_, err := storage.Stat(t.ctx, path.Join("/", imagePath))
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return true
+		}
+	}
+	return false
+}
+
+// orphanSourceCandidates 由缓存键推算可能的原图路径. 缓存键为 [/@分区]/模式目录/原图路径, 其后可能追加
+// format_rule 的输出格式、降级格式和占位图、平均颜色、校验信息的后缀, 因此逐个去掉这些后缀得到候选路径
+func orphanSourceCandidates(key string) []string {
+	key = strings.TrimPrefix(key, "/")
+	if strings.HasPrefix(key, cacheBucketPrefix) {
+		_, key, _ = strings.Cut(key, "/")
+	}
+	_, source, ok := strings.Cut(key, "/")
+	if !ok || source == "" {
+		return nil
+	}
+	source = companionOwner(source)
+	candidates := []string{source}
+	for range 2 {
+		ext := path.Ext(source)
+		if !slices.Contains(outputFormats, strings.ToLower(ext)) || ext == source {
+			break
+		}
+		source = strings.TrimSuffix(source, ext)
+		candidates = append(candidates, source)
+	}
+	return candidates
+}
+
+func unmarshalOrphanPurge(d *caddyfile.Dispenser) (*OrphanPurgeConfig, error) {
+	cfg := new(OrphanPurgeConfig)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		key := d.Val()
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		switch key {
+		case "interval":
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid interval value: %s", d.Val())
+			}
+			cfg.Interval = caddy.Duration(dur)
+		case "rate":
+			val, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid rate value: %s", d.Val())
+			}
+			cfg.Rate = val
+		default:
+			return nil, d.Errf("unrecognized orphan_purge subdirective: %s", key)
+		}
+	}
+	return cfg, nil
+}
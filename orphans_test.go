@@ -0,0 +1,41 @@
+package caddy_thumbs
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+// TestPurgeOrphans 原图删除后, 下一次清理删除它的所有缩略图并更新索引, 其他原图的缩略图保留
+func TestPurgeOrphans(t *testing.T) {
+	ts, src, thumbs := newTestServer(t, func(ts *ThumbsServer) { ts.OrphanPurge = &OrphanPurgeConfig{Rate: 1000} })
+	src.put("/photos/a.png", encodePNG(t, gradientImage(40, 40)))
+	src.put("/photos/b.png", encodePNG(t, gradientImage(40, 40)))
+	for _, target := range []string{"/c20x20/photos/a.png", "/m30x30/photos/a.png", "/c20x20/photos/b.png"} {
+		mustStatus(t, get(t, ts, target), http.StatusOK)
+	}
+	before := thumbs.keys()
+	if len(before) != 3 {
+		t.Fatalf("got %d cached thumbnails, want 3: %v", len(before), before)
+	}
+
+	// 原图存在时清理不删除任何缩略图
+	ts.purgeOrphans()
+	if keys := thumbs.keys(); !slices.Equal(keys, before) {
+		t.Fatalf("purge removed thumbnails of existing sources: %v -> %v", before, keys)
+	}
+
+	if err := src.Delete(ts.ctx, "/photos/a.png"); err != nil {
+		t.Fatal(err)
+	}
+	ts.purgeOrphans()
+	keys := thumbs.keys()
+	if len(keys) != 1 || keys[0] != "/c20x20/photos/b.png" {
+		t.Errorf("after purge keys = %v, want only /c20x20/photos/b.png", keys)
+	}
+	var indexed []string
+	ts.index.each(func(key string, _ int64) { indexed = append(indexed, key) })
+	if !slices.Equal(indexed, keys) {
+		t.Errorf("index = %v, want %v", indexed, keys)
+	}
+}
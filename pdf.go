@@ -0,0 +1,55 @@
+package caddy_thumbs
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// pdfHeader PDF 文件头
+var pdfHeader = []byte("%PDF-")
+
+// errPDFNotCompiled 未使用 pdf 构建标签编译时, PDF 原图无法栅格化
+var errPDFNotCompiled = errors.New("pdf support is not compiled in, build with -tags pdf")
+
+// pdfPage PDF 页面的栅格化接口, 由 pdf 构建标签下的实现提供, 避免默认构建引入 MuPDF
+type pdfPage interface {
+	// bounds 页面尺寸, 单位为点(1/72 英寸)
+	bounds() (float64, float64)
+	// render 按 dpi 栅格化页面
+	render(dpi float64) (image.Image, error)
+	close()
+}
+
+// rasterizePDF 栅格化 PDF 的第一页. 与 SVG 相同, 按覆盖目标尺寸的比例选择分辨率, 极端纵横比时退回到适应目标尺寸
+func (t ThumbsServer) rasterizePDF(data []byte, width, height uint) (image.Image, error) {
+	if !t.PDFSources {
+		return nil, caddyhttp.Error(http.StatusUnsupportedMediaType, errors.New("pdf sources are not enabled"))
+	}
+	page, err := openPDFFirstPage(data)
+	if errors.Is(err, errPDFNotCompiled) {
+		return nil, caddyhttp.Error(http.StatusUnsupportedMediaType, err)
+	}
+	if err != nil {
+		return nil, caddyhttp.Error(http.StatusUnprocessableEntity, fmt.Errorf("corrupt or empty source: %v", err))
+	}
+	defer page.close()
+
+	pw, ph := page.bounds()
+	if pw <= 0 || ph <= 0 {
+		return nil, caddyhttp.Error(http.StatusUnprocessableEntity, errors.New("corrupt or empty source: pdf page has no size"))
+	}
+	scale := math.Max(float64(width)/pw, float64(height)/ph)
+	if pw*scale > float64(t.MaxDimension) || ph*scale > float64(t.MaxDimension) {
+		scale = math.Min(float64(width)/pw, float64(height)/ph)
+	}
+	img, err := page.render(72 * scale)
+	if err != nil {
+		return nil, caddyhttp.Error(http.StatusUnprocessableEntity, fmt.Errorf("failed to render pdf: %v", err))
+	}
+	return img, nil
+}
@@ -0,0 +1,43 @@
+//go:build pdf
+
+package caddy_thumbs
+
+import (
+	"image"
+
+	"github.com/gen2brain/go-fitz"
+)
+
+// fitzPage 使用 MuPDF 栅格化的 PDF 页面
+type fitzPage struct {
+	doc *fitz.Document
+}
+
+// openPDFFirstPage 打开 PDF 并定位到第一页
+func openPDFFirstPage(data []byte) (pdfPage, error) {
+	doc, err := fitz.NewFromMemory(data)
+	if err != nil {
+		return nil, err
+	}
+	if doc.NumPage() == 0 {
+		doc.Close()
+		return nil, fitz.ErrPageMissing
+	}
+	return fitzPage{doc: doc}, nil
+}
+
+func (p fitzPage) bounds() (float64, float64) {
+	rect, err := p.doc.Bound(0)
+	if err != nil {
+		return 0, 0
+	}
+	return float64(rect.Dx()), float64(rect.Dy())
+}
+
+func (p fitzPage) render(dpi float64) (image.Image, error) {
+	return p.doc.ImageDPI(0, dpi)
+}
+
+func (p fitzPage) close() {
+	p.doc.Close()
+}
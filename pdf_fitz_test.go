@@ -0,0 +1,32 @@
+//go:build pdf
+
+package caddy_thumbs
+
+import (
+	"image/color"
+	"net/http"
+	"testing"
+)
+
+// TestPDFSource 开启 pdf_sources 时栅格化一页 PDF 的第一页, 按请求的尺寸生成缩略图, 左红右蓝
+func TestPDFSource(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.PDFSources = true })
+	src.put("/doc.pdf", onePagePDF(200, 100))
+
+	w := get(t, ts, "/m100x100/doc.pdf")
+	mustStatus(t, w, http.StatusOK)
+	img, _ := decodeBody(t, w.Body.Bytes())
+	if b := img.Bounds(); b.Dx() != 100 || b.Dy() != 50 {
+		t.Fatalf("size = %dx%d, want 100x50", b.Dx(), b.Dy())
+	}
+	near := func(a, b uint8) bool { return max(a, b)-min(a, b) < 16 }
+	for _, tc := range []struct {
+		x    int
+		want color.NRGBA
+	}{{20, color.NRGBA{0xFF, 0, 0, 0xFF}}, {80, color.NRGBA{0, 0, 0xFF, 0xFF}}} {
+		got := color.NRGBAModel.Convert(img.At(tc.x, 25)).(color.NRGBA)
+		if !near(got.R, tc.want.R) || !near(got.G, tc.want.G) || !near(got.B, tc.want.B) {
+			t.Errorf("pixel (%d,25) = %v, want %v", tc.x, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !pdf
+
+package caddy_thumbs
+
+// openPDFFirstPage 默认构建不包含 PDF 栅格化
+func openPDFFirstPage(data []byte) (pdfPage, error) {
+	return nil, errPDFNotCompiled
+}
@@ -0,0 +1,40 @@
+package caddy_thumbs
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// onePagePDF 构造一页 width x height 点的 PDF, 左半边填充红色, 右半边填充蓝色
+func onePagePDF(width, height int) []byte {
+	content := fmt.Sprintf("1 0 0 rg 0 0 %d %d re f 0 0 1 rg %d 0 %d %d re f", width/2, height, width/2, width-width/2, height)
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Contents 4 0 R >>", width, height),
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+	}
+	var b strings.Builder
+	b.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return []byte(b.String())
+}
+
+// TestPDFSourcesDisabled 未开启 pdf_sources 时 PDF 原图返回 415
+func TestPDFSourcesDisabled(t *testing.T) {
+	ts, src, _ := newTestServer(t, nil)
+	src.put("/doc.pdf", onePagePDF(200, 100))
+	mustStatus(t, get(t, ts, "/m100x100/doc.pdf"), http.StatusUnsupportedMediaType)
+}
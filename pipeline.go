@@ -0,0 +1,126 @@
+package caddy_thumbs
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"strconv"
+	"strings"
+)
+
+// pipelineOp 缩放后依次执行的图像处理操作, URL 中写作 m200x200.blur5.gray
+type pipelineOp struct {
+	name string
+	arg  int
+	spec pipelineOpSpec
+}
+
+// pipelineOpSpec 操作的参数范围和实现
+type pipelineOpSpec struct {
+	minArg, maxArg int // 参数范围, 均为 0 时表示不带参数
+	apply          func(img *image.RGBA, arg int) *image.RGBA
+}
+
+// pipelineOps 内置操作, 配置的 ImageFilter 模块在 Provision 时合并到实例的操作表中
+var pipelineOps = map[string]pipelineOpSpec{
+	"blur": {minArg: 1, maxArg: 50, apply: blurImage},
+	"gray": {apply: grayImage},
+}
+
+// parsePipeline 从模式目录中解析操作列表, 如 m200x200.blur5.gray,q80 中的 blur5 和 gray
+func parsePipeline(modeDir string, specs map[string]pipelineOpSpec) ([]pipelineOp, error) {
+	head, _, _ := strings.Cut(modeDir, ",")
+	tokens := strings.Split(head, ".")[1:]
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	ops := make([]pipelineOp, 0, len(tokens))
+	for _, token := range tokens {
+		name := strings.TrimRight(token, "0123456789")
+		spec, ok := specs[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown pipeline operation: %s", token)
+		}
+		op := pipelineOp{name: name, spec: spec}
+		if argStr := token[len(name):]; argStr != "" || spec.maxArg > 0 {
+			arg, err := strconv.Atoi(argStr)
+			if err != nil || arg < spec.minArg || arg > spec.maxArg {
+				return nil, fmt.Errorf("invalid argument for %s: %q (must be between %d and %d)", name, argStr, spec.minArg, spec.maxArg)
+			}
+			op.arg = arg
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// applyPipeline 依次执行操作列表
+func applyPipeline(img image.Image, ops []pipelineOp) image.Image {
+	if len(ops) == 0 {
+		return img
+	}
+	rgba := toRGBA(img)
+	for _, op := range ops {
+		rgba = op.spec.apply(rgba, op.arg)
+	}
+	return rgba
+}
+
+// toRGBA 转换为以 (0,0) 为原点的 RGBA 图片
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) && rgba.Stride == 4*rgba.Rect.Dx() {
+		return rgba
+	}
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	return dst
+}
+
+// blurImage 半径为 radius 的盒式模糊, 水平和垂直各做一次滑动窗口平均
+func blurImage(img *image.RGBA, radius int) *image.RGBA {
+	var (
+		w, h = img.Rect.Dx(), img.Rect.Dy()
+		tmp  = image.NewRGBA(img.Rect)
+		dst  = image.NewRGBA(img.Rect)
+	)
+	boxBlurPass(img.Pix, tmp.Pix, w, h, img.Stride, 4, radius)
+	boxBlurPass(tmp.Pix, dst.Pix, h, w, 4, img.Stride, radius)
+	return dst
+}
+
+// boxBlurPass 沿一个方向做滑动窗口平均, step 为相邻像素的间距, lineStep 为相邻行(列)的间距
+func boxBlurPass(src, dst []uint8, length, lines, lineStep, step, radius int) {
+	for line := 0; line < lines; line++ {
+		base := line * lineStep
+		for c := 0; c < 4; c++ {
+			var sum, n int
+			for i := 0; i <= min(radius, length-1); i++ {
+				sum += int(src[base+i*step+c])
+				n++
+			}
+			for i := 0; i < length; i++ {
+				dst[base+i*step+c] = uint8(sum / n)
+				if out := i - radius; out >= 0 {
+					sum -= int(src[base+out*step+c])
+					n--
+				}
+				if in := i + radius + 1; in < length {
+					sum += int(src[base+in*step+c])
+					n++
+				}
+			}
+		}
+	}
+}
+
+// grayImage 按 BT.601 亮度转换为灰度, 保留透明通道
+func grayImage(img *image.RGBA, _ int) *image.RGBA {
+	dst := image.NewRGBA(img.Rect)
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		r, g, b := int(img.Pix[i]), int(img.Pix[i+1]), int(img.Pix[i+2])
+		y := uint8((299*r + 587*g + 114*b + 500) / 1000)
+		dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = y, y, y, img.Pix[i+3]
+	}
+	return dst
+}
@@ -0,0 +1,35 @@
+package caddy_thumbs
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"testing"
+)
+
+// TestPipeline 串联 blur 和 gray 两个操作: 输出为灰度, 红蓝两半之间的边缘被模糊
+func TestPipeline(t *testing.T) {
+	ts, src, _ := newTestServer(t, nil)
+	img := solidImage(40, 40, color.NRGBA{0xFF, 0, 0, 0xFF})
+	draw.Draw(img, image.Rect(20, 0, 40, 40), image.NewUniform(color.NRGBA{0, 0, 0xFF, 0xFF}), image.Point{}, draw.Src)
+	src.put("/a.png", encodePNG(t, img))
+
+	w := get(t, ts, "/m40x40.blur3.gray/a.png")
+	mustStatus(t, w, http.StatusOK)
+	out, _ := decodeBody(t, w.Body.Bytes())
+	gray := func(x int) int {
+		r, g, b, _ := out.At(x, 20).RGBA()
+		if r != g || g != b {
+			t.Fatalf("pixel (%d,20) = %d,%d,%d, not gray", x, r>>8, g>>8, b>>8)
+		}
+		return int(r >> 8)
+	}
+	left, edge, right := gray(2), gray(19), gray(37)
+	if left == right {
+		t.Fatalf("red and blue halves have the same gray %d", left)
+	}
+	if edge <= min(left, right)+5 || edge >= max(left, right)-5 {
+		t.Errorf("edge gray %d not between %d and %d, blur not applied", edge, left, right)
+	}
+}
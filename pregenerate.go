@@ -0,0 +1,152 @@
+package caddy_thumbs
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// PregenerateConfig 上传后预生成缩略图的接口配置
+type PregenerateConfig struct {
+	// 接口路径, 完整匹配请求路径, 如 /thumbs/_pregenerate
+	Path string `json:"path,omitempty"`
+	// 需要预生成的模式目录列表, 格式与 URL 中的一致, 如 c200x200,q85
+	Variants []string `json:"variants,omitempty"`
+	// 同时生成的最大数量, 默认 4
+	Concurrency int `json:"concurrency,omitempty"`
+	// 请求需在 X-Thumbs-Pregenerate-Secret 头中携带该密钥
+	Secret string `json:"secret,omitempty"`
+}
+
+// pregenerateHeader 预生成请求携带密钥的请求头
+const pregenerateHeader = "X-Thumbs-Pregenerate-Secret"
+
+// pregenerateResult 单个预生成变体的结果
+type pregenerateResult struct {
+	Variant string `json:"variant"`
+	Path    string `json:"path"`
+	Cached  bool   `json:"cached,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// servePregenerate 为 source 参数指定的原图生成所有配置的变体, 生成完成后返回 JSON 结果.
+// 一次请求会生成多个缩略图, 因此只接受携带密钥的 POST 请求. 缩略图按请求的 cache_key_header 分区保存
+func (t ThumbsServer) servePregenerate(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(pregenerateHeader)), []byte(t.Pregenerate.Secret)) != 1 {
+		return caddyhttp.Error(http.StatusForbidden, errors.New("invalid pregenerate secret"))
+	}
+	source := strings.TrimPrefix(r.FormValue("source"), "/")
+	if source == "" {
+		return caddyhttp.Error(http.StatusBadRequest, errors.New("missing source parameter"))
+	}
+
+	var (
+		results = make([]pregenerateResult, len(t.Pregenerate.Variants))
+		sem     = make(chan struct{}, t.Pregenerate.Concurrency)
+		wg      sync.WaitGroup
+	)
+	t.stats.queued.Add(int64(len(t.Pregenerate.Variants)))
+	for i, variant := range t.Pregenerate.Variants {
+		wg.Add(1)
+		sem <- struct{}{}
+		t.stats.queued.Add(-1)
+		go func(i int, variant string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = t.pregenerateVariant(r, variant, source)
+		}(i, variant)
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(results)
+}
+
+// pregenerateVariant 生成单个变体, 已缓存的变体直接跳过
+func (t ThumbsServer) pregenerateVariant(r *http.Request, variant, source string) pregenerateResult {
+	res := pregenerateResult{Variant: variant}
+	req, err := t.parseRequest(path.Join("/", variant, source), nil)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	t.applyCacheBucket(r, req)
+	req.sourceToken = t.sourceToken(r)
+	res.Path = req.thumbPath
+	if _, ok := t.lookupCache(req); ok {
+		res.Cached = true
+		return res
+	}
+	// 禁止生成的 User-Agent 不能通过预生成和 srcset 接口生成未缓存的缩略图
+	if t.generationDenied(r) {
+		res.Error = t.denyGeneration(r, req).Error()
+		return res
+	}
+	result, err := t.renderThumb(req)
+	if err == nil {
+		err = result.storeErr
+	}
+	if err != nil {
+		t.logger.Warn("Failed to pregenerate thumbnail", zap.String("variant", variant), zap.String("source", source), zap.Error(err))
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// unmarshalPregenerate 解析 pregenerate 配置块
+//
+//	pregenerate <path> {
+//	    variants <variant...>
+//	    concurrency <n>
+//	    secret <secret>
+//	}
+func unmarshalPregenerate(d *caddyfile.Dispenser) (*PregenerateConfig, error) {
+	cfg := new(PregenerateConfig)
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	cfg.Path = d.Val()
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "variants":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return nil, d.ArgErr()
+			}
+			cfg.Variants = append(cfg.Variants, args...)
+		case "concurrency":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			val, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid concurrency value: %s", d.Val())
+			}
+			cfg.Concurrency = val
+		case "secret":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			cfg.Secret = d.Val()
+		default:
+			return nil, d.Errf("unrecognized pregenerate subdirective: %s", d.Val())
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,67 @@
+package caddy_thumbs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestPregenerate 提交原图路径后所有配置的变体都已生成, 并保存在请求所属的缓存分区中
+func TestPregenerate(t *testing.T) {
+	variants := []string{"c20x20", "m40x40,q60", "w30x10"}
+	ts, src, thumbs := newTestServer(t, func(ts *ThumbsServer) {
+		ts.CacheKeyHeader = "X-Tenant"
+		ts.Pregenerate = &PregenerateConfig{Path: "/_pregenerate", Variants: variants, Secret: "s3cret"}
+	})
+	src.put("/photos/a.jpg", encodeJPEG(t, gradientImage(80, 60), 90))
+
+	post := func(secret string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/_pregenerate", strings.NewReader(url.Values{"source": {"photos/a.jpg"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("X-Tenant", "acme")
+		if secret != "" {
+			r.Header.Set(pregenerateHeader, secret)
+		}
+		return serve(t, ts, r)
+	}
+
+	mustStatus(t, post(""), http.StatusForbidden)
+	mustStatus(t, post("wrong"), http.StatusForbidden)
+	mustStatus(t, get(t, ts, "/_pregenerate?source=photos/a.jpg"), http.StatusMethodNotAllowed)
+	if n := len(thumbs.keys()); n != 0 {
+		t.Fatalf("rejected requests stored %d thumbnails", n)
+	}
+
+	w := post("s3cret")
+	mustStatus(t, w, http.StatusOK)
+	var results []pregenerateResult
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(variants) {
+		t.Fatalf("got %d results, want %d", len(results), len(variants))
+	}
+	for i, res := range results {
+		want := "/@acme/" + variants[i] + "/photos/a.jpg"
+		if res.Error != "" || res.Path != want {
+			t.Errorf("result %d = %+v, want path %s", i, res, want)
+		}
+		if _, ok := thumbs.get(want); !ok {
+			t.Errorf("variant %s not stored", want)
+		}
+	}
+
+	// 再次提交时全部命中缓存
+	results = nil
+	if err := json.Unmarshal(post("s3cret").Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range results {
+		if !res.Cached {
+			t.Errorf("variant %s regenerated", res.Variant)
+		}
+	}
+}
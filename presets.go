@@ -0,0 +1,116 @@
+package caddy_thumbs
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// QualityPreset URL 中具名质量(如 qhigh)对应的质量, 可以按输出格式覆盖
+type QualityPreset struct {
+	// 未单独配置的输出格式使用的质量
+	Quality float32 `json:"quality"`
+	// 按输出格式配置的质量, 如 webp、jxl
+	Formats map[string]float32 `json:"formats,omitempty"`
+}
+
+// defaultQualityPresets 内置的具名质量, 配置中同名的预设会覆盖
+var defaultQualityPresets = map[string]QualityPreset{
+	"low":  {Quality: 50},
+	"med":  {Quality: 75},
+	"high": {Quality: 90},
+}
+
+// qualityPresetName 预设名只能为小写字母, 与数字质量区分
+var qualityPresetName = regexp.MustCompile(`^[a-z]+$`)
+
+// provisionQualityPresets 统一格式名并补充未配置的内置预设
+func (t *ThumbsServer) provisionQualityPresets() {
+	presets := make(map[string]QualityPreset, len(t.QualityPresets)+len(defaultQualityPresets))
+	for name, preset := range t.QualityPresets {
+		formats := make(map[string]float32, len(preset.Formats))
+		for format, q := range preset.Formats {
+			formats[formatKey(format)] = q
+		}
+		preset.Formats = formats
+		presets[name] = preset
+	}
+	for name, preset := range defaultQualityPresets {
+		if _, ok := presets[name]; !ok {
+			presets[name] = preset
+		}
+	}
+	t.QualityPresets = presets
+}
+
+// validateQualityPresets 检查预设名、格式和质量范围
+func (t ThumbsServer) validateQualityPresets() error {
+	for name, preset := range t.QualityPresets {
+		if !qualityPresetName.MatchString(name) {
+			return fmt.Errorf("invalid quality_preset name, only lowercase letters are allowed: %s", name)
+		}
+		if preset.Quality < 0 || preset.Quality > 100 {
+			return fmt.Errorf("quality_preset %s must be between 0 and 100", name)
+		}
+		for format, q := range preset.Formats {
+			if !slices.Contains(outputFormats, format) || format == ".svg" {
+				return fmt.Errorf("invalid quality_preset %s format: %s", name, format)
+			}
+			if q < 0 || q > 100 {
+				return fmt.Errorf("quality_preset %s for %s must be between 0 and 100", name, format)
+			}
+		}
+	}
+	return nil
+}
+
+// presetQuality 返回预设在输出格式下的质量, 输出格式未确定时使用预设的默认质量
+func (t ThumbsServer) presetQuality(name, format string) (float32, bool) {
+	preset, ok := t.QualityPresets[name]
+	if !ok {
+		return 0, false
+	}
+	if q, ok := preset.Formats[formatKey(format)]; ok {
+		return q, true
+	}
+	return preset.Quality, true
+}
+
+// applyQualityPreset 输出格式确定后按格式重新取预设的质量, 未使用预设的请求不处理
+func (t ThumbsServer) applyQualityPreset(req *thumbRequest) {
+	if req.qualityPreset == "" {
+		return
+	}
+	if q, ok := t.presetQuality(req.qualityPreset, req.format); ok {
+		req.quality = q
+	}
+}
+
+// unmarshalQualityPreset 解析 quality_preset <名称> <质量> [<格式>:<质量>...]
+func unmarshalQualityPreset(d *caddyfile.Dispenser) (string, QualityPreset, error) {
+	args := d.RemainingArgs()
+	if len(args) < 2 {
+		return "", QualityPreset{}, d.ArgErr()
+	}
+	q, err := strconv.ParseFloat(args[1], 32)
+	if err != nil {
+		return "", QualityPreset{}, d.Errf("invalid quality_preset quality: %s", args[1])
+	}
+	preset := QualityPreset{Quality: float32(q)}
+	for _, arg := range args[2:] {
+		format, value, ok := strings.Cut(arg, ":")
+		fq, err := strconv.ParseFloat(value, 32)
+		if !ok || err != nil {
+			return "", QualityPreset{}, d.Errf("invalid quality_preset format quality, expected format:quality: %s", arg)
+		}
+		if preset.Formats == nil {
+			preset.Formats = make(map[string]float32)
+		}
+		preset.Formats[format] = float32(fq)
+	}
+	return args[0], preset, nil
+}
@@ -0,0 +1,44 @@
+package caddy_thumbs
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// TestQualityPresets 每个具名质量按输出格式映射到配置的数值质量, 配置覆盖同名的内置预设, 未知的预设使用 default_quality
+func TestQualityPresets(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) {
+		ts.DefaultQuality = 60
+		ts.QualityPresets = map[string]QualityPreset{
+			"low":  {Quality: 40},
+			"tiny": {Quality: 20, Formats: map[string]float32{"WebP": 10}},
+		}
+	})
+	for _, tc := range []struct {
+		path string
+		want float32
+	}{
+		{"/m20x20,qlow/a.jpg", 40},
+		{"/m20x20,qmed/a.jpg", 75},
+		{"/m20x20,qhigh/a.jpg", 90},
+		{"/m20x20,qtiny/a.jpg", 20},
+		{"/m20x20,qtiny/a.webp", 10},
+		{"/m20x20,qunknown/a.jpg", 60},
+	} {
+		req, err := ts.parseRequest(tc.path, url.Values{})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.path, err)
+		}
+		if req.quality != tc.want {
+			t.Errorf("%s: quality = %v, want %v", tc.path, req.quality, tc.want)
+		}
+	}
+
+	src.put("/a.jpg", encodeJPEG(t, gradientImage(40, 40), 95))
+	w := get(t, ts, "/m20x20,qlow/a.jpg")
+	mustStatus(t, w, http.StatusOK)
+	if got := jpegQuality(w.Body.Bytes()); got < 39 || got > 41 {
+		t.Errorf("qlow output quality = %d, want 40", got)
+	}
+}
@@ -0,0 +1,143 @@
+package caddy_thumbs
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sort"
+)
+
+// pngPaletteSize 按质量换算调色板颜色数: q100 为 256 色, 最少 2 色
+func pngPaletteSize(quality float32) int {
+	return max(2, min(256, int(math.Round(float64(quality)/100*256))))
+}
+
+// colorCount 图片中出现的颜色及其像素数
+type colorCount struct {
+	c [4]uint8 // 非预乘的 RGBA
+	n int
+}
+
+// quantizeImage 使用中位切分算法将图片量化为最多 colors 种颜色的调色板图片
+func quantizeImage(img image.Image, colors int) *image.Paletted {
+	b := img.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(nrgba, nrgba.Bounds(), img, b.Min, draw.Src)
+
+	// 统计颜色直方图
+	histogram := make(map[[4]uint8]int)
+	for i := 0; i+3 < len(nrgba.Pix); i += 4 {
+		histogram[[4]uint8(nrgba.Pix[i:i+4])]++
+	}
+	counts := make([]colorCount, 0, len(histogram))
+	for c, n := range histogram {
+		counts = append(counts, colorCount{c: c, n: n})
+	}
+	palette := medianCut(counts, colors)
+
+	// 映射到调色板中最接近的颜色, 相同颜色只计算一次
+	dst := image.NewPaletted(nrgba.Bounds(), palette)
+	indexes := make(map[[4]uint8]uint8, len(histogram))
+	for i, j := 0, 0; i+3 < len(nrgba.Pix); i, j = i+4, j+1 {
+		c := [4]uint8(nrgba.Pix[i : i+4])
+		idx, ok := indexes[c]
+		if !ok {
+			idx = nearestColor(palette, c)
+			indexes[c] = idx
+		}
+		dst.Pix[j] = idx
+	}
+	return dst
+}
+
+// medianCut 反复沿跨度最大的通道按像素数中位切分颜色最多的盒子, 直到数量达到 colors, 每个盒子取加权平均色
+func medianCut(counts []colorCount, colors int) color.Palette {
+	boxes := [][]colorCount{counts}
+	for len(boxes) < colors {
+		// 选择可切分且像素最多的盒子
+		best, bestPixels := -1, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			if pixels := boxPixels(box); pixels > bestPixels {
+				best, bestPixels = i, pixels
+			}
+		}
+		if best < 0 {
+			break
+		}
+		box := boxes[best]
+		channel := widestChannel(box)
+		sort.Slice(box, func(i, j int) bool { return box[i].c[channel] < box[j].c[channel] })
+		// 按像素数找中位位置, 两侧至少各保留一种颜色
+		split, acc := 1, 0
+		for i, cc := range box[:len(box)-1] {
+			acc += cc.n
+			split = i + 1
+			if acc*2 >= bestPixels {
+				break
+			}
+		}
+		boxes = append(boxes, box[split:])
+		boxes[best] = box[:split]
+	}
+
+	palette := make(color.Palette, 0, len(boxes))
+	for _, box := range boxes {
+		var sum [4]int
+		pixels := boxPixels(box)
+		for _, cc := range box {
+			for ch := 0; ch < 4; ch++ {
+				sum[ch] += int(cc.c[ch]) * cc.n
+			}
+		}
+		palette = append(palette, color.NRGBA{
+			R: uint8(sum[0] / pixels), G: uint8(sum[1] / pixels), B: uint8(sum[2] / pixels), A: uint8(sum[3] / pixels),
+		})
+	}
+	return palette
+}
+
+func boxPixels(box []colorCount) int {
+	n := 0
+	for _, cc := range box {
+		n += cc.n
+	}
+	return n
+}
+
+// widestChannel 返回盒子中取值范围最大的通道
+func widestChannel(box []colorCount) int {
+	lo, hi := [4]uint8{255, 255, 255, 255}, [4]uint8{}
+	for _, cc := range box {
+		for ch := 0; ch < 4; ch++ {
+			lo[ch], hi[ch] = min(lo[ch], cc.c[ch]), max(hi[ch], cc.c[ch])
+		}
+	}
+	channel := 0
+	for ch := 1; ch < 4; ch++ {
+		if hi[ch]-lo[ch] > hi[channel]-lo[channel] {
+			channel = ch
+		}
+	}
+	return channel
+}
+
+// nearestColor 返回调色板中与 c 距离最近的颜色下标
+func nearestColor(palette color.Palette, c [4]uint8) uint8 {
+	best, bestDist := 0, math.MaxInt
+	for i, p := range palette {
+		pc := p.(color.NRGBA)
+		dist := 0
+		for ch, v := range [4]uint8{pc.R, pc.G, pc.B, pc.A} {
+			d := int(v) - int(c[ch])
+			dist += d * d
+		}
+		if dist < bestDist {
+			best, bestDist = i, dist
+		}
+	}
+	return uint8(best)
+}
@@ -0,0 +1,83 @@
+package caddy_thumbs
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"net/http"
+	"testing"
+)
+
+// distinctColors 图片中不同颜色的数量
+func distinctColors(img image.Image) int {
+	seen := make(map[[4]uint32]bool)
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			seen[[4]uint32{r, g, bl, a}] = true
+		}
+	}
+	return len(seen)
+}
+
+// TestPNGQuantize 开启 png_quantize 后按质量量化为调色板, 颜色数减少且文件更小
+func TestPNGQuantize(t *testing.T) {
+	ts, src, _ := newTestServer(t, nil)
+	data := encodePNG(t, noiseImage(128, 128))
+	src.put("/a.png", data)
+	src.put("/b.png", data)
+	full := get(t, ts, "/c64x64/b.png")
+	mustStatus(t, full, http.StatusOK)
+	ts.PNGQuantize = true
+
+	w := get(t, ts, "/c64x64,q25/a.png")
+	mustStatus(t, w, http.StatusOK)
+	img, _ := decodeBody(t, w.Body.Bytes())
+	if _, ok := img.(*image.Paletted); !ok {
+		t.Errorf("decoded %T, want a palette image", img)
+	}
+	want := pngPaletteSize(25)
+	if n := distinctColors(img); n > want {
+		t.Errorf("%d colors, want at most %d", n, want)
+	}
+	fullImg, _ := decodeBody(t, full.Body.Bytes())
+	if n := distinctColors(fullImg); n <= want {
+		t.Fatalf("unquantized output has only %d colors", n)
+	}
+	if w.Body.Len() >= full.Body.Len() {
+		t.Errorf("quantized PNG is %d bytes, unquantized %d", w.Body.Len(), full.Body.Len())
+	}
+}
+
+// TestPalettePassthrough 不需要缩放的调色板 PNG 原图输出时保留原有的调色板, 开启 png_quantize 时也不重新量化
+func TestPalettePassthrough(t *testing.T) {
+	palette := color.Palette{
+		color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 255, 0, 255},
+		color.NRGBA{0, 0, 255, 255}, color.NRGBA{0, 0, 0, 0},
+	}
+	source := image.NewPaletted(image.Rect(0, 0, 32, 32), palette)
+	for i := range source.Pix {
+		source.Pix[i] = uint8(i % len(palette))
+	}
+	for _, quantize := range []bool{false, true} {
+		ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.PNGQuantize = quantize })
+		src.put("/a.png", encodePNG(t, source))
+
+		w := get(t, ts, "/m64x64/a.png")
+		mustStatus(t, w, http.StatusOK)
+		img, _ := decodeBody(t, w.Body.Bytes())
+		paletted, ok := img.(*image.Paletted)
+		if !ok {
+			t.Fatalf("png_quantize %v: decoded %T, want the palette kept", quantize, img)
+		}
+		if len(paletted.Palette) != len(palette) || !bytes.Equal(paletted.Pix, source.Pix) {
+			t.Errorf("png_quantize %v: got %d palette entries, want the source palette of %d", quantize, len(paletted.Palette), len(palette))
+		}
+		for i, c := range palette {
+			if color.NRGBAModel.Convert(paletted.Palette[i]) != c {
+				t.Errorf("palette[%d] = %v, want %v", i, paletted.Palette[i], c)
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package caddy_thumbs
+
+import (
+	"encoding/binary"
+
+	"go.uber.org/zap"
+)
+
+// stdLuminanceQuant JPEG 标准(附录 K)的亮度量化表, libjpeg 按质量缩放该表
+var stdLuminanceQuant = [64]int{
+	16, 11, 10, 16, 24, 40, 51, 61,
+	12, 12, 14, 19, 26, 58, 60, 55,
+	14, 13, 16, 24, 40, 57, 69, 56,
+	14, 17, 22, 29, 51, 87, 80, 62,
+	18, 22, 37, 56, 68, 109, 103, 77,
+	24, 35, 55, 64, 81, 104, 113, 92,
+	49, 64, 78, 87, 103, 121, 120, 101,
+	72, 92, 95, 98, 112, 100, 103, 99,
+}
+
+// jpegQuality 由亮度量化表估算 JPEG 的质量(1-100), 按 libjpeg 的缩放公式反推. 找不到量化表时返回 0
+func jpegQuality(data []byte) int {
+	table := jpegLuminanceQuant(data)
+	if table == nil {
+		return 0
+	}
+	// 量化表按之字形顺序存储, 求和与顺序无关
+	var sum, std int
+	for i, q := range table {
+		sum += q
+		std += stdLuminanceQuant[i]
+	}
+	// libjpeg: 质量低于 50 时缩放比例为 5000/quality, 否则为 200-2*quality (百分比)
+	scale := float64(sum) * 100 / float64(std)
+	quality := 5000 / scale
+	if scale <= 100 {
+		quality = (200 - scale) / 2
+	}
+	return min(100, max(1, int(quality+0.5)))
+}
+
+// jpegLuminanceQuant 读取 DQT 段中编号为 0 的量化表, 通常为亮度量化表
+func jpegLuminanceQuant(data []byte) []int {
+	for pos := 2; pos+4 <= len(data) && data[pos] == 0xFF; {
+		marker := data[pos+1]
+		if marker == 0xDA {
+			break
+		}
+		size := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if size < 2 || pos+2+size > len(data) {
+			break
+		}
+		// 一个 DQT 段可以包含多个表, 每个表以精度(高 4 位)和编号(低 4 位)开头, 16 位精度的表每项两个字节
+		segment := data[pos+4 : pos+2+size]
+		for marker == 0xDB && len(segment) > 0 {
+			precision, id := segment[0]>>4, segment[0]&0x0F
+			n := 64 * (1 + int(precision))
+			if len(segment) < 1+n {
+				break
+			}
+			if id == 0 {
+				table := make([]int, 64)
+				for i := range table {
+					if precision == 0 {
+						table[i] = int(segment[1+i])
+					} else {
+						table[i] = int(binary.BigEndian.Uint16(segment[1+2*i:]))
+					}
+				}
+				return table
+			}
+			segment = segment[1+n:]
+		}
+		pos += 2 + size
+	}
+	return nil
+}
+
+// matchSourceQuality 开启 match_source_quality 时, JPEG 原图按估算的质量限制有损输出的质量,
+// 避免以高于原图的质量重新编码浪费字节
+func (t ThumbsServer) matchSourceQuality(req *thumbRequest, source []byte) {
+	if !t.MatchSourceQuality || sniffFormat(source[:min(len(source), sniffHeaderSize)], t.ContainerFormatOrder) != ".jpg" {
+		return
+	}
+	if req.format != "" && !isLossyFormat(req.format) {
+		return
+	}
+	estimated := jpegQuality(source)
+	if estimated == 0 || float32(estimated) >= req.quality {
+		return
+	}
+	t.logger.Debug("Capping quality to estimated source quality",
+		zap.String("path", req.imagePath), zap.Float32("requested", req.quality), zap.Int("source", estimated))
+	req.quality = float32(estimated)
+	// quality_range 的下限优先
+	t.clampQuality(req)
+}
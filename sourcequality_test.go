@@ -0,0 +1,42 @@
+package caddy_thumbs
+
+import (
+	"net/http"
+	"testing"
+)
+
+// TestJPEGQuality 由量化表估算的质量与编码时使用的质量一致. 质量过低时量化表的部分项被截断, 估算偏高, 不在检查范围内
+func TestJPEGQuality(t *testing.T) {
+	img := gradientImage(32, 32)
+	for _, quality := range []int{20, 30, 50, 75, 95} {
+		if got := jpegQuality(encodeJPEG(t, img, quality)); got < quality-1 || got > quality+1 {
+			t.Errorf("quality %d estimated as %d", quality, got)
+		}
+	}
+	if got := jpegQuality(encodePNG(t, img)); got != 0 {
+		t.Errorf("PNG estimated as %d, want 0", got)
+	}
+}
+
+// TestMatchSourceQuality 开启 match_source_quality 时低质量 JPEG 原图的输出质量限制在原图质量附近, 未开启时使用请求的质量
+func TestMatchSourceQuality(t *testing.T) {
+	source := encodeJPEG(t, gradientImage(200, 200), 30)
+	outputQuality := func(ts *ThumbsServer) int {
+		t.Helper()
+		w := get(t, ts, "/m100x100,q90/a.jpg")
+		mustStatus(t, w, http.StatusOK)
+		return jpegQuality(w.Body.Bytes())
+	}
+
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.MatchSourceQuality = true })
+	src.put("/a.jpg", source)
+	if got := outputQuality(ts); got < 29 || got > 31 {
+		t.Errorf("match_source_quality: output quality = %d, want about 30", got)
+	}
+
+	plain, plainSrc, _ := newTestServer(t, nil)
+	plainSrc.put("/a.jpg", source)
+	if got := outputQuality(plain); got < 89 || got > 91 {
+		t.Errorf("without match_source_quality: output quality = %d, want about 90", got)
+	}
+}
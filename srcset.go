@@ -0,0 +1,147 @@
+package caddy_thumbs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// SrcsetConfig 生成响应式图片 srcset 的接口配置
+type SrcsetConfig struct {
+	// 接口路径, 完整匹配请求路径, 如 /thumbs/_srcset
+	Path string `json:"path,omitempty"`
+	// 需要生成的宽度列表
+	Widths []int `json:"widths,omitempty"`
+	// 缩放模式, 默认 m
+	Mode string `json:"mode,omitempty"`
+	// 缩略图 URL 前缀, 默认为接口路径所在的目录
+	Prefix string `json:"prefix,omitempty"`
+	// 同时生成的最大数量, 默认 4
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+// srcsetVariant srcset 中单个宽度的结果
+type srcsetVariant struct {
+	Width  int    `json:"width"`
+	URL    string `json:"url"`
+	Cached bool   `json:"cached,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// srcsetResponse srcset 接口返回的 JSON
+type srcsetResponse struct {
+	Source   string          `json:"source"`
+	Srcset   string          `json:"srcset"`
+	Variants []srcsetVariant `json:"variants"`
+}
+
+// serveSrcset 为 source 参数指定的原图生成所有配置宽度的缩略图, 返回各宽度的 URL 和可直接使用的 srcset 属性值
+func (t ThumbsServer) serveSrcset(w http.ResponseWriter, r *http.Request) error {
+	source := strings.TrimPrefix(r.FormValue("source"), "/")
+	if source == "" {
+		return caddyhttp.Error(http.StatusBadRequest, errors.New("missing source parameter"))
+	}
+
+	var (
+		cfg      = t.Srcset
+		variants = make([]srcsetVariant, len(cfg.Widths))
+		sem      = make(chan struct{}, cfg.Concurrency)
+		wg       sync.WaitGroup
+	)
+	t.stats.queued.Add(int64(len(cfg.Widths)))
+	for i, width := range cfg.Widths {
+		wg.Add(1)
+		sem <- struct{}{}
+		t.stats.queued.Add(-1)
+		go func(i, width int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			// 高度取最大尺寸, 使 m 等模式只受宽度约束
+			variant := cfg.Mode + strconv.Itoa(width) + "x" + strconv.Itoa(t.MaxDimension)
+			res := t.pregenerateVariant(r, variant, source)
+			variants[i] = srcsetVariant{
+				Width:  width,
+				URL:    path.Join(cfg.Prefix, variant, source),
+				Cached: res.Cached,
+				Error:  res.Error,
+			}
+		}(i, width)
+	}
+	wg.Wait()
+
+	resp := srcsetResponse{Source: source, Variants: variants}
+	var entries []string
+	for _, v := range variants {
+		if v.Error == "" {
+			entries = append(entries, fmt.Sprintf("%s %dw", v.URL, v.Width))
+		}
+	}
+	resp.Srcset = strings.Join(entries, ", ")
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// unmarshalSrcset 解析 srcset 配置块
+//
+//	srcset <path> {
+//	    widths <width...>
+//	    mode <mode>
+//	    prefix <prefix>
+//	    concurrency <n>
+//	}
+func unmarshalSrcset(d *caddyfile.Dispenser) (*SrcsetConfig, error) {
+	cfg := new(SrcsetConfig)
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	cfg.Path = d.Val()
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "widths":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return nil, d.ArgErr()
+			}
+			for _, arg := range args {
+				width, err := strconv.Atoi(arg)
+				if err != nil {
+					return nil, d.Errf("invalid width value: %s", arg)
+				}
+				cfg.Widths = append(cfg.Widths, width)
+			}
+		case "mode":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			cfg.Mode = d.Val()
+		case "prefix":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			cfg.Prefix = d.Val()
+		case "concurrency":
+			if !d.NextArg() {
+				return nil, d.ArgErr()
+			}
+			val, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid concurrency value: %s", d.Val())
+			}
+			cfg.Concurrency = val
+		default:
+			return nil, d.Errf("unrecognized srcset subdirective: %s", d.Val())
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,70 @@
+package caddy_thumbs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// TestSrcset 接口返回所有配置的宽度, 对应的缩略图都已生成
+func TestSrcset(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) {
+		ts.Srcset = &SrcsetConfig{Path: "/_srcset", Widths: []int{20, 40}}
+		ts.DebugHeaders = true
+	})
+	src.put("/photos/a.png", encodePNG(t, gradientImage(80, 40)))
+
+	w := get(t, ts, "/_srcset?source=photos/a.png")
+	mustStatus(t, w, http.StatusOK)
+	var resp srcsetResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Variants) != 2 || resp.Variants[0].Width != 20 || resp.Variants[1].Width != 40 {
+		t.Fatalf("variants = %+v, want widths 20 and 40", resp.Variants)
+	}
+	if resp.Srcset == "" {
+		t.Error("empty srcset")
+	}
+	for _, v := range resp.Variants {
+		if v.Error != "" {
+			t.Errorf("width %d: %s", v.Width, v.Error)
+			continue
+		}
+		w := get(t, ts, v.URL)
+		mustStatus(t, w, http.StatusOK)
+		if cache := w.Header().Get(debugCacheHeader); cache != "HIT" {
+			t.Errorf("%s: %s = %s, want HIT", v.URL, debugCacheHeader, cache)
+		}
+		if width, _ := imageSize(t, w.Body.Bytes()); width != v.Width {
+			t.Errorf("%s: width = %d, want %d", v.URL, width, v.Width)
+		}
+	}
+}
+
+// TestSrcsetMode srcset 只接受等比缩放的 m 模式, 填充、裁剪和单尺寸模式以及开启 m_pad 时配置无效
+func TestSrcsetMode(t *testing.T) {
+	for _, tc := range []struct {
+		mode string
+		mPad bool
+	}{{"w", false}, {"wlt", false}, {"c", false}, {"long", false}, {"m", true}} {
+		ts := &ThumbsServer{
+			ImageStorageRaw:  registerStorage(t, "src", newMemStorage()),
+			ThumbsStorageRaw: registerStorage(t, "thumbs", newMemStorage()),
+			Srcset:           &SrcsetConfig{Path: "/_srcset", Widths: []int{20}, Mode: tc.mode},
+			MPad:             tc.mPad,
+		}
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		err := ts.Provision(ctx)
+		if err == nil {
+			err = ts.Validate()
+		}
+		cancel()
+		if err == nil {
+			t.Errorf("srcset mode %s (m_pad %v) was accepted", tc.mode, tc.mPad)
+		}
+	}
+}
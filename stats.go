@@ -0,0 +1,95 @@
+package caddy_thumbs
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// serverStats 运行时统计, 供调试接口输出
+type serverStats struct {
+	hits   atomic.Int64
+	misses atomic.Int64
+	queued atomic.Int64 // 等待生成槽位的任务数
+
+	mu       sync.Mutex
+	nextID   uint64
+	inFlight map[uint64]inFlightGeneration // 正在生成的任务, 同一路径可能同时有多个生成
+}
+
+func newServerStats() *serverStats {
+	return &serverStats{inFlight: make(map[uint64]inFlightGeneration)}
+}
+
+// begin 标记开始生成, 返回结束时调用的函数. 每次生成单独记录, 同一路径重叠的生成不会互相覆盖
+func (s *serverStats) begin(path string) func() {
+	s.mu.Lock()
+	s.nextID++
+	id := s.nextID
+	s.inFlight[id] = inFlightGeneration{Path: path, started: time.Now()}
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		delete(s.inFlight, id)
+		s.mu.Unlock()
+	}
+}
+
+// inFlightGeneration 调试接口中正在生成的任务
+type inFlightGeneration struct {
+	Path      string `json:"path"`
+	ElapsedMs int64  `json:"elapsed_ms"`
+	started   time.Time
+}
+
+// debugSnapshot 调试接口返回的 JSON
+type debugSnapshot struct {
+	InFlight    int                  `json:"in_flight"`
+	Generations []inFlightGeneration `json:"generations"`
+	CacheHits   int64                `json:"cache_hits"`
+	CacheMisses int64                `json:"cache_misses"`
+	HitRatio    float64              `json:"hit_ratio"`
+	QueueDepth  int64                `json:"queue_depth"`
+	Coalesced   int64                `json:"coalesced"`
+}
+
+func (s *serverStats) snapshot() debugSnapshot {
+	snap := debugSnapshot{
+		CacheHits:   s.hits.Load(),
+		CacheMisses: s.misses.Load(),
+		QueueDepth:  s.queued.Load(),
+		Generations: []inFlightGeneration{},
+	}
+	if total := snap.CacheHits + snap.CacheMisses; total > 0 {
+		snap.HitRatio = float64(snap.CacheHits) / float64(total)
+	}
+
+	s.mu.Lock()
+	for _, g := range s.inFlight {
+		g.ElapsedMs = time.Since(g.started).Milliseconds()
+		snap.Generations = append(snap.Generations, g)
+	}
+	s.mu.Unlock()
+	sort.Slice(snap.Generations, func(i, j int) bool {
+		a, b := snap.Generations[i], snap.Generations[j]
+		return a.Path < b.Path || a.Path == b.Path && a.started.Before(b.started)
+	})
+	snap.InFlight = len(snap.Generations)
+	return snap
+}
+
+// serveDebug 输出运行时统计
+func (t ThumbsServer) serveDebug(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	snap := t.stats.snapshot()
+	for _, jobs := range []*asyncJobs{t.async, t.approximate} {
+		if jobs != nil {
+			snap.Coalesced += jobs.coalesced.Load()
+		}
+	}
+	return json.NewEncoder(w).Encode(snap)
+}
@@ -0,0 +1,66 @@
+package caddy_thumbs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// blockingStorage 读取时阻塞, 直到 release 关闭, 用于保持生成任务在进行中
+type blockingStorage struct {
+	*memStorage
+	entered chan string
+	release chan struct{}
+}
+
+func (s blockingStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	s.entered <- key
+	<-s.release
+	return s.memStorage.Load(ctx, key)
+}
+
+// TestDebugInFlight 生成被阻塞时调试接口列出正在生成的任务, 同一路径重叠的生成分别计数
+func TestDebugInFlight(t *testing.T) {
+	src := blockingStorage{memStorage: newMemStorage(), entered: make(chan string), release: make(chan struct{})}
+	src.put("/a.png", encodePNG(t, gradientImage(40, 40)))
+	ts := &ThumbsServer{
+		ImageStorageRaw:  registerStorage(t, "src", src),
+		ThumbsStorageRaw: registerStorage(t, "thumbs", newMemStorage()),
+		DebugPath:        "/_debug",
+	}
+	provisionServer(t, ts)
+
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(t, ts, httptest.NewRequest(http.MethodGet, "/c20x20/a.png", nil))
+		}()
+		<-src.entered
+	}
+
+	w := get(t, ts, "/_debug")
+	mustStatus(t, w, http.StatusOK)
+	var snap debugSnapshot
+	if err := json.Unmarshal(w.Body.Bytes(), &snap); err != nil {
+		t.Fatal(err)
+	}
+	if snap.InFlight != 2 || len(snap.Generations) != 2 {
+		t.Fatalf("in_flight = %d with %d generations, want 2", snap.InFlight, len(snap.Generations))
+	}
+	for _, g := range snap.Generations {
+		if g.Path != "/c20x20/a.png" {
+			t.Errorf("generation path = %s", g.Path)
+		}
+	}
+
+	close(src.release)
+	wg.Wait()
+	if snap := ts.stats.snapshot(); snap.InFlight != 0 {
+		t.Errorf("in_flight after completion = %d, want 0", snap.InFlight)
+	}
+}
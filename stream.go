@@ -0,0 +1,160 @@
+package caddy_thumbs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// StreamingStorage 支持流式写入的存储后端. 缩略图存储实现该接口时, 编码输出直接写入存储并同时发送给客户端,
+// 不需要在内存中保留完整的编码结果. Close 返回错误时视为写入失败
+type StreamingStorage interface {
+	StoreWriter(ctx context.Context, key string) (io.WriteCloser, error)
+}
+
+// errStreamingUnsupported 包装的存储不支持流式写入, 调用前应先用 supportsStreaming 检查
+var errStreamingUnsupported = errors.New("storage does not support streaming writes")
+
+// supportsStreaming 判断存储能否流式写入. 哈希键和分层存储的包装在底层存储(分层存储为两层)都支持时才支持
+func supportsStreaming(storage certmagic.Storage) bool {
+	switch s := storage.(type) {
+	case hashedStorage:
+		return supportsStreaming(s.Storage)
+	case tieredStorage:
+		return supportsStreaming(s.Storage) && supportsStreaming(s.slow)
+	}
+	_, ok := storage.(StreamingStorage)
+	return ok
+}
+
+// canStream 判断请求能否流式编码. 需要完整编码结果的功能(字节预算、prefer_smaller、外部优化程序、LQIP、平均颜色等)使用缓冲编码
+func (t ThumbsServer) canStream(req *thumbRequest) bool {
+	if t.NoCache || !supportsStreaming(t.thumbsStorage) {
+		return false
+	}
+	if req.format == "" || req.format == ".svg" || req.maxBytes > 0 {
+		return false
+	}
+	if req.format == ".webp" && (t.WebPNearLossless != nil || req.nearLossless != nil) {
+		return false
+	}
+	if t.MinModernFormatBytes > 0 && isModernFormat(req.format) {
+		return false
+	}
+	return !t.PreferSmaller && !t.LQIP && !t.ColorHeader && t.MaxVariantsPerSource == 0 && !t.TranscodeFromCache && !t.EncodeFallback && t.Optimizers[req.format] == nil
+}
+
+// streamThumb 生成缩略图并边编码边写入存储和响应. 开始写出后发生的错误无法再返回给客户端, 只记录日志并删除不完整的缓存.
+// 内容的哈希在编码完成后才能得到, ETag 作为 trailer 发送, 与之后缓存命中时的 ETag 相同
+func (t ThumbsServer) streamThumb(w http.ResponseWriter, req *thumbRequest) error {
+	defer t.stats.begin(req.thumbPath)()
+	start := time.Now()
+
+	source, err := t.loadSource(req.imagePath, req.sourceToken)
+	if err != nil {
+		return err
+	}
+	if err := t.checkSourceType(req.imagePath, source); err != nil {
+		return err
+	}
+	t.matchSourceQuality(req, source)
+	thumb, err := t.buildThumbnail(bytes.NewReader(source), req)
+	if err != nil {
+		t.logger.Error("Failed to generate thumbnail", zap.Error(err))
+		var handlerErr caddyhttp.HandlerError
+		if errors.As(err, &handlerErr) {
+			return handlerErr
+		}
+		return fmt.Errorf("unsupported thumbnail mode: %s", req.mode)
+	}
+
+	// 存储无法写入时仍然发送给客户端
+	tee := &streamTee{response: w, hash: sha256.New()}
+	store, err := t.thumbsStorage.(StreamingStorage).StoreWriter(t.ctx, req.thumbPath)
+	if err != nil {
+		t.logger.Error("Failed to store thumbnail", zap.String("path", req.thumbPath), zap.Error(err))
+	} else {
+		tee.store = store
+	}
+
+	t.setCacheHeaders(w, req)
+	// 流式输出时响应头先于编码写出, 生成耗时只包含解码和缩放
+	t.setDebugHeaders(w, req, "MISS", time.Since(start))
+	w.Header().Set("Content-Type", mime.TypeByExtension(req.format))
+	modified := time.Now()
+	w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Trailer", "ETag")
+	w.WriteHeader(http.StatusOK)
+
+	err = t.encodeImageTo(tee, thumb, req.quality, req.format)
+	releaseCanvas(thumb)
+	etag := formatETag(tee.hash.Sum(nil))
+	if err == nil {
+		w.Header().Set("ETag", etag)
+	}
+	if tee.store == nil {
+		if err != nil {
+			t.logger.Error("Failed to encode thumbnail", zap.String("path", req.thumbPath), zap.Error(err))
+		}
+		return nil
+	}
+	if closeErr := tee.store.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		t.logger.Error("Failed to stream thumbnail", zap.String("path", req.thumbPath), zap.Error(err))
+		if err := t.thumbsStorage.Delete(t.ctx, req.thumbPath); err != nil {
+			t.logger.Warn("Failed to delete incomplete thumbnail", zap.String("path", req.thumbPath), zap.Error(err))
+		}
+		return nil
+	}
+	if t.index != nil {
+		t.index.record(req.thumbPath, tee.written, time.Now())
+	}
+	t.storeThumbMeta(req.thumbPath, etag, modified)
+
+	t.logger.Info("Generated and streamed new thumbnail",
+		zap.String("path", req.thumbPath),
+		zap.String("mode", req.mode),
+		zap.Float32("quality", req.quality),
+		zap.String("format", req.format),
+		zap.Int64("size", tee.written))
+	return nil
+}
+
+// streamTee 将编码输出同时写入存储和响应. 写入存储失败时中止编码; 客户端断开后继续写入存储, 保证缓存完整
+type streamTee struct {
+	store       io.WriteCloser
+	response    io.Writer
+	responseErr error
+	written     int64
+	hash        hash.Hash // 写出内容的哈希, 用于保存 ETag
+}
+
+func (s *streamTee) Write(p []byte) (int, error) {
+	if s.store != nil {
+		if _, err := s.store.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	if s.responseErr == nil {
+		_, s.responseErr = s.response.Write(p)
+		if s.responseErr != nil && s.store == nil {
+			return 0, s.responseErr
+		}
+	}
+	s.hash.Write(p)
+	s.written += int64(len(p))
+	return len(p), nil
+}
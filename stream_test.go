@@ -0,0 +1,114 @@
+package caddy_thumbs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// streamingMemStorage 支持流式写入的内存存储, 记录每次写入时响应中已有的字节数
+type streamingMemStorage struct {
+	*memStorage
+	response *httptest.ResponseRecorder
+	chunks   []int // 每次写入时响应已发送的字节数
+}
+
+func (s *streamingMemStorage) StoreWriter(_ context.Context, key string) (io.WriteCloser, error) {
+	s.record("StoreWriter")
+	return &streamingMemWriter{storage: s, key: key}, nil
+}
+
+// streamingMemWriter 关闭时才写入数据, 未关闭的条目不可见
+type streamingMemWriter struct {
+	storage *streamingMemStorage
+	key     string
+	buf     bytes.Buffer
+}
+
+func (w *streamingMemWriter) Write(p []byte) (int, error) {
+	w.storage.chunks = append(w.storage.chunks, w.storage.response.Body.Len())
+	return w.buf.Write(p)
+}
+
+func (w *streamingMemWriter) Close() error {
+	w.storage.put(w.key, w.buf.Bytes())
+	return nil
+}
+
+// TestStreamThumb 缩略图存储支持流式写入时, 编码输出分多次写入存储, 与响应交替进行;
+// 哈希键和分层存储的包装转发流式写入, 流式响应带 Last-Modified 和 ETag trailer
+func TestStreamThumb(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(ts *ThumbsServer, slow *streamingMemStorage)
+	}{
+		{"plain", func(*ThumbsServer, *streamingMemStorage) {}},
+		{"hashed", func(ts *ThumbsServer, _ *streamingMemStorage) { ts.HashStorageKeys = 2 }},
+		{"tiered", func(ts *ThumbsServer, slow *streamingMemStorage) {
+			ts.ThumbsSlowStorageRaw = registerStorage(t, "slow", slow)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := newMemStorage()
+			thumbs := &streamingMemStorage{memStorage: newMemStorage()}
+			slow := &streamingMemStorage{memStorage: newMemStorage()}
+			ts := &ThumbsServer{
+				ImageStorageRaw:  registerStorage(t, "src", src),
+				ThumbsStorageRaw: registerStorage(t, "thumbs", thumbs),
+			}
+			tt.setup(ts, slow)
+			provisionServer(t, ts)
+			src.put("/a.jpg", encodeJPEG(t, noiseImage(600, 600), 95))
+
+			w := httptest.NewRecorder()
+			thumbs.response, slow.response = w, w
+			next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+			if err := ts.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/c500x500/a.jpg", nil), next); err != nil {
+				t.Fatal(err)
+			}
+			mustStatus(t, w, http.StatusOK)
+			if n := thumbs.count("StoreWriter"); n != 1 {
+				t.Fatalf("StoreWriter called %d times, want 1", n)
+			}
+			if len(thumbs.chunks) < 2 || thumbs.chunks[len(thumbs.chunks)-1] == 0 {
+				t.Errorf("store received %d writes with response sizes %v, want incremental writes", len(thumbs.chunks), thumbs.chunks)
+			}
+
+			var stored []byte
+			for _, key := range thumbs.keys() {
+				if data, _ := thumbs.get(key); len(data) > len(stored) {
+					stored = data
+				}
+			}
+			if !bytes.Equal(stored, w.Body.Bytes()) {
+				t.Errorf("stored %d bytes, responded %d bytes", len(stored), w.Body.Len())
+			}
+			if tt.name == "tiered" {
+				if data, ok := slow.get("/c500x500/a.jpg"); !ok || !bytes.Equal(data, stored) {
+					t.Errorf("slow tier did not receive the streamed thumbnail, keys: %v", slow.keys())
+				}
+			}
+
+			res := w.Result()
+			if res.Header.Get("Last-Modified") == "" {
+				t.Error("streamed response has no Last-Modified")
+			}
+			etag := res.Trailer.Get("ETag")
+			if etag == "" {
+				t.Fatal("streamed response has no ETag trailer")
+			}
+			// 缓存命中时的 ETag 与流式响应的 trailer 相同
+			hit := get(t, ts, "/c500x500/a.jpg")
+			mustStatus(t, hit, http.StatusOK)
+			if got := hit.Header().Get("ETag"); got != etag {
+				t.Errorf("cached ETag = %s, streamed %s", got, etag)
+			}
+		})
+	}
+}
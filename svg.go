@@ -0,0 +1,100 @@
+package caddy_thumbs
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"net/http"
+
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+)
+
+var (
+	svgHeader = []byte("<svg")
+	utf8BOM   = []byte{0xEF, 0xBB, 0xBF}
+)
+
+// svgContentSecurityPolicy SVG 可以包含脚本和外部资源, 直接打开缩略图地址时在沙箱中显示且不加载任何资源
+const svgContentSecurityPolicy = "default-src 'none'; style-src 'unsafe-inline'; sandbox"
+
+// isSVG 根据文件头判断是否为 SVG 矢量图: 跳过 XML 声明、处理指令、注释和 DOCTYPE 后根元素必须为 svg
+func isSVG(header []byte) bool {
+	header = bytes.TrimPrefix(header, utf8BOM)
+	for {
+		header = bytes.TrimLeft(header, " \t\r\n")
+		var ok bool
+		switch {
+		case bytes.HasPrefix(header, svgHeader):
+			rest := header[len(svgHeader):]
+			return len(rest) == 0 || bytes.IndexByte([]byte(" \t\r\n/>"), rest[0]) >= 0
+		case bytes.HasPrefix(header, []byte("<?")):
+			header, ok = skipPast(header, "?>")
+		case bytes.HasPrefix(header, []byte("<!--")):
+			header, ok = skipPast(header, "-->")
+		case bytes.HasPrefix(header, []byte("<!")):
+			// DOCTYPE 的内部子集中可以包含 >, 以 ]> 结束
+			end := ">"
+			if i := bytes.IndexAny(header, "[>"); i >= 0 && header[i] == '[' {
+				end = "]>"
+			}
+			header, ok = skipPast(header, end)
+		}
+		if !ok {
+			return false
+		}
+	}
+}
+
+// skipPast 返回 end 之后的内容, 不包含 end 时返回 false
+func skipPast(data []byte, end string) ([]byte, bool) {
+	_, rest, ok := bytes.Cut(data, []byte(end))
+	return rest, ok
+}
+
+// setContentSecurityHeaders 缩略图响应禁止浏览器猜测类型并限制 SVG 中的脚本. 不指定输出格式的请求读取原图后才能确定格式,
+// 因此对所有缩略图响应设置, 对位图没有影响
+func setContentSecurityHeaders(w http.ResponseWriter) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", svgContentSecurityPolicy)
+}
+
+// passthroughSVG 输出格式为 .svg 时原样返回矢量图内容
+func passthroughSVG(reader io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !isSVG(data) {
+		return nil, fmt.Errorf("unsupported output format: .svg (source is not svg)")
+	}
+	return data, nil
+}
+
+// rasterizeSVG 将 SVG 栅格化, 栅格化后的尺寸刚好覆盖目标尺寸, 以便后续的缩放/裁剪模式处理
+func (t ThumbsServer) rasterizeSVG(reader io.Reader, width, height uint) (image.Image, error) {
+	icon, err := oksvg.ReadIconStream(reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse svg: %v", err)
+	}
+	vbW, vbH := icon.ViewBox.W, icon.ViewBox.H
+	if vbW <= 0 || vbH <= 0 {
+		vbW, vbH = float64(width), float64(height)
+	}
+
+	// 按覆盖目标尺寸的比例缩放, 极端纵横比时退回到适应目标尺寸, 避免画布过大
+	scale := math.Max(float64(width)/vbW, float64(height)/vbH)
+	if vbW*scale > float64(t.MaxDimension) || vbH*scale > float64(t.MaxDimension) {
+		scale = math.Min(float64(width)/vbW, float64(height)/vbH)
+	}
+	w := int(math.Max(1, math.Round(vbW*scale)))
+	h := int(math.Max(1, math.Round(vbH*scale)))
+
+	icon.SetTarget(0, 0, float64(w), float64(h))
+	canvas := image.NewRGBA(image.Rect(0, 0, w, h))
+	scanner := rasterx.NewScannerGV(w, h, canvas, canvas.Bounds())
+	icon.Draw(rasterx.NewDasher(w, h, scanner), 1)
+	return canvas, nil
+}
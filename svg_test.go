@@ -0,0 +1,71 @@
+package caddy_thumbs
+
+import (
+	"net/http"
+	"testing"
+)
+
+const testSVG = `<?xml version="1.0" encoding="UTF-8"?>
+<!-- test -->
+<!DOCTYPE svg PUBLIC "-//W3C//DTD SVG 1.1//EN" "http://www.w3.org/Graphics/SVG/1.1/DTD/svg11.dtd">
+<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100 50" width="100" height="50">
+<rect x="0" y="0" width="100" height="50" fill="#ff0000"/>
+</svg>`
+
+// TestRasterizeSVG 简单的 SVG 栅格化为请求尺寸的 PNG
+func TestRasterizeSVG(t *testing.T) {
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.FormatRule = "png" })
+	src.put("/icon", []byte(testSVG))
+
+	w := get(t, ts, "/c120x80/icon")
+	mustStatus(t, w, http.StatusOK)
+	img, format := decodeBody(t, w.Body.Bytes())
+	if format != "png" {
+		t.Fatalf("format = %s, want png", format)
+	}
+	if b := img.Bounds(); b.Dx() != 120 || b.Dy() != 80 {
+		t.Fatalf("size = %dx%d, want 120x80", b.Dx(), b.Dy())
+	}
+	if r, g, b, a := img.At(60, 40).RGBA(); r>>8 < 0xF0 || g>>8 > 0x10 || b>>8 > 0x10 || a>>8 != 0xFF {
+		t.Errorf("center pixel = %d,%d,%d,%d, want red", r>>8, g>>8, b>>8, a>>8)
+	}
+}
+
+// TestSVGPassthroughHeaders 透传的 SVG 在沙箱中显示
+func TestSVGPassthroughHeaders(t *testing.T) {
+	ts, src, _ := newTestServer(t, nil)
+	src.put("/icon.svg", []byte(testSVG))
+
+	w := get(t, ts, "/c120x80/icon.svg")
+	mustStatus(t, w, http.StatusOK)
+	if w.Body.String() != testSVG {
+		t.Errorf("passthrough body changed")
+	}
+	if got := w.Header().Get("Content-Security-Policy"); got != svgContentSecurityPolicy {
+		t.Errorf("Content-Security-Policy = %q", got)
+	}
+	if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Errorf("X-Content-Type-Options = %q", got)
+	}
+}
+
+func TestIsSVG(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{testSVG, true},
+		{"\xEF\xBB\xBF  <svg>", true},
+		{`<svg xmlns="http://www.w3.org/2000/svg"/>`, true},
+		{`<?xml version="1.0"?><!DOCTYPE svg [<!ENTITY a "<b>">]><svg>`, true},
+		{`<?xml version="1.0"?><rss version="2.0"></rss>`, false},
+		{`<?xml version="1.0"?><!-- <svg> --><html>`, false},
+		{`<svgx/>`, false},
+		{`<?xml version="1.0"`, false},
+	}
+	for _, tt := range tests {
+		if got := isSVG([]byte(tt.header)); got != tt.want {
+			t.Errorf("isSVG(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package caddy_thumbs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"slices"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+// tieredStorage 由快速存储(如本地磁盘)和慢速存储(如 S3)组成的缩略图存储. 读取时先查快速存储,
+// 只在慢速存储中的条目读取后写入快速存储; 新的缩略图写入两层. 慢速存储保存完整的缓存,
+// 快速存储可以随时清空. 锁由慢速存储提供, 以便多个实例共享
+type tieredStorage struct {
+	certmagic.Storage // 快速存储
+	slow              certmagic.Storage
+	logger            *zap.Logger
+}
+
+// Store 先写慢速存储再写快速存储, 快速存储写入失败只记录警告, 下次读取时重新写入
+func (s tieredStorage) Store(ctx context.Context, key string, value []byte) error {
+	if err := s.slow.Store(ctx, key, value); err != nil {
+		return err
+	}
+	if err := s.Storage.Store(ctx, key, value); err != nil {
+		s.logger.Warn("Failed to store thumbnail in fast storage tier", zap.String("path", key), zap.Error(err))
+	}
+	return nil
+}
+
+// StoreWriter 两层都支持流式写入时同时写入两层, 与 Store 一样快速存储写入失败只记录警告
+func (s tieredStorage) StoreWriter(ctx context.Context, key string) (io.WriteCloser, error) {
+	slowStreaming, ok := s.slow.(StreamingStorage)
+	fastStreaming, fastOk := s.Storage.(StreamingStorage)
+	if !ok || !fastOk {
+		return nil, errStreamingUnsupported
+	}
+	slow, err := slowStreaming.StoreWriter(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	w := &tieredWriter{slow: slow, storage: s, ctx: ctx, key: key}
+	if w.fast, err = fastStreaming.StoreWriter(ctx, key); err != nil {
+		s.logger.Warn("Failed to store thumbnail in fast storage tier", zap.String("path", key), zap.Error(err))
+	}
+	return w, nil
+}
+
+// tieredWriter 同时流式写入两层, 快速存储写入失败后不再写入并在关闭时删除不完整的条目
+type tieredWriter struct {
+	slow, fast io.WriteCloser
+	fastErr    error
+	storage    tieredStorage
+	ctx        context.Context
+	key        string
+}
+
+func (w *tieredWriter) Write(p []byte) (int, error) {
+	if _, err := w.slow.Write(p); err != nil {
+		return 0, err
+	}
+	if w.fast != nil && w.fastErr == nil {
+		_, w.fastErr = w.fast.Write(p)
+	}
+	return len(p), nil
+}
+
+func (w *tieredWriter) Close() error {
+	err := w.slow.Close()
+	if w.fast == nil {
+		return err
+	}
+	if closeErr := w.fast.Close(); w.fastErr == nil {
+		w.fastErr = closeErr
+	}
+	if w.fastErr != nil {
+		w.storage.logger.Warn("Failed to store thumbnail in fast storage tier", zap.String("path", w.key), zap.Error(w.fastErr))
+		_ = w.storage.Storage.Delete(w.ctx, w.key)
+	}
+	return err
+}
+
+// Load 快速存储中不存在时从慢速存储读取, 并写入快速存储
+func (s tieredStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	data, err := s.Storage.Load(ctx, key)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return data, err
+	}
+	if data, err = s.slow.Load(ctx, key); err != nil {
+		return nil, err
+	}
+	if err := s.Storage.Store(ctx, key, data); err != nil {
+		s.logger.Warn("Failed to promote thumbnail to fast storage tier", zap.String("path", key), zap.Error(err))
+	} else {
+		s.logger.Debug("Promoted thumbnail to fast storage tier", zap.String("path", key))
+	}
+	return data, nil
+}
+
+func (s tieredStorage) Exists(ctx context.Context, key string) bool {
+	return s.Storage.Exists(ctx, key) || s.slow.Exists(ctx, key)
+}
+
+// Delete 从两层中删除, 两层都不存在时返回不存在的错误
+func (s tieredStorage) Delete(ctx context.Context, key string) error {
+	fastErr := s.Storage.Delete(ctx, key)
+	slowErr := s.slow.Delete(ctx, key)
+	if slowErr != nil && !errors.Is(slowErr, fs.ErrNotExist) {
+		return slowErr
+	}
+	if fastErr != nil && !errors.Is(fastErr, fs.ErrNotExist) {
+		return fastErr
+	}
+	if fastErr != nil && slowErr != nil {
+		return slowErr
+	}
+	return nil
+}
+
+func (s tieredStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	info, err := s.Storage.Stat(ctx, key)
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return info, err
+	}
+	return s.slow.Stat(ctx, key)
+}
+
+// List 合并两层的列举结果, 快速存储列举失败时只返回慢速存储的结果
+func (s tieredStorage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	keys, err := s.slow.List(ctx, prefix, recursive)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	fast, err := s.Storage.List(ctx, prefix, recursive)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		s.logger.Warn("Failed to list fast storage tier", zap.String("prefix", prefix), zap.Error(err))
+	}
+	keys = append(keys, fast...)
+	slices.Sort(keys)
+	return slices.Compact(keys), nil
+}
+
+func (s tieredStorage) Lock(ctx context.Context, name string) error {
+	return s.slow.Lock(ctx, name)
+}
+
+func (s tieredStorage) Unlock(ctx context.Context, name string) error {
+	return s.slow.Unlock(ctx, name)
+}
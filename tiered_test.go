@@ -0,0 +1,41 @@
+package caddy_thumbs
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+// TestTieredStorage 只在慢速层中的缩略图读取后写入快速层, 之后从快速层返回; 新的缩略图写入两层
+func TestTieredStorage(t *testing.T) {
+	slow := newMemStorage()
+	ts, src, fast := newTestServer(t, func(ts *ThumbsServer) {
+		ts.ThumbsSlowStorageRaw = registerStorage(t, "slow", slow)
+		ts.DebugHeaders = true
+	})
+	src.put("/a.png", encodePNG(t, gradientImage(40, 40)))
+	cached := encodePNG(t, gradientImage(20, 20))
+	slow.put("/c20x20/a.png", cached)
+
+	w := get(t, ts, "/c20x20/a.png")
+	mustStatus(t, w, http.StatusOK)
+	if cache := w.Header().Get(debugCacheHeader); cache != "HIT" {
+		t.Errorf("%s = %s, want HIT", debugCacheHeader, cache)
+	}
+	if data, ok := fast.get("/c20x20/a.png"); !ok || !bytes.Equal(data, cached) {
+		t.Fatalf("slow-tier hit not promoted to the fast tier, keys: %v", fast.keys())
+	}
+
+	loads := slow.count("Load")
+	mustStatus(t, get(t, ts, "/c20x20/a.png"), http.StatusOK)
+	if slow.count("Load") != loads {
+		t.Error("fast-tier hit read the slow tier")
+	}
+
+	mustStatus(t, get(t, ts, "/c10x10/a.png"), http.StatusOK)
+	for name, storage := range map[string]*memStorage{"fast": fast, "slow": slow} {
+		if _, ok := storage.get("/c10x10/a.png"); !ok {
+			t.Errorf("new thumbnail not stored in the %s tier", name)
+		}
+	}
+}
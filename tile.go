@@ -0,0 +1,110 @@
+package caddy_thumbs
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"math/bits"
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// 瓦片请求的路径格式(不含前缀部分): /tile<尺寸>,z<层级>,x<列>,y<行>[,q<质量>]/<原图路径>
+const tilePattern = `(tile(\d+),z(\d+),x(\d+),y(\d+)(?:,q(\d+(?:\.\d+)?))?)\/((?:.+?)(\.\w+))$`
+
+// maxTileLevel 支持的最大层级, 对应 2^30 像素的原图
+const maxTileLevel = 30
+
+// tileSpec Deep Zoom 瓦片坐标
+type tileSpec struct {
+	size  int // 瓦片边长
+	level int // 层级, 0 为 1x1 像素, 最高层级为原图尺寸
+	col   int // 列号
+	row   int // 行号
+}
+
+// parseTileRequest 解析瓦片请求, 路径不是瓦片格式时返回 nil
+func (t ThumbsServer) parseTileRequest(path string) (*thumbRequest, error) {
+	matches := t.tileRegex.FindStringSubmatch(path)
+	if matches == nil {
+		return nil, nil
+	}
+
+	var (
+		tile    = new(tileSpec)
+		numbers = []*int{&tile.size, &tile.level, &tile.col, &tile.row}
+	)
+	for i, target := range numbers {
+		val, err := strconv.Atoi(matches[i+2])
+		if err != nil {
+			return nil, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid tile coordinate: %s", matches[i+2]))
+		}
+		*target = val
+	}
+	if tile.size <= 0 || tile.size > t.MaxDimension {
+		return nil, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("tile size must be between 1 and %d", t.MaxDimension))
+	}
+	if tile.level > maxTileLevel {
+		return nil, caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("tile level must not exceed %d", maxTileLevel))
+	}
+
+	req := &thumbRequest{
+		modeDir:   matches[1],
+		mode:      "tile",
+		width:     tile.size,
+		height:    tile.size,
+		bgColor:   color.White,
+		quality:   parseQuality(matches[6], t.DefaultQuality),
+		imagePath: matches[7],
+		format:    t.normalizeFormat(matches[8]),
+		tile:      tile,
+	}
+	if req.format == ".svg" || !t.formatAllowed(req.format) {
+		return nil, caddyhttp.Error(http.StatusUnsupportedMediaType, fmt.Errorf("output format not allowed for tiles: %s", req.format))
+	}
+	req.thumbPath = filepath.Join("/", req.modeDir, req.imagePath)
+	req.originalPath = filepath.Join("/", req.imagePath)
+	return req, nil
+}
+
+// extractTile 按 Deep Zoom 的金字塔规则截取瓦片: 最高层级为原图尺寸, 每降低一级宽高减半, 边缘瓦片按实际剩余尺寸输出
+func (t ThumbsServer) extractTile(img image.Image, tile *tileSpec, quality float32) (image.Image, error) {
+	var (
+		bounds   = img.Bounds()
+		maxLevel = bits.Len(uint(max(bounds.Dx(), bounds.Dy()) - 1))
+	)
+	if tile.level > maxLevel {
+		return nil, caddyhttp.Error(http.StatusNotFound, fmt.Errorf("tile level %d exceeds maximum level %d", tile.level, maxLevel))
+	}
+
+	var (
+		scale          = math.Ldexp(1, tile.level-maxLevel)
+		levelW, levelH = int(math.Ceil(float64(bounds.Dx()) * scale)), int(math.Ceil(float64(bounds.Dy()) * scale))
+	)
+	// 先按行列数检查, 过大的行列号与瓦片边长相乘会溢出
+	if tile.col >= (levelW+tile.size-1)/tile.size || tile.row >= (levelH+tile.size-1)/tile.size {
+		return nil, caddyhttp.Error(http.StatusNotFound, errors.New("tile coordinates out of range"))
+	}
+	var (
+		x0, y0 = tile.col * tile.size, tile.row * tile.size
+		x1, y1 = min(x0+tile.size, levelW), min(y0+tile.size, levelH)
+	)
+
+	// 换算为原图中的区域
+	region := image.Rect(
+		int(float64(x0)/scale), int(float64(y0)/scale),
+		min(int(math.Ceil(float64(x1)/scale)), bounds.Dx()), min(int(math.Ceil(float64(y1)/scale)), bounds.Dy()),
+	)
+	cropped := image.NewRGBA(image.Rect(0, 0, region.Dx(), region.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), img, bounds.Min.Add(region.Min), draw.Src)
+	if region.Dx() == x1-x0 && region.Dy() == y1-y0 {
+		return cropped, nil
+	}
+	return t.resizeImage(uint(x1-x0), uint(y1-y0), cropped, quality, ""), nil
+}
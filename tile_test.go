@@ -0,0 +1,64 @@
+package caddy_thumbs
+
+import (
+	"image/color"
+	"net/http"
+	"testing"
+)
+
+// TestTile 瓦片与原图中对应区域一致: 原图 100x60 的最高层级为 7 (128), 层级 7 的瓦片为原图像素, 层级 6 缩小一半
+func TestTile(t *testing.T) {
+	ts, src, _ := newTestServer(t, nil)
+	source := gradientImage(100, 60)
+	src.put("/a.png", encodePNG(t, source))
+
+	tests := []struct {
+		path    string
+		w, h    int
+		originX int // 瓦片左上角在原图中的位置
+		originY int
+		scale   int // 瓦片一个像素对应原图的像素数
+	}{
+		{"/tile32,z7,x1,y0/a.png", 32, 32, 32, 0, 1},
+		{"/tile32,z7,x3,y1/a.png", 4, 28, 96, 32, 1}, // 右下角的边缘瓦片
+		{"/tile32,z6,x1,y0/a.png", 18, 30, 64, 0, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := get(t, ts, tt.path)
+			mustStatus(t, w, http.StatusOK)
+			img, _ := decodeBody(t, w.Body.Bytes())
+			if img.Bounds().Dx() != tt.w || img.Bounds().Dy() != tt.h {
+				t.Fatalf("size = %dx%d, want %dx%d", img.Bounds().Dx(), img.Bounds().Dy(), tt.w, tt.h)
+			}
+			for _, p := range [][2]int{{0, 0}, {tt.w - 1, 0}, {0, tt.h - 1}, {tt.w / 2, tt.h / 2}} {
+				got := color.NRGBAModel.Convert(img.At(p[0], p[1])).(color.NRGBA)
+				want := source.NRGBAAt(tt.originX+p[0]*tt.scale, tt.originY+p[1]*tt.scale)
+				if diff(got.R, want.R) > 8 || diff(got.G, want.G) > 8 {
+					t.Errorf("pixel %v = %v, want %v", p, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestTileOutOfRange 超出范围的行列号返回 404, 极大的行列号不会溢出
+func TestTileOutOfRange(t *testing.T) {
+	ts, src, _ := newTestServer(t, nil)
+	src.put("/a.png", encodePNG(t, gradientImage(100, 60)))
+	for _, path := range []string{
+		"/tile32,z7,x4,y0/a.png",
+		"/tile32,z7,x0,y2/a.png",
+		"/tile32,z7,x288230376151711744,y0/a.png",
+		"/tile32,z7,x0,y576460752303423488/a.png",
+	} {
+		mustStatus(t, get(t, ts, path), http.StatusNotFound)
+	}
+}
+
+func diff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
@@ -0,0 +1,21 @@
+package caddy_thumbs
+
+import (
+	"context"
+	"net/http"
+)
+
+// TokenStorage 原图存储可以实现的可选接口, 使用请求携带的凭据读取原图, 用于私有存储桶中按用户授权的图片.
+// 配置 source_token_header 且请求携带该请求头时, 实现了该接口的存储改用 LoadWithToken 读取原图;
+// 原图不存在时应返回 fs.ErrNotExist
+type TokenStorage interface {
+	LoadWithToken(ctx context.Context, key, token string) ([]byte, error)
+}
+
+// sourceToken 从 source_token_header 请求头中读取转交给原图存储的凭据, 未配置时返回空字符串
+func (t ThumbsServer) sourceToken(r *http.Request) string {
+	if t.SourceTokenHeader == "" {
+		return ""
+	}
+	return r.Header.Get(t.SourceTokenHeader)
+}
@@ -0,0 +1,67 @@
+package caddy_thumbs
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// tokenMemStorage 实现 TokenStorage 的内存存储, 记录 LoadWithToken 收到的凭据, 只接受 token 与 secret 一致的读取
+type tokenMemStorage struct {
+	*memStorage
+	secret string
+
+	mu     sync.Mutex
+	tokens []string
+}
+
+func (s *tokenMemStorage) LoadWithToken(ctx context.Context, key, token string) ([]byte, error) {
+	s.mu.Lock()
+	s.tokens = append(s.tokens, token)
+	s.mu.Unlock()
+	if token != s.secret {
+		return nil, fs.ErrPermission
+	}
+	return s.Load(ctx, key)
+}
+
+// TestSourceToken 请求携带 source_token_header 时凭据转交给实现了 TokenStorage 的原图存储, 凭据无效时返回 500;
+// 不带请求头时使用普通的 Load 读取
+func TestSourceToken(t *testing.T) {
+	private := &tokenMemStorage{memStorage: newMemStorage(), secret: "secret"}
+	private.put("/a.png", encodePNG(t, gradientImage(40, 40)))
+	private.put("/b.png", encodePNG(t, gradientImage(40, 40)))
+	private.put("/c.png", encodePNG(t, gradientImage(40, 40)))
+	ts := &ThumbsServer{
+		ImageStorageRaw:   registerStorage(t, "src", private),
+		ThumbsStorageRaw:  registerStorage(t, "thumbs", newMemStorage()),
+		SourceTokenHeader: "X-Source-Token",
+	}
+	provisionServer(t, ts)
+
+	withToken := func(target, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("X-Source-Token", token)
+		return serve(t, ts, r)
+	}
+	mustStatus(t, withToken("/m20x20/a.png", "secret"), http.StatusOK)
+	mustStatus(t, withToken("/m20x20/b.png", "wrong"), http.StatusInternalServerError)
+	if !slices.Equal(private.tokens, []string{"secret", "wrong"}) {
+		t.Errorf("forwarded tokens = %v, want [secret wrong]", private.tokens)
+	}
+	if n := private.count("Load"); n != 1 {
+		t.Errorf("Load called %d times, want 1 for the valid token", n)
+	}
+
+	mustStatus(t, get(t, ts, "/m20x20/c.png"), http.StatusOK)
+	if len(private.tokens) != 2 {
+		t.Errorf("LoadWithToken called without a token header")
+	}
+	if n := private.count("Load"); n != 2 {
+		t.Errorf("Load called %d times, want 2", n)
+	}
+}
@@ -0,0 +1,43 @@
+package caddy_thumbs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// checkTokens strict_tokens 开启时拒绝对当前模式或输出格式不起作用的参数. 输出格式要读取原图后才能确定时只检查与模式相关的参数
+func (t ThumbsServer) checkTokens(req *thumbRequest, colorGiven, qualityGiven bool) error {
+	modeId, ok := cropModeMap[req.mode]
+	if !ok {
+		return fmt.Errorf("unknown mode %q: use m, a w mode (wlt, wlc, wlb, wrt, wrc, wrb, wct, wcc, wcb, wc, w), a crop mode (lt, lc, lb, rt, rc, rb, ct, cc, cb, c), long or short", req.mode)
+	}
+	var (
+		isWMode     = (modeId >= SCALE_MODE_WLT && modeId <= SCALE_MODE_WCB) || (modeId == SCALE_MODE_M && t.MPad)
+		isCropMode  = modeId >= CROP_MODE_LEFTTOP && modeId <= CROP_MODE_CENTERBOTTOM
+		knownFormat = req.format != ""
+	)
+
+	if req.format == ".svg" {
+		if colorGiven || qualityGiven || req.checker || req.nearLossless != nil || req.focal != nil || len(req.ops) > 0 || req.maxBytes > 0 || req.dither > 0 {
+			return errors.New("svg output is passed through unchanged: color, quality, flags, operations and maxbytes do not apply")
+		}
+		return nil
+	}
+	// 背景用于 w 模式的填充区域, 以及不支持透明通道的输出格式中的透明区域
+	if (colorGiven || req.checker) && !isWMode && knownFormat && formatSupportsAlpha(req.format) {
+		return fmt.Errorf("color and checker only apply to w modes or to output without transparency (jpg), not to %s output in mode %s", req.format, req.mode)
+	}
+	if req.focal != nil && !isCropMode {
+		return fmt.Errorf("fp (focal point) only applies to crop modes (lt, lc, lb, rt, rc, rb, ct, cc, cb, c), not to mode %s", req.mode)
+	}
+	if req.nearLossless != nil && knownFormat && req.format != ".webp" {
+		return fmt.Errorf("nl (near-lossless) only applies to webp output, not to %s", req.format)
+	}
+	if qualityGiven && knownFormat && !isLossyFormat(req.format) && !(req.format == ".png" && t.PNGQuantize) {
+		return fmt.Errorf("quality only applies to jpg, webp and jxl output (or png with png_quantize), not to %s", req.format)
+	}
+	if req.maxBytes > 0 && knownFormat && !isLossyFormat(req.format) {
+		return fmt.Errorf("maxbytes only applies to jpg, webp and jxl output, not to %s", req.format)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package caddy_thumbs
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestStrictTokens strict_tokens 开启时对当前模式或输出格式不起作用的参数返回 400 并说明适用范围, 关闭时忽略
+func TestStrictTokens(t *testing.T) {
+	tests := []struct {
+		target string
+		status int
+		hint   string // 400 的错误信息中应说明的适用范围
+	}{
+		{"/c20x20,ff0000/a.png", http.StatusBadRequest, "w modes"},
+		{"/cc20x20,ff0000/a.png", http.StatusBadRequest, "w modes"},
+		{"/wcc20x20,ff0000/a.png", http.StatusOK, ""},
+		{"/c20x20,ff0000/a.jpg", http.StatusOK, ""},
+		{"/m20x20,fp50x50/a.png", http.StatusBadRequest, "crop modes"},
+		{"/c20x20,q80/a.png", http.StatusBadRequest, "jpg, webp and jxl"},
+		{"/c20x20,nl60/a.jpg", http.StatusBadRequest, "webp output"},
+		{"/c20x20,q80/a.jpg", http.StatusOK, ""},
+	}
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.StrictTokens = true })
+	lenient, lenientSrc, _ := newTestServer(t, nil)
+	for _, s := range []*memStorage{src, lenientSrc} {
+		s.put("/a.png", encodePNG(t, gradientImage(40, 40)))
+		s.put("/a.jpg", encodeJPEG(t, gradientImage(40, 40), 90))
+	}
+	for _, tt := range tests {
+		w := get(t, ts, tt.target)
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d (body: %.200s)", tt.target, w.Code, tt.status, w.Body.String())
+		} else if !strings.Contains(w.Body.String(), tt.hint) {
+			t.Errorf("%s: error %q does not mention %q", tt.target, w.Body.String(), tt.hint)
+		}
+		// 关闭时忽略不起作用的参数
+		if w := get(t, lenient, tt.target); w.Code != http.StatusOK {
+			t.Errorf("%s without strict_tokens: status = %d, want 200", tt.target, w.Code)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package caddy_thumbs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// SourceTransformer 由第三方 Caddy 模块实现, 在解码前处理原图的原始字节, 如解密、去除水印.
+// 模块注册在 http.handlers.thumbs_server.transformers 命名空间下, 按配置顺序依次执行,
+// 返回的数据作为下一个处理器或解码器的输入
+type SourceTransformer interface {
+	TransformSource(ctx context.Context, imagePath string, data []byte) ([]byte, error)
+}
+
+// transformSource 依次执行配置的原图处理器, 处理失败返回 500, 处理结果为空时返回 422
+func (t ThumbsServer) transformSource(imagePath string, data []byte) ([]byte, error) {
+	for i, transformer := range t.transformers {
+		out, err := transformer.TransformSource(t.ctx, imagePath, data)
+		if err != nil {
+			return nil, caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("source transformer %d failed for %s: %v", i, imagePath, err))
+		}
+		if len(out) == 0 {
+			return nil, corruptSourceError(imagePath, fmt.Sprintf("source transformer %d returned no data", i))
+		}
+		data = out
+	}
+	return data, nil
+}
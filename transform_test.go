@@ -0,0 +1,90 @@
+package caddy_thumbs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image/color"
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(xorTransformer{})
+	caddy.RegisterModule(prefixTransformer{})
+}
+
+// xorTransformer 测试用的原图处理器, 将每个字节与 Key 异或, 模拟解密
+type xorTransformer struct {
+	Key byte `json:"key"`
+}
+
+func (xorTransformer) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.thumbs_server.transformers.test_xor",
+		New: func() caddy.Module { return new(xorTransformer) },
+	}
+}
+
+func (x xorTransformer) TransformSource(_ context.Context, _ string, data []byte) ([]byte, error) {
+	out := make([]byte, len(data))
+	for i, b := range data {
+		out[i] = b ^ x.Key
+	}
+	return out, nil
+}
+
+// prefixTransformer 测试用的原图处理器, 去掉 Prefix 前缀, 没有前缀时返回错误
+type prefixTransformer struct {
+	Prefix string `json:"prefix"`
+}
+
+func (prefixTransformer) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.thumbs_server.transformers.test_prefix",
+		New: func() caddy.Module { return new(prefixTransformer) },
+	}
+}
+
+func (p prefixTransformer) TransformSource(_ context.Context, _ string, data []byte) ([]byte, error) {
+	rest, ok := bytes.CutPrefix(data, []byte(p.Prefix))
+	if !ok {
+		return nil, errors.New("missing prefix")
+	}
+	return rest, nil
+}
+
+// TestSourceTransformers 原图处理器在解码前按配置顺序执行: 先去掉前缀再异或还原, 处理失败时返回 500
+func TestSourceTransformers(t *testing.T) {
+	plain := encodePNG(t, solidImage(40, 40, color.NRGBA{0, 0, 255, 255}))
+	encrypted := []byte("ENC:")
+	for _, b := range plain {
+		encrypted = append(encrypted, b^0x5A)
+	}
+	transformers := []json.RawMessage{
+		json.RawMessage(`{"transformer":"test_prefix","prefix":"ENC:"}`),
+		json.RawMessage(`{"transformer":"test_xor","key":90}`),
+	}
+
+	ts, src, _ := newTestServer(t, func(ts *ThumbsServer) { ts.SourceTransformersRaw = transformers })
+	src.put("/a.png", encrypted)
+	src.put("/plain.png", plain)
+	w := get(t, ts, "/c20x20/a.png")
+	mustStatus(t, w, http.StatusOK)
+	img, _ := decodeBody(t, w.Body.Bytes())
+	if r, g, b, _ := img.At(10, 10).RGBA(); r>>8 > 0x10 || g>>8 > 0x10 || b>>8 < 0xF0 {
+		t.Errorf("color = %v, want blue", img.At(10, 10))
+	}
+	// 未加密的原图不满足第一个处理器
+	mustStatus(t, get(t, ts, "/c20x20/plain.png"), http.StatusInternalServerError)
+
+	// 顺序颠倒时异或后的数据没有前缀
+	ts, src, _ = newTestServer(t, func(ts *ThumbsServer) {
+		ts.SourceTransformersRaw = []json.RawMessage{transformers[1], transformers[0]}
+	})
+	src.put("/a.png", encrypted)
+	mustStatus(t, get(t, ts, "/c20x20/a.png"), http.StatusInternalServerError)
+}
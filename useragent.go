@@ -0,0 +1,98 @@
+package caddy_thumbs
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+const (
+	// UA_DENY_CACHED_ONLY 匹配的请求只能读取已有缓存, 未缓存时返回 404
+	UA_DENY_CACHED_ONLY = "cached_only"
+	// UA_DENY_REJECT 匹配的请求在需要生成时返回 403
+	UA_DENY_REJECT = "reject"
+)
+
+// UserAgentDenyConfig 禁止 User-Agent 匹配的请求(如爬虫)触发缩略图生成, 已缓存的缩略图不受影响
+type UserAgentDenyConfig struct {
+	// User-Agent 正则表达式, 任一匹配即禁止生成
+	Patterns []string `json:"patterns,omitempty"`
+	// 未缓存时的处理方式: cached_only(默认, 返回 404) 或 reject(返回 403)
+	Action string `json:"action,omitempty"`
+
+	patterns []*regexp.Regexp
+}
+
+// provision 编译正则表达式
+func (c *UserAgentDenyConfig) provision() error {
+	if c.Action == "" {
+		c.Action = UA_DENY_CACHED_ONLY
+	}
+	c.patterns = make([]*regexp.Regexp, 0, len(c.Patterns))
+	for _, pattern := range c.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid generation_user_agent_deny pattern %q: %v", pattern, err)
+		}
+		c.patterns = append(c.patterns, re)
+	}
+	return nil
+}
+
+// validate 至少需要一个正则表达式, action 只能为 cached_only 或 reject
+func (c *UserAgentDenyConfig) validate() error {
+	if len(c.Patterns) == 0 {
+		return errors.New("generation_user_agent_deny requires at least one pattern")
+	}
+	if c.Action != UA_DENY_CACHED_ONLY && c.Action != UA_DENY_REJECT {
+		return fmt.Errorf("invalid generation_user_agent_deny action: %s", c.Action)
+	}
+	return nil
+}
+
+// generationDenied 判断请求的 User-Agent 是否禁止触发生成
+func (t ThumbsServer) generationDenied(r *http.Request) bool {
+	if t.GenerationUADeny == nil {
+		return false
+	}
+	ua := r.UserAgent()
+	for _, re := range t.GenerationUADeny.patterns {
+		if re.MatchString(ua) {
+			return true
+		}
+	}
+	return false
+}
+
+// denyGeneration 返回禁止生成时的错误
+func (t ThumbsServer) denyGeneration(r *http.Request, req *thumbRequest) error {
+	if t.GenerationUADeny.Action == UA_DENY_REJECT {
+		return caddyhttp.Error(http.StatusForbidden, fmt.Errorf("user agent not allowed to generate thumbnails: %s", r.UserAgent()))
+	}
+	return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("thumbnail not cached: %s", req.thumbPath))
+}
+
+// unmarshalUserAgentDeny 解析 generation_user_agent_deny, 参数和块内的 pattern 均为正则表达式
+func unmarshalUserAgentDeny(d *caddyfile.Dispenser) (*UserAgentDenyConfig, error) {
+	cfg := &UserAgentDenyConfig{Patterns: d.RemainingArgs()}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		key := d.Val()
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return nil, d.ArgErr()
+		}
+		switch key {
+		case "pattern":
+			cfg.Patterns = append(cfg.Patterns, args...)
+		case "action":
+			cfg.Action = args[0]
+		default:
+			return nil, d.Errf("unrecognized generation_user_agent_deny subdirective: %s", key)
+		}
+	}
+	return cfg, nil
+}
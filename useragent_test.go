@@ -0,0 +1,89 @@
+package caddy_thumbs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestGenerationUserAgentDeny 匹配的 User-Agent 不能触发未缓存的生成(cached_only 返回 404, reject 返回 403),
+// 但可以读取已缓存的缩略图; 其他 User-Agent 不受影响
+func TestGenerationUserAgentDeny(t *testing.T) {
+	for _, tt := range []struct {
+		name, action string
+		status       int
+	}{
+		{"default", "", http.StatusNotFound},
+		{UA_DENY_REJECT, UA_DENY_REJECT, http.StatusForbidden},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, src, thumbs := newTestServer(t, func(ts *ThumbsServer) {
+				ts.GenerationUADeny = &UserAgentDenyConfig{Patterns: []string{`(?i)bot\b`, `^curl/`}, Action: tt.action}
+			})
+			src.put("/a.png", encodePNG(t, gradientImage(40, 40)))
+			request := func(userAgent string) *httptest.ResponseRecorder {
+				r := httptest.NewRequest(http.MethodGet, "/c20x20/a.png", nil)
+				r.Header.Set("User-Agent", userAgent)
+				return serve(t, ts, r)
+			}
+
+			for _, ua := range []string{"Mozilla/5.0 (compatible; Googlebot/2.1)", "curl/8.0"} {
+				mustStatus(t, request(ua), tt.status)
+			}
+			if n := src.count("Load"); n != 0 || len(thumbs.keys()) != 0 {
+				t.Fatalf("denied request loaded the source %d times and cached %v", n, thumbs.keys())
+			}
+
+			mustStatus(t, request("Mozilla/5.0 (Windows NT 10.0)"), http.StatusOK)
+			w := request("Mozilla/5.0 (compatible; Googlebot/2.1)")
+			mustStatus(t, w, http.StatusOK)
+			if w.Body.Len() == 0 {
+				t.Error("denied user agent got an empty cached thumbnail")
+			}
+		})
+	}
+}
+
+// TestGenerationUserAgentDenyEndpoints 禁止生成的 User-Agent 不能通过 srcset 和 BlurHash 接口生成, srcset 只包含已缓存的宽度
+func TestGenerationUserAgentDenyEndpoints(t *testing.T) {
+	ts, src, thumbs := newTestServer(t, func(ts *ThumbsServer) {
+		ts.GenerationUADeny = &UserAgentDenyConfig{Patterns: []string{`(?i)bot\b`}}
+		ts.Srcset = &SrcsetConfig{Path: "/_srcset", Widths: []int{20, 40}}
+		ts.BlurHashPath = "/_blurhash"
+	})
+	src.put("/a.png", encodePNG(t, gradientImage(80, 40)))
+	request := func(target, userAgent string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("User-Agent", userAgent)
+		return serve(t, ts, r)
+	}
+	const bot = "Mozilla/5.0 (compatible; Googlebot/2.1)"
+
+	w := request("/_srcset?source=a.png", bot)
+	mustStatus(t, w, http.StatusOK)
+	var resp srcsetResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Srcset != "" {
+		t.Errorf("srcset = %q, want empty", resp.Srcset)
+	}
+	mustStatus(t, request("/_blurhash?source=a.png", bot), http.StatusNotFound)
+	if n := src.count("Load"); n != 0 || len(thumbs.keys()) != 0 {
+		t.Fatalf("denied user agent loaded the source %d times and cached %v", n, thumbs.keys())
+	}
+
+	// 已缓存的宽度和 BlurHash 仍然可以读取
+	mustStatus(t, request("/m20x2000/a.png", "Mozilla/5.0"), http.StatusOK)
+	mustStatus(t, request("/_blurhash?source=a.png", "Mozilla/5.0"), http.StatusOK)
+	w = request("/_srcset?source=a.png", bot)
+	mustStatus(t, w, http.StatusOK)
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Srcset != "/m20x2000/a.png 20w" {
+		t.Errorf("srcset = %q, want only the cached width", resp.Srcset)
+	}
+	mustStatus(t, request("/_blurhash?source=a.png", bot), http.StatusOK)
+}
@@ -0,0 +1,145 @@
+package caddy_thumbs
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// variantIndex 记录每个原图已缓存的缩略图, 用于 max_variants_per_source. 启动时由 seedVariants 按缩略图存储中
+// 已有的条目初始化, 之后随写入登记; 缩略图被淘汰或删除时同步移除
+type variantIndex struct {
+	mu       sync.Mutex
+	bySource map[string]map[string]struct{} // 原图路径 → 缩略图键
+	sources  map[string]string              // 缩略图键 → 原图路径
+	loaded   atomic.Bool                    // 已有的缩略图是否登记完成
+}
+
+func newVariantIndex() *variantIndex {
+	return &variantIndex{
+		bySource: make(map[string]map[string]struct{}),
+		sources:  make(map[string]string),
+	}
+}
+
+// reserve 为原图登记一个缩略图. 已登记的缩略图(如重新生成)总是允许, 原图的缩略图数量已达 limit 时返回 false
+func (v *variantIndex) reserve(source, key string, limit int) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	keys := v.bySource[source]
+	if _, ok := keys[key]; ok {
+		return true
+	}
+	if len(keys) >= limit {
+		return false
+	}
+	v.add(source, key)
+	return true
+}
+
+// register 登记已缓存的缩略图, 不检查数量限制
+func (v *variantIndex) register(source, key string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.add(source, key)
+}
+
+// add 登记缩略图, 调用方持有锁
+func (v *variantIndex) add(source, key string) {
+	keys := v.bySource[source]
+	if keys == nil {
+		keys = make(map[string]struct{})
+		v.bySource[source] = keys
+	}
+	keys[key] = struct{}{}
+	v.sources[key] = source
+}
+
+// count 返回已登记缩略图的原图数量
+func (v *variantIndex) count() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return len(v.bySource)
+}
+
+// remove 移除缩略图的登记
+func (v *variantIndex) remove(key string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	source, ok := v.sources[key]
+	if !ok {
+		return
+	}
+	delete(v.sources, key)
+	delete(v.bySource[source], key)
+	if len(v.bySource[source]) == 0 {
+		delete(v.bySource, source)
+	}
+}
+
+// reserveVariant 开启 max_variants_per_source 时检查能否缓存原图的又一个缩略图. 超出限制的缩略图照常返回但不写入缓存.
+// 已有的缩略图登记完成之前无法判断是否超出限制, 同样不写入缓存
+func (t ThumbsServer) reserveVariant(req *thumbRequest, key string) bool {
+	if t.variants == nil {
+		return true
+	}
+	if !t.variants.loaded.Load() {
+		t.logger.Debug("Variant index still loading, thumbnail not cached", zap.String("path", key))
+		return false
+	}
+	if t.variants.reserve(req.imagePath, key, t.MaxVariantsPerSource) {
+		return true
+	}
+	t.logger.Warn("Source reached max_variants_per_source, thumbnail not cached",
+		zap.String("source", req.imagePath), zap.String("path", key), zap.Int("limit", t.MaxVariantsPerSource))
+	return false
+}
+
+// forgetVariant 缩略图从缓存中删除后释放其登记
+func (t ThumbsServer) forgetVariant(key string) {
+	if t.variants != nil {
+		t.variants.remove(key)
+	}
+}
+
+// seedVariants 遍历缩略图存储, 将已有的缩略图登记到所属原图, 使重启后的计数包含之前写入的缩略图.
+// 原图路径由缓存键推算, 有多个候选路径(如缓存键追加了输出格式)时取存在的原图, 原图已不存在的缩略图不计数.
+// 已有的缩略图多于限制时照常登记, 该原图不再缓存新的缩略图
+func (t ThumbsServer) seedVariants() {
+	defer t.variants.loaded.Store(true)
+	keys, err := t.thumbsStorage.List(t.ctx, "/", true)
+	if err != nil {
+		t.logger.Warn("Failed to list thumbs storage, variant counts start empty", zap.Error(err))
+		return
+	}
+	var (
+		exists  = make(map[string]bool)
+		entries int
+	)
+	for _, key := range keys {
+		key = path.Join("/", key)
+		// 附属条目和 BlurHash 结果不是缩略图
+		if companionOwner(key) != key || strings.HasPrefix(key, "/"+blurHashCachePrefix) {
+			continue
+		}
+		if info, err := t.thumbsStorage.Stat(t.ctx, key); err != nil || !info.IsTerminal {
+			continue
+		}
+		for _, source := range orphanSourceCandidates(key) {
+			found, checked := exists[source]
+			if !checked {
+				found = t.sourceExists(source)
+				exists[source] = found
+			}
+			if found {
+				t.variants.register(source, key)
+				entries++
+				break
+			}
+		}
+	}
+	t.logger.Info("Variant index loaded", zap.Int("entries", entries), zap.Int("sources", t.variants.count()))
+}
@@ -0,0 +1,82 @@
+package caddy_thumbs
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// waitVariantsLoaded 等待启动时的缩略图登记完成
+func waitVariantsLoaded(t *testing.T, ts *ThumbsServer) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !ts.variants.loaded.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("variant index was not loaded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestMaxVariantsPerSource 原图的缩略图数量达到 max_variants_per_source 后, 新的尺寸照常生成和返回但不写入缓存;
+// 已缓存的尺寸和其他原图不受影响
+func TestMaxVariantsPerSource(t *testing.T) {
+	ts, src, thumbs := newTestServer(t, func(ts *ThumbsServer) { ts.MaxVariantsPerSource = 2 })
+	waitVariantsLoaded(t, ts)
+	src.put("/a.png", encodePNG(t, gradientImage(100, 100)))
+	src.put("/b.png", encodePNG(t, gradientImage(100, 100)))
+
+	for _, target := range []string{"/m10x10/a.png", "/m20x20/a.png", "/m30x30/a.png", "/m30x30/a.png", "/m10x10/a.png", "/m30x30/b.png"} {
+		w := get(t, ts, target)
+		mustStatus(t, w, http.StatusOK)
+		if width, _ := imageSize(t, w.Body.Bytes()); width == 0 {
+			t.Errorf("%s: empty image", target)
+		}
+	}
+	want := []string{"/m10x10/a.png", "/m20x20/a.png", "/m30x30/b.png"}
+	if keys := thumbs.keys(); !slices.Equal(keys, want) {
+		t.Errorf("cached keys = %v, want %v", keys, want)
+	}
+
+	// 删除缓存后释放名额
+	if err := ts.deleteThumbSet("/m20x20/a.png"); err != nil {
+		t.Fatal(err)
+	}
+	mustStatus(t, get(t, ts, "/m30x30/a.png"), http.StatusOK)
+	if _, ok := thumbs.get("/m30x30/a.png"); !ok {
+		t.Errorf("variant not cached after another was deleted, keys: %v", thumbs.keys())
+	}
+}
+
+// TestMaxVariantsPerSourceSeed 重启后按缩略图存储中已有的缩略图恢复计数: 已达上限的原图不再缓存新的缩略图,
+// 追加了输出格式的缓存键归属到存在的原图, 附属条目、BlurHash 结果和原图已不存在的缩略图不计数
+func TestMaxVariantsPerSourceSeed(t *testing.T) {
+	src, thumbs := newMemStorage(), newMemStorage()
+	src.put("/a.png", encodePNG(t, gradientImage(100, 100)))
+	src.put("/b.webp", encodePNG(t, gradientImage(100, 100)))
+	for _, key := range []string{
+		"/m10x10/a.png", "/m20x20/a.png", "/m10x10/a.png" + lqipSuffix,
+		"/m10x10/b.webp.jpg", "/_blurhash4x3/b.webp", "/m20x20/b.webp" + colorSuffix,
+		"/m10x10/gone.png", "/m20x20/gone.png",
+	} {
+		thumbs.put(key, []byte("cached"))
+	}
+	ts := &ThumbsServer{
+		ImageStorageRaw:      registerStorage(t, "src", src),
+		ThumbsStorageRaw:     registerStorage(t, "thumbs", thumbs),
+		MaxVariantsPerSource: 2,
+	}
+	provisionServer(t, ts)
+	waitVariantsLoaded(t, ts)
+
+	for _, tc := range []struct {
+		target string
+		stored bool
+	}{{"/m30x30/a.png", false}, {"/m30x30/b.webp", true}, {"/m40x40/b.webp", false}} {
+		mustStatus(t, get(t, ts, tc.target), http.StatusOK)
+		if _, ok := thumbs.get(tc.target); ok != tc.stored {
+			t.Errorf("%s: stored = %v, want %v", tc.target, ok, tc.stored)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package caddy_thumbs
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+// WarmerConfig 缓存预热配置, 周期性重新生成最近访问过但已不在缓存中的缩略图
+type WarmerConfig struct {
+	// 检查周期, 默认 5m
+	Interval caddy.Duration `json:"interval,omitempty"`
+	// 记录最近访问路径的数量, 默认 1000
+	Size int `json:"size,omitempty"`
+	// 同时生成的最大数量, 默认 2
+	Concurrency int `json:"concurrency,omitempty"`
+	// 每轮最多重新生成的数量, 默认 100
+	MaxPerRound int `json:"max_per_round,omitempty"`
+}
+
+// recentRequest 最近访问的缩略图请求, 包含影响缓存键的分区和读取原图的凭据
+type recentRequest struct {
+	path     string
+	rawQuery string
+	bucket   string // cache_key_header 请求头的值
+	token    string // source_token_header 请求头的值
+}
+
+// recentRequest 提取请求中预热需要的信息
+func (t ThumbsServer) recentRequest(r *http.Request) recentRequest {
+	entry := recentRequest{path: r.URL.Path, rawQuery: r.URL.RawQuery, token: t.sourceToken(r)}
+	if t.CacheKeyHeader != "" {
+		entry.bucket = r.Header.Get(t.CacheKeyHeader)
+	}
+	return entry
+}
+
+// recentRequests 记录最近访问的缩略图请求的环形缓冲区
+type recentRequests struct {
+	mu   sync.Mutex
+	buf  []recentRequest
+	next int
+	full bool
+}
+
+func newRecentRequests(size int) *recentRequests {
+	return &recentRequests{buf: make([]recentRequest, size)}
+}
+
+// record 记录一次访问, 缓冲区满时覆盖最旧的记录
+func (rr *recentRequests) record(entry recentRequest) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.buf[rr.next] = entry
+	rr.next = (rr.next + 1) % len(rr.buf)
+	if rr.next == 0 {
+		rr.full = true
+	}
+}
+
+// snapshot 从新到旧返回去重后的记录
+func (rr *recentRequests) snapshot() []recentRequest {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	count := rr.next
+	if rr.full {
+		count = len(rr.buf)
+	}
+	var (
+		seen   = make(map[recentRequest]bool, count)
+		result = make([]recentRequest, 0, count)
+	)
+	for i := 1; i <= count; i++ {
+		entry := rr.buf[(rr.next-i+len(rr.buf))%len(rr.buf)]
+		if !seen[entry] {
+			seen[entry] = true
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// runWarmer 周期性重新生成最近访问过但已不在缓存中的缩略图
+func (t ThumbsServer) runWarmer() {
+	ticker := time.NewTicker(time.Duration(t.Warmer.Interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+			t.warmCache()
+		}
+	}
+}
+
+// warmCache 执行一轮缓存预热
+func (t ThumbsServer) warmCache() {
+	var (
+		sem       = make(chan struct{}, t.Warmer.Concurrency)
+		wg        sync.WaitGroup
+		generated int
+	)
+	for _, entry := range t.warmer.snapshot() {
+		if generated >= t.Warmer.MaxPerRound {
+			break
+		}
+		query, err := url.ParseQuery(entry.rawQuery)
+		if err != nil {
+			continue
+		}
+		// 与 ServeHTTP 相同的缓存键和原图凭据
+		req, err := t.parseRequest(entry.path, query)
+		if err != nil {
+			continue
+		}
+		if t.CacheKeyHeader != "" {
+			t.setCacheBucket(req, entry.bucket)
+		}
+		req.sourceToken = entry.token
+		if _, ok := t.lookupCache(req); ok {
+			continue
+		}
+		generated++
+
+		select {
+		case <-t.ctx.Done():
+			wg.Wait()
+			return
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(req *thumbRequest) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			result, err := t.renderThumb(req)
+			if err == nil {
+				err = result.storeErr
+			}
+			if err != nil {
+				t.logger.Warn("Failed to warm thumbnail", zap.String("path", req.thumbPath), zap.Error(err))
+			}
+		}(req)
+	}
+	wg.Wait()
+	if generated > 0 {
+		t.logger.Info("Cache warmer regenerated thumbnails", zap.Int("count", generated))
+	}
+}
+
+// unmarshalWarmer 解析 cache_warmer 配置块
+//
+//	cache_warmer {
+//	    interval <duration>
+//	    size <n>
+//	    concurrency <n>
+//	    max_per_round <n>
+//	}
+func unmarshalWarmer(d *caddyfile.Dispenser) (*WarmerConfig, error) {
+	cfg := new(WarmerConfig)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		key := d.Val()
+		if !d.NextArg() {
+			return nil, d.ArgErr()
+		}
+		switch key {
+		case "interval":
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid interval value: %s", d.Val())
+			}
+			cfg.Interval = caddy.Duration(dur)
+		case "size", "concurrency", "max_per_round":
+			val, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return nil, d.Errf("invalid %s value: %s", key, d.Val())
+			}
+			switch key {
+			case "size":
+				cfg.Size = val
+			case "concurrency":
+				cfg.Concurrency = val
+			default:
+				cfg.MaxPerRound = val
+			}
+		default:
+			return nil, d.Errf("unrecognized cache_warmer subdirective: %s", key)
+		}
+	}
+	return cfg, nil
+}
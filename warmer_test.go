@@ -0,0 +1,67 @@
+package caddy_thumbs
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// tokenStorage 只允许携带正确凭据读取原图
+type tokenStorage struct {
+	*memStorage
+	token string
+}
+
+func (s tokenStorage) LoadWithToken(ctx context.Context, key, token string) ([]byte, error) {
+	if token != s.token {
+		return nil, fs.ErrPermission
+	}
+	return s.memStorage.Load(ctx, key)
+}
+
+// TestWarmCache 预热按记录的分区和凭据重新生成已被淘汰的缩略图, 失败的请求不记录
+func TestWarmCache(t *testing.T) {
+	src := tokenStorage{memStorage: newMemStorage(), token: "t0ken"}
+	src.put("/a.jpg", encodeJPEG(t, gradientImage(40, 40), 90))
+	src.put("/b.jpg", encodeJPEG(t, gradientImage(40, 40), 90))
+	thumbs := newMemStorage()
+	ts := &ThumbsServer{
+		ImageStorageRaw:   registerStorage(t, "src", src),
+		ThumbsStorageRaw:  registerStorage(t, "thumbs", thumbs),
+		CacheKeyHeader:    "X-Tenant",
+		SourceTokenHeader: "X-Source-Token",
+		Warmer:            &WarmerConfig{Size: 8},
+	}
+	provisionServer(t, ts)
+
+	request := func(target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("X-Tenant", "acme")
+		r.Header.Set("X-Source-Token", "t0ken")
+		return serve(t, ts, r)
+	}
+	mustStatus(t, request("/c20x20/a.jpg"), http.StatusOK)
+	mustStatus(t, request("/m30x30/b.jpg"), http.StatusOK)
+	mustStatus(t, request("/c20x20/missing.jpg"), http.StatusNotFound)
+
+	recent := ts.warmer.snapshot()
+	if len(recent) != 2 {
+		t.Fatalf("recorded %d requests, want 2: %+v", len(recent), recent)
+	}
+
+	// 模拟缩略图被淘汰
+	for _, key := range thumbs.keys() {
+		_ = thumbs.Delete(context.Background(), key)
+	}
+	ts.warmCache()
+	for _, key := range []string{"/@acme/c20x20/a.jpg", "/@acme/m30x30/b.jpg"} {
+		if _, ok := thumbs.get(key); !ok {
+			t.Errorf("%s not regenerated, keys: %v", key, thumbs.keys())
+		}
+	}
+	if n := len(thumbs.keys()); n != 2 {
+		t.Errorf("warmer stored %d thumbnails, want 2: %v", n, thumbs.keys())
+	}
+}
@@ -0,0 +1,42 @@
+package caddy_thumbs
+
+import (
+	"bytes"
+	"image"
+
+	"github.com/chai2010/webp"
+)
+
+// encodeWebPNearLossless 以近无损模式编码 WebP, level 取值 0-100, 100 等同于无损.
+//
+// chai2010/webp 未开放 libwebp 的 near_lossless 选项, 这里按 libwebp 的规则对像素做同等的预处理:
+// 每降低 20 级多舍去一位低位(最多 5 位), 再以无损模式编码. 透明通道保持不变.
+func encodeWebPNearLossless(img image.Image, level int) ([]byte, error) {
+	rgba := toRGBA(img)
+	if bits := min(5, (100-level)/20); bits > 0 {
+		rgba = quantizeLowBits(rgba, uint(bits))
+	}
+	var buf bytes.Buffer
+	if err := webp.Encode(&buf, rgba, &webp.Options{Lossless: true, Exact: true}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// quantizeLowBits 将颜色通道四舍五入到 2^bits 的倍数, 减少无损编码需要保存的信息量
+func quantizeLowBits(img *image.RGBA, bits uint) *image.RGBA {
+	var (
+		dst  = image.NewRGBA(img.Rect)
+		half = 1 << (bits - 1)
+		mask = ^(1<<bits - 1)
+	)
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		alpha := int(img.Pix[i+3])
+		for c := 0; c < 3; c++ {
+			// RGBA 为预乘格式, 结果不能超过透明度
+			dst.Pix[i+c] = uint8(min(alpha, (int(img.Pix[i+c])+half)&mask))
+		}
+		dst.Pix[i+3] = img.Pix[i+3]
+	}
+	return dst
+}
@@ -0,0 +1,95 @@
+package caddy_thumbs
+
+import (
+	"bytes"
+	"image"
+	"net/http"
+	"testing"
+)
+
+// maxChannelDiff 两张同尺寸图片颜色通道的最大差值
+func maxChannelDiff(a, b image.Image) int {
+	diff := 0
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, _ := a.At(x, y).RGBA()
+			r2, g2, b2, _ := b.At(x, y).RGBA()
+			for _, d := range []int{int(r1>>8) - int(r2>>8), int(g1>>8) - int(g2>>8), int(b1>>8) - int(b2>>8)} {
+				diff = max(diff, d, -d)
+			}
+		}
+	}
+	return diff
+}
+
+// TestWebPNearLossless 与相同名义质量的有损编码相比, 近无损输出与无损参考的误差在舍去的位数以内且更小, 体积更大
+func TestWebPNearLossless(t *testing.T) {
+	ts, src, _ := newTestServer(t, nil)
+	data := encodePNG(t, noiseImage(64, 64))
+	src.put("/a.png", data)
+	src.put("/a.webp", data)
+
+	decode := func(target string) (image.Image, int) {
+		w := get(t, ts, target)
+		mustStatus(t, w, http.StatusOK)
+		img, _ := decodeBody(t, w.Body.Bytes())
+		return img, w.Body.Len()
+	}
+	reference, _ := decode("/c32x32/a.png")
+	nearLossless, nearSize := decode("/c32x32,q80,nl60/a.webp")
+	lossy, lossySize := decode("/c32x32,q80/a.webp")
+
+	// nl60 舍去 2 位, 四舍五入后误差不超过 2
+	nearDiff, lossyDiff := maxChannelDiff(reference, nearLossless), maxChannelDiff(reference, lossy)
+	if nearDiff > 2 {
+		t.Errorf("near-lossless max channel error = %d, want at most 2", nearDiff)
+	}
+	if lossyDiff <= nearDiff {
+		t.Errorf("lossy max channel error %d not above near-lossless %d", lossyDiff, nearDiff)
+	}
+	// 更高的保真度以更大的体积为代价
+	if nearSize <= lossySize {
+		t.Errorf("near-lossless %d bytes not larger than lossy %d bytes", nearSize, lossySize)
+	}
+}
+
+// TestAlphaQualityBoost 带透明通道的图片按 alpha_quality_boost 提高 WebP 质量, 不超过 100; 不透明的图片和其他格式不受影响
+func TestAlphaQualityBoost(t *testing.T) {
+	ts, _, _ := newTestServer(t, func(ts *ThumbsServer) { ts.AlphaQualityBoost = 30 })
+	plain, _, _ := newTestServer(t, nil)
+
+	transparent := noiseImage(64, 64)
+	for i := 3; i < len(transparent.Pix); i += 8 {
+		transparent.Pix[i] = 0x80
+	}
+	opaque := noiseImage(64, 64)
+	encode := func(ts *ThumbsServer, img image.Image, quality float32, format string) []byte {
+		t.Helper()
+		data, err := ts.encodeImage(img, quality, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	for _, tt := range []struct {
+		name    string
+		img     image.Image
+		quality float32
+		format  string
+		want    float32 // 未开启时得到相同输出的质量
+	}{
+		{"transparent webp", transparent, 60, ".webp", 90},
+		{"transparent webp capped", transparent, 90, ".webp", 100},
+		{"opaque webp", opaque, 60, ".webp", 60},
+		{"opaque jpg", opaque, 60, ".jpg", 60},
+	} {
+		if !bytes.Equal(encode(ts, tt.img, tt.quality, tt.format), encode(plain, tt.img, tt.want, tt.format)) {
+			t.Errorf("%s: q%g with alpha_quality_boost does not match q%g", tt.name, tt.quality, tt.want)
+		}
+	}
+	if bytes.Equal(encode(ts, transparent, 60, ".webp"), encode(plain, transparent, 60, ".webp")) {
+		t.Error("transparent webp was not boosted")
+	}
+}